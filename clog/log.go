@@ -23,6 +23,7 @@ import (
 	"path/filepath"
 	"runtime"
 	"strconv"
+	"sync/atomic"
 
 	"github.com/fatih/color"
 	"gopkg.in/natefinch/lumberjack.v2"
@@ -32,6 +33,39 @@ const (
 	processName = "UrnaDB"
 )
 
+// Level 日志输出级别，级别越高输出的日志越多
+type Level int32
+
+const (
+	LevelError Level = iota
+	LevelWarn
+	LevelInfo
+	LevelDebug
+)
+
+// 默认只输出 Info 及以上的日志，Debug 日志还是由 IsDebug 开关控制
+var level atomic.Int32
+
+func init() {
+	level.Store(int32(LevelInfo))
+}
+
+// SetLevel 设置日志的输出级别，低于该级别的日志会被直接丢弃，
+// 例如生产环境中设置为 LevelError 就只会输出错误日志，Failed 和 Failedf 不受级别限制。
+func SetLevel(l Level) {
+	level.Store(int32(l))
+}
+
+// GetLevel 返回当前的日志输出级别
+func GetLevel() Level {
+	return Level(level.Load())
+}
+
+// enabled 在格式化日志之前判断级别，避免被过滤掉的日志产生格式化开销
+func enabled(l Level) bool {
+	return Level(level.Load()) >= l
+}
+
 var (
 	// Logger colors and log message prefixes
 	warnColor   = color.New(color.Bold, color.FgYellow)
@@ -68,87 +102,114 @@ func multipleLogger(out io.Writer, prefix string, flag int) {
 	clog = log.New(out, prefix, flag)
 }
 
+// LogRotateOptions 日志文件轮转的参数，字段为零值的时候使用 lumberjack 的默认行为，
+// 压缩只支持 lumberjack 自带的 gzip 格式，日志量很大的时候可以关闭压缩交给外部工具处理。
+type LogRotateOptions struct {
+	MaxSize    int  // 单个日志文件的最大大小，单位 MB
+	MaxBackups int  // 最多保留的旧日志文件个数
+	MaxAge     int  // 旧日志文件最多保留的天数
+	Compress   bool // 是否使用 gzip 压缩轮转后的日志文件
+}
+
+// DefaultLogRotateOptions 是 SetOutput 使用的默认轮转参数
+var DefaultLogRotateOptions = LogRotateOptions{
+	MaxSize:    10,   // 每个日志文件最大 10 MB
+	MaxBackups: 3,    // 最多保留 3 个备份
+	MaxAge:     7,    // 日志文件最多保留 7 天
+	Compress:   true, // 启用压缩
+}
+
 func SetOutput(path string) {
+	SetOutputWithOptions(path, DefaultLogRotateOptions)
+}
+
+// SetOutputWithOptions 和 SetOutput 一样把日志同时输出到控制台和日志文件中，轮转参数由调用方指定
+func SetOutputWithOptions(path string, opts LogRotateOptions) {
 	// 正常模式的日志记录需要输出到控制台和日志文件中
 	multipleLogger(io.MultiWriter(os.Stdout, &lumberjack.Logger{
 		Filename:   path, // 使用 lumberjack 设置日志轮转
-		MaxSize:    10,   // 每个日志文件最大 10 MB
-		MaxBackups: 3,    // 最多保留 3 个备份
-		MaxAge:     7,    // 日志文件最多保留 7 天
-		Compress:   true, // 启用压缩
+		MaxSize:    opts.MaxSize,
+		MaxBackups: opts.MaxBackups,
+		MaxAge:     opts.MaxAge,
+		Compress:   opts.Compress,
 	}), "["+processName+":C] ", log.Ldate|log.Ltime)
 }
 
+// caller 返回调用日志函数的位置，格式为 [file.go:line::package.func()]，skip 和 runtime.Caller 的含义一致
+func caller(skip int) string {
+	pc, file, line, ok := runtime.Caller(skip + 1)
+	if !ok {
+		return "[unknown]"
+	}
+
+	shortFn := filepath.Base(file) + ":" + strconv.Itoa(line)
+
+	fn := runtime.FuncForPC(pc)
+	if fn == nil {
+		return "[" + shortFn + "]"
+	}
+
+	// 只取函数名
+	return fmt.Sprintf("[%s::%s()]", shortFn, path.Base(fn.Name()))
+}
+
+// Error 和 Warn 系列的日志会带上调用者的位置，垃圾回收、检查点之类的后台任务失败的时候可以直接定位到出错的代码
 func Error(v ...interface{}) {
-	clog.Output(2, errorPrefix+fmt.Sprint(v...))
+	if !enabled(LevelError) {
+		return
+	}
+	clog.Output(2, errorPrefix+caller(1)+" "+fmt.Sprint(v...))
 }
 
 func Errorf(format string, v ...interface{}) {
-	clog.Output(2, errorPrefix+fmt.Sprintf(format, v...))
+	if !enabled(LevelError) {
+		return
+	}
+	clog.Output(2, errorPrefix+caller(1)+" "+fmt.Sprintf(format, v...))
 }
 
 func Warn(v ...interface{}) {
-	clog.Output(2, warnPrefix+fmt.Sprint(v...))
+	if !enabled(LevelWarn) {
+		return
+	}
+	clog.Output(2, warnPrefix+caller(1)+" "+fmt.Sprint(v...))
 }
 
 func Warnf(format string, v ...interface{}) {
-	clog.Output(2, warnPrefix+fmt.Sprintf(format, v...))
+	if !enabled(LevelWarn) {
+		return
+	}
+	clog.Output(2, warnPrefix+caller(1)+" "+fmt.Sprintf(format, v...))
 }
 
 func Info(v ...interface{}) {
+	if !enabled(LevelInfo) {
+		return
+	}
 	clog.Output(2, infoPrefix+fmt.Sprint(v...))
 }
 
 func Infof(format string, v ...interface{}) {
+	if !enabled(LevelInfo) {
+		return
+	}
 	clog.Output(2, infoPrefix+fmt.Sprintf(format, v...))
 }
 
 func Debug(v ...interface{}) {
-	if IsDebug {
-		pc, file, line, _ := runtime.Caller(1)
-		fn := runtime.FuncForPC(pc)
-
-		shortFn := filepath.Base(file) + ":" + strconv.Itoa(line)
-
-		message := fmt.Sprintf("[%s::%s()] %s",
-			shortFn,
-			path.Base(fn.Name()),
-			fmt.Sprint(v...),
-		)
-
-		dlog.Output(2, debugPrefix+message)
+	if IsDebug || enabled(LevelDebug) {
+		dlog.Output(2, debugPrefix+caller(1)+" "+fmt.Sprint(v...))
 	}
 }
 
 func Debugf(format string, v ...interface{}) {
-	if IsDebug {
-		pc, file, line, _ := runtime.Caller(1)
-		fn := runtime.FuncForPC(pc)
-
-		shortFn := filepath.Base(file) + ":" + strconv.Itoa(line)
-
-		message := fmt.Sprintf("[%s::%s()] %s",
-			shortFn,
-			path.Base(fn.Name()),
-			fmt.Sprintf(format, v...),
-		)
-
-		dlog.Output(2, debugPrefix+message)
+	if IsDebug || enabled(LevelDebug) {
+		dlog.Output(2, debugPrefix+caller(1)+" "+fmt.Sprintf(format, v...))
 	}
 }
 
 func Failed(v ...interface{}) {
-	// skip=1 表示跳过 fatalf 和 clog.Output 两层
-	pc, file, line, _ := runtime.Caller(1)
-	fn := runtime.FuncForPC(pc)
-
-	shortFn := filepath.Base(file) + ":" + strconv.Itoa(line)
-
-	message := fmt.Sprintf("[%s::%s()] %s",
-		shortFn,
-		path.Base(fn.Name()), // 只取函数名
-		fmt.Sprint(v...),
-	)
+	message := caller(1) + " " + fmt.Sprint(v...)
 
 	// 让日志定位到实际调用者
 	clog.Output(2, message)
@@ -157,17 +218,7 @@ func Failed(v ...interface{}) {
 }
 
 func Failedf(format string, v ...interface{}) {
-	// skip=1 表示跳过 fatalf 和 clog.Output 两层
-	pc, file, line, _ := runtime.Caller(1)
-	fn := runtime.FuncForPC(pc)
-
-	shortFn := filepath.Base(file) + ":" + strconv.Itoa(line)
-
-	message := fmt.Sprintf("[%s::%s()] %s",
-		shortFn,
-		path.Base(fn.Name()), // 只取函数名
-		fmt.Sprintf(format, v...),
-	)
+	message := caller(1) + " " + fmt.Sprintf(format, v...)
 
 	// 让日志定位到实际调用者
 	clog.Output(2, message)
@@ -15,7 +15,13 @@
 package clog
 
 import (
+	"bytes"
+	"log"
 	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
 	"testing"
 )
 
@@ -46,6 +52,149 @@ func TestLogging(t *testing.T) {
 
 }
 
+func TestSetOutputWithOptions(t *testing.T) {
+	dir := t.TempDir()
+	logfile := filepath.Join(dir, "urnadb.log")
+
+	// 日志同时会输出到标准输出中，测试的时候把标准输出丢弃掉
+	devnull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer devnull.Close()
+
+	oldc, stdout := clog, os.Stdout
+	os.Stdout = devnull
+	SetOutputWithOptions(logfile, LogRotateOptions{MaxSize: 1, MaxBackups: 2})
+	os.Stdout = stdout
+	defer func() { clog = oldc }()
+
+	countFiles := func() int {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(entries)
+	}
+
+	// 每条日志大约 100KB，10 条日志还不到 1MB 不会触发轮转
+	message := strings.Repeat("x", 100*1024)
+	for i := 0; i < 10; i++ {
+		Info(message)
+	}
+
+	if n := countFiles(); n != 1 {
+		t.Fatalf("expected no rotation below max size, got %d files", n)
+	}
+
+	// 第 11 条日志超过了 1MB 的边界，写入之前先轮转出一个备份文件
+	Info(message)
+
+	if n := countFiles(); n != 2 {
+		t.Fatalf("expected rotation at max size boundary, got %d files", n)
+	}
+
+	stat, err := os.Stat(logfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stat.Size() > 1024*1024/10 {
+		t.Errorf("expected active log file to only contain the latest entry, got %d bytes", stat.Size())
+	}
+}
+
+func TestSetLevel(t *testing.T) {
+	var buf bytes.Buffer
+	oldc, oldd, olddebug := clog, dlog, IsDebug
+	clog, dlog, IsDebug = log.New(&buf, "", 0), log.New(&buf, "", 0), false
+	defer func() {
+		clog, dlog, IsDebug = oldc, oldd, olddebug
+		SetLevel(LevelInfo)
+	}()
+
+	tests := []struct {
+		level    Level
+		expected []string
+		filtered []string
+	}{
+		{LevelError, []string{"error"}, []string{"warn", "info", "debug"}},
+		{LevelWarn, []string{"error", "warn"}, []string{"info", "debug"}},
+		{LevelInfo, []string{"error", "warn", "info"}, []string{"debug"}},
+		{LevelDebug, []string{"error", "warn", "info", "debug"}, nil},
+	}
+
+	for _, tt := range tests {
+		buf.Reset()
+		SetLevel(tt.level)
+
+		Errorf("%s message", "error")
+		Warnf("%s message", "warn")
+		Infof("%s message", "info")
+		Debugf("%s message", "debug")
+
+		output := buf.String()
+		for _, msg := range tt.expected {
+			if !strings.Contains(output, msg+" message") {
+				t.Errorf("level %d: expected %q in output %q", tt.level, msg, output)
+			}
+		}
+		for _, msg := range tt.filtered {
+			if strings.Contains(output, msg+" message") {
+				t.Errorf("level %d: unexpected %q in output %q", tt.level, msg, output)
+			}
+		}
+	}
+
+	// Failed 不受日志级别的限制
+	buf.Reset()
+	SetLevel(LevelError)
+	_, panicked := capturePanic(func() {
+		Failed("failed message")
+	})
+	if !panicked || !strings.Contains(buf.String(), "failed message") {
+		t.Errorf("Failed() should always output and panic, got %q", buf.String())
+	}
+}
+
+func TestCallerInWarnAndError(t *testing.T) {
+	var buf bytes.Buffer
+	oldc := clog
+	clog = log.New(&buf, "", 0)
+	defer func() { clog = oldc }()
+
+	// 每个闭包在调用日志函数的同一行记录行号，输出中的位置应该和它一致
+	var line int
+	logs := []struct {
+		prefix string
+		log    func()
+	}{
+		{warnPrefix, func() { _, _, line, _ = runtime.Caller(0); Warn("warn message") }},
+		{warnPrefix, func() { _, _, line, _ = runtime.Caller(0); Warnf("%s message", "warn") }},
+		{errorPrefix, func() { _, _, line, _ = runtime.Caller(0); Error("error message") }},
+		{errorPrefix, func() { _, _, line, _ = runtime.Caller(0); Errorf("%s message", "error") }},
+	}
+
+	for _, l := range logs {
+		buf.Reset()
+		l.log()
+
+		// 彩色的级别前缀仍然在最前面，后面跟着调用者的位置
+		output := buf.String()
+		location := "[log_test.go:" + strconv.Itoa(line) + "::"
+		if !strings.HasPrefix(output, l.prefix+location) {
+			t.Errorf("expected %q at the beginning of output %q", l.prefix+location, output)
+		}
+	}
+
+	// Info 不需要调用者的位置
+	buf.Reset()
+	Info("info message")
+	if strings.Contains(buf.String(), "log_test.go") {
+		t.Errorf("unexpected caller in info output %q", buf.String())
+	}
+}
+
 // 测试 Failed 函数
 func TestFailed(t *testing.T) {
 	msg, panicked := capturePanic(func() {
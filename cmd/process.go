@@ -126,11 +126,18 @@ func runServer() {
 	}
 
 	clog.Info("Loading and parsing region data files...")
-	fss, err := vfs.OpenFS(&vfs.Options{
+	opts := &vfs.Options{
 		FSPerm:    conf.FSPerm,
 		Path:      conf.Settings.Path,
 		Threshold: conf.Settings.Region.Threshold,
-	})
+	}
+
+	if conf.Settings.IsIndexSnapshotEnabled() {
+		opts.IndexSnapshotInterval = time.Duration(conf.Settings.IndexSnapshotInterval()) * time.Second
+		clog.Info("Index snapshot activated successfully")
+	}
+
+	fss, err := vfs.OpenFS(opts)
 	if err != nil {
 		clog.Failed(err)
 	}
@@ -174,7 +181,7 @@ func runServer() {
 
 	// Delay output of normal messages
 	time.Sleep(500 * time.Millisecond)
-	clog.Infof("HTTP server started at http://%s:%d 🚀", hts.IPv4(), hts.Port())
+	clog.Infof("HTTP server started at %s 🚀", hts.URL())
 
 	// Keep the daemon process alive
 	blocking := make(chan os.Signal, 1)
@@ -55,6 +55,10 @@ const (
 			"enable": false,
 			"interval":  1800
 		},
+		"snapshot": {
+			"enable": false,
+			"interval": 600
+		},
 		"allow_ip": null
 	}
 `
@@ -233,6 +237,14 @@ func (opt *ServerOptions) CheckpointInterval() uint32 {
 	return opt.Checkpoint.Interval
 }
 
+func (opt *ServerOptions) IsIndexSnapshotEnabled() bool {
+	return opt.Snapshot.Enable
+}
+
+func (opt *ServerOptions) IndexSnapshotInterval() uint32 {
+	return opt.Snapshot.Interval
+}
+
 // HasCustom checked enable custom config
 func (*ServerOptions) HasCustom(path string) bool {
 	return path != defaultFilePath
@@ -253,6 +265,7 @@ type ServerOptions struct {
 	Encryptor  Encryptor  `json:"encryptor"`
 	Compressor Compressor `json:"compressor"`
 	Checkpoint Checkpoint `json:"checkpoint"`
+	Snapshot   Snapshot   `json:"snapshot"`
 	AllowIP    []string   `json:"allowip"`
 }
 
@@ -275,3 +288,8 @@ type Checkpoint struct {
 	Enable   bool   `json:"enable"`
 	Interval uint32 `json:"interval"`
 }
+
+type Snapshot struct {
+	Enable   bool   `json:"enable"`
+	Interval uint32 `json:"interval"`
+}
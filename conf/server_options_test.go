@@ -481,7 +481,7 @@ func TestMarshal(t *testing.T) {
 	require.NoError(t, err)
 
 	// Verify the marshaled data is correct
-	expectedJSON := `{"port":8080,"path":"/tmp/myconfig","debug":false,"logpath":"","auth":"testpassword","region":{"enable":false,"cron":"","threshold":0},"encryptor":{"enable":false,"secret":""},"compressor":{"enable":false},"checkpoint":{"enable":false,"interval":0},"allowip":null}`
+	expectedJSON := `{"port":8080,"path":"/tmp/myconfig","debug":false,"logpath":"","auth":"testpassword","region":{"enable":false,"cron":"","threshold":0},"encryptor":{"enable":false,"secret":""},"compressor":{"enable":false},"checkpoint":{"enable":false,"interval":0},"snapshot":{"enable":false,"interval":0},"allowip":null}`
 	assert.JSONEq(t, expectedJSON, string(data))
 }
 
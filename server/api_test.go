@@ -0,0 +1,2756 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/auula/urnadb/server/controller"
+	"github.com/auula/urnadb/server/middleware"
+	"github.com/auula/urnadb/server/router"
+	"github.com/auula/urnadb/server/service"
+	"github.com/auula/urnadb/types"
+	"github.com/auula/urnadb/vfs"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+const testAuthToken = "secret1234567890"
+
+// setupTestRouter 使用临时目录打开存储引擎并初始化路由，测试结束之后自动关闭存储
+func setupTestRouter(t *testing.T) http.Handler {
+	_, h := setupTestStorage(t)
+	return h
+}
+
+// setupTestStorage 和 setupTestRouter 一样，同时返回存储引擎方便测试直接操作存储层
+func setupTestStorage(t *testing.T) (*vfs.LogStructuredFS, http.Handler) {
+	fss, err := vfs.OpenFS(&vfs.Options{
+		FSPerm:    fs.FileMode(0755),
+		Path:      t.TempDir(),
+		Threshold: 3,
+	})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	t.Cleanup(func() {
+		fss.StopExpireLoop()
+		_ = fss.CloseFS()
+	})
+
+	middleware.SetAuthPassword(testAuthToken)
+	err = controller.InitAllComponents(fss)
+	assert.NoError(t, err)
+
+	return fss, router.SetupRoutes()
+}
+
+// doRequest 发送带有认证头的请求，并且把响应体中的 data 字段解析出来
+func doRequest(t *testing.T, h http.Handler, method, path string, body any) (int, map[string]any) {
+	code, resp := doRequestBody(t, h, method, path, body)
+	data, _ := resp["data"].(map[string]any)
+	return code, data
+}
+
+// doRequestBody 和 doRequest 一样，但是返回整个响应体，GET 响应的元数据和 data 并列放在 meta 中
+func doRequestBody(t *testing.T, h http.Handler, method, path string, body any) (int, map[string]any) {
+	var reader *bytes.Reader
+	if body != nil {
+		buf, err := json.Marshal(body)
+		assert.NoError(t, err)
+		reader = bytes.NewReader(buf)
+	} else {
+		reader = bytes.NewReader(nil)
+	}
+
+	req := httptest.NewRequest(method, path, reader)
+	req.Header.Set("Auth-Token", testAuthToken)
+	req.Header.Set("Content-Type", "application/json")
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	var resp map[string]any
+	_ = json.Unmarshal(rec.Body.Bytes(), &resp)
+
+	return rec.Code, resp
+}
+
+// doRequestMeta 和 doRequest 一样，但是返回响应体中的 meta
+func doRequestMeta(t *testing.T, h http.Handler, method, path string, body any) (int, map[string]any) {
+	code, resp := doRequestBody(t, h, method, path, body)
+	meta, _ := resp["meta"].(map[string]any)
+	return code, meta
+}
+
+func assertCreatedAt(t *testing.T, body map[string]any, before time.Time) {
+	meta, _ := body["meta"].(map[string]any)
+	raw, ok := meta["created_at"].(string)
+	if !assert.True(t, ok, "created_at should be present") {
+		return
+	}
+
+	created, err := time.Parse(time.RFC3339, raw)
+	assert.NoError(t, err)
+
+	// RFC3339 只精确到秒，所以和插入前的时间比较的时候要先截断
+	assert.False(t, created.Before(before.Truncate(time.Second)))
+	assert.False(t, created.After(time.Now()))
+
+	age, ok := meta["age"].(float64)
+	assert.True(t, ok, "age should be present")
+	assert.GreaterOrEqual(t, age, float64(0))
+}
+
+func TestGetResponsesCreatedAt(t *testing.T) {
+	h := setupTestRouter(t)
+	before := time.Now()
+
+	code, _ := doRequest(t, h, http.MethodPut, "/variants/created-variant", map[string]any{
+		"variant": "hello",
+	})
+	assert.Equal(t, http.StatusCreated, code)
+
+	code, _ = doRequest(t, h, http.MethodPut, "/records/created-record", map[string]any{
+		"record": map[string]any{"name": "urnadb"},
+	})
+	assert.Equal(t, http.StatusCreated, code)
+
+	code, _ = doRequest(t, h, http.MethodPut, "/tables/created-table", map[string]any{})
+	assert.Equal(t, http.StatusCreated, code)
+
+	// 所有 GET 响应的元数据都放在 meta 中，data 保持原来的结构
+	code, body := doRequestBody(t, h, http.MethodGet, "/variants/created-variant", nil)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, map[string]any{"variant": "hello"}, body["data"])
+	assertCreatedAt(t, body, before)
+
+	code, body = doRequestBody(t, h, http.MethodGet, "/records/created-record", nil)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, map[string]any{"name": "urnadb"}, body["data"])
+	assertCreatedAt(t, body, before)
+
+	code, body = doRequestBody(t, h, http.MethodGet, "/tables/created-table", nil)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, map[string]any{}, body["data"])
+	assertCreatedAt(t, body, before)
+
+	code, body = doRequestBody(t, h, http.MethodGet, "/query/created-variant", nil)
+	assert.Equal(t, http.StatusOK, code)
+	assert.NotContains(t, body["data"], "created_at")
+	assertCreatedAt(t, body, before)
+}
+
+func TestPutSetNX(t *testing.T) {
+	h := setupTestRouter(t)
+
+	record := map[string]any{"record": map[string]any{"name": "urnadb"}}
+	code, _ := doRequest(t, h, http.MethodPut, "/records/nx-record?nx=true", record)
+	assert.Equal(t, http.StatusCreated, code)
+
+	code, _ = doRequest(t, h, http.MethodPut, "/records/nx-record?nx=true", record)
+	assert.Equal(t, http.StatusConflict, code)
+
+	// 不带 nx 参数的时候记录依旧允许覆盖
+	code, _ = doRequest(t, h, http.MethodPut, "/records/nx-record", record)
+	assert.Equal(t, http.StatusOK, code)
+
+	variant := map[string]any{"variant": 1}
+	code, _ = doRequest(t, h, http.MethodPut, "/variants/nx-variant?nx=true", variant)
+	assert.Equal(t, http.StatusCreated, code)
+
+	code, _ = doRequest(t, h, http.MethodPut, "/variants/nx-variant?nx=true", variant)
+	assert.Equal(t, http.StatusConflict, code)
+}
+
+func TestQueryDecodedValue(t *testing.T) {
+	h := setupTestRouter(t)
+
+	code, _ := doRequest(t, h, http.MethodPut, "/variants/query-variant", map[string]any{"variant": "hello"})
+	assert.Equal(t, http.StatusCreated, code)
+
+	code, _ = doRequest(t, h, http.MethodPut, "/records/query-record", map[string]any{
+		"record": map[string]any{"name": "urnadb", "stars": 100},
+	})
+	assert.Equal(t, http.StatusCreated, code)
+
+	code, _ = doRequest(t, h, http.MethodPut, "/tables/query-table", map[string]any{})
+	assert.Equal(t, http.StatusCreated, code)
+
+	code, _ = doRequest(t, h, http.MethodPost, "/tables/query-table/rows", map[string]any{
+		"rows": map[string]any{"name": "leon"},
+	})
+	assert.Equal(t, http.StatusOK, code)
+
+	code, _ = doRequest(t, h, http.MethodPut, "/locks/query-lock", map[string]any{"ttl": 60})
+	assert.Equal(t, http.StatusCreated, code)
+
+	code, data := doRequest(t, h, http.MethodGet, "/query/query-variant", nil)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "VARIANT", data["type"])
+	assert.Equal(t, "hello", data["value"])
+
+	code, data = doRequest(t, h, http.MethodGet, "/query/query-record", nil)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "RECORD", data["type"])
+	assert.Equal(t, map[string]any{"name": "urnadb", "stars": float64(100)}, data["value"])
+
+	code, data = doRequest(t, h, http.MethodGet, "/query/query-table", nil)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "TABLE", data["type"])
+	rows, ok := data["value"].(map[string]any)
+	if assert.True(t, ok) && assert.Len(t, rows, 1) {
+		for _, row := range rows {
+			assert.Equal(t, "leon", row.(map[string]any)["name"])
+		}
+	}
+
+	// 租约锁的 token 不能通过通用查询接口泄露
+	code, data = doRequest(t, h, http.MethodGet, "/query/query-lock", nil)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "LEASELOCK", data["type"])
+	assert.Nil(t, data["value"])
+}
+
+func TestHealthProbes(t *testing.T) {
+	fss, err := vfs.OpenFS(&vfs.Options{
+		FSPerm:    fs.FileMode(0755),
+		Path:      t.TempDir(),
+		Threshold: 3,
+	})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer fss.StopExpireLoop()
+
+	middleware.SetAuthPassword(testAuthToken)
+	assert.NoError(t, controller.InitAllComponents(fss))
+	h := router.SetupRoutes()
+
+	// 探针不需要携带 Auth-Token
+	probe := func(path string) int {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec.Code
+	}
+
+	assert.Equal(t, http.StatusOK, probe("/livez"))
+	assert.Equal(t, http.StatusOK, probe("/readyz"))
+
+	// 详细的健康信息仍然需要认证
+	assert.Equal(t, http.StatusUnauthorized, probe("/health"))
+	code, _ := doRequest(t, h, http.MethodGet, "/health", nil)
+	assert.Equal(t, http.StatusOK, code)
+
+	// 存储关闭之后不再就绪，但是进程仍然存活
+	assert.NoError(t, fss.CloseFS())
+	assert.Equal(t, http.StatusOK, probe("/livez"))
+	assert.Equal(t, http.StatusServiceUnavailable, probe("/readyz"))
+
+	// 存储还没有初始化的时候也不是就绪状态
+	assert.NoError(t, controller.InitAllComponents(nil))
+	assert.Equal(t, http.StatusServiceUnavailable, probe("/readyz"))
+}
+
+func TestRecoverPanic(t *testing.T) {
+	_, h := setupTestStorage(t)
+
+	engine := h.(*gin.Engine)
+	engine.GET("/panic-test", func(ctx *gin.Context) {
+		var v any = "not a bool"
+		_ = v.(bool)
+	})
+
+	// 控制器中的 panic 返回 500，之后的请求仍然可以正常处理
+	for i := 0; i < 2; i++ {
+		code, _ := doRequest(t, h, http.MethodGet, "/panic-test", nil)
+		assert.Equal(t, http.StatusInternalServerError, code)
+	}
+
+	code, _ := doRequest(t, h, http.MethodGet, "/health", nil)
+	assert.Equal(t, http.StatusOK, code)
+}
+
+func TestDeleteKeysByType(t *testing.T) {
+	h := setupTestRouter(t)
+
+	for i := 0; i < 3; i++ {
+		code, _ := doRequest(t, h, http.MethodPut, fmt.Sprintf("/locks/stale-lock-%d", i), map[string]any{"ttl": 60})
+		assert.Equal(t, http.StatusCreated, code)
+	}
+
+	code, _ := doRequest(t, h, http.MethodPut, "/variants/kept-variant", map[string]any{"variant": "hello"})
+	assert.Equal(t, http.StatusCreated, code)
+
+	code, data := doRequest(t, h, http.MethodDelete, "/admin/keys?type=leaselock", nil)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, float64(3), data["deleted"])
+
+	code, _ = doRequest(t, h, http.MethodPut, "/locks/stale-lock-0", map[string]any{"ttl": 60})
+	assert.Equal(t, http.StatusCreated, code)
+
+	code, _ = doRequest(t, h, http.MethodGet, "/variants/kept-variant", nil)
+	assert.Equal(t, http.StatusOK, code)
+
+	code, _ = doRequest(t, h, http.MethodDelete, "/admin/keys?type=unknown", nil)
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	code, _ = doRequest(t, h, http.MethodDelete, "/admin/keys", nil)
+	assert.Equal(t, http.StatusBadRequest, code)
+}
+
+func TestUninitializedStorage(t *testing.T) {
+	middleware.SetAuthPassword(testAuthToken)
+	assert.NoError(t, controller.InitAllComponents(nil))
+	h := router.SetupRoutes()
+
+	// 没有初始化存储的时候数据请求返回 503，而不是空指针导致进程崩溃
+	for _, req := range []struct{ method, path string }{
+		{http.MethodGet, "/variants/nil-key"},
+		{http.MethodPut, "/tables/nil-key"},
+		{http.MethodGet, "/query/nil-key"},
+		{http.MethodGet, "/health"},
+		{http.MethodPost, "/admin/snapshot"},
+	} {
+		code, _ := doRequest(t, h, req.method, req.path, map[string]any{})
+		assert.Equal(t, http.StatusServiceUnavailable, code, req.path)
+	}
+
+	// 探针不受影响
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/livez", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	// 初始化之后恢复正常
+	code, _ := doRequest(t, setupTestRouter(t), http.MethodPut, "/variants/nil-key", map[string]any{"variant": "value"})
+	assert.Equal(t, http.StatusCreated, code)
+}
+
+func TestTypeMismatchConflict(t *testing.T) {
+	h := setupTestRouter(t)
+
+	code, _ := doRequest(t, h, http.MethodPut, "/tables/mismatch-table", map[string]any{})
+	assert.Equal(t, http.StatusCreated, code)
+
+	// 把 table 当作 record 或者 variant 读取返回 409 而不是 500
+	code, _ = doRequest(t, h, http.MethodGet, "/records/mismatch-table", nil)
+	assert.Equal(t, http.StatusConflict, code)
+
+	code, _ = doRequest(t, h, http.MethodGet, "/variants/mismatch-table", nil)
+	assert.Equal(t, http.StatusConflict, code)
+}
+
+func TestExpireKeys(t *testing.T) {
+	h := setupTestRouter(t)
+
+	for _, key := range []string{"touch-1", "touch-2"} {
+		code, _ := doRequest(t, h, http.MethodPut, "/variants/"+key, map[string]any{
+			"variant": key,
+			"ttl":     10,
+		})
+		assert.Equal(t, http.StatusCreated, code)
+	}
+
+	code, data := doRequest(t, h, http.MethodPost, "/query/expire", map[string]any{
+		"keys": []string{"touch-1", "touch-missing", "touch-2"},
+		"ttl":  3600,
+	})
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, float64(2), data["updated"])
+
+	code, data = doRequest(t, h, http.MethodGet, "/query/touch-1", nil)
+	assert.Equal(t, http.StatusOK, code)
+	assert.InDelta(t, 3600, data["ttl"], 2)
+
+	code, _ = doRequest(t, h, http.MethodPost, "/query/expire", map[string]any{})
+	assert.Equal(t, http.StatusBadRequest, code)
+}
+
+func TestListConcurrentPush(t *testing.T) {
+	h := setupTestRouter(t)
+
+	const workers, pushes = 8, 25
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < pushes; i++ {
+				code, _ := doRequest(t, h, http.MethodPost, "/lists/concurrent-list/push", map[string]any{
+					"values": []any{fmt.Sprintf("%d-%d", w, i)},
+				})
+				assert.Equal(t, http.StatusOK, code)
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	code, data := doRequest(t, h, http.MethodGet, "/lists/concurrent-list", nil)
+	assert.Equal(t, http.StatusOK, code)
+
+	// 并发追加不能丢失任何一个元素，并且同一个请求者追加的元素保持先后顺序
+	list := data["list"].([]any)
+	assert.Len(t, list, workers*pushes)
+
+	next := make(map[int]int, workers)
+	for _, item := range list {
+		var w, i int
+		_, err := fmt.Sscanf(item.(string), "%d-%d", &w, &i)
+		assert.NoError(t, err)
+		assert.Equal(t, next[w], i)
+		next[w]++
+	}
+}
+
+func TestListPopOrder(t *testing.T) {
+	h := setupTestRouter(t)
+
+	code, _ := doRequest(t, h, http.MethodPut, "/lists/order-list", map[string]any{
+		"list": []any{"a", "b"},
+	})
+	assert.Equal(t, http.StatusCreated, code)
+
+	code, data := doRequest(t, h, http.MethodPost, "/lists/order-list/push", map[string]any{
+		"values": []any{"c", "d"},
+	})
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, float64(4), data["length"])
+
+	pop := func(query string) any {
+		code, data := doRequest(t, h, http.MethodPost, "/lists/order-list/pop"+query, nil)
+		assert.Equal(t, http.StatusOK, code)
+		return data["value"]
+	}
+
+	// 默认后进先出，fifo 从头部弹出
+	assert.Equal(t, "d", pop(""))
+	assert.Equal(t, "a", pop("?order=fifo"))
+	assert.Equal(t, "c", pop("?order=lifo"))
+	assert.Equal(t, "b", pop("?order=fifo"))
+
+	code, _ = doRequest(t, h, http.MethodPost, "/lists/order-list/pop", nil)
+	assert.Equal(t, http.StatusNotFound, code)
+
+	code, _ = doRequest(t, h, http.MethodPost, "/lists/order-list/pop?order=random", nil)
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	code, _ = doRequest(t, h, http.MethodPost, "/lists/missing-list/pop", nil)
+	assert.Equal(t, http.StatusNotFound, code)
+}
+
+func TestDumpIndexEndpoint(t *testing.T) {
+	fss, h := setupTestStorage(t)
+
+	// 还没有生成 index.db 快照
+	code, _ := doRequest(t, h, http.MethodGet, "/admin/index/dump", nil)
+	assert.Equal(t, http.StatusNotFound, code)
+
+	code, _ = doRequest(t, h, http.MethodPut, "/variants/dump-key", map[string]any{"variant": "value"})
+	assert.Equal(t, http.StatusCreated, code)
+	assert.NoError(t, fss.ExportSnapshotIndex())
+
+	req := httptest.NewRequest(http.MethodGet, "/admin/index/dump", nil)
+	req.Header.Set("Auth-Token", testAuthToken)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "application/x-ndjson", rec.Header().Get("Content-Type"))
+
+	var entry vfs.IndexEntry
+	assert.NoError(t, json.Unmarshal(bytes.TrimSpace(rec.Body.Bytes()), &entry))
+	assert.Equal(t, "VARIANT", entry.Type)
+	assert.Empty(t, entry.Error)
+}
+
+func TestSnapshotIndexEndpoint(t *testing.T) {
+	fss, h := setupTestStorage(t)
+
+	for i := 0; i < 3; i++ {
+		code, _ := doRequest(t, h, http.MethodPut, fmt.Sprintf("/variants/snapshot-key-%d", i), map[string]any{"variant": "value"})
+		assert.Equal(t, http.StatusCreated, code)
+	}
+
+	code, data := doRequest(t, h, http.MethodPost, "/admin/snapshot", nil)
+	assert.Equal(t, http.StatusOK, code)
+	assert.EqualValues(t, 3, data["entries"])
+
+	stat, err := os.Stat(filepath.Join(fss.GetDirectory(), "index.db"))
+	assert.NoError(t, err)
+	assert.EqualValues(t, stat.Size(), data["size"])
+
+	// 再次导出之后 index.db 被重写为当前的索引
+	code, _ = doRequest(t, h, http.MethodDelete, "/variants/snapshot-key-0", nil)
+	assert.Equal(t, http.StatusOK, code)
+	code, _ = doRequest(t, h, http.MethodPut, "/variants/snapshot-key-3", map[string]any{"variant": "value"})
+	assert.Equal(t, http.StatusCreated, code)
+	code, _ = doRequest(t, h, http.MethodPut, "/variants/snapshot-key-4", map[string]any{"variant": "value"})
+	assert.Equal(t, http.StatusCreated, code)
+
+	code, data = doRequest(t, h, http.MethodPost, "/admin/snapshot", nil)
+	assert.Equal(t, http.StatusOK, code)
+	assert.EqualValues(t, 4, data["entries"])
+
+	stat, err = os.Stat(filepath.Join(fss.GetDirectory(), "index.db"))
+	assert.NoError(t, err)
+	assert.EqualValues(t, stat.Size(), data["size"])
+
+	req := httptest.NewRequest(http.MethodGet, "/admin/index/dump", nil)
+	req.Header.Set("Auth-Token", testAuthToken)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, 4, bytes.Count(rec.Body.Bytes(), []byte("\n")))
+}
+
+func TestCORSMiddleware(t *testing.T) {
+	h := setupTestRouter(t)
+
+	middleware.SetCORSPolicy([]string{"https://admin.urnadb.io"}, nil, true)
+	t.Cleanup(func() {
+		middleware.SetCORSPolicy(nil, nil, false)
+	})
+
+	// 预检请求不携带 Auth-Token 也不能被认证中间件拒绝
+	req := httptest.NewRequest(http.MethodOptions, "/variants/cors-key", nil)
+	req.Header.Set("Origin", "https://admin.urnadb.io")
+	req.Header.Set("Access-Control-Request-Method", http.MethodPut)
+	req.Header.Set("Access-Control-Request-Headers", "Auth-Token, Content-Type")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+	assert.Equal(t, "https://admin.urnadb.io", rec.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "true", rec.Header().Get("Access-Control-Allow-Credentials"))
+	assert.Contains(t, rec.Header().Get("Access-Control-Allow-Methods"), http.MethodPut)
+	assert.Equal(t, "Auth-Token, Content-Type", rec.Header().Get("Access-Control-Allow-Headers"))
+
+	// 允许的来源，普通请求带上跨域响应头
+	req = httptest.NewRequest(http.MethodGet, "/health", nil)
+	req.Header.Set("Origin", "https://admin.urnadb.io")
+	req.Header.Set("Auth-Token", testAuthToken)
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "https://admin.urnadb.io", rec.Header().Get("Access-Control-Allow-Origin"))
+
+	// 不允许的来源，预检请求被拒绝，普通请求没有跨域响应头
+	req = httptest.NewRequest(http.MethodOptions, "/variants/cors-key", nil)
+	req.Header.Set("Origin", "https://evil.example.com")
+	req.Header.Set("Access-Control-Request-Method", http.MethodPut)
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	assert.Empty(t, rec.Header().Get("Access-Control-Allow-Origin"))
+
+	req = httptest.NewRequest(http.MethodGet, "/health", nil)
+	req.Header.Set("Origin", "https://evil.example.com")
+	req.Header.Set("Auth-Token", testAuthToken)
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Empty(t, rec.Header().Get("Access-Control-Allow-Origin"))
+}
+
+func TestRawSegmentEndpoint(t *testing.T) {
+	h := setupTestRouter(t)
+
+	code, _ := doRequest(t, h, http.MethodGet, "/admin/raw/raw-key", nil)
+	assert.Equal(t, http.StatusNotFound, code)
+
+	code, _ = doRequest(t, h, http.MethodPut, "/variants/raw-key", map[string]any{"variant": "value"})
+	assert.Equal(t, http.StatusCreated, code)
+
+	code, data := doRequest(t, h, http.MethodGet, "/admin/raw/raw-key", nil)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "VARIANT", data["type"])
+	// 没有开启压缩和加密的时候存储大小和原始大小一致
+	assert.Equal(t, data["raw_size"], data["stored_size"])
+	assert.Equal(t, float64(1), data["compression_ratio"])
+
+	code, data = doRequest(t, h, http.MethodGet, "/health", nil)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, data, "compression_ratio")
+}
+
+func TestHealthPipelineStatus(t *testing.T) {
+	fss, h := setupTestStorage(t)
+	defer fss.ResetPipeline()
+
+	code, data := doRequest(t, h, http.MethodGet, "/health", nil)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, false, data["encryption_enabled"])
+	assert.Equal(t, false, data["compression_enabled"])
+	assert.Equal(t, "", data["compressor"])
+
+	assert.NoError(t, fss.SetEncryptor(vfs.AESBlockCipher, []byte("1234567890123456")))
+
+	code, data = doRequest(t, h, http.MethodGet, "/health", nil)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, true, data["encryption_enabled"])
+	assert.Equal(t, false, data["compression_enabled"])
+
+	fss.SetCompressor(vfs.SnappyCompressor)
+
+	code, data = doRequest(t, h, http.MethodGet, "/health", nil)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, true, data["encryption_enabled"])
+	assert.Equal(t, true, data["compression_enabled"])
+	assert.Equal(t, "snappy", data["compressor"])
+}
+
+func TestValueSizeInGetResponse(t *testing.T) {
+	fss, h := setupTestStorage(t)
+
+	value := strings.Repeat("urnadb", 200)
+	code, _ := doRequest(t, h, http.MethodPut, "/variants/plain-size", map[string]any{"variant": value})
+	assert.Equal(t, http.StatusCreated, code)
+
+	// 没有开启压缩的时候两个大小一致
+	code, data := doRequestMeta(t, h, http.MethodGet, "/variants/plain-size", nil)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Greater(t, data["value_size"], float64(len(value)))
+	assert.Equal(t, data["value_size"], data["stored_size"])
+
+	fss.SetCompressor(vfs.SnappyCompressor)
+	t.Cleanup(func() { fss.SetCompressor(nil) })
+
+	code, _ = doRequest(t, h, http.MethodPut, "/variants/compressed-size", map[string]any{"variant": value})
+	assert.Equal(t, http.StatusCreated, code)
+
+	for _, path := range []string{"/variants/compressed-size", "/query/compressed-size"} {
+		code, data = doRequestMeta(t, h, http.MethodGet, path, nil)
+		assert.Equal(t, http.StatusOK, code)
+		assert.Greater(t, data["value_size"], float64(len(value)))
+		assert.Less(t, data["stored_size"], data["value_size"])
+	}
+}
+
+func TestWriterIdHeader(t *testing.T) {
+	h := setupTestRouter(t)
+
+	send := func(method, path, writer string, body any) int {
+		buf, err := json.Marshal(body)
+		assert.NoError(t, err)
+		req := httptest.NewRequest(method, path, bytes.NewReader(buf))
+		req.Header.Set("Auth-Token", testAuthToken)
+		req.Header.Set("Content-Type", "application/json")
+		if writer != "" {
+			req.Header.Set("X-Writer-Id", writer)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	put := func(path, writer string, body any) int {
+		return send(http.MethodPut, path, writer, body)
+	}
+
+	assert.Equal(t, http.StatusCreated, put("/records/tagged-record", "billing-service", map[string]any{"record": map[string]any{"n": 1}}))
+	assert.Equal(t, http.StatusCreated, put("/variants/tagged-variant", "orders-service", map[string]any{"variant": "v"}))
+	// 没有携带请求头写入的数据和之前的格式一致，响应中没有 writer
+	assert.Equal(t, http.StatusCreated, put("/records/plain-record", "", map[string]any{"record": map[string]any{"n": 2}}))
+
+	code, meta := doRequestMeta(t, h, http.MethodGet, "/records/tagged-record", nil)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "billing-service", meta["writer"])
+
+	code, meta = doRequestMeta(t, h, http.MethodGet, "/variants/tagged-variant", nil)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "orders-service", meta["writer"])
+
+	code, meta = doRequestMeta(t, h, http.MethodGet, "/query/tagged-record", nil)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "billing-service", meta["writer"])
+
+	code, body := doRequestBody(t, h, http.MethodGet, "/records/plain-record", nil)
+	assert.Equal(t, http.StatusOK, code)
+	assert.NotContains(t, body["meta"], "writer")
+	assert.Equal(t, map[string]any{"n": float64(2)}, body["data"])
+
+	code, data := doRequest(t, h, http.MethodGet, "/query/tagged-record/history", nil)
+	assert.Equal(t, http.StatusOK, code)
+	versions, ok := data["versions"].([]any)
+	if assert.True(t, ok) && assert.Len(t, versions, 1) {
+		assert.Equal(t, "billing-service", versions[0].(map[string]any)["writer"])
+	}
+
+	assert.Equal(t, http.StatusBadRequest, put("/records/long-writer", strings.Repeat("w", vfs.MaxWriterSize+1), map[string]any{"record": map[string]any{}}))
+
+	// 自动创建的列表和表记录请求中的写入者，之后不带请求头的 CAS 重写沿用之前的写入者
+	assert.Equal(t, http.StatusOK, send(http.MethodPost, "/lists/tagged-list/push", "queue-service", map[string]any{"values": []any{1}}))
+	assert.Equal(t, http.StatusOK, send(http.MethodPost, "/lists/tagged-list/push", "", map[string]any{"values": []any{2}}))
+	code, meta = doRequestMeta(t, h, http.MethodGet, "/lists/tagged-list", nil)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "queue-service", meta["writer"])
+
+	assert.Equal(t, http.StatusCreated, send(http.MethodPost, "/tables/tagged-table/ensure", "orders-service", map[string]any{}))
+	assert.Equal(t, http.StatusOK, send(http.MethodPost, "/tables/tagged-table/rows", "", map[string]any{"rows": map[string]any{"id": 1}}))
+	code, meta = doRequestMeta(t, h, http.MethodGet, "/tables/tagged-table", nil)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "orders-service", meta["writer"])
+
+	assert.Equal(t, http.StatusOK, send(http.MethodPost, "/tables/upserted-table/rows", "billing-service", map[string]any{"rows": map[string]any{"id": 1}, "upsert": true}))
+	code, meta = doRequestMeta(t, h, http.MethodGet, "/tables/upserted-table", nil)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "billing-service", meta["writer"])
+
+	// 携带新的写入者的时候替换之前的写入者
+	assert.Equal(t, http.StatusOK, send(http.MethodPost, "/tables/upserted-table/rows", "orders-service", map[string]any{"rows": map[string]any{"id": 2}}))
+	code, meta = doRequestMeta(t, h, http.MethodGet, "/tables/upserted-table", nil)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "orders-service", meta["writer"])
+}
+
+func TestCreateStatusCodes(t *testing.T) {
+	h := setupTestRouter(t)
+
+	record := map[string]any{"record": map[string]any{"a": 1}}
+	list := map[string]any{"list": []any{"a"}}
+	for _, c := range []struct {
+		name      string
+		path      string
+		body      map[string]any
+		wait      time.Duration
+		overwrite int
+	}{
+		// record 和 list 允许覆盖，覆盖已经存在的 key 返回 200
+		{"record", "/records/status-record", record, 0, http.StatusOK},
+		{"list", "/lists/status-list", list, 0, http.StatusOK},
+		// variant 和 table 不允许通过 PUT 覆盖，租约锁已经被持有返回 423
+		{"variant", "/variants/status-variant", map[string]any{"variant": "v"}, 0, http.StatusConflict},
+		{"table", "/tables/status-table", map[string]any{}, 0, http.StatusConflict},
+		{"lock", "/locks/status-lock", map[string]any{"ttl": 30}, 0, http.StatusLocked},
+		// nx 创建的 record 一定是新创建的
+		{"record nx", "/records/status-record-nx?nx=true", record, 0, http.StatusConflict},
+		// 覆盖已经过期的 key 也算新创建
+		{"expired record", "/records/status-expired", map[string]any{"record": map[string]any{}, "ttl": 1}, 1100 * time.Millisecond, http.StatusCreated},
+	} {
+		code, _ := doRequest(t, h, http.MethodPut, c.path, c.body)
+		assert.Equal(t, http.StatusCreated, code, c.name)
+
+		time.Sleep(c.wait)
+
+		code, _ = doRequest(t, h, http.MethodPut, c.path, c.body)
+		assert.Equal(t, c.overwrite, code, c.name)
+	}
+
+	// 并发创建同一个 key 只有一个请求返回 201
+	for path, body := range map[string]map[string]any{
+		"/records/status-concurrent-record": record,
+		"/lists/status-concurrent-list":     list,
+	} {
+		var (
+			wg      sync.WaitGroup
+			created atomic.Int32
+		)
+		for i := 0; i < 16; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if code, _ := doRequest(t, h, http.MethodPut, path, body); code == http.StatusCreated {
+					created.Add(1)
+				}
+			}()
+		}
+		wg.Wait()
+		assert.EqualValues(t, 1, created.Load(), path)
+	}
+}
+
+func TestInsertRowsExpiredTable(t *testing.T) {
+	h := setupTestRouter(t)
+
+	for _, key := range []string{"expired-strict", "expired-upsert"} {
+		code, _ := doRequest(t, h, http.MethodPut, "/tables/"+key, map[string]any{"ttl": 1})
+		assert.Equal(t, http.StatusCreated, code)
+	}
+
+	time.Sleep(1100 * time.Millisecond)
+
+	// 没有 upsert 的时候明确返回 410，而不是让人困惑的 not found
+	code, _ := doRequest(t, h, http.MethodPost, "/tables/expired-strict/rows", map[string]any{
+		"rows": map[string]any{"name": "urnadb"},
+	})
+	assert.Equal(t, http.StatusGone, code)
+
+	code, _ = doRequest(t, h, http.MethodPatch, "/tables/expired-strict", map[string]any{
+		"wheres": map[string]any{"name": "urnadb"},
+		"sets":   map[string]any{"name": "urnadb"},
+	})
+	assert.Equal(t, http.StatusNotFound, code)
+
+	// upsert 重新创建一张没有过期时间的空表
+	code, data := doRequest(t, h, http.MethodPost, "/tables/expired-upsert/rows", map[string]any{
+		"rows":   map[string]any{"name": "urnadb"},
+		"upsert": true,
+	})
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, float64(1), data["t_id"])
+
+	code, data = doRequest(t, h, http.MethodGet, "/tables/expired-upsert", nil)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Len(t, data, 1)
+
+	code, _ = doRequest(t, h, http.MethodPatch, "/tables/expired-strict", map[string]any{
+		"wheres": map[string]any{"name": "urnadb"},
+		"sets":   map[string]any{"name": "urnadb"},
+		"upsert": true,
+	})
+	assert.Equal(t, http.StatusOK, code)
+}
+
+func TestReloadAuthConcurrent(t *testing.T) {
+	h := setupTestRouter(t)
+	t.Cleanup(func() {
+		middleware.ReloadAuthPolicy(testAuthToken, nil)
+	})
+
+	request := func(token string) int {
+		req := httptest.NewRequest(http.MethodGet, "/health", nil)
+		req.Header.Set("Auth-Token", token)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	code, _ := doRequest(t, h, http.MethodPost, "/admin/reload-auth", map[string]any{"auth": "short"})
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	const rotated = "rotated1234567890"
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			token := testAuthToken
+			if i%2 == 0 {
+				token = rotated
+			}
+			for j := 0; j < 50; j++ {
+				code := request(token)
+				assert.Contains(t, []int{http.StatusOK, http.StatusUnauthorized}, code)
+			}
+		}(i)
+	}
+
+	for i := 0; i < 50; i++ {
+		if i%2 == 0 {
+			middleware.ReloadAuthPolicy(rotated, nil)
+		} else {
+			middleware.ReloadAuthPolicy(testAuthToken, []string{"192.0.2.1"})
+		}
+	}
+	middleware.ReloadAuthPolicy(testAuthToken, nil)
+
+	code, _ = doRequest(t, h, http.MethodPost, "/admin/reload-auth", map[string]any{"auth": rotated})
+	assert.Equal(t, http.StatusOK, code)
+
+	wg.Wait()
+
+	assert.Equal(t, http.StatusOK, request(rotated))
+	assert.Equal(t, http.StatusUnauthorized, request(testAuthToken))
+}
+
+func TestAllowIpList(t *testing.T) {
+	h := setupTestRouter(t)
+	t.Cleanup(func() {
+		middleware.SetAllowIpList(nil)
+	})
+
+	request := func(remote, forwarded string) int {
+		req := httptest.NewRequest(http.MethodGet, "/health", nil)
+		req.RemoteAddr = remote
+		req.Header.Set("Auth-Token", testAuthToken)
+		if forwarded != "" {
+			req.Header.Set("X-Forwarded-For", forwarded)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	middleware.SetAllowIpList([]string{"192.0.2.1", "::1", "2001:db8::1"})
+
+	cases := []struct {
+		remote    string
+		forwarded string
+		code      int
+	}{
+		{"192.0.2.1:54321", "", http.StatusOK},
+		{"192.0.2.2:54321", "", http.StatusUnauthorized},
+		{"[::1]:54321", "", http.StatusOK},
+		{"[2001:db8:0:0:0:0:0:1]:54321", "", http.StatusOK},
+		{"[2001:db8::2]:54321", "", http.StatusUnauthorized},
+		{"[::2]:54321", "2001:db8::1", http.StatusOK},
+		{"[::2]:54321", "[2001:db8::1]:8080, 192.0.2.9", http.StatusOK},
+		{"[::2]:54321", "2001:db8::", http.StatusUnauthorized},
+	}
+
+	for _, c := range cases {
+		assert.Equal(t, c.code, request(c.remote, c.forwarded), "%s %s", c.remote, c.forwarded)
+	}
+}
+
+func TestQueryNumericVariant(t *testing.T) {
+	h := setupTestRouter(t)
+
+	code, _ := doRequest(t, h, http.MethodPut, "/variants/query-counter", map[string]any{"variant": 41})
+	assert.Equal(t, http.StatusCreated, code)
+
+	code, _ = doRequest(t, h, http.MethodPost, "/variants/query-counter", map[string]any{"delta": 1})
+	assert.Equal(t, http.StatusOK, code)
+
+	// 数值类型的 variant 通过通用查询接口直接返回标量，而不是原始的字节
+	code, data := doRequest(t, h, http.MethodGet, "/query/query-counter", nil)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "VARIANT", data["type"])
+	assert.Equal(t, float64(42), data["value"])
+}
+
+func TestTableConcurrentInsertRows(t *testing.T) {
+	h := setupTestRouter(t)
+
+	code, _ := doRequest(t, h, http.MethodPut, "/tables/concurrent-table", map[string]any{})
+	assert.Equal(t, http.StatusCreated, code)
+
+	const workers, inserts = 8, 25
+
+	var (
+		wg  sync.WaitGroup
+		mu  sync.Mutex
+		ids = make(map[float64]bool, workers*inserts)
+	)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < inserts; i++ {
+				code, data := doRequest(t, h, http.MethodPost, "/tables/concurrent-table/rows", map[string]any{
+					"rows": map[string]any{"worker": w, "seq": i},
+				})
+				if assert.Equal(t, http.StatusOK, code) {
+					mu.Lock()
+					ids[data["t_id"].(float64)] = true
+					mu.Unlock()
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	// 每一次插入都拿到了不同的 t_id，并且所有的行都写入了表中
+	assert.Len(t, ids, workers*inserts)
+
+	code, data := doRequest(t, h, http.MethodGet, "/tables/concurrent-table", nil)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Len(t, data, workers*inserts)
+}
+
+func TestQueryTableStream(t *testing.T) {
+	fss, h := setupTestStorage(t)
+
+	const rows = 20000
+	tab := types.NewTable()
+	for i := 0; i < rows; i++ {
+		tab.AddRows(map[string]any{"name": fmt.Sprintf("row-%d", i), "seq": i})
+	}
+
+	seg, err := vfs.NewSegment("stream-table", tab, 0)
+	assert.NoError(t, err)
+	assert.NoError(t, fss.PutSegment("stream-table", seg))
+
+	get := func(path string) (*httptest.ResponseRecorder, uint64) {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("Auth-Token", testAuthToken)
+		rec := httptest.NewRecorder()
+
+		var before, after runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+		h.ServeHTTP(rec, req)
+		runtime.ReadMemStats(&after)
+
+		return rec, after.TotalAlloc - before.TotalAlloc
+	}
+
+	buffered, bufferedAlloc := get("/tables/stream-table")
+	assert.Equal(t, http.StatusOK, buffered.Code)
+
+	streamed, streamedAlloc := get("/tables/stream-table?stream=true")
+	assert.Equal(t, http.StatusOK, streamed.Code)
+	assert.True(t, json.Valid(streamed.Body.Bytes()))
+	assert.Less(t, streamedAlloc, bufferedAlloc)
+
+	var resp struct {
+		Status string          `json:"status"`
+		Meta   map[string]any  `json:"meta"`
+		Data   json.RawMessage `json:"data"`
+	}
+	assert.NoError(t, json.Unmarshal(streamed.Body.Bytes(), &resp))
+	assert.Equal(t, "success", resp.Status)
+	assert.NotEmpty(t, resp.Meta["created_at"])
+
+	// 行按照 t_id 从小到大的顺序输出
+	dec := json.NewDecoder(bytes.NewReader(resp.Data))
+	_, err = dec.Token()
+	assert.NoError(t, err)
+
+	next := 1
+	for dec.More() {
+		key, err := dec.Token()
+		if !assert.NoError(t, err) {
+			break
+		}
+		assert.Equal(t, strconv.Itoa(next), key)
+
+		var row map[string]any
+		assert.NoError(t, dec.Decode(&row))
+		assert.Equal(t, float64(next-1), row["seq"])
+		next++
+	}
+	assert.Equal(t, rows+1, next)
+}
+
+func TestExpiringKeys(t *testing.T) {
+	h := setupTestRouter(t)
+
+	for key, ttl := range map[string]int{"soon": 10, "later": 600} {
+		code, _ := doRequest(t, h, http.MethodPut, "/variants/"+key, map[string]any{"variant": key, "ttl": ttl})
+		assert.Equal(t, http.StatusCreated, code)
+	}
+
+	code, _ := doRequest(t, h, http.MethodGet, "/query/expiring?within=abc", nil)
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	code, data := doRequest(t, h, http.MethodGet, "/query/expiring?within=1m", nil)
+	assert.Equal(t, http.StatusOK, code)
+
+	keys := data["keys"].([]any)
+	if assert.Len(t, keys, 1) {
+		item := keys[0].(map[string]any)
+		assert.Equal(t, "soon", item["key"])
+		assert.InDelta(t, 10, item["ttl"], 1)
+	}
+
+	// 普通的 key 查询不受影响
+	code, _ = doRequest(t, h, http.MethodGet, "/query/soon", nil)
+	assert.Equal(t, http.StatusOK, code)
+}
+
+func TestExpiringKeysCancelled(t *testing.T) {
+	fss, h := setupTestStorage(t)
+
+	for i := 0; i < 5000; i++ {
+		key := fmt.Sprintf("cancel-%d", i)
+		seg, err := vfs.NewSegment(key, types.NewVariant(i), 30)
+		assert.NoError(t, err)
+		assert.NoError(t, fss.PutSegment(key, seg))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// 客户端已经断开的请求不需要扫描完整个索引
+	req := httptest.NewRequest(http.MethodGet, "/query/expiring?within=1m", nil).WithContext(ctx)
+	req.Header.Set("Auth-Token", testAuthToken)
+	rec := httptest.NewRecorder()
+
+	start := time.Now()
+	h.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusRequestTimeout, rec.Code)
+	assert.Less(t, time.Since(start), time.Second)
+
+	code, data := doRequest(t, h, http.MethodGet, "/query/expiring?within=1m", nil)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Len(t, data["keys"], 5000)
+}
+
+func TestQueryRowsWithIDs(t *testing.T) {
+	h := setupTestRouter(t)
+
+	code, _ := doRequest(t, h, http.MethodPut, "/tables/ids-table", map[string]any{})
+	assert.Equal(t, http.StatusCreated, code)
+
+	for _, name := range []string{"leon", "ding", "leon"} {
+		code, _ := doRequest(t, h, http.MethodPost, "/tables/ids-table/rows", map[string]any{
+			"rows": map[string]any{"name": name},
+		})
+		assert.Equal(t, http.StatusOK, code)
+	}
+
+	queryRows := func(withIDs bool) []map[string]any {
+		buf, err := json.Marshal(map[string]any{
+			"wheres":   map[string]any{"name": "leon"},
+			"with_ids": withIDs,
+		})
+		assert.NoError(t, err)
+
+		req := httptest.NewRequest(http.MethodGet, "/tables/ids-table/rows", bytes.NewReader(buf))
+		req.Header.Set("Auth-Token", testAuthToken)
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusOK, rec.Code)
+
+		var resp struct {
+			Data []map[string]any `json:"data"`
+		}
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+		return resp.Data
+	}
+
+	rows := queryRows(true)
+	if assert.Len(t, rows, 2) {
+		assert.Equal(t, float64(1), rows[0]["t_id"])
+		assert.Equal(t, float64(3), rows[1]["t_id"])
+	}
+
+	// 默认不返回 t_id，并且带 t_id 的查询不会把 t_id 写入表中
+	for _, row := range queryRows(false) {
+		assert.NotContains(t, row, "t_id")
+	}
+}
+
+func TestVariantPrecision(t *testing.T) {
+	h := setupTestRouter(t)
+
+	code, _ := doRequest(t, h, http.MethodPut, "/variants/precision-variant", map[string]any{"variant": 0.1})
+	assert.Equal(t, http.StatusCreated, code)
+
+	code, data := doRequest(t, h, http.MethodPost, "/variants/precision-variant?precision=2", map[string]any{"delta": 0.2})
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, 0.3, data["variant"])
+
+	code, data = doRequest(t, h, http.MethodGet, "/variants/precision-variant?precision=1", nil)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, 0.3, data["variant"])
+
+	// 存储的值保持完整的精度
+	code, data = doRequest(t, h, http.MethodGet, "/variants/precision-variant", nil)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, 0.30000000000000004, data["variant"])
+
+	for _, precision := range []string{"-1", "18", "abc"} {
+		code, _ = doRequest(t, h, http.MethodGet, "/variants/precision-variant?precision="+precision, nil)
+		assert.Equal(t, http.StatusBadRequest, code, precision)
+	}
+}
+
+func TestExistsKeys(t *testing.T) {
+	h := setupTestRouter(t)
+
+	code, _ := doRequest(t, h, http.MethodPut, "/variants/exists-variant", map[string]any{"variant": "hello"})
+	assert.Equal(t, http.StatusCreated, code)
+
+	code, _ = doRequest(t, h, http.MethodPut, "/records/exists-record", map[string]any{
+		"record": map[string]any{"name": "urnadb"},
+	})
+	assert.Equal(t, http.StatusCreated, code)
+
+	code, data := doRequest(t, h, http.MethodPost, "/query/exists", map[string]any{
+		"keys": []string{"exists-variant", "exists-record", "exists-missing"},
+	})
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, map[string]any{
+		"exists-variant": true,
+		"exists-record":  true,
+		"exists-missing": false,
+	}, data["keys"])
+
+	code, _ = doRequest(t, h, http.MethodPost, "/query/exists", map[string]any{})
+	assert.Equal(t, http.StatusBadRequest, code)
+}
+
+func TestCountRowsMatchesQueryRows(t *testing.T) {
+	h := setupTestRouter(t)
+
+	code, _ := doRequest(t, h, http.MethodPut, "/tables/count-table", map[string]any{})
+	assert.Equal(t, http.StatusCreated, code)
+
+	for i := 0; i < 30; i++ {
+		code, _ := doRequest(t, h, http.MethodPost, "/tables/count-table/rows", map[string]any{
+			"rows": map[string]any{"group": fmt.Sprintf("g-%d", i%3), "even": i%2 == 0},
+		})
+		assert.Equal(t, http.StatusOK, code)
+	}
+
+	queryRows := func(wheres map[string]any) int {
+		buf, err := json.Marshal(map[string]any{"wheres": wheres})
+		assert.NoError(t, err)
+
+		req := httptest.NewRequest(http.MethodGet, "/tables/count-table/rows", bytes.NewReader(buf))
+		req.Header.Set("Auth-Token", testAuthToken)
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusOK, rec.Code)
+
+		var resp struct {
+			Data []map[string]any `json:"data"`
+		}
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+		return len(resp.Data)
+	}
+
+	predicates := []map[string]any{
+		{},
+		{"group": "g-0"},
+		{"even": true},
+		{"group": "g-1", "even": false},
+		{"group": "missing"},
+	}
+	for _, wheres := range predicates {
+		code, data := doRequest(t, h, http.MethodGet, "/tables/count-table/rows/count", map[string]any{"wheres": wheres})
+		if assert.Equal(t, http.StatusOK, code) {
+			assert.Equal(t, float64(queryRows(wheres)), data["count"], "wheres: %v", wheres)
+		}
+	}
+
+	// 没有请求体的时候统计整张表
+	code, data := doRequest(t, h, http.MethodGet, "/tables/count-table/rows/count", nil)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, float64(30), data["count"])
+
+	code, _ = doRequest(t, h, http.MethodGet, "/tables/missing-table/rows/count", nil)
+	assert.Equal(t, http.StatusNotFound, code)
+}
+
+func TestQueryHistory(t *testing.T) {
+	h := setupTestRouter(t)
+
+	for i, value := range []string{"v1", "v2", "v3"} {
+		code, _ := doRequest(t, h, http.MethodPut, "/records/history-key", map[string]any{"record": map[string]any{"v": value}})
+		if i == 0 {
+			assert.Equal(t, http.StatusCreated, code)
+		} else {
+			assert.Equal(t, http.StatusOK, code)
+		}
+	}
+
+	code, data := doRequest(t, h, http.MethodGet, "/query/history-key/history", nil)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "history-key", data["key"])
+
+	versions := data["versions"].([]any)
+	if assert.Len(t, versions, 3) {
+		for i, expected := range []string{"v3", "v2", "v1"} {
+			item := versions[i].(map[string]any)
+			assert.Equal(t, map[string]any{"v": expected}, item["value"])
+			assert.Equal(t, false, item["deleted"])
+		}
+	}
+
+	code, data = doRequest(t, h, http.MethodGet, "/query/history-key/history?limit=1", nil)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Len(t, data["versions"], 1)
+
+	code, _ = doRequest(t, h, http.MethodGet, "/query/history-key/history?limit=0", nil)
+	assert.Equal(t, http.StatusBadRequest, code)
+}
+
+func TestQuerySwap(t *testing.T) {
+	h := setupTestRouter(t)
+
+	code, data := doRequest(t, h, http.MethodPost, "/query/swap-key/swap", map[string]any{"type": "record", "value": map[string]any{"v": "v1"}})
+	assert.Equal(t, http.StatusOK, code)
+	assert.Nil(t, data["previous"])
+
+	code, data = doRequest(t, h, http.MethodPost, "/query/swap-key/swap", map[string]any{"type": "record", "value": map[string]any{"v": "v2"}})
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, map[string]any{"v": "v1"}, data["previous"])
+
+	code, data = doRequest(t, h, http.MethodGet, "/records/swap-key", nil)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, map[string]any{"v": "v2"}, data)
+
+	// 类型和已经存在的值不一致
+	code, _ = doRequest(t, h, http.MethodPost, "/query/swap-key/swap", map[string]any{"type": "list", "value": []any{1}})
+	assert.Equal(t, http.StatusConflict, code)
+
+	// 值和声明的类型不一致
+	code, _ = doRequest(t, h, http.MethodPost, "/query/swap-key/swap", map[string]any{"type": "record", "value": "v3"})
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	code, _ = doRequest(t, h, http.MethodPost, "/query/swap-key/swap", map[string]any{"type": "table", "value": map[string]any{}})
+	assert.Equal(t, http.StatusBadRequest, code)
+}
+
+func TestCreateWithEmptyBody(t *testing.T) {
+	h := setupTestRouter(t)
+
+	// 可以为空的容器类型，空请求体创建空的容器
+	code, _ := doRequest(t, h, http.MethodPut, "/records/empty-record", nil)
+	assert.Equal(t, http.StatusCreated, code)
+
+	code, data := doRequest(t, h, http.MethodGet, "/records/empty-record", nil)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, map[string]any{}, data)
+
+	code, _ = doRequest(t, h, http.MethodPut, "/lists/empty-list", nil)
+	assert.Equal(t, http.StatusCreated, code)
+
+	code, data = doRequest(t, h, http.MethodGet, "/lists/empty-list", nil)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, []any{}, data["list"])
+
+	code, _ = doRequest(t, h, http.MethodPut, "/tables/empty-table", nil)
+	assert.Equal(t, http.StatusCreated, code)
+
+	code, _ = doRequest(t, h, http.MethodGet, "/tables/empty-table", nil)
+	assert.Equal(t, http.StatusOK, code)
+
+	// variant 必须携带值
+	req := httptest.NewRequest(http.MethodPut, "/variants/empty-variant", nil)
+	req.Header.Set("Auth-Token", testAuthToken)
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Contains(t, rec.Body.String(), "request body is required")
+}
+
+func TestConditionalGetETag(t *testing.T) {
+	h := setupTestRouter(t)
+
+	code, _ := doRequest(t, h, http.MethodPut, "/lists/etag-list", map[string]any{"list": []any{"a"}})
+	assert.Equal(t, http.StatusCreated, code)
+
+	get := func(ifNoneMatch string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/lists/etag-list", nil)
+		req.Header.Set("Auth-Token", testAuthToken)
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := get("")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	tag := rec.Header().Get("ETag")
+	assert.Regexp(t, `^"\d+-0"$`, tag)
+
+	rec = get(tag)
+	assert.Equal(t, http.StatusNotModified, rec.Code)
+	assert.Empty(t, rec.Body.String())
+
+	rec = get(`"7"`)
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	// push 通过 CAS 更新，版本号递增之后旧的 ETag 不再匹配
+	code, _ = doRequest(t, h, http.MethodPost, "/lists/etag-list/push", map[string]any{"values": []any{"b"}})
+	assert.Equal(t, http.StatusOK, code)
+
+	rec = get(tag)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	tag = rec.Header().Get("ETag")
+	assert.Regexp(t, `^"\d+-1"$`, tag)
+
+	rec = get("W/" + tag)
+	assert.Equal(t, http.StatusNotModified, rec.Code)
+
+	// 普通的 PUT 覆盖写入之后版本号重置为 0，两次覆盖写入的 ETag 仍然不同，旧的 ETag 不能返回 304
+	code, _ = doRequest(t, h, http.MethodPut, "/lists/etag-list", map[string]any{"list": []any{"c"}})
+	assert.Equal(t, http.StatusOK, code)
+	rec = get("")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	overwritten := rec.Header().Get("ETag")
+
+	time.Sleep(time.Millisecond)
+	code, _ = doRequest(t, h, http.MethodPut, "/lists/etag-list", map[string]any{"list": []any{"d"}})
+	assert.Equal(t, http.StatusOK, code)
+
+	rec = get(overwritten)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"d"`)
+	assert.NotEqual(t, overwritten, rec.Header().Get("ETag"))
+}
+
+func TestTimeSeries(t *testing.T) {
+	h := setupTestRouter(t)
+
+	now := time.Now().UnixMilli()
+	base := now - now%1000 - 10_000
+
+	// 乱序写入
+	code, data := doRequest(t, h, http.MethodPost, "/ts/cpu", map[string]any{
+		"samples": []map[string]any{
+			{"ts": base + 2500, "value": 30},
+			{"ts": base, "value": 10},
+			{"ts": base + 500, "value": 20},
+		},
+	})
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, float64(3), data["length"])
+
+	code, data = doRequest(t, h, http.MethodPost, "/ts/cpu", map[string]any{
+		"samples": []map[string]any{{"ts": base + 1000, "value": 40}},
+	})
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, float64(4), data["length"])
+
+	code, data = doRequest(t, h, http.MethodGet, fmt.Sprintf("/ts/cpu?from=%d&to=%d", base+500, base+1000), nil)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, []any{
+		map[string]any{"ts": float64(base + 500), "value": float64(20)},
+		map[string]any{"ts": float64(base + 1000), "value": float64(40)},
+	}, data["samples"])
+
+	code, data = doRequest(t, h, http.MethodGet, "/ts/cpu?bucket=1000&agg=max", nil)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, []any{
+		map[string]any{"ts": float64(base), "value": float64(20)},
+		map[string]any{"ts": float64(base + 1000), "value": float64(40)},
+		map[string]any{"ts": float64(base + 2000), "value": float64(30)},
+	}, data["samples"])
+
+	code, data = doRequest(t, h, http.MethodGet, "/ts/cpu?bucket=1000", nil)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, float64(15), data["samples"].([]any)[0].(map[string]any)["value"])
+
+	code, _ = doRequest(t, h, http.MethodGet, "/ts/cpu?bucket=1000&agg=sum", nil)
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	code, _ = doRequest(t, h, http.MethodGet, "/ts/cpu?from=yesterday", nil)
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	// 按照数量保留最新的采样点
+	code, data = doRequest(t, h, http.MethodPost, "/ts/cpu", map[string]any{
+		"samples":     []map[string]any{{"ts": base + 3000, "value": 50}},
+		"max_samples": 2,
+	})
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, float64(2), data["length"])
+
+	code, _ = doRequest(t, h, http.MethodGet, "/ts/missing", nil)
+	assert.Equal(t, http.StatusNotFound, code)
+
+	code, _ = doRequest(t, h, http.MethodDelete, "/ts/cpu", nil)
+	assert.Equal(t, http.StatusOK, code)
+}
+
+func TestDefaultTTL(t *testing.T) {
+	h := setupTestRouter(t)
+
+	controller.SetDefaultTTL(60, map[string]int64{"variants": 120})
+	t.Cleanup(func() { controller.SetDefaultTTL(0, nil) })
+
+	ttlOf := func(key string) float64 {
+		code, data := doRequest(t, h, http.MethodGet, "/query/"+key, nil)
+		assert.Equal(t, http.StatusOK, code)
+		return data["ttl"].(float64)
+	}
+
+	// 省略 ttl 使用对应类型的默认值，没有覆盖的类型使用全局的默认值
+	code, _ := doRequest(t, h, http.MethodPut, "/variants/default-ttl-variant", map[string]any{"variant": "v"})
+	assert.Equal(t, http.StatusCreated, code)
+	assert.InDelta(t, 120, ttlOf("default-ttl-variant"), 1)
+
+	code, _ = doRequest(t, h, http.MethodPut, "/records/default-ttl-record", map[string]any{"record": map[string]any{"k": "v"}})
+	assert.Equal(t, http.StatusCreated, code)
+	assert.InDelta(t, 60, ttlOf("default-ttl-record"), 1)
+
+	code, _ = doRequest(t, h, http.MethodPut, "/tables/default-ttl-table", map[string]any{})
+	assert.Equal(t, http.StatusCreated, code)
+	assert.InDelta(t, 60, ttlOf("default-ttl-table"), 1)
+
+	// 追加元素和 upsert 自动创建的数据同样使用默认值
+	code, _ = doRequest(t, h, http.MethodPost, "/lists/default-ttl-list/push", map[string]any{"values": []any{1}})
+	assert.Equal(t, http.StatusOK, code)
+	assert.InDelta(t, 60, ttlOf("default-ttl-list"), 1)
+
+	code, _ = doRequest(t, h, http.MethodPost, "/tables/default-ttl-upsert/rows", map[string]any{
+		"rows":   map[string]any{"name": "urnadb"},
+		"upsert": true,
+	})
+	assert.Equal(t, http.StatusOK, code)
+	assert.InDelta(t, 60, ttlOf("default-ttl-upsert"), 1)
+
+	// 显式指定的 ttl 不受默认值影响
+	code, _ = doRequest(t, h, http.MethodPut, "/lists/explicit-ttl-list", map[string]any{"list": []any{1}, "ttl": 300})
+	assert.Equal(t, http.StatusCreated, code)
+	assert.InDelta(t, 300, ttlOf("explicit-ttl-list"), 1)
+
+	// 显式请求永不过期的数据仍然永不过期
+	code, _ = doRequest(t, h, http.MethodPut, "/variants/immortal-variant", map[string]any{"variant": "v", "ttl": vfs.ImmortalTTL})
+	assert.Equal(t, http.StatusCreated, code)
+	assert.Equal(t, float64(vfs.ImmortalTTL), ttlOf("immortal-variant"))
+
+	code, _ = doRequest(t, h, http.MethodPut, "/tables/immortal-table", map[string]any{"ttl": vfs.ImmortalTTL})
+	assert.Equal(t, http.StatusCreated, code)
+	assert.Equal(t, float64(vfs.ImmortalTTL), ttlOf("immortal-table"))
+
+	code, _ = doRequest(t, h, http.MethodPut, "/tables/negative-table", map[string]any{"ttl": -5})
+	assert.Equal(t, http.StatusBadRequest, code)
+}
+
+func TestVerifyRegionEndpoint(t *testing.T) {
+	h := setupTestRouter(t)
+
+	for i := 0; i < 3; i++ {
+		code, _ := doRequest(t, h, http.MethodPut, fmt.Sprintf("/variants/verify-%d", i), map[string]any{"variant": i})
+		assert.Equal(t, http.StatusCreated, code)
+	}
+
+	// 新打开的存储只有一个 region
+	code, data := doRequest(t, h, http.MethodGet, "/admin/regions/1/verify", nil)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, float64(3), data["good"])
+	assert.Equal(t, float64(0), data["corrupt"])
+	assert.Equal(t, float64(-1), data["first_corrupt_offset"])
+
+	code, _ = doRequest(t, h, http.MethodGet, "/admin/regions/99/verify", nil)
+	assert.Equal(t, http.StatusNotFound, code)
+
+	code, _ = doRequest(t, h, http.MethodGet, "/admin/regions/abc/verify", nil)
+	assert.Equal(t, http.StatusBadRequest, code)
+}
+
+func TestExportImportEndpoints(t *testing.T) {
+	h := setupTestRouter(t)
+
+	for _, key := range []string{"ns1:a", "ns1:b", "ns2:a"} {
+		code, _ := doRequest(t, h, http.MethodPut, "/records/"+key, map[string]any{"record": map[string]any{"key": key}, "ttl": 600})
+		assert.Equal(t, http.StatusCreated, code)
+	}
+
+	raw := func(method, path string, body []byte) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, bytes.NewReader(body))
+		req.Header.Set("Auth-Token", testAuthToken)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := raw(http.MethodGet, "/admin/export?prefix=ns1:", nil)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "application/octet-stream", rec.Header().Get("Content-Type"))
+	archive := rec.Body.Bytes()
+
+	for _, key := range []string{"ns1:a", "ns1:b"} {
+		code, _ := doRequest(t, h, http.MethodDelete, "/records/"+key, nil)
+		assert.Equal(t, http.StatusOK, code)
+	}
+
+	rec = raw(http.MethodPost, "/admin/import", archive)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"imported": 2`)
+
+	for _, key := range []string{"ns1:a", "ns1:b", "ns2:a"} {
+		code, data := doRequest(t, h, http.MethodGet, "/query/"+key, nil)
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, "RECORD", data["type"])
+		assert.Equal(t, map[string]any{"key": key}, data["value"])
+		assert.Greater(t, data["ttl"], float64(500))
+	}
+
+	rec = raw(http.MethodPost, "/admin/import", []byte("garbage"))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestAcquireLocksAtomic(t *testing.T) {
+	fss, h := setupTestStorage(t)
+
+	sets := [][]string{
+		{"multi-b", "multi-a"},
+		{"multi-c", "multi-b"},
+	}
+
+	for round := 0; round < 20; round++ {
+		var (
+			wg    sync.WaitGroup
+			start = make(chan struct{})
+			codes = make([]int, len(sets))
+			datas = make([]map[string]any, len(sets))
+		)
+		for i, keys := range sets {
+			wg.Add(1)
+			go func(i int, keys []string) {
+				defer wg.Done()
+				<-start
+				codes[i], datas[i] = doRequest(t, h, http.MethodPut, "/locks", map[string]any{"keys": keys, "ttl": 30})
+			}(i, keys)
+		}
+		close(start)
+		wg.Wait()
+
+		// 重叠的 key 只能被一个请求持有，失败的请求不能留下任何一把锁
+		winner := -1
+		for i, code := range codes {
+			if code == http.StatusCreated {
+				assert.Equal(t, -1, winner, "only one caller may acquire all locks")
+				winner = i
+			} else {
+				assert.Equal(t, http.StatusLocked, code)
+			}
+		}
+		if !assert.NotEqual(t, -1, winner) {
+			return
+		}
+
+		tokens := datas[winner]["tokens"].(map[string]any)
+		assert.Len(t, tokens, 2)
+
+		loser := sets[1-winner]
+		for _, key := range loser {
+			if _, ok := tokens[key]; !ok {
+				assert.False(t, fss.IsActive(key), "round %d: %s should be rolled back", round, key)
+			}
+		}
+
+		for key, token := range tokens {
+			code, _ := doRequest(t, h, http.MethodDelete, "/locks/"+key, map[string]any{"token": token})
+			assert.Equal(t, http.StatusOK, code)
+		}
+	}
+
+	code, _ := doRequest(t, h, http.MethodPut, "/locks", map[string]any{"keys": []string{}, "ttl": 30})
+	assert.Equal(t, http.StatusBadRequest, code)
+}
+
+func TestNotFoundEnvelope(t *testing.T) {
+	h := setupTestRouter(t)
+
+	for _, method := range []string{http.MethodGet, http.MethodPost} {
+		req := httptest.NewRequest(method, "/no/such/route", nil)
+		req.Header.Set("Auth-Token", testAuthToken)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+
+		assert.Equal(t, http.StatusNotFound, rec.Code)
+
+		// 未知路由和其他接口的失败响应使用同样的 status/message 结构
+		var body map[string]any
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &body))
+		assert.Equal(t, "error", body["status"])
+		assert.NotEmpty(t, body["message"])
+		assert.NotContains(t, body, "data")
+	}
+}
+
+func TestContentNegotiation(t *testing.T) {
+	h := setupTestRouter(t)
+
+	code, _ := doRequest(t, h, http.MethodPut, "/records/negotiate", map[string]any{
+		"record": map[string]any{"name": "urnadb", "stars": 42},
+	})
+	assert.Equal(t, http.StatusCreated, code)
+
+	get := func(accept string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/records/negotiate", nil)
+		req.Header.Set("Auth-Token", testAuthToken)
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	type envelope struct {
+		Status string         `json:"status" msgpack:"status"`
+		Meta   map[string]any `json:"meta" msgpack:"meta"`
+		Data   map[string]any `json:"data" msgpack:"data"`
+	}
+
+	for _, accept := range []string{"", "application/json"} {
+		rec := get(accept)
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Contains(t, rec.Header().Get("Content-Type"), "application/json")
+
+		var body envelope
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &body))
+		assert.Equal(t, "success", body.Status)
+		assert.Equal(t, map[string]any{"name": "urnadb", "stars": float64(42)}, body.Data)
+	}
+
+	rec := get("application/msgpack, application/json;q=0.9")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "application/msgpack", rec.Header().Get("Content-Type"))
+
+	var body envelope
+	assert.NoError(t, msgpack.Unmarshal(rec.Body.Bytes(), &body))
+	assert.Equal(t, "success", body.Status)
+	assert.Equal(t, "urnadb", body.Data["name"])
+	assert.EqualValues(t, 42, body.Data["stars"])
+	assert.NotEmpty(t, body.Meta["created_at"])
+
+	// 失败的响应同样按照 Accept 编码
+	req := httptest.NewRequest(http.MethodGet, "/records/negotiate-missing", nil)
+	req.Header.Set("Auth-Token", testAuthToken)
+	req.Header.Set("Accept", "application/msgpack")
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	assert.NoError(t, msgpack.Unmarshal(rec.Body.Bytes(), &body))
+	assert.Equal(t, "error", body.Status)
+}
+
+// syncCountFS 统计通过它打开的文件调用 fsync 的次数
+type syncCountFS struct {
+	vfs.OSFilesystem
+	syncs atomic.Int64
+}
+
+type syncCountFile struct {
+	vfs.File
+	syncs *atomic.Int64
+}
+
+func (s *syncCountFS) OpenFile(name string, flag int, perm fs.FileMode) (vfs.File, error) {
+	fd, err := s.OSFilesystem.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &syncCountFile{File: fd, syncs: &s.syncs}, nil
+}
+
+func (f *syncCountFile) Sync() error {
+	f.syncs.Add(1)
+	return f.File.Sync()
+}
+
+func TestLeaseLockWritesAreSynced(t *testing.T) {
+	fsys := new(syncCountFS)
+	fss, err := vfs.OpenFS(&vfs.Options{
+		FS:        fsys,
+		FSPerm:    fs.FileMode(0755),
+		Path:      t.TempDir(),
+		Threshold: 3,
+	})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	t.Cleanup(func() {
+		fss.StopExpireLoop()
+		_ = fss.CloseFS()
+	})
+
+	middleware.SetAuthPassword(testAuthToken)
+	assert.NoError(t, controller.InitAllComponents(fss))
+	h := router.SetupRoutes()
+
+	// 普通的写入不会 fsync
+	before := fsys.syncs.Load()
+	code, _ := doRequest(t, h, http.MethodPut, "/variants/not-synced", map[string]any{"variant": "value"})
+	assert.Equal(t, http.StatusCreated, code)
+	assert.Equal(t, before, fsys.syncs.Load())
+
+	// 租约锁在返回之前已经 fsync 到磁盘
+	code, data := doRequest(t, h, http.MethodPut, "/locks/synced-lock", map[string]any{"ttl": 30})
+	assert.Equal(t, http.StatusCreated, code)
+	assert.Equal(t, before+1, fsys.syncs.Load())
+
+	// 续租换发的新 token 同样在返回之前落盘
+	code, _ = doRequest(t, h, http.MethodPatch, "/locks/synced-lock", map[string]any{"token": data["token"]})
+	assert.Equal(t, http.StatusCreated, code)
+	assert.Equal(t, before+2, fsys.syncs.Load())
+
+	// 同时获取多把锁的时候每一把锁都会 fsync
+	code, _ = doRequest(t, h, http.MethodPut, "/locks", map[string]any{"keys": []string{"synced-a", "synced-b"}, "ttl": 30})
+	assert.Equal(t, http.StatusCreated, code)
+	assert.Equal(t, before+4, fsys.syncs.Load())
+}
+
+func TestSearchRecordDepthLimit(t *testing.T) {
+	h := setupTestRouter(t)
+
+	nested := map[string]any{"name": "leaf"}
+	for i := 0; i < 50; i++ {
+		nested = map[string]any{"name": i, "next": nested}
+	}
+
+	code, _ := doRequest(t, h, http.MethodPut, "/records/deep-record", map[string]any{"record": nested})
+	assert.Equal(t, http.StatusCreated, code)
+
+	search := func(body map[string]any) (*httptest.ResponseRecorder, []any) {
+		buf, err := json.Marshal(body)
+		assert.NoError(t, err)
+
+		req := httptest.NewRequest(http.MethodPost, "/records/deep-record", bytes.NewReader(buf))
+		req.Header.Set("Auth-Token", testAuthToken)
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+
+		var resp struct {
+			Data []any `json:"data"`
+		}
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+		return rec, resp.Data
+	}
+
+	// 默认深度 32 截断了 51 层的嵌套，返回部分结果
+	rec, results := search(map[string]any{"column": "name"})
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "true", rec.Header().Get("X-Search-Depth-Exceeded"))
+	assert.Len(t, results, 32)
+
+	rec, results = search(map[string]any{"column": "name", "depth": 100})
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Empty(t, rec.Header().Get("X-Search-Depth-Exceeded"))
+	assert.Len(t, results, 51)
+
+	rec, _ = search(map[string]any{"column": "name", "depth": 100000})
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestMaxNestingDepth(t *testing.T) {
+	h := setupTestRouter(t)
+
+	service.SetMaxNestingDepth(3)
+	t.Cleanup(func() { service.SetMaxNestingDepth(0) })
+
+	code, _ := doRequest(t, h, http.MethodPut, "/records/shallow-record", map[string]any{
+		"record": map[string]any{"a": map[string]any{"b": map[string]any{"c": 1}}},
+	})
+	assert.Equal(t, http.StatusCreated, code)
+
+	code, _ = doRequest(t, h, http.MethodPut, "/records/deep-record", map[string]any{
+		"record": map[string]any{"a": map[string]any{"b": map[string]any{"c": map[string]any{"d": 1}}}},
+	})
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	code, _ = doRequest(t, h, http.MethodPut, "/tables/depth-table", map[string]any{})
+	assert.Equal(t, http.StatusCreated, code)
+
+	code, _ = doRequest(t, h, http.MethodPost, "/tables/depth-table/rows", map[string]any{
+		"rows": map[string]any{"tags": []any{"go", "db"}},
+	})
+	assert.Equal(t, http.StatusOK, code)
+
+	code, _ = doRequest(t, h, http.MethodPost, "/tables/depth-table/rows", map[string]any{
+		"rows": map[string]any{"tags": []any{[]any{[]any{"go"}}}},
+	})
+	assert.Equal(t, http.StatusBadRequest, code)
+}
+
+func TestHotKeysEndpoint(t *testing.T) {
+	fss, err := vfs.OpenFS(&vfs.Options{
+		FSPerm:           fs.FileMode(0755),
+		Path:             t.TempDir(),
+		Threshold:        3,
+		TrackAccessStats: true,
+	})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	t.Cleanup(func() {
+		fss.StopExpireLoop()
+		_ = fss.CloseFS()
+	})
+
+	middleware.SetAuthPassword(testAuthToken)
+	assert.NoError(t, controller.InitAllComponents(fss))
+	h := router.SetupRoutes()
+
+	for _, key := range []string{"cold", "warm", "hot"} {
+		code, _ := doRequest(t, h, http.MethodPut, "/variants/"+key, map[string]any{"variant": key})
+		assert.Equal(t, http.StatusCreated, code)
+	}
+
+	for key, times := range map[string]int{"hot": 5, "warm": 2} {
+		for i := 0; i < times; i++ {
+			code, _ := doRequest(t, h, http.MethodGet, "/variants/"+key, nil)
+			assert.Equal(t, http.StatusOK, code)
+		}
+	}
+
+	code, data := doRequest(t, h, http.MethodGet, "/admin/hotkeys?n=2", nil)
+	assert.Equal(t, http.StatusOK, code)
+	keys, ok := data["keys"].([]any)
+	if assert.True(t, ok) && assert.Len(t, keys, 2) {
+		assert.Equal(t, "hot", keys[0].(map[string]any)["key"])
+		assert.Equal(t, float64(5), keys[0].(map[string]any)["reads"])
+		assert.Equal(t, "warm", keys[1].(map[string]any)["key"])
+	}
+
+	code, _ = doRequest(t, h, http.MethodGet, "/admin/hotkeys?by=deletes", nil)
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	code, _ = doRequest(t, h, http.MethodGet, "/admin/hotkeys?n=0", nil)
+	assert.Equal(t, http.StatusBadRequest, code)
+}
+
+func TestShardsEndpoint(t *testing.T) {
+	h := setupTestRouter(t)
+
+	code, _ := doRequest(t, h, http.MethodPut, "/variants/shard-key", map[string]any{"variant": 1})
+	assert.Equal(t, http.StatusCreated, code)
+
+	for i := 0; i < 2; i++ {
+		code, _ = doRequest(t, h, http.MethodGet, "/variants/shard-key", nil)
+		assert.Equal(t, http.StatusOK, code)
+	}
+
+	code, data := doRequest(t, h, http.MethodGet, "/admin/shards", nil)
+	assert.Equal(t, http.StatusOK, code)
+
+	shards, ok := data["shards"].([]any)
+	if !assert.True(t, ok) || !assert.NotEmpty(t, shards) {
+		return
+	}
+
+	var keys, acquisitions float64
+	for _, s := range shards {
+		stat := s.(map[string]any)
+		keys += stat["keys"].(float64)
+		acquisitions += stat["acquisitions"].(float64)
+		assert.Contains(t, stat, "contended")
+	}
+	assert.Equal(t, float64(1), keys)
+	assert.GreaterOrEqual(t, acquisitions, float64(3))
+}
+
+func TestResponseEnvelope(t *testing.T) {
+	h := setupTestRouter(t)
+
+	cases := []struct {
+		method string
+		path   string
+		body   string
+		code   int
+		status string
+	}{
+		{http.MethodPut, "/variants/envelope", `{"variant":"value"}`, http.StatusCreated, "success"},
+		{http.MethodGet, "/variants/envelope", "", http.StatusOK, "success"},
+		{http.MethodGet, "/query/envelope", "", http.StatusOK, "success"},
+		{http.MethodPut, "/records/envelope-record", `{"record":{"name":"urnadb"}}`, http.StatusCreated, "success"},
+		{http.MethodGet, "/records/envelope-record", "", http.StatusOK, "success"},
+		{http.MethodPut, "/tables/envelope-table", `{}`, http.StatusCreated, "success"},
+		{http.MethodGet, "/tables/envelope-table", "", http.StatusOK, "success"},
+		{http.MethodGet, "/tables/envelope-table?stream=true", "", http.StatusOK, "success"},
+		{http.MethodGet, "/query/envelope-missing", "", http.StatusNotFound, "error"},
+		{http.MethodPut, "/variants/envelope-empty", "", http.StatusBadRequest, "error"},
+	}
+
+	// 所有的接口都使用 response.ResponseBody 的 status/message/data 结构，GET 响应的元数据统一放在 meta 中，
+	// 失败的响应没有 data 字段
+	for _, c := range cases {
+		req := httptest.NewRequest(c.method, c.path, strings.NewReader(c.body))
+		req.Header.Set("Auth-Token", testAuthToken)
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+
+		assert.Equal(t, c.code, rec.Code, "%s %s", c.method, c.path)
+
+		var body map[string]any
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &body))
+		assert.Equal(t, c.status, body["status"], "%s %s", c.method, c.path)
+		assert.NotEmpty(t, body["message"], "%s %s", c.method, c.path)
+		for field := range body {
+			assert.Contains(t, []string{"status", "message", "data", "meta"}, field, "%s %s", c.method, c.path)
+		}
+		if c.status == "success" && c.method == http.MethodGet {
+			assert.Contains(t, body, "data", "%s %s", c.method, c.path)
+			assert.Contains(t, body["meta"], "created_at", "%s %s", c.method, c.path)
+		} else if c.status == "error" {
+			assert.NotContains(t, body, "data", "%s %s", c.method, c.path)
+		}
+	}
+}
+
+func TestConditionalDelete(t *testing.T) {
+	h := setupTestRouter(t)
+
+	code, _ := doRequest(t, h, http.MethodPut, "/records/cad-record", map[string]any{
+		"record": map[string]any{"name": "urnadb", "stars": 100},
+	})
+	assert.Equal(t, http.StatusCreated, code)
+
+	code, data := doRequest(t, h, http.MethodGet, "/query/cad-record", nil)
+	assert.Equal(t, http.StatusOK, code)
+	observed := data["value"]
+
+	// 读取之后被其他客户端修改，基于旧值的删除返回 409 并且 key 仍然存在
+	code, _ = doRequest(t, h, http.MethodPut, "/records/cad-record", map[string]any{
+		"record": map[string]any{"name": "urnadb", "stars": 101},
+	})
+	assert.Equal(t, http.StatusOK, code)
+
+	code, _ = doRequest(t, h, http.MethodDelete, "/query/cad-record", map[string]any{"expected": observed})
+	assert.Equal(t, http.StatusConflict, code)
+
+	code, _ = doRequest(t, h, http.MethodGet, "/query/cad-record", nil)
+	assert.Equal(t, http.StatusOK, code)
+
+	// 字段的顺序和数字的类型不影响比较
+	code, data = doRequest(t, h, http.MethodDelete, "/query/cad-record", map[string]any{
+		"expected": map[string]any{"stars": 101, "name": "urnadb"},
+	})
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, true, data["deleted"])
+
+	code, _ = doRequest(t, h, http.MethodGet, "/query/cad-record", nil)
+	assert.Equal(t, http.StatusNotFound, code)
+
+	code, _ = doRequest(t, h, http.MethodDelete, "/query/cad-record", map[string]any{"expected": observed})
+	assert.Equal(t, http.StatusNotFound, code)
+
+	code, _ = doRequest(t, h, http.MethodDelete, "/query/cad-record", map[string]any{})
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	// 租约锁的值不对外暴露，不能通过条件删除释放
+	code, _ = doRequest(t, h, http.MethodPut, "/locks/cad-lock", map[string]any{"ttl": 60})
+	assert.Equal(t, http.StatusCreated, code)
+
+	code, _ = doRequest(t, h, http.MethodDelete, "/query/cad-lock", map[string]any{"expected": nil})
+	assert.Equal(t, http.StatusConflict, code)
+}
+
+func TestCompactRegionEndpoint(t *testing.T) {
+	h := setupTestRouter(t)
+
+	code, _ := doRequest(t, h, http.MethodPut, "/variants/compact-region", map[string]any{"variant": "value"})
+	assert.Equal(t, http.StatusCreated, code)
+
+	// 新打开的存储只有一个活跃的 region，不能被回收
+	code, _ = doRequest(t, h, http.MethodPost, "/admin/regions/1/compact", nil)
+	assert.Equal(t, http.StatusConflict, code)
+
+	code, _ = doRequest(t, h, http.MethodPost, "/admin/regions/99/compact", nil)
+	assert.Equal(t, http.StatusNotFound, code)
+
+	code, _ = doRequest(t, h, http.MethodPost, "/admin/regions/abc/compact", nil)
+	assert.Equal(t, http.StatusBadRequest, code)
+}
+
+func TestDecodeFailedReturns422(t *testing.T) {
+	fss, h := setupTestStorage(t)
+
+	// 类型正确但是 value 是其他结构的 msgpack 数据
+	corrupt := func(key string, data vfs.Serializable) {
+		seg, err := vfs.NewSegment(key, data, 0)
+		assert.NoError(t, err)
+		other, err := vfs.NewSegment(key, types.NewVariant("not the expected shape"), 0)
+		assert.NoError(t, err)
+		seg.Value, seg.ValueSize = other.Value, other.ValueSize
+		assert.NoError(t, fss.PutSegment(key, seg))
+	}
+
+	corrupt("corrupt-table", types.NewTable())
+	corrupt("corrupt-record", types.NewRecord())
+
+	code, _ := doRequest(t, h, http.MethodGet, "/tables/corrupt-table", nil)
+	assert.Equal(t, http.StatusUnprocessableEntity, code)
+
+	code, _ = doRequest(t, h, http.MethodGet, "/records/corrupt-record", nil)
+	assert.Equal(t, http.StatusUnprocessableEntity, code)
+
+	code, _ = doRequest(t, h, http.MethodGet, "/query/corrupt-table", nil)
+	assert.Equal(t, http.StatusUnprocessableEntity, code)
+}
+
+func TestQueryStorageErrorIsNotNotFound(t *testing.T) {
+	fss, h := setupTestStorage(t)
+
+	seg, err := vfs.NewSegment("damaged-variant", types.NewVariant("hello"), 0)
+	assert.NoError(t, err)
+	assert.NoError(t, fss.PutSegment("damaged-variant", seg))
+
+	// 破坏数据文件中最后一个字节，读取时 value 的校验失败，这不是 key 不存在
+	files, err := filepath.Glob(filepath.Join(fss.GetDirectory(), "0*.db"))
+	assert.NoError(t, err)
+	if !assert.Len(t, files, 1) {
+		t.FailNow()
+	}
+	fd, err := os.OpenFile(files[0], os.O_RDWR, 0644)
+	assert.NoError(t, err)
+	info, err := fd.Stat()
+	assert.NoError(t, err)
+	_, err = fd.WriteAt([]byte{0xFF}, info.Size()-1)
+	assert.NoError(t, err)
+	assert.NoError(t, fd.Close())
+
+	qs := service.NewQueryServiceImpl(fss)
+	_, err = qs.GetDecoded("damaged-variant")
+	assert.Error(t, err)
+	assert.NotErrorIs(t, err, service.ErrSegmentNotFound)
+
+	code, _ := doRequest(t, h, http.MethodGet, "/query/damaged-variant", nil)
+	assert.Equal(t, http.StatusInternalServerError, code)
+
+	code, _ = doRequest(t, h, http.MethodGet, "/query/missing-variant", nil)
+	assert.Equal(t, http.StatusNotFound, code)
+}
+
+func TestTableStorageErrorIsNotRecreated(t *testing.T) {
+	fss, _ := setupTestStorage(t)
+
+	seg, err := vfs.NewSegment("damaged-table", types.NewTable(), 0)
+	assert.NoError(t, err)
+	assert.NoError(t, fss.PutSegment("damaged-table", seg))
+
+	files, err := filepath.Glob(filepath.Join(fss.GetDirectory(), "0*.db"))
+	assert.NoError(t, err)
+	if !assert.Len(t, files, 1) {
+		t.FailNow()
+	}
+	fd, err := os.OpenFile(files[0], os.O_RDWR, 0644)
+	assert.NoError(t, err)
+	info, err := fd.Stat()
+	assert.NoError(t, err)
+	_, err = fd.WriteAt([]byte{0xFF}, info.Size()-1)
+	assert.NoError(t, err)
+	assert.NoError(t, fd.Close())
+
+	// 读取错误的时候 inode 仍然存在，不能尝试重新创建，否则会一直重试直到返回冲突
+	ts := service.NewTablesServiceImpl(fss)
+	_, _, _, err = ts.EnsureTable("damaged-table", 0, "")
+	assert.Error(t, err)
+	assert.NotErrorIs(t, err, service.ErrTableUpdateConflict)
+
+	_, err = ts.InsertRows("damaged-table", map[string]any{"name": "urnadb"}, true, 0, "")
+	assert.Error(t, err)
+	assert.NotErrorIs(t, err, service.ErrTableUpdateConflict)
+	assert.NotErrorIs(t, err, service.ErrTableNotFound)
+}
+
+func TestIncrementFieldStorageError(t *testing.T) {
+	fss, _ := setupTestStorage(t)
+
+	record := types.NewRecord()
+	record.Record = map[string]any{"count": 1}
+	seg, err := vfs.NewSegment("damaged-record", record, 0)
+	assert.NoError(t, err)
+	assert.NoError(t, fss.PutSegment("damaged-record", seg))
+
+	files, err := filepath.Glob(filepath.Join(fss.GetDirectory(), "0*.db"))
+	assert.NoError(t, err)
+	if !assert.Len(t, files, 1) {
+		t.FailNow()
+	}
+	fd, err := os.OpenFile(files[0], os.O_RDWR, 0644)
+	assert.NoError(t, err)
+	info, err := fd.Stat()
+	assert.NoError(t, err)
+	_, err = fd.WriteAt([]byte{0xFF}, info.Size()-1)
+	assert.NoError(t, err)
+	assert.NoError(t, fd.Close())
+
+	// 读取错误的时候记录仍然存在，不能当作不存在返回 404
+	rs := service.NewRecordsService(fss)
+	_, err = rs.IncrementField("damaged-record", "count", 1, "")
+	assert.Error(t, err)
+	assert.NotErrorIs(t, err, service.ErrRecordNotFound)
+	assert.NotErrorIs(t, err, service.ErrRecordExpired)
+}
+
+func TestRecordExpiryGuards(t *testing.T) {
+	fss, h := setupTestStorage(t)
+
+	put := func(key string, expiredAt int64) {
+		record := types.NewRecord()
+		record.Record = map[string]any{"name": key}
+		seg, err := vfs.NewSegment(key, record, 0)
+		assert.NoError(t, err)
+		seg.ExpiredAt = expiredAt
+		assert.NoError(t, fss.PutSegment(key, seg))
+	}
+
+	// 永不过期的 key 可能使用 -1 或者 0 表示，两种都是存活的
+	put("immortal-record", vfs.ImmortalTTL)
+	put("zero-expiry-record", 0)
+	put("future-record", time.Now().Add(time.Minute).UnixMicro())
+	put("expired-record", time.Now().Add(-time.Second).UnixMicro())
+
+	for _, key := range []string{"immortal-record", "zero-expiry-record", "future-record"} {
+		code, data := doRequest(t, h, http.MethodGet, "/records/"+key, nil)
+		assert.Equal(t, http.StatusOK, code, key)
+		assert.Equal(t, key, data["name"], key)
+
+		code, _ = doRequest(t, h, http.MethodDelete, "/records/"+key, nil)
+		assert.Equal(t, http.StatusOK, code, key)
+
+		code, _ = doRequest(t, h, http.MethodGet, "/records/"+key, nil)
+		assert.Equal(t, http.StatusNotFound, code, key)
+	}
+
+	code, _ := doRequest(t, h, http.MethodGet, "/records/expired-record", nil)
+	assert.Equal(t, http.StatusNotFound, code)
+
+	code, _ = doRequest(t, h, http.MethodDelete, "/records/expired-record", nil)
+	assert.Equal(t, http.StatusNotFound, code)
+}
+
+func TestIncrementRecordField(t *testing.T) {
+	h := setupTestRouter(t)
+
+	code, _ := doRequest(t, h, http.MethodPut, "/records/incr-record", map[string]any{
+		"record": map[string]any{"name": "page", "stats": map[string]any{"views": 0}},
+	})
+	assert.Equal(t, http.StatusCreated, code)
+
+	const workers, rounds = 16, 20
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < rounds; j++ {
+				code, _ := doRequest(t, h, http.MethodPost, "/records/incr-record/incr", map[string]any{
+					"field": "stats.views",
+					"delta": 1,
+				})
+				assert.Equal(t, http.StatusOK, code)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// 所有并发的自增都必须生效，不能有丢失的更新
+	code, data := doRequest(t, h, http.MethodGet, "/records/incr-record", nil)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "page", data["name"])
+	if stats, ok := data["stats"].(map[string]any); assert.True(t, ok) {
+		assert.EqualValues(t, workers*rounds, stats["views"])
+	}
+
+	code, data = doRequest(t, h, http.MethodPost, "/records/incr-record/incr", map[string]any{
+		"field": "stats.likes",
+		"delta": 2.5,
+	})
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "stats.likes", data["field"])
+	assert.Equal(t, 2.5, data["value"])
+
+	// delta 为 0 是合法的请求，字段保持不变
+	code, data = doRequest(t, h, http.MethodPost, "/records/incr-record/incr", map[string]any{
+		"field": "stats.likes",
+		"delta": 0,
+	})
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, 2.5, data["value"])
+
+	code, _ = doRequest(t, h, http.MethodPost, "/records/incr-record/incr", map[string]any{
+		"field": "stats.likes",
+	})
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	code, _ = doRequest(t, h, http.MethodPost, "/records/incr-record/incr", map[string]any{
+		"field": "name",
+		"delta": 1,
+	})
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	code, _ = doRequest(t, h, http.MethodPost, "/records/missing-record/incr", map[string]any{
+		"field": "count",
+		"delta": 1,
+	})
+	assert.Equal(t, http.StatusNotFound, code)
+}
+
+func TestReapOrphanKeyLocks(t *testing.T) {
+	fss, _ := setupTestStorage(t)
+
+	ls := service.NewLocksServiceImpl(fss)
+	rs := service.NewRecordsService(fss)
+
+	const n = 200
+	for i := 0; i < n; i++ {
+		_, err := ls.AcquireLock(fmt.Sprintf("orphan-lock-%d", i), 1)
+		assert.NoError(t, err)
+
+		name := fmt.Sprintf("orphan-record-%d", i)
+		_, err = rs.CreateRecord(name, types.NewRecord(), 1, "")
+		assert.NoError(t, err)
+	}
+
+	_, err := ls.AcquireLock("live-lock", 60)
+	assert.NoError(t, err)
+
+	time.Sleep(1100 * time.Millisecond)
+
+	reaped, remaining := ls.(service.KeyLockReaper).ReapLocks()
+	assert.Equal(t, n, reaped)
+	assert.Equal(t, 1, remaining)
+
+	reaped, remaining = rs.(service.KeyLockReaper).ReapLocks()
+	assert.Equal(t, n, reaped)
+	assert.Equal(t, 0, remaining)
+
+	lr := service.NewLockReaper(time.Hour, ls.(service.KeyLockReaper), rs.(service.KeyLockReaper))
+	defer lr.Stop()
+	assert.Equal(t, 0, lr.ReapOnce())
+
+	// 存活的租约锁不受影响，仍然不能被重复获取
+	_, err = ls.AcquireLock("live-lock", 60)
+	assert.ErrorIs(t, err, service.ErrAlreadyLocked)
+}
+
+func TestReapKeyLocksWithWaiters(t *testing.T) {
+	fss, _ := setupTestStorage(t)
+	rs := service.NewRecordsService(fss)
+
+	// 不存在的 key 在等待锁的时候可能被 reaper 删除，等待者拿到锁之后必须重新获取，不能解锁另外一把锁
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+					_, err := rs.IncrementField("reaped-record", "n", 1, "")
+					assert.ErrorIs(t, err, service.ErrRecordNotFound)
+				}
+			}
+		}()
+	}
+
+	deadline := time.Now().Add(300 * time.Millisecond)
+	for time.Now().Before(deadline) {
+		rs.(service.KeyLockReaper).ReapLocks()
+	}
+	close(done)
+	wg.Wait()
+}
+
+func TestMaxBodyBytes(t *testing.T) {
+	h := setupTestRouter(t)
+
+	middleware.SetMaxBodyBytes(1024)
+	t.Cleanup(func() { middleware.SetMaxBodyBytes(0) })
+
+	code, _ := doRequest(t, h, http.MethodPut, "/tables/small-table", map[string]any{
+		"table": map[string]any{"name": "urnadb"},
+	})
+	assert.Equal(t, http.StatusCreated, code)
+
+	large := map[string]any{
+		"table": map[string]any{"blob": strings.Repeat("x", 4096)},
+	}
+	code, _ = doRequest(t, h, http.MethodPut, "/tables/large-table", large)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, code)
+
+	// 没有 Content-Length 的请求在读取到上限之后同样返回 413
+	buf, err := json.Marshal(large)
+	assert.NoError(t, err)
+	req := httptest.NewRequest(http.MethodPut, "/tables/large-table", io.NopCloser(bytes.NewReader(buf)))
+	req.ContentLength = -1
+	req.Header.Set("Auth-Token", testAuthToken)
+	req.Header.Set("Content-Type", "application/json")
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rec.Code)
+
+	code, _ = doRequest(t, h, http.MethodGet, "/tables/large-table", nil)
+	assert.Equal(t, http.StatusNotFound, code)
+}
+
+func TestTableInfo(t *testing.T) {
+	h := setupTestRouter(t)
+
+	code, _ := doRequest(t, h, http.MethodPut, "/tables/info-table", map[string]any{"ttl": 600})
+	assert.Equal(t, http.StatusCreated, code)
+
+	for i := 0; i < 4; i++ {
+		code, _ = doRequest(t, h, http.MethodPost, "/tables/info-table/rows", map[string]any{
+			"rows": map[string]any{"n": i},
+		})
+		assert.Equal(t, http.StatusOK, code)
+	}
+
+	code, _ = doRequest(t, h, http.MethodDelete, "/tables/info-table/rows", map[string]any{
+		"wheres": map[string]any{"n": 0},
+	})
+	assert.Equal(t, http.StatusOK, code)
+
+	code, rows := doRequest(t, h, http.MethodGet, "/tables/info-table", nil)
+	assert.Equal(t, http.StatusOK, code)
+
+	code, info := doRequest(t, h, http.MethodGet, "/tables/info-table/info", nil)
+	assert.Equal(t, http.StatusOK, code)
+	assert.EqualValues(t, len(rows), info["size"])
+	assert.EqualValues(t, 3, info["size"])
+	assert.EqualValues(t, 4, info["next_id"])
+	ttl, _ := info["ttl"].(float64)
+	assert.True(t, ttl > 0 && ttl <= 600)
+	assert.NotContains(t, info, "created_at")
+	assert.NotContains(t, info, "1")
+
+	code, meta := doRequestMeta(t, h, http.MethodGet, "/tables/info-table/info", nil)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, meta, "created_at")
+
+	code, _ = doRequest(t, h, http.MethodGet, "/tables/missing-table/info", nil)
+	assert.Equal(t, http.StatusNotFound, code)
+}
+
+func TestLockTokenInHeader(t *testing.T) {
+	h := setupTestRouter(t)
+
+	controller.SetLockTokenInHeader(true)
+	t.Cleanup(func() { controller.SetLockTokenInHeader(false) })
+
+	send := func(method, path string, body any) *httptest.ResponseRecorder {
+		buf, err := json.Marshal(body)
+		assert.NoError(t, err)
+		req := httptest.NewRequest(method, path, bytes.NewReader(buf))
+		req.Header.Set("Auth-Token", testAuthToken)
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := send(http.MethodPut, "/locks/header-lock", map[string]any{"ttl": 30})
+	assert.Equal(t, http.StatusCreated, rec.Code)
+	token := rec.Header().Get("X-Lease-Token")
+	assert.NotEmpty(t, token)
+	assert.NotContains(t, rec.Body.String(), token)
+
+	rec = send(http.MethodPatch, "/locks/header-lock", map[string]any{"token": token})
+	assert.Equal(t, http.StatusCreated, rec.Code)
+	renewed := rec.Header().Get("X-Lease-Token")
+	assert.NotEmpty(t, renewed)
+	assert.NotContains(t, rec.Body.String(), renewed)
+
+	code, _ := doRequest(t, h, http.MethodDelete, "/locks/header-lock", map[string]any{"token": renewed})
+	assert.Equal(t, http.StatusOK, code)
+
+	// 默认仍然在响应体中返回 token
+	controller.SetLockTokenInHeader(false)
+	rec = send(http.MethodPut, "/locks/body-lock", map[string]any{"ttl": 30})
+	assert.Equal(t, http.StatusCreated, rec.Code)
+	assert.Empty(t, rec.Header().Get("X-Lease-Token"))
+	assert.Contains(t, rec.Body.String(), `"token"`)
+}
+
+func TestMaxLeaseRenewals(t *testing.T) {
+	h := setupTestRouter(t)
+
+	service.SetMaxLeaseRenewals(2)
+	t.Cleanup(func() { service.SetMaxLeaseRenewals(0) })
+
+	code, data := doRequest(t, h, http.MethodPut, "/locks/renew-lock", map[string]any{"ttl": 30})
+	assert.Equal(t, http.StatusCreated, code)
+	token := data["token"].(string)
+
+	for i := 0; i < 2; i++ {
+		code, data = doRequest(t, h, http.MethodPatch, "/locks/renew-lock", map[string]any{"token": token})
+		assert.Equal(t, http.StatusCreated, code)
+		token = data["token"].(string)
+	}
+
+	// 超过续租次数之后被拒绝，锁仍然由当前的 token 持有
+	code, _ = doRequest(t, h, http.MethodPatch, "/locks/renew-lock", map[string]any{"token": token})
+	assert.Equal(t, http.StatusConflict, code)
+
+	code, _ = doRequest(t, h, http.MethodDelete, "/locks/renew-lock", map[string]any{"token": token})
+	assert.Equal(t, http.StatusOK, code)
+
+	// 重新获取之后续租次数从 0 开始计数
+	code, data = doRequest(t, h, http.MethodPut, "/locks/renew-lock", map[string]any{"ttl": 30})
+	assert.Equal(t, http.StatusCreated, code)
+	code, _ = doRequest(t, h, http.MethodPatch, "/locks/renew-lock", map[string]any{"token": data["token"]})
+	assert.Equal(t, http.StatusCreated, code)
+}
+
+func TestGetDecoded(t *testing.T) {
+	fss, _ := setupTestStorage(t)
+
+	record := types.NewRecord()
+	record.AddRecord("name", "urnadb")
+
+	table := types.NewTable()
+	table.AddRows(map[string]any{"id": 1})
+
+	ts := types.NewTimeSeries()
+	ts.Append(time.Now().UnixMilli(), types.Sample{TS: time.Now().UnixMilli(), Value: 1.5})
+
+	put := func(key string, seg *vfs.Segment, err error) {
+		assert.NoError(t, err)
+		assert.NoError(t, fss.PutSegment(key, seg))
+	}
+
+	seg, err := vfs.NewSegment("decoded-record", record, 0)
+	put("decoded-record", seg, err)
+	seg, err = vfs.NewSegment("decoded-table", table, 60)
+	put("decoded-table", seg, err)
+	seg, err = vfs.NewSegment("decoded-variant", types.NewVariant("hello"), 0)
+	put("decoded-variant", seg, err)
+	seg, err = vfs.NewSegment("decoded-list", types.NewList("a", "b"), 0)
+	put("decoded-list", seg, err)
+	seg, err = vfs.NewSegment("decoded-ts", ts, 0)
+	put("decoded-ts", seg, err)
+	seg, err = vfs.NewSegment("decoded-lock", types.NewLeaseLock(), 60)
+	put("decoded-lock", seg, err)
+
+	qs := service.NewQueryServiceImpl(fss)
+
+	decoded, err := qs.GetDecoded("decoded-record")
+	assert.NoError(t, err)
+	assert.Equal(t, "RECORD", decoded.Type)
+	assert.Equal(t, map[string]any{"name": "urnadb"}, decoded.Value)
+	assert.EqualValues(t, vfs.ImmortalTTL, decoded.TTL)
+
+	decoded, err = qs.GetDecoded("decoded-table")
+	assert.NoError(t, err)
+	assert.Equal(t, "TABLE", decoded.Type)
+	rows, ok := decoded.Value.(map[uint32]map[string]any)
+	assert.True(t, ok)
+	assert.Len(t, rows, 1)
+	assert.True(t, decoded.TTL > 0 && decoded.TTL <= 60)
+
+	decoded, err = qs.GetDecoded("decoded-variant")
+	assert.NoError(t, err)
+	assert.Equal(t, "VARIANT", decoded.Type)
+	assert.Equal(t, "hello", decoded.Value)
+
+	decoded, err = qs.GetDecoded("decoded-list")
+	assert.NoError(t, err)
+	assert.Equal(t, "LIST", decoded.Type)
+	assert.Equal(t, []any{"a", "b"}, decoded.Value)
+
+	decoded, err = qs.GetDecoded("decoded-ts")
+	assert.NoError(t, err)
+	assert.Equal(t, "TIMESERIES", decoded.Type)
+	samples, ok := decoded.Value.([]types.Sample)
+	assert.True(t, ok)
+	assert.Len(t, samples, 1)
+
+	// 租约锁的 token 不能通过查询接口泄露
+	decoded, err = qs.GetDecoded("decoded-lock")
+	assert.NoError(t, err)
+	assert.Equal(t, "LEASELOCK", decoded.Type)
+	assert.Nil(t, decoded.Value)
+
+	_, err = qs.GetDecoded("decoded-missing")
+	assert.ErrorIs(t, err, service.ErrSegmentNotFound)
+}
+
+func TestEnsureTable(t *testing.T) {
+	h := setupTestRouter(t)
+
+	const n = 32
+	var (
+		wg    sync.WaitGroup
+		start = make(chan struct{})
+		codes = make([]int, n)
+	)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+			codes[i], _ = doRequest(t, h, http.MethodPost, "/tables/ensure-table/ensure", nil)
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+
+	created := 0
+	for _, code := range codes {
+		if code == http.StatusCreated {
+			created++
+			continue
+		}
+		assert.Equal(t, http.StatusOK, code)
+	}
+	assert.Equal(t, 1, created)
+
+	code, _ := doRequest(t, h, http.MethodPost, "/tables/ensure-table/rows", map[string]any{
+		"rows": map[string]any{"name": "urnadb"},
+	})
+	assert.Equal(t, http.StatusOK, code)
+
+	// 已经存在的表原样返回，不会被覆盖
+	code, body := doRequestBody(t, h, http.MethodPost, "/tables/ensure-table/ensure", nil)
+	assert.Equal(t, http.StatusOK, code)
+	rows, _ := body["data"].(map[string]any)
+	assert.Len(t, rows, 1)
+	assert.Contains(t, body["meta"], "created_at")
+
+	code, _ = doRequest(t, h, http.MethodPut, "/variants/ensure-variant", map[string]any{"variant": "hello"})
+	assert.Equal(t, http.StatusCreated, code)
+
+	code, _ = doRequest(t, h, http.MethodPost, "/tables/ensure-variant/ensure", nil)
+	assert.Equal(t, http.StatusConflict, code)
+}
+
+func TestUpsertRows(t *testing.T) {
+	h := setupTestRouter(t)
+
+	code, _ := doRequest(t, h, http.MethodPut, "/tables/upsert-table", map[string]any{})
+	assert.Equal(t, http.StatusCreated, code)
+	for _, name := range []string{"alice", "bob"} {
+		code, _ = doRequest(t, h, http.MethodPost, "/tables/upsert-table/rows", map[string]any{
+			"rows": map[string]any{"name": name, "profile": map[string]any{"age": 20}},
+		})
+		assert.Equal(t, http.StatusOK, code)
+	}
+
+	code, data := doRequest(t, h, http.MethodPost, "/tables/upsert-table/upsert", map[string]any{
+		"rows": map[string]any{
+			"1": map[string]any{"profile": map[string]any{"city": "shanghai"}},
+			"5": map[string]any{"name": "carol"},
+		},
+	})
+	assert.Equal(t, http.StatusOK, code)
+	assert.EqualValues(t, 1, data["inserted"])
+	assert.EqualValues(t, 1, data["merged"])
+
+	code, data = doRequest(t, h, http.MethodGet, "/tables/upsert-table", nil)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Len(t, data, 3)
+
+	// 已经存在的行深度合并，没有出现在请求中的行保持不变
+	alice, _ := data["1"].(map[string]any)
+	assert.Equal(t, "alice", alice["name"])
+	assert.Equal(t, map[string]any{"age": float64(20), "city": "shanghai"}, alice["profile"])
+	bob, _ := data["2"].(map[string]any)
+	assert.Equal(t, map[string]any{"name": "bob", "profile": map[string]any{"age": float64(20)}}, bob)
+	carol, _ := data["5"].(map[string]any)
+	assert.Equal(t, "carol", carol["name"])
+
+	// 之后插入的行不会覆盖 upsert 添加的 t_id
+	code, data = doRequest(t, h, http.MethodPost, "/tables/upsert-table/rows", map[string]any{
+		"rows": map[string]any{"name": "dave"},
+	})
+	assert.Equal(t, http.StatusOK, code)
+	assert.EqualValues(t, 6, data["t_id"])
+
+	code, _ = doRequest(t, h, http.MethodPost, "/tables/upsert-table/upsert", map[string]any{
+		"rows": map[string]any{"abc": map[string]any{"name": "bad"}},
+	})
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	code, _ = doRequest(t, h, http.MethodPost, "/tables/upsert-missing/upsert", map[string]any{
+		"rows": map[string]any{"1": map[string]any{"name": "x"}},
+	})
+	assert.Equal(t, http.StatusNotFound, code)
+}
+
+func TestImmutableRecord(t *testing.T) {
+	h := setupTestRouter(t)
+
+	record := map[string]any{"record": map[string]any{"name": "urnadb"}, "immutable": true}
+	code, _ := doRequest(t, h, http.MethodPut, "/records/audit-record", record)
+	assert.Equal(t, http.StatusCreated, code)
+
+	code, _ = doRequest(t, h, http.MethodPut, "/records/audit-record", map[string]any{
+		"record": map[string]any{"name": "changed"},
+	})
+	assert.Equal(t, http.StatusConflict, code)
+
+	code, _ = doRequest(t, h, http.MethodDelete, "/records/audit-record", nil)
+	assert.Equal(t, http.StatusConflict, code)
+
+	code, data := doRequest(t, h, http.MethodGet, "/records/audit-record", nil)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, map[string]any{"name": "urnadb"}, data)
+
+	// 没有带 immutable 标记的记录仍然可以覆盖和删除
+	code, _ = doRequest(t, h, http.MethodPut, "/records/plain-record", map[string]any{
+		"record": map[string]any{"name": "urnadb"},
+	})
+	assert.Equal(t, http.StatusCreated, code)
+
+	code, _ = doRequest(t, h, http.MethodPut, "/records/plain-record", map[string]any{
+		"record": map[string]any{"name": "changed"},
+	})
+	assert.Equal(t, http.StatusOK, code)
+
+	code, _ = doRequest(t, h, http.MethodDelete, "/records/plain-record", nil)
+	assert.Equal(t, http.StatusOK, code)
+}
+
+func TestEmptyWheresRequiresAll(t *testing.T) {
+	h := setupTestRouter(t)
+
+	code, _ := doRequest(t, h, http.MethodPut, "/tables/wheres-table", map[string]any{})
+	assert.Equal(t, http.StatusCreated, code)
+
+	for _, name := range []string{"urnadb", "leon"} {
+		code, _ = doRequest(t, h, http.MethodPost, "/tables/wheres-table/rows", map[string]any{
+			"rows": map[string]any{"name": name, "stars": 1},
+		})
+		assert.Equal(t, http.StatusOK, code)
+	}
+
+	// 没有条件的修改和删除会作用于整张表，必须显式设置 all
+	code, _ = doRequest(t, h, http.MethodPatch, "/tables/wheres-table", map[string]any{
+		"wheres": map[string]any{},
+		"sets":   map[string]any{"stars": 2},
+	})
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	code, _ = doRequest(t, h, http.MethodPatch, "/tables/wheres-table", map[string]any{
+		"sets": map[string]any{"stars": 2},
+	})
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	code, _ = doRequest(t, h, http.MethodDelete, "/tables/wheres-table/rows", map[string]any{})
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	code, data := doRequest(t, h, http.MethodGet, "/tables/wheres-table/rows/count", map[string]any{
+		"wheres": map[string]any{"stars": 1},
+	})
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, float64(2), data["count"])
+
+	code, _ = doRequest(t, h, http.MethodPatch, "/tables/wheres-table", map[string]any{
+		"sets": map[string]any{"stars": 2},
+		"all":  true,
+	})
+	assert.Equal(t, http.StatusOK, code)
+
+	code, data = doRequest(t, h, http.MethodGet, "/tables/wheres-table/rows/count", map[string]any{
+		"wheres": map[string]any{"stars": 2},
+	})
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, float64(2), data["count"])
+
+	code, _ = doRequest(t, h, http.MethodDelete, "/tables/wheres-table/rows", map[string]any{"all": true})
+	assert.Equal(t, http.StatusOK, code)
+
+	code, data = doRequest(t, h, http.MethodGet, "/tables/wheres-table/rows/count", nil)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, float64(0), data["count"])
+}
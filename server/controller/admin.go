@@ -0,0 +1,255 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"errors"
+	"io/fs"
+	"net/http"
+	"strconv"
+
+	"github.com/auula/urnadb/clog"
+	"github.com/auula/urnadb/server/middleware"
+	"github.com/auula/urnadb/server/response"
+	"github.com/auula/urnadb/server/service"
+	"github.com/auula/urnadb/utils"
+	"github.com/gin-gonic/gin"
+)
+
+// DumpIndexController 以 JSON Lines 格式流式返回 index.db 中的索引记录，每一行是一条记录
+func DumpIndexController(ctx *gin.Context) {
+	ctx.Header("Content-Type", "application/x-ndjson")
+
+	err := ads.DumpIndex(ctx.Writer)
+	if err == nil {
+		return
+	}
+
+	// 已经开始输出之后就不能再修改状态码了，只能记录日志
+	if ctx.Writer.Written() {
+		clog.Errorf("[DumpIndexController] %v", err)
+		return
+	}
+
+	if errors.Is(err, fs.ErrNotExist) {
+		render(ctx, http.StatusNotFound, response.FailJSON("index snapshot file not found"))
+		return
+	}
+
+	render(ctx, http.StatusInternalServerError, response.FailJSON(err.Error()))
+}
+
+// RawSegmentController 返回 key 在存储层实际占用的大小和压缩比，用来评估开启压缩是否划算
+func RawSegmentController(ctx *gin.Context) {
+	key := ctx.Param("key")
+	if !utils.NotNullString(key) {
+		render(ctx, http.StatusBadRequest, miss_key)
+		return
+	}
+
+	raw, err := ads.RawSegment(key)
+	if err != nil {
+		handlerAdminError(ctx, err)
+		return
+	}
+
+	render(ctx, http.StatusOK, response.OkJSON("raw segment query completed successfully", raw))
+}
+
+// VerifyRegionController 逐条校验 region 中记录的 CRC32，用于数据完整性审计，遇到损坏的记录不会中断
+func VerifyRegionController(ctx *gin.Context) {
+	regionId, err := strconv.ParseInt(ctx.Param("id"), 10, 64)
+	if err != nil || regionId <= 0 {
+		render(ctx, http.StatusBadRequest, response.FailJSON("region id must be a positive integer"))
+		return
+	}
+
+	report, err := ads.VerifyRegion(regionId)
+	if err != nil {
+		handlerAdminError(ctx, err)
+		return
+	}
+
+	render(ctx, http.StatusOK, response.OkJSON("region verified successfully", report))
+}
+
+// CompactRegionController 只回收指定的一个 region，用于定向清理已知大部分都是垃圾数据的 region，不能回收活跃的 region
+func CompactRegionController(ctx *gin.Context) {
+	regionId, err := strconv.ParseInt(ctx.Param("id"), 10, 64)
+	if err != nil || regionId <= 0 {
+		render(ctx, http.StatusBadRequest, response.FailJSON("region id must be a positive integer"))
+		return
+	}
+
+	err = ads.CompactRegion(regionId)
+	if err != nil {
+		handlerAdminError(ctx, err)
+		return
+	}
+
+	render(ctx, http.StatusOK, response.OkJSON("region compacted successfully", gin.H{
+		"region_id": regionId,
+	}))
+}
+
+// SnapshotIndexController 立即导出一次 index.db 索引快照，用于升级或者磁盘维护之前不停机的保存索引，
+// 下次启动可以直接从快照恢复而不需要扫描所有的 region 文件。
+func SnapshotIndexController(ctx *gin.Context) {
+	info, err := ads.SnapshotIndex()
+	if err != nil {
+		handlerAdminError(ctx, err)
+		return
+	}
+
+	render(ctx, http.StatusOK, response.OkJSON("index snapshot exported successfully", info))
+}
+
+// DeleteKeysByTypeController 删除 ?type= 指定类型的所有 key，例如 DELETE /admin/keys?type=leaselock 清理所有残留的租约锁，
+// 用于在不清空整个数据库的情况下重置一类数据。
+func DeleteKeysByTypeController(ctx *gin.Context) {
+	typ := ctx.Query("type")
+	if !utils.NotNullString(typ) {
+		render(ctx, http.StatusBadRequest, response.FailJSON("type must not be empty"))
+		return
+	}
+
+	deleted, err := ads.DeleteKeysByType(typ)
+	if err != nil {
+		handlerAdminError(ctx, err)
+		return
+	}
+
+	clog.Infof("Deleted %d keys of type %q", deleted, typ)
+
+	render(ctx, http.StatusOK, response.OkJSON("keys deleted successfully", gin.H{
+		"deleted": deleted,
+	}))
+}
+
+// ExportController 流式导出以 ?prefix= 开头的所有存活 key，导出的文件可以通过 POST /admin/import 导入到其他实例，
+// 用于在实例之间迁移一个命名空间的数据，prefix 为空表示导出全部数据。
+func ExportController(ctx *gin.Context) {
+	prefix := ctx.Query("prefix")
+
+	ctx.Header("Content-Type", "application/octet-stream")
+	ctx.Header("Content-Disposition", `attachment; filename="urnadb-export.bin"`)
+
+	count, err := ads.Export(ctx.Writer, prefix)
+	if err == nil {
+		clog.Infof("Exported %d keys with prefix %q", count, prefix)
+		return
+	}
+
+	// 已经开始输出之后就不能再修改状态码了，只能记录日志
+	if ctx.Writer.Written() {
+		clog.Errorf("[ExportController] %v", err)
+		return
+	}
+
+	render(ctx, http.StatusInternalServerError, response.FailJSON(err.Error()))
+}
+
+// ImportController 导入 GET /admin/export 导出的数据，请求体就是导出的文件，已经存在的 key 会被覆盖
+func ImportController(ctx *gin.Context) {
+	count, err := ads.Import(ctx.Request.Body)
+	if err != nil {
+		handlerAdminError(ctx, err)
+		return
+	}
+
+	render(ctx, http.StatusOK, response.OkJSON("archive imported successfully", gin.H{
+		"imported": count,
+	}))
+}
+
+// defaultHotKeysLimit 是没有指定 n 的时候返回的热点 key 个数
+const defaultHotKeysLimit = 10
+
+// HotKeysController 返回访问次数最多的 key，?by=reads 按照读取次数排序（默认），?by=writes 按照写入次数排序，
+// ?n= 指定返回的个数，用于决定哪些 key 需要缓存或者拆分，存储层需要开启 TrackAccessStats。
+func HotKeysController(ctx *gin.Context) {
+	n, err := queryInt64(ctx, "n", defaultHotKeysLimit)
+	if err != nil || n <= 0 {
+		render(ctx, http.StatusBadRequest, response.FailJSON("n must be a positive integer"))
+		return
+	}
+
+	by := ctx.DefaultQuery("by", "reads")
+	if by != "reads" && by != "writes" {
+		render(ctx, http.StatusBadRequest, response.FailJSON("by must be reads or writes"))
+		return
+	}
+
+	keys, err := ads.HotKeys(int(n), by == "reads")
+	if err != nil {
+		handlerAdminError(ctx, err)
+		return
+	}
+
+	render(ctx, http.StatusOK, response.OkJSON("hot keys query completed successfully", gin.H{
+		"keys": keys,
+	}))
+}
+
+// ShardsController 返回每个 index shard 的 key 数量、获取锁的次数和近似的等待次数，
+// 少数 shard 的等待次数明显偏高的时候说明需要增加 shard 的数量。
+func ShardsController(ctx *gin.Context) {
+	render(ctx, http.StatusOK, response.OkJSON("shard stats query completed successfully", gin.H{
+		"shards": ads.ShardStats(),
+	}))
+}
+
+type ReloadAuthRequest struct {
+	Auth    string   `json:"auth" binding:"required"`
+	AllowIP []string `json:"allowip" binding:"omitempty"`
+}
+
+// ReloadAuthController 在运行时替换访问密码和 IP 白名单，不需要重启服务就可以轮换凭证，
+// allowip 为空表示关闭白名单，新的策略只对之后的请求生效。
+func ReloadAuthController(ctx *gin.Context) {
+	var req ReloadAuthRequest
+	err := ctx.ShouldBindJSON(&req)
+	if err != nil {
+		render(ctx, http.StatusBadRequest, response.FailJSON(err.Error()))
+		return
+	}
+
+	// 和启动时 server.Options 的校验规则保持一致
+	if len(req.Auth) < 16 {
+		render(ctx, http.StatusBadRequest, response.FailJSON("auth password must be at least 16 characters"))
+		return
+	}
+
+	middleware.ReloadAuthPolicy(req.Auth, req.AllowIP)
+	clog.Info("Server auth policy reloaded successfully")
+
+	render(ctx, http.StatusOK, response.OkJSON("auth policy reloaded successfully", nil))
+}
+
+func handlerAdminError(ctx *gin.Context, err error) {
+	switch {
+	case errors.Is(err, service.ErrSegmentNotFound), errors.Is(err, service.ErrRegionNotFound):
+		render(ctx, http.StatusNotFound, response.FailJSON(err.Error()))
+	case errors.Is(err, service.ErrInvalidArchive), errors.Is(err, service.ErrUnknownKind):
+		render(ctx, http.StatusBadRequest, response.FailJSON(err.Error()))
+	case errors.Is(err, service.ErrSegmentTooLarge):
+		render(ctx, http.StatusRequestEntityTooLarge, response.FailJSON(err.Error()))
+	case errors.Is(err, service.ErrAccessStatsDisabled),
+		errors.Is(err, service.ErrActiveRegion), errors.Is(err, service.ErrCompactInProgress):
+		render(ctx, http.StatusConflict, response.FailJSON(err.Error()))
+	default:
+		render(ctx, http.StatusInternalServerError, response.FailJSON(err.Error()))
+	}
+}
@@ -0,0 +1,61 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// etag 使用当前版本写入时的创建时间和存储层的 mvcc 版本号作为 ETag，格式为 "<created_at>-<mvcc>"。
+// 普通的 PUT 覆盖写入之后版本号会重置为 0，只使用版本号的话多次覆盖写入的 ETag 都相同，
+// 每次写入都会生成新的创建时间，CAS 更新和事务提交的版本号递增，两者组合之后每一次写入都会得到不同的 ETag。
+func etag(createdAt int64, version uint64) string {
+	return `"` + strconv.FormatInt(createdAt, 10) + "-" + strconv.FormatUint(version, 10) + `"`
+}
+
+// notModified 处理 GET 请求的 If-None-Match 条件请求，版本号只从内存索引中读取不需要读取磁盘，
+// 设置 ETag 响应头，客户端缓存的版本和当前版本一致的时候直接返回 304 并且返回 true，调用者不需要再读取数据。
+// key 不存在的时候返回 false，交给后续的处理逻辑返回 404。
+func notModified(ctx *gin.Context, name string) bool {
+	createdAt, version, ok := qs.VersionStamp(name)
+	if !ok {
+		return false
+	}
+
+	tag := etag(createdAt, version)
+	ctx.Header("ETag", tag)
+
+	if matchETag(ctx.GetHeader("If-None-Match"), tag) {
+		ctx.Status(http.StatusNotModified)
+		return true
+	}
+
+	return false
+}
+
+// matchETag 判断 If-None-Match 中是否包含 tag，支持多个值、* 以及弱校验 W/ 前缀
+func matchETag(header, tag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == tag {
+			return true
+		}
+	}
+	return false
+}
@@ -33,18 +33,44 @@ type SystemInfo struct {
 	MemoryTotal    string `json:"mem_total"`
 	DiskPercent    string `json:"disk_percent"`
 	SpaceTotalUsed string `json:"space_total"`
+	// CompressionRatio 编码之后和编码之前的 value 总大小比值，越小说明压缩效果越好
+	CompressionRatio float64 `json:"compression_ratio"`
+	// EncryptionEnabled 和 CompressionEnabled 写入的 value 是否经过加密和压缩，Compressor 是压缩算法的名称
+	EncryptionEnabled  bool   `json:"encryption_enabled"`
+	CompressionEnabled bool   `json:"compression_enabled"`
+	Compressor         string `json:"compressor"`
 }
 
 func HealthController(ctx *gin.Context) {
-	ctx.IndentedJSON(http.StatusOK, response.OkJSON("server is healthy", SystemInfo{
-		GCState:        hs.RegionCompactStatus(),
-		KeyCount:       hs.RegionInodeCount(),
-		DiskFree:       fmt.Sprintf("%.2fGB", utils.BytesToGB(hs.GetFreeDisk())),
-		DiskUsed:       fmt.Sprintf("%.2fGB", utils.BytesToGB(hs.GetUsedDisk())),
-		DiskTotal:      fmt.Sprintf("%.2fGB", utils.BytesToGB(hs.GetTotalDisk())),
-		MemoryFree:     fmt.Sprintf("%.2fGB", utils.BytesToGB(hs.GetFreeMemory())),
-		MemoryTotal:    fmt.Sprintf("%.2fGB", utils.BytesToGB(hs.GetTotalMemory())),
-		SpaceTotalUsed: fmt.Sprintf("%.2fGB", utils.BytesToGB(hs.GetTotalSpaceUsed())),
-		DiskPercent:    fmt.Sprintf("%.2f%%", hs.GetDiskPercent()),
+	pipeline := hs.PipelineStatus()
+	render(ctx, http.StatusOK, response.OkJSON("server is healthy", SystemInfo{
+		GCState:            hs.RegionCompactStatus(),
+		KeyCount:           hs.RegionInodeCount(),
+		DiskFree:           fmt.Sprintf("%.2fGB", utils.BytesToGB(hs.GetFreeDisk())),
+		DiskUsed:           fmt.Sprintf("%.2fGB", utils.BytesToGB(hs.GetUsedDisk())),
+		DiskTotal:          fmt.Sprintf("%.2fGB", utils.BytesToGB(hs.GetTotalDisk())),
+		MemoryFree:         fmt.Sprintf("%.2fGB", utils.BytesToGB(hs.GetFreeMemory())),
+		MemoryTotal:        fmt.Sprintf("%.2fGB", utils.BytesToGB(hs.GetTotalMemory())),
+		SpaceTotalUsed:     fmt.Sprintf("%.2fGB", utils.BytesToGB(hs.GetTotalSpaceUsed())),
+		DiskPercent:        fmt.Sprintf("%.2f%%", hs.GetDiskPercent()),
+		CompressionRatio:   hs.CompressionRatio(),
+		EncryptionEnabled:  pipeline.EncryptionEnabled,
+		CompressionEnabled: pipeline.CompressionEnabled,
+		Compressor:         pipeline.Compressor,
 	}))
 }
+
+// LivezController 存活探针，只要进程还能处理 HTTP 请求就返回 200
+func LivezController(ctx *gin.Context) {
+	render(ctx, http.StatusOK, response.OkJSON("server is alive", nil))
+}
+
+// ReadyzController 就绪探针，存储引擎还没有初始化完成或者已经关闭的时候返回 503
+func ReadyzController(ctx *gin.Context) {
+	if hs == nil || !hs.IsReady() {
+		render(ctx, http.StatusServiceUnavailable, response.FailJSON("storage is not ready"))
+		return
+	}
+
+	render(ctx, http.StatusOK, response.OkJSON("server is ready", nil))
+}
@@ -15,30 +15,120 @@
 package controller
 
 import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
 	"github.com/auula/urnadb/server/response"
 	"github.com/auula/urnadb/server/service"
 	"github.com/auula/urnadb/vfs"
+	"github.com/gin-gonic/gin"
 )
 
 var (
-	ts service.TablesService
-	qs service.QueryService
-	ls service.LocksService
-	rs service.RecordsService
-	vs service.VariantsService
-	hs *service.HealthService
+	ts  service.TablesService
+	qs  service.QueryService
+	ls  service.LocksService
+	rs  service.RecordsService
+	vs  service.VariantsService
+	lis service.ListsService
+	tss service.TimeSeriesService
+	hs  *service.HealthService
+	ads *service.AdminService
+	lr  *service.LockReaper
+
+	// initialized 所有的服务都已经基于存储引擎完成初始化
+	initialized atomic.Bool
 )
 
+// lockReapInterval 后台清理遗留 key 锁的周期
+const lockReapInterval = 60 * time.Second
+
 var (
 	miss_key = response.FailJSON("missing key in request path")
 )
 
+var errEmptyBody = errors.New("request body is required")
+
 func InitAllComponents(storage *vfs.LogStructuredFS) error {
 	hs = service.NewHealthService(storage)
+	ads = service.NewAdminService(storage)
 	rs = service.NewRecordsService(storage)
 	ls = service.NewLocksServiceImpl(storage)
 	qs = service.NewQueryServiceImpl(storage)
 	ts = service.NewTablesServiceImpl(storage)
 	vs = service.NewVariantsServiceImpl(storage)
+	lis = service.NewListsServiceImpl(storage)
+	tss = service.NewTimeSeriesServiceImpl(storage)
+
+	// 重新初始化的时候旧的服务实例被替换，需要先停止旧的清理协程
+	StopLockReaper()
+	var reapers []service.KeyLockReaper
+	for _, s := range []any{rs, ls, ts, vs, lis} {
+		if r, ok := s.(service.KeyLockReaper); ok {
+			reapers = append(reapers, r)
+		}
+	}
+	lr = service.NewLockReaper(lockReapInterval, reapers...)
+
+	// 存储引擎为空的时候服务中访问存储都是空指针，数据请求由 ReadyMiddleware 拦截
+	initialized.Store(storage != nil)
 	return nil
 }
+
+// Initialized 判断服务是否已经通过 InitAllComponents 完成初始化，没有初始化之前所有的数据请求都返回 503
+func Initialized() bool {
+	return initialized.Load()
+}
+
+// StopLockReaper 停止后台清理 key 锁的协程
+func StopLockReaper() {
+	if lr != nil {
+		lr.Stop()
+		lr = nil
+	}
+}
+
+// writerId 返回 X-Writer-Id 请求头中的写入者标识，用于多个服务共用一个实例的时候区分数据是谁写入的，
+// 超过 vfs.MaxWriterSize 的时候直接返回 400，调用者只需要在第二个返回值为 false 的时候结束请求。
+func writerId(ctx *gin.Context) (string, bool) {
+	writer := ctx.GetHeader("X-Writer-Id")
+	if len(writer) > vfs.MaxWriterSize {
+		render(ctx, http.StatusBadRequest, response.FailJSON(
+			fmt.Sprintf("X-Writer-Id cannot exceed %d bytes", vfs.MaxWriterSize),
+		))
+		return "", false
+	}
+	return writer, true
+}
+
+// createdStatus 返回创建接口的状态码和消息，key 之前不存在的时候返回 201，覆盖已经存在的 key 的时候返回 200
+func createdStatus(created bool, kind string) (int, string) {
+	if created {
+		return http.StatusCreated, kind + " created successfully"
+	}
+	return http.StatusOK, kind + " updated successfully"
+}
+
+// isSetNX 判断 PUT 请求是否带有 ?nx=true 参数，带有的话只有在 key 不存在的时候才会写入
+func isSetNX(ctx *gin.Context) bool {
+	nx, err := strconv.ParseBool(ctx.Query("nx"))
+	return err == nil && nx
+}
+
+// bindJSON 统一处理请求体的绑定，allowEmpty 为 true 的时候空请求体不算错误，用来创建空的容器，
+// 例如 table、record、list；否则空请求体返回 errEmptyBody，例如 variant 必须携带值。
+func bindJSON(ctx *gin.Context, obj any, allowEmpty bool) error {
+	err := ctx.ShouldBindJSON(obj)
+	if errors.Is(err, io.EOF) {
+		if allowEmpty {
+			return nil
+		}
+		return errEmptyBody
+	}
+	return err
+}
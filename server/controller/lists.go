@@ -0,0 +1,197 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/auula/urnadb/server/response"
+	"github.com/auula/urnadb/server/service"
+	"github.com/auula/urnadb/types"
+	"github.com/auula/urnadb/utils"
+	"github.com/auula/urnadb/vfs"
+	"github.com/gin-gonic/gin"
+)
+
+func GetListController(ctx *gin.Context) {
+	name := ctx.Param("key")
+	if !utils.NotNullString(name) {
+		render(ctx, http.StatusBadRequest, miss_key)
+		return
+	}
+
+	if notModified(ctx, name) {
+		return
+	}
+
+	list, meta, err := lis.GetList(name)
+	if err != nil {
+		handlerListsError(ctx, err)
+		return
+	}
+
+	defer list.ReleaseToPool()
+
+	render(ctx, http.StatusOK, okWithMetadata("list queried successfully", gin.H{
+		"list": list.List,
+	}, meta))
+}
+
+type CreateListRequest struct {
+	List       []any `json:"list" binding:"required"`
+	TTLSeconds int64 `json:"ttl" binding:"omitempty"`
+}
+
+func CreateListController(ctx *gin.Context) {
+	name := ctx.Param("key")
+	if !utils.NotNullString(name) {
+		render(ctx, http.StatusBadRequest, miss_key)
+		return
+	}
+
+	var req CreateListRequest
+	err := bindJSON(ctx, &req, true)
+	if err != nil {
+		render(ctx, http.StatusBadRequest, response.FailJSON(err.Error()))
+		return
+	}
+
+	list := types.AcquireList()
+	if req.List != nil {
+		list.List = req.List
+	}
+
+	defer list.ReleaseToPool()
+
+	writer, ok := writerId(ctx)
+	if !ok {
+		return
+	}
+
+	created, err := lis.CreateList(name, list, resolveTTL("lists", req.TTLSeconds), writer)
+	if err != nil {
+		handlerListsError(ctx, err)
+		return
+	}
+
+	code, message := createdStatus(created, "list")
+	render(ctx, code, response.OkJSON(message, nil))
+}
+
+func DeleteListController(ctx *gin.Context) {
+	name := ctx.Param("key")
+	if !utils.NotNullString(name) {
+		render(ctx, http.StatusBadRequest, miss_key)
+		return
+	}
+
+	err := lis.DeleteList(name)
+	if err != nil {
+		handlerListsError(ctx, err)
+		return
+	}
+
+	render(ctx, http.StatusOK, response.OkJSON("list deleted successfully", nil))
+}
+
+type PushListRequest struct {
+	Values []any `json:"values" binding:"required"`
+}
+
+func PushListController(ctx *gin.Context) {
+	name := ctx.Param("key")
+	if !utils.NotNullString(name) {
+		render(ctx, http.StatusBadRequest, miss_key)
+		return
+	}
+
+	var req PushListRequest
+	err := ctx.ShouldBindJSON(&req)
+	if err != nil {
+		render(ctx, http.StatusBadRequest, response.FailJSON(err.Error()))
+		return
+	}
+
+	writer, ok := writerId(ctx)
+	if !ok {
+		return
+	}
+
+	// 列表不存在的时候自动创建，和 CreateList 一样使用默认的过期时间
+	size, err := lis.Push(name, req.Values, resolveTTL("lists", 0), writer)
+	if err != nil {
+		handlerListsError(ctx, err)
+		return
+	}
+
+	render(ctx, http.StatusOK, response.OkJSON("list pushed successfully", gin.H{
+		"length": size,
+	}))
+}
+
+// PopListController 通过 ?order=fifo 从头部弹出最早追加的元素，默认 lifo 从尾部弹出最后追加的元素
+func PopListController(ctx *gin.Context) {
+	name := ctx.Param("key")
+	if !utils.NotNullString(name) {
+		render(ctx, http.StatusBadRequest, miss_key)
+		return
+	}
+
+	var order service.PopOrder
+	switch ctx.DefaultQuery("order", "lifo") {
+	case "lifo":
+		order = service.PopLIFO
+	case "fifo":
+		order = service.PopFIFO
+	default:
+		render(ctx, http.StatusBadRequest, response.FailJSON("order must be lifo or fifo"))
+		return
+	}
+
+	value, err := lis.Pop(name, order)
+	if err != nil {
+		handlerListsError(ctx, err)
+		return
+	}
+
+	render(ctx, http.StatusOK, response.OkJSON("list popped successfully", gin.H{
+		"value": value,
+	}))
+}
+
+func handlerListsError(ctx *gin.Context, err error) {
+	switch {
+	case errors.Is(err, service.ErrListNotFound):
+		render(ctx, http.StatusNotFound, response.FailJSON(err.Error()))
+	case errors.Is(err, service.ErrListEmpty):
+		render(ctx, http.StatusNotFound, response.FailJSON(err.Error()))
+	case errors.Is(err, service.ErrListExpired):
+		render(ctx, http.StatusGone, response.FailJSON(err.Error()))
+	case errors.Is(err, service.ErrListUpdateConflict):
+		render(ctx, http.StatusConflict, response.FailJSON(err.Error()))
+	case errors.Is(err, vfs.ErrSegmentTooLarge):
+		render(ctx, http.StatusRequestEntityTooLarge, response.FailJSON(err.Error()))
+	case errors.Is(err, vfs.ErrTypeMismatch):
+		render(ctx, http.StatusConflict, response.FailJSON(err.Error()))
+	case errors.Is(err, vfs.ErrImmutable):
+		render(ctx, http.StatusConflict, response.FailJSON(err.Error()))
+	case errors.Is(err, vfs.ErrDecodeFailed):
+		render(ctx, http.StatusUnprocessableEntity, response.FailJSON(err.Error()))
+	default:
+		// 所有其他错误都统一返回 500 内部服务器错误
+		render(ctx, http.StatusInternalServerError, response.FailJSON(err.Error()))
+	}
+}
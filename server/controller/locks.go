@@ -17,13 +17,39 @@ package controller
 import (
 	"errors"
 	"net/http"
+	"sync/atomic"
 
 	"github.com/auula/urnadb/server/response"
 	"github.com/auula/urnadb/server/service"
 	"github.com/auula/urnadb/utils"
+	"github.com/auula/urnadb/vfs"
 	"github.com/gin-gonic/gin"
 )
 
+// leaseTokenHeader 开启 SetLockTokenInHeader 之后返回锁 token 的响应头
+const leaseTokenHeader = "X-Lease-Token"
+
+var lockTokenInHeader atomic.Bool
+
+// SetLockTokenInHeader 开启之后创建锁和续约的接口通过 X-Lease-Token 响应头返回 token，响应体中不再包含 token，
+// 避免记录响应体的代理或者 CDN 把 token 写进日志，一次获取多把锁的接口仍然在响应体中返回。
+func SetLockTokenInHeader(enabled bool) {
+	lockTokenInHeader.Store(enabled)
+}
+
+// renderLeaseToken 按照 SetLockTokenInHeader 的配置返回锁的 token
+func renderLeaseToken(ctx *gin.Context, message, token string) {
+	if lockTokenInHeader.Load() {
+		ctx.Header(leaseTokenHeader, token)
+		render(ctx, http.StatusCreated, response.OkJSON(message, nil))
+		return
+	}
+
+	render(ctx, http.StatusCreated, response.OkJSON(message, gin.H{
+		"token": token,
+	}))
+}
+
 type AcquireLockRequest struct {
 	TTLSeconds int64 `json:"ttl" binding:"required"`
 }
@@ -35,14 +61,14 @@ type LeaseLockRequest struct {
 func NewLockController(ctx *gin.Context) {
 	name := ctx.Param("key")
 	if !utils.NotNullString(name) {
-		ctx.IndentedJSON(http.StatusBadRequest, miss_key)
+		render(ctx, http.StatusBadRequest, miss_key)
 		return
 	}
 
 	var req AcquireLockRequest
 	err := ctx.ShouldBindJSON(&req)
 	if err != nil {
-		ctx.IndentedJSON(http.StatusBadRequest, response.FailJSON(err.Error()))
+		render(ctx, http.StatusBadRequest, response.FailJSON(err.Error()))
 		return
 	}
 
@@ -54,22 +80,58 @@ func NewLockController(ctx *gin.Context) {
 
 	defer slock.ReleaseToPool()
 
-	ctx.IndentedJSON(http.StatusCreated, response.OkJSON("lock created successfully", gin.H{
-		"token": slock.Token,
+	renderLeaseToken(ctx, "lock created successfully", slock.Token)
+}
+
+type AcquireLocksRequest struct {
+	Keys       []string `json:"keys" binding:"required,min=1"`
+	TTLSeconds int64    `json:"ttl" binding:"required"`
+}
+
+// NewLocksController 一次性获取多把锁，全部获取成功才会返回每把锁的 token，否则一把锁都不会持有
+func NewLocksController(ctx *gin.Context) {
+	var req AcquireLocksRequest
+	err := ctx.ShouldBindJSON(&req)
+	if err != nil {
+		render(ctx, http.StatusBadRequest, response.FailJSON(err.Error()))
+		return
+	}
+
+	for _, key := range req.Keys {
+		if !utils.NotNullString(key) {
+			render(ctx, http.StatusBadRequest, miss_key)
+			return
+		}
+	}
+
+	leases, err := ls.AcquireLocks(req.Keys, req.TTLSeconds)
+	if err != nil {
+		handlerLocksError(ctx, err)
+		return
+	}
+
+	tokens := make(map[string]string, len(leases))
+	for key, lease := range leases {
+		tokens[key] = lease.Token
+		lease.ReleaseToPool()
+	}
+
+	render(ctx, http.StatusCreated, response.OkJSON("locks created successfully", gin.H{
+		"tokens": tokens,
 	}))
 }
 
 func DeleteLockController(ctx *gin.Context) {
 	name := ctx.Param("key")
 	if !utils.NotNullString(name) {
-		ctx.IndentedJSON(http.StatusBadRequest, miss_key)
+		render(ctx, http.StatusBadRequest, miss_key)
 		return
 	}
 
 	var req LeaseLockRequest
 	err := ctx.ShouldBindJSON(&req)
 	if err != nil {
-		ctx.IndentedJSON(http.StatusBadRequest, response.FailJSON(err.Error()))
+		render(ctx, http.StatusBadRequest, response.FailJSON(err.Error()))
 		return
 	}
 
@@ -79,20 +141,20 @@ func DeleteLockController(ctx *gin.Context) {
 		return
 	}
 
-	ctx.IndentedJSON(http.StatusOK, response.OkJSON("lock deleted successfully", nil))
+	render(ctx, http.StatusOK, response.OkJSON("lock deleted successfully", nil))
 }
 
 func DoLeaseLockController(ctx *gin.Context) {
 	name := ctx.Param("key")
 	if !utils.NotNullString(name) {
-		ctx.IndentedJSON(http.StatusBadRequest, miss_key)
+		render(ctx, http.StatusBadRequest, miss_key)
 		return
 	}
 
 	var req LeaseLockRequest
 	err := ctx.ShouldBindJSON(&req)
 	if err != nil {
-		ctx.IndentedJSON(http.StatusBadRequest, response.FailJSON(err.Error()))
+		render(ctx, http.StatusBadRequest, response.FailJSON(err.Error()))
 		return
 	}
 
@@ -104,20 +166,26 @@ func DoLeaseLockController(ctx *gin.Context) {
 
 	defer slock.ReleaseToPool()
 
-	ctx.IndentedJSON(http.StatusCreated, response.OkJSON("lease acquired successfully", gin.H{
-		"token": slock.Token,
-	}))
+	renderLeaseToken(ctx, "lease acquired successfully", slock.Token)
 }
 
 func handlerLocksError(ctx *gin.Context, err error) {
 	switch {
 	case errors.Is(err, service.ErrInvalidToken):
-		ctx.IndentedJSON(http.StatusForbidden, response.FailJSON(err.Error()))
+		render(ctx, http.StatusForbidden, response.FailJSON(err.Error()))
 	case errors.Is(err, service.ErrLockNotFound):
-		ctx.IndentedJSON(http.StatusNotFound, response.FailJSON(err.Error()))
+		render(ctx, http.StatusNotFound, response.FailJSON(err.Error()))
 	case errors.Is(err, service.ErrAlreadyLocked):
-		ctx.IndentedJSON(http.StatusLocked, response.FailJSON(err.Error()))
+		render(ctx, http.StatusLocked, response.FailJSON(err.Error()))
+	case errors.Is(err, service.ErrLeaseRenewalLimit):
+		render(ctx, http.StatusConflict, response.FailJSON(err.Error()))
+	case errors.Is(err, vfs.ErrTypeMismatch):
+		render(ctx, http.StatusConflict, response.FailJSON(err.Error()))
+	case errors.Is(err, vfs.ErrImmutable):
+		render(ctx, http.StatusConflict, response.FailJSON(err.Error()))
+	case errors.Is(err, vfs.ErrDecodeFailed):
+		render(ctx, http.StatusUnprocessableEntity, response.FailJSON(err.Error()))
 	default:
-		ctx.IndentedJSON(http.StatusInternalServerError, response.FailJSON(err.Error()))
+		render(ctx, http.StatusInternalServerError, response.FailJSON(err.Error()))
 	}
 }
@@ -15,34 +15,308 @@
 package controller
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/auula/urnadb/server/response"
+	"github.com/auula/urnadb/server/service"
 	"github.com/auula/urnadb/utils"
+	"github.com/auula/urnadb/vfs"
 	"github.com/gin-gonic/gin"
 )
 
 func QueryController(ctx *gin.Context) {
 	name := ctx.Param("key")
 	if !utils.NotNullString(name) {
-		ctx.IndentedJSON(http.StatusBadRequest, miss_key)
+		render(ctx, http.StatusBadRequest, miss_key)
 		return
 	}
 
-	version, seg, err := qs.QuerySegment(name)
+	if notModified(ctx, name) {
+		return
+	}
+
+	decoded, err := qs.GetDecoded(name)
+	if err != nil {
+		handlerQueryError(ctx, err)
+		return
+	}
+
+	render(ctx, http.StatusOK, okWithMetadata("metadata query completed successfully", gin.H{
+		"type":  decoded.Type,
+		"key":   name,
+		"value": decoded.Value,
+		"ttl":   decoded.TTL,
+		"mvcc":  decoded.MVCC,
+	}, decoded.Meta))
+}
+
+type ExpireKeysRequest struct {
+	Keys       []string `json:"keys" binding:"required"`
+	TTLSeconds int64    `json:"ttl" binding:"omitempty"`
+}
+
+// ExpireKeysController 批量刷新多个 key 的过期时间，不存在的 key 会被跳过，只返回实际更新的数量
+func ExpireKeysController(ctx *gin.Context) {
+	var req ExpireKeysRequest
+	err := ctx.ShouldBindJSON(&req)
+	if err != nil {
+		render(ctx, http.StatusBadRequest, response.FailJSON(err.Error()))
+		return
+	}
+
+	updated, err := qs.ExpireKeys(ctx.Request.Context(), req.Keys, req.TTLSeconds)
+	if err != nil {
+		handlerQueryError(ctx, err)
+		return
+	}
+
+	render(ctx, http.StatusOK, response.OkJSON("keys expiry refreshed successfully", gin.H{
+		"updated": updated,
+	}))
+}
+
+type ExistsKeysRequest struct {
+	Keys []string `json:"keys" binding:"required"`
+}
+
+// ExistsKeysController 批量判断多个 key 是否存在，只返回 key 到 bool 的映射，不读取任何值，
+// 客户端只需要知道哪些 key 存在的时候比批量查询的开销小很多
+func ExistsKeysController(ctx *gin.Context) {
+	var req ExistsKeysRequest
+	err := ctx.ShouldBindJSON(&req)
+	if err != nil {
+		render(ctx, http.StatusBadRequest, response.FailJSON(err.Error()))
+		return
+	}
+
+	render(ctx, http.StatusOK, response.OkJSON("keys existence checked successfully", gin.H{
+		"keys": qs.Exists(req.Keys),
+	}))
+}
+
+// ExpiringKeysController 返回 within 时间窗口内即将过期的 key，within 使用 Go 的时长格式，例如 30s、5m
+func ExpiringKeysController(ctx *gin.Context) {
+	within, err := time.ParseDuration(ctx.Query("within"))
+	if err != nil || within <= 0 {
+		render(ctx, http.StatusBadRequest, response.FailJSON("within must be a positive duration, e.g. 30s or 5m"))
+		return
+	}
+
+	keys, err := qs.ExpiringKeys(ctx.Request.Context(), within)
+	if err != nil {
+		handlerQueryError(ctx, err)
+		return
+	}
+
+	items := make([]gin.H, 0, len(keys))
+	for _, key := range keys {
+		items = append(items, gin.H{
+			"key":  key.Key,
+			"inum": key.Inum,
+			"ttl":  int64(key.TTL.Seconds()),
+		})
+	}
+
+	render(ctx, http.StatusOK, response.OkJSON("expiring keys query completed successfully", gin.H{
+		"keys": items,
+	}))
+}
+
+// defaultHistoryLimit 是没有指定 limit 的时候最多返回的历史版本个数
+const defaultHistoryLimit = 10
+
+// HistoryController 返回 key 的历史版本，用于排查数据是什么时候被修改的，只能找到还没有被垃圾回收清理掉的版本
+func HistoryController(ctx *gin.Context) {
+	name := ctx.Param("key")
+	if !utils.NotNullString(name) {
+		render(ctx, http.StatusBadRequest, miss_key)
+		return
+	}
+
+	limit := defaultHistoryLimit
+	if raw := ctx.Query("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n <= 0 {
+			render(ctx, http.StatusBadRequest, response.FailJSON("limit must be a positive integer"))
+			return
+		}
+		limit = n
+	}
+
+	versions, err := qs.History(name, limit)
+	if err != nil {
+		handlerQueryError(ctx, err)
+		return
+	}
+
+	items := make([]gin.H, 0, len(versions))
+	for _, version := range versions {
+		item := gin.H{
+			"type":       version.Segment.TypeString(),
+			"deleted":    version.Deleted,
+			"created_at": time.UnixMicro(version.CreatedAt).Format(time.RFC3339Nano),
+		}
+
+		if version.ExpiredAt > 0 {
+			item["expired_at"] = time.UnixMicro(version.ExpiredAt).Format(time.RFC3339Nano)
+		}
+
+		if version.Segment.Writer != "" {
+			item["writer"] = version.Segment.Writer
+		}
+
+		if !version.Deleted {
+			value, err := service.DecodeValue(version.Segment)
+			if err != nil {
+				handlerQueryError(ctx, err)
+				return
+			}
+			item["value"] = value
+		}
+
+		items = append(items, item)
+	}
+
+	render(ctx, http.StatusOK, response.OkJSON("history query completed successfully", gin.H{
+		"key":      name,
+		"versions": items,
+	}))
+}
+
+type SwapRequest struct {
+	Type       string `json:"type" binding:"required,oneof=variant record list"`
+	Value      any    `json:"value" binding:"required"`
+	TTLSeconds int64  `json:"ttl" binding:"omitempty"`
+	KeepTTL    bool   `json:"keep_ttl"`
+}
+
+// SwapController 原子性的替换 key 的值并且返回替换之前的值，类似于 Redis 的 GETSET，key 不存在的时候 previous 为 null
+func SwapController(ctx *gin.Context) {
+	name := ctx.Param("key")
+	if !utils.NotNullString(name) {
+		render(ctx, http.StatusBadRequest, miss_key)
+		return
+	}
+
+	var req SwapRequest
+	err := ctx.ShouldBindJSON(&req)
 	if err != nil {
-		ctx.IndentedJSON(http.StatusNotFound, response.FailJSON(err.Error()))
+		render(ctx, http.StatusBadRequest, response.FailJSON(err.Error()))
 		return
 	}
 
-	defer utils.ReleaseToPool(seg)
-	ttl, _ := seg.ExpiresIn()
+	previous, err := qs.Swap(name, req.Type, req.Value, resolveTTL(req.Type+"s", req.TTLSeconds), req.KeepTTL)
+	if err != nil {
+		handlerQueryError(ctx, err)
+		return
+	}
+
+	var value any
+	if previous != nil {
+		value, err = service.DecodeValue(previous)
+		if err != nil {
+			handlerQueryError(ctx, err)
+			return
+		}
+	}
 
-	ctx.IndentedJSON(http.StatusOK, response.OkJSON("metadata query completed successfully", gin.H{
-		"type":  seg.TypeString(),
-		"key":   seg.KeyString(),
-		"value": seg.Value,
-		"ttl":   ttl,
-		"mvcc":  version,
+	render(ctx, http.StatusOK, response.OkJSON("value swapped successfully", gin.H{
+		"key":      name,
+		"previous": value,
 	}))
 }
+
+type DeleteIfEqualsRequest struct {
+	// 使用 RawMessage 区分没有传 expected 和 expected 为 null 两种情况
+	Expected json.RawMessage `json:"expected"`
+}
+
+// DeleteQueryController 只有在 key 当前的值等于请求体中的 expected 时才删除 key，expected 和 GET /query/:key 返回的 value 格式一致，
+// 值在客户端读取之后被其他人修改过的时候返回 409，避免误删别人刚写入的数据。
+func DeleteQueryController(ctx *gin.Context) {
+	name := ctx.Param("key")
+	if !utils.NotNullString(name) {
+		render(ctx, http.StatusBadRequest, miss_key)
+		return
+	}
+
+	var req DeleteIfEqualsRequest
+	err := bindJSON(ctx, &req, false)
+	if err != nil {
+		render(ctx, http.StatusBadRequest, response.FailJSON(err.Error()))
+		return
+	}
+
+	if len(req.Expected) == 0 {
+		render(ctx, http.StatusBadRequest, response.FailJSON("expected value is required"))
+		return
+	}
+
+	var expected any
+	err = json.Unmarshal(req.Expected, &expected)
+	if err != nil {
+		render(ctx, http.StatusBadRequest, response.FailJSON(err.Error()))
+		return
+	}
+
+	err = qs.DeleteIfEquals(name, expected)
+	if err != nil {
+		handlerQueryError(ctx, err)
+		return
+	}
+
+	render(ctx, http.StatusOK, response.OkJSON("key deleted successfully", gin.H{
+		"key":     name,
+		"deleted": true,
+	}))
+}
+
+func handlerQueryError(ctx *gin.Context, err error) {
+	switch {
+	case errors.Is(err, service.ErrInvalidSwapValue):
+		render(ctx, http.StatusBadRequest, response.FailJSON(err.Error()))
+	case errors.Is(err, service.ErrSegmentNotFound):
+		render(ctx, http.StatusNotFound, response.FailJSON(err.Error()))
+	case errors.Is(err, service.ErrValueMismatch):
+		render(ctx, http.StatusConflict, response.FailJSON(err.Error()))
+	case errors.Is(err, vfs.ErrSegmentTooLarge):
+		render(ctx, http.StatusRequestEntityTooLarge, response.FailJSON(err.Error()))
+	case errors.Is(err, vfs.ErrTypeMismatch):
+		render(ctx, http.StatusConflict, response.FailJSON(err.Error()))
+	case errors.Is(err, vfs.ErrImmutable):
+		render(ctx, http.StatusConflict, response.FailJSON(err.Error()))
+	case errors.Is(err, vfs.ErrDecodeFailed):
+		render(ctx, http.StatusUnprocessableEntity, response.FailJSON(err.Error()))
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		// 客户端已经断开或者请求超时，响应大概率不会被读取，这里只是让处理函数尽快返回
+		render(ctx, http.StatusRequestTimeout, response.FailJSON(err.Error()))
+	default:
+		render(ctx, http.StatusInternalServerError, response.FailJSON(err.Error()))
+	}
+}
+
+// metadata 把数据的创建时间、存活时长、value 的大小和写入者标识转换为响应中的 meta 对象，
+// 存储层保存的是 UnixMicro 时间戳，返回给客户端的时候转换为 RFC3339 格式。
+func metadata(meta *service.Metadata) gin.H {
+	body := gin.H{
+		"created_at":  meta.Created().Format(time.RFC3339),
+		"age":         meta.Age(),
+		"value_size":  meta.ValueSize,
+		"stored_size": meta.StoredSize,
+	}
+	if meta.Writer != "" {
+		body["writer"] = meta.Writer
+	}
+	return body
+}
+
+// okWithMetadata 和 response.OkJSON 一样，所有 GET 响应的元数据都放在最外层的 meta 中，
+// 记录和表的 data 就是用户的字段或者 t_id 对应的行，元数据放到 data 中会和它们混在一起并且改变原来的结构。
+func okWithMetadata(message string, data any, meta *service.Metadata) *response.ResponseBody {
+	return response.OkJSONWithMeta(message, data, metadata(meta))
+}
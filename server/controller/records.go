@@ -22,65 +22,87 @@ import (
 	"github.com/auula/urnadb/server/service"
 	"github.com/auula/urnadb/types"
 	"github.com/auula/urnadb/utils"
+	"github.com/auula/urnadb/vfs"
 	"github.com/gin-gonic/gin"
 )
 
 func GetRecordController(ctx *gin.Context) {
 	name := ctx.Param("key")
 	if !utils.NotNullString(name) {
-		ctx.IndentedJSON(http.StatusBadRequest, miss_key)
+		render(ctx, http.StatusBadRequest, miss_key)
 		return
 	}
 
-	rd, err := rs.GetRecord(name)
+	if notModified(ctx, name) {
+		return
+	}
+
+	rd, meta, err := rs.GetRecord(name)
 	if err != nil {
-		ctx.IndentedJSON(http.StatusInternalServerError, response.FailJSON(
-			err.Error(),
-		))
+		handlerRecordError(ctx, err)
+		return
 	}
 
 	defer rd.ReleaseToPool()
 
-	ctx.IndentedJSON(http.StatusOK, response.OkJSON("record queried successfully", rd.Record))
+	render(ctx, http.StatusOK, okWithMetadata("record queried successfully", rd.Record, meta))
 }
 
 type CreateRecordRequest struct {
 	Record     map[string]any `json:"record" binding:"required"`
 	TTLSeconds int64          `json:"ttl" binding:"omitempty"`
+	// Immutable 为 true 的记录写入之后在过期之前不能被覆盖或者删除
+	Immutable bool `json:"immutable" binding:"omitempty"`
 }
 
 func PutRecordController(ctx *gin.Context) {
 	name := ctx.Param("key")
 	if !utils.NotNullString(name) {
-		ctx.IndentedJSON(http.StatusBadRequest, miss_key)
+		render(ctx, http.StatusBadRequest, miss_key)
 		return
 	}
 
 	var req CreateRecordRequest
-	err := ctx.ShouldBindJSON(&req)
+	err := bindJSON(ctx, &req, true)
 	if err != nil {
-		handlerRecordError(ctx, err)
+		render(ctx, http.StatusBadRequest, response.FailJSON(err.Error()))
 		return
 	}
 
 	rd := types.AcquireRecord()
-	rd.Record = req.Record
+	if req.Record != nil {
+		rd.Record = req.Record
+	}
 
 	defer rd.ReleaseToPool()
 
-	err = rs.CreateRecord(name, rd, req.TTLSeconds)
+	writer, ok := writerId(ctx)
+	if !ok {
+		return
+	}
+
+	created := true
+	ttl := resolveTTL("records", req.TTLSeconds)
+	if req.Immutable {
+		created, err = rs.CreateImmutableRecord(name, rd, ttl, isSetNX(ctx), writer)
+	} else if isSetNX(ctx) {
+		err = rs.CreateRecordIfAbsent(name, rd, ttl, writer)
+	} else {
+		created, err = rs.CreateRecord(name, rd, ttl, writer)
+	}
 	if err != nil {
 		handlerRecordError(ctx, err)
 		return
 	}
 
-	ctx.IndentedJSON(http.StatusOK, response.OkJSON("record created successfully", nil))
+	code, message := createdStatus(created, "record")
+	render(ctx, code, response.OkJSON(message, nil))
 }
 
 func DeleteRecordController(ctx *gin.Context) {
 	name := ctx.Param("key")
 	if !utils.NotNullString(name) {
-		ctx.IndentedJSON(http.StatusBadRequest, miss_key)
+		render(ctx, http.StatusBadRequest, miss_key)
 		return
 	}
 
@@ -90,46 +112,116 @@ func DeleteRecordController(ctx *gin.Context) {
 		return
 	}
 
-	ctx.IndentedJSON(http.StatusOK, response.OkJSON("record deleted successfully", nil))
+	render(ctx, http.StatusOK, response.OkJSON("record deleted successfully", nil))
 }
 
 type SearchRecordRequest struct {
 	Column string `json:"column" binding:"required"`
+	// Depth 最大搜索深度，没有指定的时候使用 utils.DefaultSearchDepth
+	Depth int `json:"depth" binding:"omitempty,min=1,max=1024"`
 }
 
 func SearchRecordController(ctx *gin.Context) {
 	name := ctx.Param("key")
 	if !utils.NotNullString(name) {
-		ctx.IndentedJSON(http.StatusBadRequest, miss_key)
+		render(ctx, http.StatusBadRequest, miss_key)
 		return
 	}
 
 	var req SearchRecordRequest
 	err := ctx.ShouldBindJSON(&req)
+	if err != nil {
+		render(ctx, http.StatusBadRequest, response.FailJSON(err.Error()))
+		return
+	}
+
+	depth := req.Depth
+	if depth == 0 {
+		depth = utils.DefaultSearchDepth
+	}
+
+	res, exceeded, err := rs.SearchRows(name, req.Column, depth)
 	if err != nil {
 		handlerRecordError(ctx, err)
 		return
 	}
 
-	res, err := rs.SearchRows(name, req.Column)
+	// 响应体的结构保持不变，结果被深度限制截断的时候通过响应头和 message 告诉客户端结果不完整
+	if exceeded {
+		ctx.Header("X-Search-Depth-Exceeded", "true")
+		render(ctx, http.StatusOK, response.OkJSON("search depth exceeded, results are partial", res))
+		return
+	}
+
+	render(ctx, http.StatusOK, response.OkJSON("search completed successfully", res))
+}
+
+type IncrementFieldRequest struct {
+	// Field 需要自增的字段，使用 . 分隔嵌套的字段，例如 stats.views
+	Field string `json:"field" binding:"required"`
+	// Delta 使用指针区分没有传递和传递了 0，0 只读取字段当前的值，字段不存在的时候创建为 0
+	Delta *float64 `json:"delta" binding:"required"`
+}
+
+// IncrementFieldController 原子的把记录中的一个数值字段加上 delta，字段不存在的时候会被创建，
+// 客户端不需要读取整条记录修改之后再写回，也不会和其他并发的自增互相覆盖。
+func IncrementFieldController(ctx *gin.Context) {
+	name := ctx.Param("key")
+	if !utils.NotNullString(name) {
+		render(ctx, http.StatusBadRequest, miss_key)
+		return
+	}
+
+	var req IncrementFieldRequest
+	err := ctx.ShouldBindJSON(&req)
+	if err != nil {
+		render(ctx, http.StatusBadRequest, response.FailJSON(err.Error()))
+		return
+	}
+
+	writer, ok := writerId(ctx)
+	if !ok {
+		return
+	}
+
+	value, err := rs.IncrementField(name, req.Field, *req.Delta, writer)
 	if err != nil {
 		handlerRecordError(ctx, err)
 		return
 	}
 
-	ctx.IndentedJSON(http.StatusOK, response.OkJSON("search completed successfully", res))
+	render(ctx, http.StatusOK, response.OkJSON("record field incremented successfully", gin.H{
+		"field": req.Field,
+		"value": value,
+	}))
 }
 
 func handlerRecordError(ctx *gin.Context, err error) {
 	switch {
+	case errors.Is(err, service.ErrNestingTooDeep):
+		render(ctx, http.StatusBadRequest, response.FailJSON(err.Error()))
+	case errors.Is(err, types.ErrInvalidFieldPath), errors.Is(err, types.ErrFieldNotNumber):
+		render(ctx, http.StatusBadRequest, response.FailJSON(err.Error()))
+	case errors.Is(err, service.ErrRecordUpdateConflict):
+		render(ctx, http.StatusConflict, response.FailJSON(err.Error()))
 	case errors.Is(err, service.ErrRecordUpdateFailed):
-		ctx.IndentedJSON(http.StatusConflict, response.FailJSON(err.Error()))
+		render(ctx, http.StatusConflict, response.FailJSON(err.Error()))
+	case errors.Is(err, service.ErrRecordAlreadyExists):
+		render(ctx, http.StatusConflict, response.FailJSON(err.Error()))
 	case errors.Is(err, service.ErrRecordNotFound):
-		ctx.IndentedJSON(http.StatusNotFound, response.FailJSON(err.Error()))
+		render(ctx, http.StatusNotFound, response.FailJSON(err.Error()))
 	case errors.Is(err, service.ErrRecordExpired):
-		ctx.IndentedJSON(http.StatusGone, response.FailJSON(err.Error()))
+		render(ctx, http.StatusGone, response.FailJSON(err.Error()))
+	case errors.Is(err, vfs.ErrSegmentTooLarge):
+		render(ctx, http.StatusRequestEntityTooLarge, response.FailJSON(err.Error()))
+	case errors.Is(err, vfs.ErrTypeMismatch):
+		render(ctx, http.StatusConflict, response.FailJSON(err.Error()))
+	case errors.Is(err, vfs.ErrImmutable):
+		render(ctx, http.StatusConflict, response.FailJSON(err.Error()))
+	case errors.Is(err, vfs.ErrDecodeFailed):
+		render(ctx, http.StatusUnprocessableEntity, response.FailJSON(err.Error()))
 	default:
 		// 所有其他错误都统一返回 500 内部服务器错误
-		ctx.IndentedJSON(http.StatusInternalServerError, response.FailJSON(err.Error()))
+		render(ctx, http.StatusInternalServerError, response.FailJSON(err.Error()))
 	}
 }
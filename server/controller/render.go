@@ -0,0 +1,65 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+
+	"github.com/auula/urnadb/server/middleware"
+	"github.com/auula/urnadb/server/response"
+	"github.com/gin-gonic/gin"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+const mimeMsgPack = "application/msgpack"
+
+// render 根据请求头中的 Accept 选择响应的编码格式，客户端声明接受 msgpack 的时候返回 msgpack 编码的响应，
+// 和 types 中的 ToBytes 使用同一个编码库，字段名沿用 json 标签，两种格式的响应结构完全一致，默认仍然返回 JSON。
+func render(ctx *gin.Context, code int, body any) {
+	// 请求体超过上限导致的绑定失败统一返回 413，客户端可以区分格式错误和请求体过大
+	if code >= http.StatusBadRequest && middleware.BodyTooLarge(ctx) {
+		code = http.StatusRequestEntityTooLarge
+	}
+
+	if !acceptMsgPack(ctx) {
+		ctx.IndentedJSON(code, body)
+		return
+	}
+
+	var buf bytes.Buffer
+	enc := msgpack.NewEncoder(&buf)
+	enc.SetCustomStructTag("json")
+	enc.SetOmitEmpty(true)
+
+	err := enc.Encode(body)
+	if err != nil {
+		ctx.IndentedJSON(http.StatusInternalServerError, response.FailJSON(err.Error()))
+		return
+	}
+
+	ctx.Data(code, mimeMsgPack, buf.Bytes())
+}
+
+func acceptMsgPack(ctx *gin.Context) bool {
+	for _, accept := range strings.Split(ctx.GetHeader("Accept"), ",") {
+		mime, _, _ := strings.Cut(strings.TrimSpace(accept), ";")
+		if mime == mimeMsgPack || mime == "application/x-msgpack" {
+			return true
+		}
+	}
+	return false
+}
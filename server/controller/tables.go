@@ -15,14 +15,17 @@
 package controller
 
 import (
+	"encoding/json"
 	"errors"
-	"io"
+	"fmt"
 	"net/http"
 
+	"github.com/auula/urnadb/clog"
 	"github.com/auula/urnadb/server/response"
 	"github.com/auula/urnadb/server/service"
 	"github.com/auula/urnadb/types"
 	"github.com/auula/urnadb/utils"
+	"github.com/auula/urnadb/vfs"
 	"github.com/gin-gonic/gin"
 )
 
@@ -33,35 +36,85 @@ type CreateTableRequest struct {
 func CreateTableController(ctx *gin.Context) {
 	name := ctx.Param("key")
 	if !utils.NotNullString(name) {
-		ctx.IndentedJSON(http.StatusBadRequest, miss_key)
+		render(ctx, http.StatusBadRequest, miss_key)
 		return
 	}
 
 	var req CreateTableRequest
-	err := ctx.ShouldBindJSON(&req)
-	if err != nil && !errors.Is(err, io.EOF) {
-		ctx.IndentedJSON(http.StatusBadRequest, response.FailJSON(err.Error()))
+	err := bindJSON(ctx, &req, true)
+	if err != nil {
+		render(ctx, http.StatusBadRequest, response.FailJSON(err.Error()))
+		return
+	}
+
+	ttl := resolveTTL("tables", req.TTLSeconds)
+	if !validTTL(ttl) {
+		render(ctx, http.StatusBadRequest, response.FailJSON("ttl cannot be negative"))
+		return
+	}
+
+	writer, ok := writerId(ctx)
+	if !ok {
+		return
+	}
+
+	err = ts.CreateTable(name, types.AcquireTable(), ttl, writer)
+	if err != nil {
+		handlerTablesError(ctx, err)
+		return
+	}
+
+	// 已经存在的表会返回 ErrTableAlreadyExists，成功的时候一定是新创建的
+	render(ctx, http.StatusCreated, response.OkJSON("table created successfully", nil))
+}
+
+// EnsureTableController 表已经存在的时候返回 200 和这张表，不存在的时候原子的创建一张空表并返回 201，
+// 代替客户端先查询再创建的两次请求，并发的请求不会互相覆盖。
+func EnsureTableController(ctx *gin.Context) {
+	name := ctx.Param("key")
+	if !utils.NotNullString(name) {
+		render(ctx, http.StatusBadRequest, miss_key)
 		return
 	}
 
-	if req.TTLSeconds < 0 {
-		ctx.IndentedJSON(http.StatusBadRequest, response.FailJSON("ttl cannot be negative"))
+	var req CreateTableRequest
+	err := bindJSON(ctx, &req, true)
+	if err != nil {
+		render(ctx, http.StatusBadRequest, response.FailJSON(err.Error()))
 		return
 	}
 
-	err = ts.CreateTable(name, types.AcquireTable(), req.TTLSeconds)
+	ttl := resolveTTL("tables", req.TTLSeconds)
+	if !validTTL(ttl) {
+		render(ctx, http.StatusBadRequest, response.FailJSON("ttl cannot be negative"))
+		return
+	}
+
+	writer, ok := writerId(ctx)
+	if !ok {
+		return
+	}
+
+	tab, meta, created, err := ts.EnsureTable(name, ttl, writer)
 	if err != nil {
 		handlerTablesError(ctx, err)
 		return
 	}
 
-	ctx.IndentedJSON(http.StatusOK, response.OkJSON("table created successfully", nil))
+	defer tab.ReleaseToPool()
+
+	code, message := http.StatusOK, "table queried successfully"
+	if created {
+		code, message = http.StatusCreated, "table created successfully"
+	}
+
+	render(ctx, code, okWithMetadata(message, tab.Table, meta))
 }
 
 func DeleteTableController(ctx *gin.Context) {
 	name := ctx.Param("key")
 	if !utils.NotNullString(name) {
-		ctx.IndentedJSON(http.StatusBadRequest, miss_key)
+		render(ctx, http.StatusBadRequest, miss_key)
 		return
 	}
 
@@ -71,91 +124,243 @@ func DeleteTableController(ctx *gin.Context) {
 		return
 	}
 
-	ctx.IndentedJSON(http.StatusOK, response.OkJSON("table deleted successfully", nil))
+	render(ctx, http.StatusOK, response.OkJSON("table deleted successfully", nil))
 }
 
 func QueryTableController(ctx *gin.Context) {
 	name := ctx.Param("key")
 	if !utils.NotNullString(name) {
-		ctx.IndentedJSON(http.StatusBadRequest, miss_key)
+		render(ctx, http.StatusBadRequest, miss_key)
+		return
+	}
+
+	if notModified(ctx, name) {
 		return
 	}
 
-	tab, err := ts.GetTable(name)
+	tab, meta, err := ts.GetTable(name)
 	if err != nil {
 		handlerTablesError(ctx, err)
 		return
 	}
 
-	ctx.IndentedJSON(http.StatusOK, response.OkJSON("table queried successfully", tab.Table))
+	if ctx.Query("stream") == "true" {
+		streamTable(ctx, tab, meta)
+		return
+	}
+
+	render(ctx, http.StatusOK, okWithMetadata("table queried successfully", tab.Table, meta))
+}
+
+// streamTable 按照 t_id 的顺序逐行把表编码到响应中，响应体和普通查询的结构一致但是没有缩进，
+// 避免超大的表在 IndentedJSON 中整体序列化和缩进占用成倍的内存，开始输出之后出错只能记录日志并中断响应。
+func streamTable(ctx *gin.Context, tab *types.Table, meta *service.Metadata) {
+	defer tab.ReleaseToPool()
+
+	ctx.Header("Content-Type", "application/json; charset=utf-8")
+	ctx.Status(http.StatusOK)
+
+	// 元数据和普通查询一样放在 meta 中，先编码除了 data 之外的字段，去掉结尾的 } 之后再逐行输出 data
+	head, err := json.Marshal(okWithMetadata("table queried successfully", nil, meta))
+	if err != nil {
+		clog.Errorf("[streamTable] %v", err)
+		return
+	}
+
+	_, err = fmt.Fprintf(ctx.Writer, `%s,"data":{`, head[:len(head)-1])
+	if err != nil {
+		clog.Errorf("[streamTable] %v", err)
+		return
+	}
+
+	first, enc := true, json.NewEncoder(ctx.Writer)
+	tab.RangeRows(func(id uint32, row map[string]any) bool {
+		if !first {
+			_, err = ctx.Writer.WriteString(",")
+			if err != nil {
+				return false
+			}
+		}
+		first = false
+
+		_, err = fmt.Fprintf(ctx.Writer, `"%d":`, id)
+		if err != nil {
+			return false
+		}
+
+		// Encoder 每次编码之后会追加一个换行符，在 JSON 中是合法的空白字符
+		err = enc.Encode(row)
+		return err == nil
+	})
+
+	if err != nil {
+		clog.Errorf("[streamTable] %v", err)
+		return
+	}
+
+	_, err = ctx.Writer.WriteString("}}")
+	if err != nil {
+		clog.Errorf("[streamTable] %v", err)
+	}
 }
 
 type PatchRowsRequest struct {
-	Wheres map[string]any `json:"wheres" binding:"required"`
+	Wheres map[string]any `json:"wheres" binding:"omitempty"`
 	Sets   map[string]any `json:"sets" binding:"required"`
+	// Upsert 为 true 时表不存在或者已过期会重新创建一张空表，否则返回 404 或者 410
+	Upsert bool `json:"upsert" binding:"omitempty"`
+	// All 为 true 时允许 wheres 为空，显式的修改整张表的所有行
+	All bool `json:"all" binding:"omitempty"`
+}
+
+// errEmptyWheres 没有任何条件的 wheres 会匹配整张表，修改和删除的时候必须通过 all 显式确认
+var errEmptyWheres = errors.New(`wheres must not be empty, set "all": true to apply to every row`)
+
+// checkWheres 拒绝没有条件并且没有设置 all 的批量修改，避免请求体写错的时候误操作整张表
+func checkWheres(wheres map[string]any, all bool) error {
+	if len(wheres) == 0 && !all {
+		return errEmptyWheres
+	}
+	return nil
 }
 
 func PatchRowsTableController(ctx *gin.Context) {
 	name := ctx.Param("key")
 	if !utils.NotNullString(name) {
-		ctx.IndentedJSON(http.StatusBadRequest, miss_key)
+		render(ctx, http.StatusBadRequest, miss_key)
 		return
 	}
 
 	var req PatchRowsRequest
 	err := ctx.ShouldBindJSON(&req)
 	if err != nil {
-		ctx.IndentedJSON(http.StatusBadRequest, response.FailJSON(err.Error()))
+		render(ctx, http.StatusBadRequest, response.FailJSON(err.Error()))
+		return
+	}
+
+	err = checkWheres(req.Wheres, req.All)
+	if err != nil {
+		render(ctx, http.StatusBadRequest, response.FailJSON(err.Error()))
+		return
+	}
+
+	writer, ok := writerId(ctx)
+	if !ok {
 		return
 	}
 
-	err = ts.PatchRows(name, req.Wheres, req.Sets)
+	err = ts.PatchRows(name, req.Wheres, req.Sets, req.Upsert, resolveTTL("tables", 0), writer)
 	if err != nil {
 		handlerTablesError(ctx, err)
 		return
 	}
 
-	ctx.IndentedJSON(http.StatusOK, response.OkJSON("table rows patched successfully", nil))
+	render(ctx, http.StatusOK, response.OkJSON("table rows patched successfully", nil))
 }
 
 type QueryRowsRequest struct {
 	Wheres map[string]any `json:"wheres" binding:"required"`
+	// WithIDs 为 true 的时候每一行都会带上 t_id 字段，方便之后直接按照 t_id 更新或者删除匹配的行
+	WithIDs bool `json:"with_ids"`
 }
 
 func QueryRowsTableController(ctx *gin.Context) {
 	name := ctx.Param("key")
 	if !utils.NotNullString(name) {
-		ctx.IndentedJSON(http.StatusBadRequest, miss_key)
+		render(ctx, http.StatusBadRequest, miss_key)
 		return
 	}
 
 	var req QueryRowsRequest
 	err := ctx.ShouldBindJSON(&req)
 	if err != nil {
-		ctx.IndentedJSON(http.StatusBadRequest, response.FailJSON(err.Error()))
+		render(ctx, http.StatusBadRequest, response.FailJSON(err.Error()))
 		return
 	}
 
-	rows, err := ts.QueryRows(name, req.Wheres)
+	rows, err := ts.QueryRows(name, req.Wheres, req.WithIDs)
 	if err != nil {
 		handlerTablesError(ctx, err)
 		return
 	}
 
-	ctx.IndentedJSON(http.StatusOK, response.OkJSON("table queried rows successfully", rows))
+	render(ctx, http.StatusOK, response.OkJSON("table queried rows successfully", rows))
+}
+
+type CountRowsRequest struct {
+	Wheres map[string]any `json:"wheres" binding:"omitempty"`
+}
+
+// CountRowsTableController 只返回满足条件的行数，不需要把匹配的行序列化到响应中，没有条件的时候统计整张表
+func CountRowsTableController(ctx *gin.Context) {
+	name := ctx.Param("key")
+	if !utils.NotNullString(name) {
+		render(ctx, http.StatusBadRequest, miss_key)
+		return
+	}
+
+	var req CountRowsRequest
+	err := bindJSON(ctx, &req, true)
+	if err != nil {
+		render(ctx, http.StatusBadRequest, response.FailJSON(err.Error()))
+		return
+	}
+
+	count, err := ts.CountRows(name, req.Wheres)
+	if err != nil {
+		handlerTablesError(ctx, err)
+		return
+	}
+
+	render(ctx, http.StatusOK, response.OkJSON("table counted rows successfully", gin.H{
+		"count": count,
+	}))
+}
+
+// TableInfoController 只返回表的概要信息，界面上展示统计数据的时候不需要传输整张表
+func TableInfoController(ctx *gin.Context) {
+	name := ctx.Param("key")
+	if !utils.NotNullString(name) {
+		render(ctx, http.StatusBadRequest, miss_key)
+		return
+	}
+
+	info, meta, err := ts.TableInfo(name)
+	if err != nil {
+		handlerTablesError(ctx, err)
+		return
+	}
+
+	render(ctx, http.StatusOK, okWithMetadata("table info queried successfully", gin.H{
+		"size":    info.Size,
+		"next_id": info.NextID,
+		"ttl":     info.TTL,
+	}, meta))
+}
+
+type RemoveRowsRequest struct {
+	Wheres map[string]any `json:"wheres" binding:"omitempty"`
+	// All 为 true 时允许 wheres 为空，显式的删除整张表的所有行
+	All bool `json:"all" binding:"omitempty"`
 }
 
 func RemoveRowsTabelController(ctx *gin.Context) {
 	name := ctx.Param("key")
 	if !utils.NotNullString(name) {
-		ctx.IndentedJSON(http.StatusBadRequest, miss_key)
+		render(ctx, http.StatusBadRequest, miss_key)
 		return
 	}
 
-	var req QueryRowsRequest
+	var req RemoveRowsRequest
 	err := ctx.ShouldBindJSON(&req)
 	if err != nil {
-		ctx.IndentedJSON(http.StatusBadRequest, response.FailJSON(err.Error()))
+		render(ctx, http.StatusBadRequest, response.FailJSON(err.Error()))
+		return
+	}
+
+	err = checkWheres(req.Wheres, req.All)
+	if err != nil {
+		render(ctx, http.StatusBadRequest, response.FailJSON(err.Error()))
 		return
 	}
 
@@ -165,48 +370,111 @@ func RemoveRowsTabelController(ctx *gin.Context) {
 		return
 	}
 
-	ctx.IndentedJSON(http.StatusOK, response.OkJSON("table rows remove successfully", nil))
+	render(ctx, http.StatusOK, response.OkJSON("table rows remove successfully", nil))
 }
 
 type InsertRowsRequest struct {
 	Rows map[string]any `json:"rows" binding:"required"`
+	// Upsert 为 true 时表不存在或者已过期会重新创建一张空表，否则返回 404 或者 410
+	Upsert bool `json:"upsert" binding:"omitempty"`
 }
 
 func InsertRowsTableController(ctx *gin.Context) {
 	name := ctx.Param("key")
 	if !utils.NotNullString(name) {
-		ctx.IndentedJSON(http.StatusBadRequest, miss_key)
+		render(ctx, http.StatusBadRequest, miss_key)
 		return
 	}
 
 	var req InsertRowsRequest
 	err := ctx.ShouldBindJSON(&req)
 	if err != nil {
-		ctx.IndentedJSON(http.StatusBadRequest, response.FailJSON(err.Error()))
+		render(ctx, http.StatusBadRequest, response.FailJSON(err.Error()))
 		return
 	}
 
-	id, err := ts.InsertRows(name, req.Rows)
+	writer, ok := writerId(ctx)
+	if !ok {
+		return
+	}
+
+	id, err := ts.InsertRows(name, req.Rows, req.Upsert, resolveTTL("tables", 0), writer)
 	if err != nil {
 		handlerTablesError(ctx, err)
 		return
 	}
 
-	ctx.IndentedJSON(http.StatusOK, response.OkJSON("table rows insert successfully", gin.H{
+	render(ctx, http.StatusOK, response.OkJSON("table rows insert successfully", gin.H{
 		"t_id": id,
 	}))
 }
 
+type UpsertRowsRequest struct {
+	Rows map[uint32]map[string]any `json:"rows" binding:"required"`
+	// Upsert 为 true 时表不存在或者已过期会重新创建一张空表，否则返回 404 或者 410
+	Upsert bool `json:"upsert" binding:"omitempty"`
+}
+
+// UpsertRowsTableController 按照 t_id 原子的批量合并多行数据到表中，已经存在的行深度合并，
+// 不存在的行直接添加，请求中没有出现的行保持不变，整个批量修改通过 CAS 重试保证不会丢失并发的写入。
+func UpsertRowsTableController(ctx *gin.Context) {
+	name := ctx.Param("key")
+	if !utils.NotNullString(name) {
+		render(ctx, http.StatusBadRequest, miss_key)
+		return
+	}
+
+	var req UpsertRowsRequest
+	err := ctx.ShouldBindJSON(&req)
+	if err != nil {
+		render(ctx, http.StatusBadRequest, response.FailJSON(err.Error()))
+		return
+	}
+
+	if _, ok := req.Rows[0]; ok {
+		render(ctx, http.StatusBadRequest, response.FailJSON("t_id must be a positive integer"))
+		return
+	}
+
+	writer, ok := writerId(ctx)
+	if !ok {
+		return
+	}
+
+	inserted, merged, err := ts.UpsertRows(name, req.Rows, req.Upsert, resolveTTL("tables", 0), writer)
+	if err != nil {
+		handlerTablesError(ctx, err)
+		return
+	}
+
+	render(ctx, http.StatusOK, response.OkJSON("table rows upsert successfully", gin.H{
+		"inserted": inserted,
+		"merged":   merged,
+	}))
+}
+
 func handlerTablesError(ctx *gin.Context, err error) {
 	switch {
+	case errors.Is(err, service.ErrNestingTooDeep):
+		render(ctx, http.StatusBadRequest, response.FailJSON(err.Error()))
 	case errors.Is(err, service.ErrTableAlreadyExists):
-		ctx.IndentedJSON(http.StatusConflict, response.FailJSON(err.Error()))
+		render(ctx, http.StatusConflict, response.FailJSON(err.Error()))
 	case errors.Is(err, service.ErrTableNotFound):
-		ctx.IndentedJSON(http.StatusNotFound, response.FailJSON(err.Error()))
+		render(ctx, http.StatusNotFound, response.FailJSON(err.Error()))
 	case errors.Is(err, service.ErrTableExpired):
-		ctx.IndentedJSON(http.StatusGone, response.FailJSON(err.Error()))
+		render(ctx, http.StatusGone, response.FailJSON(err.Error()))
+	case errors.Is(err, service.ErrTableUpdateConflict):
+		render(ctx, http.StatusConflict, response.FailJSON(err.Error()))
+	case errors.Is(err, vfs.ErrSegmentTooLarge):
+		render(ctx, http.StatusRequestEntityTooLarge, response.FailJSON(err.Error()))
+	case errors.Is(err, vfs.ErrTypeMismatch):
+		render(ctx, http.StatusConflict, response.FailJSON(err.Error()))
+	case errors.Is(err, vfs.ErrImmutable):
+		render(ctx, http.StatusConflict, response.FailJSON(err.Error()))
+	case errors.Is(err, vfs.ErrDecodeFailed):
+		render(ctx, http.StatusUnprocessableEntity, response.FailJSON(err.Error()))
 	default:
 		// 所有其他错误都统一返回 500 内部服务器错误
-		ctx.IndentedJSON(http.StatusInternalServerError, response.FailJSON(err.Error()))
+		render(ctx, http.StatusInternalServerError, response.FailJSON(err.Error()))
 	}
 }
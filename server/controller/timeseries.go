@@ -0,0 +1,162 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/auula/urnadb/server/response"
+	"github.com/auula/urnadb/server/service"
+	"github.com/auula/urnadb/types"
+	"github.com/auula/urnadb/utils"
+	"github.com/auula/urnadb/vfs"
+	"github.com/gin-gonic/gin"
+)
+
+type AppendTimeSeriesRequest struct {
+	Samples    []types.Sample `json:"samples" binding:"required,min=1"`
+	MaxSamples int            `json:"max_samples" binding:"omitempty,min=0"`
+	MaxAge     int64          `json:"max_age" binding:"omitempty,min=0"`
+	TTLSeconds int64          `json:"ttl" binding:"omitempty"`
+}
+
+// AppendTimeSeriesController 追加采样点，时间戳为 Unix 毫秒，max_samples 和 max_age 设置保留策略，max_age 的单位是毫秒
+func AppendTimeSeriesController(ctx *gin.Context) {
+	name := ctx.Param("key")
+	if !utils.NotNullString(name) {
+		render(ctx, http.StatusBadRequest, miss_key)
+		return
+	}
+
+	var req AppendTimeSeriesRequest
+	err := ctx.ShouldBindJSON(&req)
+	if err != nil {
+		render(ctx, http.StatusBadRequest, response.FailJSON(err.Error()))
+		return
+	}
+
+	writer, ok := writerId(ctx)
+	if !ok {
+		return
+	}
+
+	size, err := tss.Append(name, req.Samples, service.Retention{
+		MaxSamples: req.MaxSamples,
+		MaxAge:     req.MaxAge,
+	}, resolveTTL("ts", req.TTLSeconds), writer)
+	if err != nil {
+		handlerTimeSeriesError(ctx, err)
+		return
+	}
+
+	render(ctx, http.StatusOK, response.OkJSON("samples appended successfully", gin.H{
+		"length": size,
+	}))
+}
+
+// RangeTimeSeriesController 返回 ?from=&to= 闭区间内的采样点，省略表示不限制，
+// 带有 ?bucket= 毫秒的时候按照 ?agg= 聚合每个桶，agg 支持 avg、max 和 min，默认 avg。
+func RangeTimeSeriesController(ctx *gin.Context) {
+	name := ctx.Param("key")
+	if !utils.NotNullString(name) {
+		render(ctx, http.StatusBadRequest, miss_key)
+		return
+	}
+
+	from, err := queryInt64(ctx, "from", math.MinInt64)
+	if err != nil {
+		render(ctx, http.StatusBadRequest, response.FailJSON("from must be a unix timestamp in milliseconds"))
+		return
+	}
+
+	to, err := queryInt64(ctx, "to", math.MaxInt64)
+	if err != nil {
+		render(ctx, http.StatusBadRequest, response.FailJSON("to must be a unix timestamp in milliseconds"))
+		return
+	}
+
+	bucket, err := queryInt64(ctx, "bucket", 0)
+	if err != nil || bucket < 0 {
+		render(ctx, http.StatusBadRequest, response.FailJSON("bucket must be a positive number of milliseconds"))
+		return
+	}
+
+	var samples []types.Sample
+	if bucket > 0 {
+		samples, err = tss.Downsample(name, from, to, bucket, ctx.DefaultQuery("agg", "avg"))
+	} else {
+		samples, err = tss.Range(name, from, to)
+	}
+	if err != nil {
+		handlerTimeSeriesError(ctx, err)
+		return
+	}
+
+	render(ctx, http.StatusOK, response.OkJSON("timeseries queried successfully", gin.H{
+		"samples": samples,
+	}))
+}
+
+func DeleteTimeSeriesController(ctx *gin.Context) {
+	name := ctx.Param("key")
+	if !utils.NotNullString(name) {
+		render(ctx, http.StatusBadRequest, miss_key)
+		return
+	}
+
+	err := tss.DeleteTimeSeries(name)
+	if err != nil {
+		handlerTimeSeriesError(ctx, err)
+		return
+	}
+
+	render(ctx, http.StatusOK, response.OkJSON("timeseries deleted successfully", nil))
+}
+
+// queryInt64 解析整数类型的查询参数，参数不存在的时候返回 fallback
+func queryInt64(ctx *gin.Context, key string, fallback int64) (int64, error) {
+	raw, ok := ctx.GetQuery(key)
+	if !ok {
+		return fallback, nil
+	}
+	return strconv.ParseInt(raw, 10, 64)
+}
+
+func handlerTimeSeriesError(ctx *gin.Context, err error) {
+	switch {
+	case errors.Is(err, service.ErrTimeSeriesNotFound):
+		render(ctx, http.StatusNotFound, response.FailJSON(err.Error()))
+	case errors.Is(err, service.ErrTimeSeriesExpired):
+		render(ctx, http.StatusGone, response.FailJSON(err.Error()))
+	case errors.Is(err, service.ErrTimeSeriesUpdateConflict):
+		render(ctx, http.StatusConflict, response.FailJSON(err.Error()))
+	case errors.Is(err, types.ErrUnknownAggregation):
+		render(ctx, http.StatusBadRequest, response.FailJSON(err.Error()))
+	case errors.Is(err, vfs.ErrSegmentTooLarge):
+		render(ctx, http.StatusRequestEntityTooLarge, response.FailJSON(err.Error()))
+	case errors.Is(err, vfs.ErrTypeMismatch):
+		render(ctx, http.StatusConflict, response.FailJSON(err.Error()))
+	case errors.Is(err, vfs.ErrImmutable):
+		render(ctx, http.StatusConflict, response.FailJSON(err.Error()))
+	case errors.Is(err, vfs.ErrDecodeFailed):
+		render(ctx, http.StatusUnprocessableEntity, response.FailJSON(err.Error()))
+	default:
+		// 所有其他错误都统一返回 500 内部服务器错误
+		render(ctx, http.StatusInternalServerError, response.FailJSON(err.Error()))
+	}
+}
@@ -0,0 +1,66 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"sync/atomic"
+
+	"github.com/auula/urnadb/vfs"
+)
+
+// ttlPolicy 客户端创建数据的时候没有指定 ttl 使用的默认过期时间，单位秒，
+// kinds 按照数据类型覆盖默认值，key 为路由分组的名字，例如 tables、records、variants、lists、ts。
+type ttlPolicy struct {
+	fallback int64
+	kinds    map[string]int64
+}
+
+var tp atomic.Pointer[ttlPolicy]
+
+func init() {
+	tp.Store(&ttlPolicy{})
+}
+
+// SetDefaultTTL 设置请求中省略 ttl 时使用的默认过期时间，0 表示保持原来永不过期的行为，
+// 缓存场景下可以避免客户端忘记设置 ttl 导致数据一直堆积，显式传入 vfs.ImmortalTTL 仍然可以创建永不过期的数据。
+func SetDefaultTTL(seconds int64, kinds map[string]int64) {
+	policy := &ttlPolicy{
+		fallback: seconds,
+		kinds:    make(map[string]int64, len(kinds)),
+	}
+	for kind, ttl := range kinds {
+		policy.kinds[kind] = ttl
+	}
+	tp.Store(policy)
+}
+
+// resolveTTL 请求中没有指定 ttl 的时候返回 kind 类型对应的默认过期时间
+func resolveTTL(kind string, ttl int64) int64 {
+	if ttl != 0 {
+		return ttl
+	}
+
+	policy := tp.Load()
+	if seconds, ok := policy.kinds[kind]; ok {
+		return seconds
+	}
+
+	return policy.fallback
+}
+
+// validTTL 合法的 ttl 是非负数或者显式声明永不过期的 vfs.ImmortalTTL，0 表示没有配置默认值的时候永不过期
+func validTTL(ttl int64) bool {
+	return ttl >= 0 || ttl == vfs.ImmortalTTL
+}
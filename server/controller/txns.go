@@ -21,6 +21,7 @@ import (
 
 	"github.com/auula/urnadb/server/response"
 	"github.com/auula/urnadb/server/service"
+	"github.com/auula/urnadb/vfs"
 	"github.com/gin-gonic/gin"
 )
 
@@ -71,14 +72,14 @@ func TransactionController(ctx *gin.Context) {
 	err := ctx.ShouldBindJSON(&req)
 	if err != nil {
 		inner := fmt.Errorf("invalid or empty request body: %w", err)
-		ctx.IndentedJSON(http.StatusBadRequest, response.FailJSON(inner.Error()))
+		render(ctx, http.StatusBadRequest, response.FailJSON(inner.Error()))
 		return
 	}
 
 	for _, mutaction := range req.Mutations {
 		err := mutaction.Validated()
 		if err != nil {
-			ctx.IndentedJSON(http.StatusBadRequest, response.FailJSON(err.Error()))
+			render(ctx, http.StatusBadRequest, response.FailJSON(err.Error()))
 			return
 		}
 	}
@@ -89,7 +90,7 @@ func TransactionController(ctx *gin.Context) {
 		return
 	}
 
-	ctx.IndentedJSON(http.StatusOK, response.OkJSON("transaction execute successfully", nil))
+	render(ctx, http.StatusOK, response.OkJSON("transaction execute successfully", nil))
 }
 
 func (req *MutationsRequest) buildTableMutation() []*service.TableMutation {
@@ -107,14 +108,24 @@ func (req *MutationsRequest) buildTableMutation() []*service.TableMutation {
 
 func handlerTxnsError(ctx *gin.Context, err error) {
 	switch {
+	case errors.Is(err, service.ErrNestingTooDeep):
+		render(ctx, http.StatusBadRequest, response.FailJSON(err.Error()))
 	case errors.Is(err, service.ErrTableAlreadyExists):
-		ctx.IndentedJSON(http.StatusConflict, response.FailJSON(err.Error()))
+		render(ctx, http.StatusConflict, response.FailJSON(err.Error()))
 	case errors.Is(err, service.ErrTableNotFound):
-		ctx.IndentedJSON(http.StatusNotFound, response.FailJSON(err.Error()))
+		render(ctx, http.StatusNotFound, response.FailJSON(err.Error()))
 	case errors.Is(err, service.ErrTableExpired):
-		ctx.IndentedJSON(http.StatusGone, response.FailJSON(err.Error()))
+		render(ctx, http.StatusGone, response.FailJSON(err.Error()))
+	case errors.Is(err, vfs.ErrSegmentTooLarge):
+		render(ctx, http.StatusRequestEntityTooLarge, response.FailJSON(err.Error()))
+	case errors.Is(err, vfs.ErrTypeMismatch):
+		render(ctx, http.StatusConflict, response.FailJSON(err.Error()))
+	case errors.Is(err, vfs.ErrImmutable):
+		render(ctx, http.StatusConflict, response.FailJSON(err.Error()))
+	case errors.Is(err, vfs.ErrDecodeFailed):
+		render(ctx, http.StatusUnprocessableEntity, response.FailJSON(err.Error()))
 	default:
 		// 所有其他错误都统一返回 500 内部服务器错误
-		ctx.IndentedJSON(http.StatusInternalServerError, response.FailJSON(err.Error()))
+		render(ctx, http.StatusInternalServerError, response.FailJSON(err.Error()))
 	}
 }
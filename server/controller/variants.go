@@ -16,19 +16,22 @@ package controller
 
 import (
 	"errors"
+	"fmt"
 	"net/http"
+	"strconv"
 
 	"github.com/auula/urnadb/server/response"
 	"github.com/auula/urnadb/server/service"
 	"github.com/auula/urnadb/types"
 	"github.com/auula/urnadb/utils"
+	"github.com/auula/urnadb/vfs"
 	"github.com/gin-gonic/gin"
 )
 
 func DeleteVariantController(ctx *gin.Context) {
 	name := ctx.Param("key")
 	if !utils.NotNullString(name) {
-		ctx.IndentedJSON(http.StatusBadRequest, miss_key)
+		render(ctx, http.StatusBadRequest, miss_key)
 		return
 	}
 
@@ -38,17 +41,26 @@ func DeleteVariantController(ctx *gin.Context) {
 		return
 	}
 
-	ctx.IndentedJSON(http.StatusOK, response.OkJSON("variant deleted successfully", nil))
+	render(ctx, http.StatusOK, response.OkJSON("variant deleted successfully", nil))
 }
 
 func GetVariantController(ctx *gin.Context) {
 	name := ctx.Param("key")
 	if !utils.NotNullString(name) {
-		ctx.IndentedJSON(http.StatusBadRequest, miss_key)
+		render(ctx, http.StatusBadRequest, miss_key)
 		return
 	}
 
-	variant, err := vs.GetVariant(name)
+	precision, ok := variantPrecision(ctx)
+	if !ok {
+		return
+	}
+
+	if notModified(ctx, name) {
+		return
+	}
+
+	variant, meta, err := vs.GetVariant(name)
 	if err != nil {
 		handlerVariantsError(ctx, err)
 		return
@@ -56,9 +68,9 @@ func GetVariantController(ctx *gin.Context) {
 
 	defer variant.ReleaseToPool()
 
-	ctx.IndentedJSON(http.StatusOK, response.OkJSON("variant queried successfully", gin.H{
-		"variant": variant.Value,
-	}))
+	render(ctx, http.StatusOK, okWithMetadata("variant queried successfully", gin.H{
+		"variant": variant.Rounded(precision),
+	}, meta))
 }
 
 type CreateVariantRequest struct {
@@ -69,14 +81,14 @@ type CreateVariantRequest struct {
 func CreateVariantController(ctx *gin.Context) {
 	name := ctx.Param("key")
 	if !utils.NotNullString(name) {
-		ctx.IndentedJSON(http.StatusBadRequest, miss_key)
+		render(ctx, http.StatusBadRequest, miss_key)
 		return
 	}
 
 	var req CreateVariantRequest
-	err := ctx.ShouldBindJSON(&req)
+	err := bindJSON(ctx, &req, false)
 	if err != nil {
-		ctx.IndentedJSON(http.StatusBadRequest, response.FailJSON(err.Error()))
+		render(ctx, http.StatusBadRequest, response.FailJSON(err.Error()))
 		return
 	}
 
@@ -84,7 +96,7 @@ func CreateVariantController(ctx *gin.Context) {
 	new_variant.Value = req.Value
 
 	if !new_variant.IsVariant() {
-		ctx.IndentedJSON(http.StatusInternalServerError, response.FailJSON(
+		render(ctx, http.StatusInternalServerError, response.FailJSON(
 			"only allow string, int, and float types",
 		))
 		return
@@ -92,14 +104,24 @@ func CreateVariantController(ctx *gin.Context) {
 
 	defer new_variant.ReleaseToPool()
 
-	err = vs.SetVariant(name, new_variant, req.TTLSeconds)
+	writer, ok := writerId(ctx)
+	if !ok {
+		return
+	}
+
+	ttl := resolveTTL("variants", req.TTLSeconds)
+	if isSetNX(ctx) {
+		err = vs.SetVariantIfAbsent(name, new_variant, ttl, writer)
+	} else {
+		err = vs.SetVariant(name, new_variant, ttl, writer)
+	}
 	if err != nil {
 		handlerVariantsError(ctx, err)
 		return
 	}
 
-	// 成功响应
-	ctx.IndentedJSON(http.StatusOK, response.OkJSON("variant created successfully", gin.H{
+	// 已经存在的变量不能通过 PUT 覆盖，成功的时候一定是新创建的
+	render(ctx, http.StatusCreated, response.OkJSON("variant created successfully", gin.H{
 		"variant": new_variant.Value,
 	}))
 }
@@ -112,14 +134,19 @@ type MathVariantRequest struct {
 func MathVariantController(ctx *gin.Context) {
 	name := ctx.Param("key")
 	if !utils.NotNullString(name) {
-		ctx.IndentedJSON(http.StatusBadRequest, miss_key)
+		render(ctx, http.StatusBadRequest, miss_key)
+		return
+	}
+
+	precision, ok := variantPrecision(ctx)
+	if !ok {
 		return
 	}
 
 	var req MathVariantRequest
 	err := ctx.ShouldBindJSON(&req)
 	if err != nil {
-		ctx.IndentedJSON(http.StatusBadRequest, response.FailJSON("delta must be a float or int type"))
+		render(ctx, http.StatusBadRequest, response.FailJSON("delta must be a float or int type"))
 		return
 	}
 
@@ -129,19 +156,50 @@ func MathVariantController(ctx *gin.Context) {
 		return
 	}
 
-	ctx.IndentedJSON(http.StatusOK, response.OkJSON("variant incremented successfully", gin.H{
-		"variant": res_num,
+	render(ctx, http.StatusOK, response.OkJSON("variant incremented successfully", gin.H{
+		"variant": types.RoundFloat(res_num, precision),
 	}))
 }
 
+// maxVariantPrecision 是 float64 有意义的最大小数位数，超过之后四舍五入没有效果
+const maxVariantPrecision = 17
+
+// variantPrecision 解析 precision 查询参数，响应中的浮点数按照这个小数位数四舍五入，存储的值不受影响，
+// 没有设置的时候返回 -1 表示保持完整的精度，参数不合法的时候直接返回 400 并且 ok 为 false
+func variantPrecision(ctx *gin.Context) (int, bool) {
+	raw, ok := ctx.GetQuery("precision")
+	if !ok {
+		return -1, true
+	}
+
+	n, err := strconv.Atoi(raw)
+	if err != nil || n < 0 || n > maxVariantPrecision {
+		render(ctx, http.StatusBadRequest, response.FailJSON(
+			fmt.Sprintf("precision must be an integer between 0 and %d", maxVariantPrecision),
+		))
+		return 0, false
+	}
+	return n, true
+}
+
 func handlerVariantsError(ctx *gin.Context, err error) {
 	switch {
 	case errors.Is(err, service.ErrVariantNotFound):
-		ctx.IndentedJSON(http.StatusNotFound, response.FailJSON(err.Error()))
+		render(ctx, http.StatusNotFound, response.FailJSON(err.Error()))
 	case errors.Is(err, service.ErrVariantExpired):
-		ctx.IndentedJSON(http.StatusGone, response.FailJSON(err.Error()))
+		render(ctx, http.StatusGone, response.FailJSON(err.Error()))
+	case errors.Is(err, service.ErrVariantAlreadyExists):
+		render(ctx, http.StatusConflict, response.FailJSON(err.Error()))
+	case errors.Is(err, vfs.ErrSegmentTooLarge):
+		render(ctx, http.StatusRequestEntityTooLarge, response.FailJSON(err.Error()))
+	case errors.Is(err, vfs.ErrTypeMismatch):
+		render(ctx, http.StatusConflict, response.FailJSON(err.Error()))
+	case errors.Is(err, vfs.ErrImmutable):
+		render(ctx, http.StatusConflict, response.FailJSON(err.Error()))
+	case errors.Is(err, vfs.ErrDecodeFailed):
+		render(ctx, http.StatusUnprocessableEntity, response.FailJSON(err.Error()))
 	default:
 		// 所有其他错误都统一返回 500 内部服务器错误
-		ctx.IndentedJSON(http.StatusInternalServerError, response.FailJSON(err.Error()))
+		render(ctx, http.StatusInternalServerError, response.FailJSON(err.Error()))
 	}
 }
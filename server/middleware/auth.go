@@ -16,15 +16,27 @@ package middleware
 
 import (
 	"fmt"
+	"net"
 	"net/http"
 	"strings"
+	"sync"
+	"sync/atomic"
 
 	"github.com/auula/urnadb/clog"
 	"github.com/auula/urnadb/server/response"
 	"github.com/gin-gonic/gin"
 )
 
-var ap *authPolicy
+// ap 会在运行时被 ReloadAuthPolicy 替换，中间件每次请求读取的都是一份不可变的快照，
+// 写入的时候通过 apmu 串行化，避免同时修改密码和白名单丢失其中一次更新。
+var (
+	ap   atomic.Pointer[authPolicy]
+	apmu sync.Mutex
+)
+
+func init() {
+	ap.Store(new(authPolicy))
+}
 
 type authPolicy struct {
 	AccessToken string
@@ -32,15 +44,35 @@ type authPolicy struct {
 }
 
 func SetAuthPassword(password string) {
-	ap.AccessToken = password
+	apmu.Lock()
+	defer apmu.Unlock()
+	policy := *ap.Load()
+	policy.AccessToken = password
+	ap.Store(&policy)
 }
 
 func SetAllowIpList(ips []string) {
-	ap.AllowedIPs = ips
+	apmu.Lock()
+	defer apmu.Unlock()
+	policy := *ap.Load()
+	policy.AllowedIPs = ips
+	ap.Store(&policy)
+}
+
+// ReloadAuthPolicy 同时替换访问密码和 IP 白名单，正在处理的请求不受影响，之后的请求使用新的策略
+func ReloadAuthPolicy(password string, ips []string) {
+	apmu.Lock()
+	defer apmu.Unlock()
+	ap.Store(&authPolicy{
+		AccessToken: password,
+		AllowedIPs:  append([]string(nil), ips...),
+	})
 }
 
 func AuthMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
+		policy := ap.Load()
+
 		// 从请求头中获取 "Auth-Token" 字段的值
 		auth := c.GetHeader("Auth-Token")
 		clog.Debugf("HTTP request header authorization: %v", c.Request)
@@ -52,16 +84,8 @@ func AuthMiddleware() gin.HandlerFunc {
 		}
 
 		// 检查 IP 白名单
-		if len(ap.AllowedIPs) > 0 {
-			ok := false
-			for _, allowedIP := range ap.AllowedIPs {
-				// 只要找到匹配的 IP，就终止循环
-				if allowedIP == strings.Split(ip, ":")[0] {
-					ok = true
-					break
-				}
-			}
-			if !ok {
+		if len(policy.AllowedIPs) > 0 {
+			if !allowedIP(parseClientIP(ip), policy.AllowedIPs) {
 				clog.Warnf("Unauthorized IP address: %s", ip)
 				c.IndentedJSON(http.StatusUnauthorized, response.FailJSON(fmt.Sprintf("client IP %s is not allowed!", ip)))
 				c.Abort()
@@ -69,7 +93,7 @@ func AuthMiddleware() gin.HandlerFunc {
 			}
 		}
 
-		if auth != ap.AccessToken {
+		if auth != policy.AccessToken {
 			clog.Warnf("Unauthorized access attempt from client %s", ip)
 			c.IndentedJSON(http.StatusUnauthorized, response.FailJSON("access not authorised!"))
 			c.Abort()
@@ -80,3 +104,28 @@ func AuthMiddleware() gin.HandlerFunc {
 		c.Next()
 	}
 }
+
+// parseClientIP 解析客户端的地址，X-Forwarded-For 中可能有多个地址，第一个是原始的客户端。
+// 地址可能带有端口，IPv6 地址本身就包含冒号，不能按照冒号分割，解析失败的时候返回 nil。
+func parseClientIP(addr string) net.IP {
+	addr = strings.TrimSpace(strings.Split(addr, ",")[0])
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	return net.ParseIP(strings.Trim(addr, "[]"))
+}
+
+// allowedIP 判断 ip 是否在白名单中，使用 net.IP.Equal 比较，同一个 IPv6 地址的不同写法以及 IPv4 映射地址都可以匹配
+func allowedIP(ip net.IP, allowed []string) bool {
+	if ip == nil {
+		return false
+	}
+
+	for _, addr := range allowed {
+		if ip.Equal(net.ParseIP(strings.TrimSpace(addr))) {
+			return true
+		}
+	}
+
+	return false
+}
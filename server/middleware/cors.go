@@ -0,0 +1,119 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package middleware
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/auula/urnadb/clog"
+	"github.com/auula/urnadb/server/response"
+	"github.com/gin-gonic/gin"
+)
+
+// 没有配置 AllowedMethods 的时候预检请求返回的默认方法
+var defaultCORSMethods = []string{
+	http.MethodGet,
+	http.MethodPost,
+	http.MethodPut,
+	http.MethodPatch,
+	http.MethodDelete,
+}
+
+var cp = new(corsPolicy)
+
+type corsPolicy struct {
+	AllowedOrigins   []string
+	AllowedMethods   []string
+	AllowCredentials bool
+}
+
+// SetCORSPolicy 设置跨域策略，origins 为空表示不开启跨域支持，"*" 表示允许所有来源
+func SetCORSPolicy(origins, methods []string, credentials bool) {
+	cp.AllowedOrigins = origins
+	cp.AllowedMethods = methods
+	cp.AllowCredentials = credentials
+}
+
+func (p *corsPolicy) allowOrigin(origin string) (string, bool) {
+	for _, allowed := range p.AllowedOrigins {
+		if allowed == origin {
+			return origin, true
+		}
+		if allowed == "*" {
+			// 携带凭证的请求浏览器不接受通配符，只能回显具体的来源
+			if p.AllowCredentials {
+				return origin, true
+			}
+			return "*", true
+		}
+	}
+	return "", false
+}
+
+// CORSMiddleware 必须注册在认证中间件之前，浏览器发送的预检请求不会携带 Auth-Token
+func CORSMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		origin := c.GetHeader("Origin")
+		if len(cp.AllowedOrigins) == 0 || origin == "" {
+			c.Next()
+			return
+		}
+
+		preflight := c.Request.Method == http.MethodOptions &&
+			c.GetHeader("Access-Control-Request-Method") != ""
+
+		c.Writer.Header().Add("Vary", "Origin")
+
+		allowed, ok := cp.allowOrigin(origin)
+		if !ok {
+			clog.Warnf("CORS request from disallowed origin %s", origin)
+			if preflight {
+				c.IndentedJSON(http.StatusForbidden, response.FailJSON("origin "+origin+" is not allowed!"))
+				c.Abort()
+				return
+			}
+			// 普通请求不设置跨域响应头，由浏览器拦截响应
+			c.Next()
+			return
+		}
+
+		c.Header("Access-Control-Allow-Origin", allowed)
+		if cp.AllowCredentials {
+			c.Header("Access-Control-Allow-Credentials", "true")
+		}
+
+		if !preflight {
+			c.Next()
+			return
+		}
+
+		methods := cp.AllowedMethods
+		if len(methods) == 0 {
+			methods = defaultCORSMethods
+		}
+		c.Header("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+
+		headers := c.GetHeader("Access-Control-Request-Headers")
+		if headers == "" {
+			headers = "Auth-Token, Content-Type"
+		}
+		c.Header("Access-Control-Allow-Headers", headers)
+		c.Header("Access-Control-Max-Age", "600")
+
+		// 预检请求到这里就结束了，不会进入认证中间件和路由
+		c.AbortWithStatus(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,82 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package middleware
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/auula/urnadb/server/response"
+	"github.com/gin-gonic/gin"
+)
+
+// bodyTooLargeKey 请求体超过限制的时候在 gin.Context 中设置的标记
+const bodyTooLargeKey = "urnadb.body_too_large"
+
+var maxBodyBytes atomic.Int64
+
+// SetMaxBodyBytes 设置请求体的最大字节数，0 表示不限制
+func SetMaxBodyBytes(n int64) {
+	maxBodyBytes.Store(n)
+}
+
+// limitedBody 在读取超过限制的时候记录标记，控制器绑定失败之后可以据此返回 413 而不是 400
+type limitedBody struct {
+	io.ReadCloser
+	ctx *gin.Context
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	var mbe *http.MaxBytesError
+	if errors.As(err, &mbe) {
+		b.ctx.Set(bodyTooLargeKey, true)
+	}
+	return n, err
+}
+
+// BodyTooLarge 判断当前请求的请求体是否超过了 SetMaxBodyBytes 设置的上限
+func BodyTooLarge(c *gin.Context) bool {
+	return c.GetBool(bodyTooLargeKey)
+}
+
+// MaxBodyBytesMiddleware 在解码之前限制请求体的大小，声明了 Content-Length 的请求直接拒绝，
+// 分块传输的请求读取到上限之后返回错误，不会把超大的请求体读入内存。
+func MaxBodyBytesMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		limit := maxBodyBytes.Load()
+		if limit <= 0 || c.Request.Body == nil {
+			c.Next()
+			return
+		}
+
+		if c.Request.ContentLength > limit {
+			c.Set(bodyTooLargeKey, true)
+			c.IndentedJSON(http.StatusRequestEntityTooLarge,
+				response.FailJSON(fmt.Sprintf("request body exceeds the limit of %d bytes", limit)))
+			c.Abort()
+			return
+		}
+
+		c.Request.Body = &limitedBody{
+			ReadCloser: http.MaxBytesReader(c.Writer, c.Request.Body, limit),
+			ctx:        c,
+		}
+		c.Next()
+	}
+}
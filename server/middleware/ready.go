@@ -0,0 +1,35 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/auula/urnadb/server/response"
+	"github.com/gin-gonic/gin"
+)
+
+// ReadyMiddleware 在 ready 返回 false 的时候直接返回 503，
+// 存储引擎还没有初始化的时候控制器中的服务都是空的，不拦截的话请求会因为空指针导致整个进程崩溃。
+func ReadyMiddleware(ready func() bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !ready() {
+			c.IndentedJSON(http.StatusServiceUnavailable, response.FailJSON("storage is not initialized"))
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
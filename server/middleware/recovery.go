@@ -0,0 +1,46 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package middleware
+
+import (
+	"net/http"
+	"runtime/debug"
+
+	"github.com/auula/urnadb/clog"
+	"github.com/auula/urnadb/server/response"
+	"github.com/gin-gonic/gin"
+)
+
+// RecoveryMiddleware 捕获控制器中的 panic 并且返回 500，路由使用的是 gin.New() 没有默认的 Recovery 中间件，
+// 不拦截的话一次类型断言失败之类的 panic 就会导致整个进程崩溃，需要第一个注册才能覆盖之后所有的中间件。
+func RecoveryMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		defer func() {
+			err := recover()
+			if err == nil {
+				return
+			}
+
+			clog.Errorf("Recovered from panic on %s %s: %v\n%s", c.Request.Method, c.Request.URL.Path, err, debug.Stack())
+
+			// 响应已经开始写入的时候不能再修改状态码，只能中断之后的处理
+			if !c.Writer.Written() {
+				c.IndentedJSON(http.StatusInternalServerError, response.FailJSON("internal server error"))
+			}
+			c.Abort()
+		}()
+		c.Next()
+	}
+}
@@ -18,6 +18,7 @@ type ResponseBody struct {
 	Status  string      `json:"status"`
 	Message string      `json:"message,omitempty"`
 	Data    interface{} `json:"data,omitempty"`
+	Meta    interface{} `json:"meta,omitempty"`
 }
 
 // 返回成功响应
@@ -29,6 +30,16 @@ func OkJSON(message string, data interface{}) *ResponseBody {
 	}
 }
 
+// 返回带有元数据的成功响应，元数据和 data 分开放在 meta 中，不会改变 data 原来的结构
+func OkJSONWithMeta(message string, data interface{}, meta interface{}) *ResponseBody {
+	return &ResponseBody{
+		Status:  "success",
+		Message: message,
+		Data:    data,
+		Meta:    meta,
+	}
+}
+
 // 返回失败响应
 func FailJSON(message string) *ResponseBody {
 	return &ResponseBody{
@@ -29,15 +29,32 @@ func SetupRoutes() *gin.Engine {
 	gin.SetMode(gin.ReleaseMode)
 	router := gin.New()
 
+	// 第一个注册，控制器和之后的中间件中出现 panic 的时候返回 500，不会导致进程崩溃
+	router.Use(middleware.RecoveryMiddleware())
+
 	// 全局中间件：添加 Server 响应头，这里加上服务器的版本号
 	router.Use(func(c *gin.Context) {
 		c.Header("Server", version)
 		c.Next()
 	})
 
+	// 跨域中间件需要在认证之前处理浏览器的预检请求
+	router.Use(middleware.CORSMiddleware())
+
+	// 负载均衡器的探针无法携带 Auth-Token，必须在认证中间件之前注册，
+	// gin 注册路由时会复制当时已有的中间件，之后 Use 的中间件不会作用在这两个路由上。
+	router.GET("/livez", controller.LivezController)
+	router.GET("/readyz", controller.ReadyzController)
+
 	// 全局中间件
 	router.Use(middleware.AuthMiddleware())
 
+	// 在控制器解码之前限制请求体的大小
+	router.Use(middleware.MaxBodyBytesMiddleware())
+
+	// 存储引擎还没有初始化的时候返回 503，避免控制器访问空的服务
+	router.Use(middleware.ReadyMiddleware(controller.Initialized))
+
 	// 404 处理
 	router.NoRoute(controller.Error404Handler)
 	router.NoMethod(controller.Error404Handler)
@@ -45,13 +62,36 @@ func SetupRoutes() *gin.Engine {
 	// 健康检查
 	router.GET("/health", controller.HealthController)
 
+	// 调试接口
+	admin := router.Group("/admin")
+	{
+		admin.GET("/index/dump", controller.DumpIndexController)
+		admin.GET("/raw/:key", controller.RawSegmentController)
+		admin.GET("/regions/:id/verify", controller.VerifyRegionController)
+		admin.POST("/regions/:id/compact", controller.CompactRegionController)
+		admin.POST("/reload-auth", controller.ReloadAuthController)
+		admin.GET("/export", controller.ExportController)
+		admin.POST("/import", controller.ImportController)
+		admin.GET("/hotkeys", controller.HotKeysController)
+		admin.GET("/shards", controller.ShardsController)
+		admin.POST("/snapshot", controller.SnapshotIndexController)
+		admin.DELETE("/keys", controller.DeleteKeysByTypeController)
+	}
+
 	// 事物处理
 	router.POST("/txns", controller.TransactionController)
 
 	// 查询路由
 	query := router.Group("/query")
 	{
+		// 静态路由优先于参数路由匹配，名为 expiring 的 key 需要通过对应类型的接口查询
+		query.GET("/expiring", controller.ExpiringKeysController)
 		query.GET("/:key", controller.QueryController)
+		query.GET("/:key/history", controller.HistoryController)
+		query.POST("/expire", controller.ExpireKeysController)
+		query.POST("/exists", controller.ExistsKeysController)
+		query.POST("/:key/swap", controller.SwapController)
+		query.DELETE("/:key", controller.DeleteQueryController)
 	}
 
 	// Table 路由
@@ -62,13 +102,18 @@ func SetupRoutes() *gin.Engine {
 		tables.DELETE("/:key", controller.DeleteTableController)
 		tables.PATCH("/:key", controller.PatchRowsTableController)
 		tables.GET("/:key/rows", controller.QueryRowsTableController)
+		tables.GET("/:key/rows/count", controller.CountRowsTableController)
+		tables.GET("/:key/info", controller.TableInfoController)
+		tables.POST("/:key/ensure", controller.EnsureTableController)
 		tables.POST("/:key/rows", controller.InsertRowsTableController)
+		tables.POST("/:key/upsert", controller.UpsertRowsTableController)
 		tables.DELETE("/:key/rows", controller.RemoveRowsTabelController)
 	}
 
 	// Lock 路由
 	locks := router.Group("/locks")
 	{
+		locks.PUT("", controller.NewLocksController)
 		locks.PUT("/:key", controller.NewLockController)
 		locks.PATCH("/:key", controller.DoLeaseLockController)
 		locks.DELETE("/:key", controller.DeleteLockController)
@@ -80,9 +125,28 @@ func SetupRoutes() *gin.Engine {
 		records.GET("/:key", controller.GetRecordController)
 		records.PUT("/:key", controller.PutRecordController)
 		records.POST("/:key", controller.SearchRecordController)
+		records.POST("/:key/incr", controller.IncrementFieldController)
 		records.DELETE("/:key", controller.DeleteRecordController)
 	}
 
+	// List 路由
+	lists := router.Group("/lists")
+	{
+		lists.GET("/:key", controller.GetListController)
+		lists.PUT("/:key", controller.CreateListController)
+		lists.DELETE("/:key", controller.DeleteListController)
+		lists.POST("/:key/push", controller.PushListController)
+		lists.POST("/:key/pop", controller.PopListController)
+	}
+
+	// TimeSeries 路由
+	ts := router.Group("/ts")
+	{
+		ts.GET("/:key", controller.RangeTimeSeriesController)
+		ts.POST("/:key", controller.AppendTimeSeriesController)
+		ts.DELETE("/:key", controller.DeleteTimeSeriesController)
+	}
+
 	// Variant 路由
 	variants := router.Group("/variants")
 	{
@@ -29,12 +29,13 @@ import (
 	"github.com/auula/urnadb/server/controller"
 	"github.com/auula/urnadb/server/middleware"
 	"github.com/auula/urnadb/server/router"
+	"github.com/auula/urnadb/server/service"
 	"github.com/auula/urnadb/vfs"
 )
 
 var (
 	pkgmut         = sync.Mutex{}
-	ipv4    string = "0.0.0.0"
+	address string = "0.0.0.0"
 	storage *vfs.LogStructuredFS
 )
 
@@ -45,6 +46,8 @@ const (
 	maxPort = uint16((1 << 16) - 1)
 	timeout = time.Second * 3
 
+	defaultBindAddress = "0.0.0.0"
+
 	idle state = iota
 	running
 	stopping
@@ -54,25 +57,45 @@ func init() {
 	// initialized local server ip address
 	addrs, err := net.Interfaces()
 	if err != nil {
-		clog.Errorf("Initial server IPv4 address failed: %s", err)
+		clog.Errorf("Initial server IP address failed: %s", err)
 	}
 
-	// const local IPv4 address
-	ipv4, err = detectIPv4(addrs)
+	// const local IP address, prefer IPv4 and fall back to IPv6
+	address, err = detectAddress(addrs)
 	if err != nil {
-		clog.Errorf("Get server IPv4 address failed: %s", err)
+		clog.Errorf("Get server IP address failed: %s", err)
 	}
 }
 
 type HttpServer struct {
 	serv  *http.Server
 	port  uint16
+	bind  string
 	state atomic.Int32
 }
 
 type Options struct {
 	Port uint16
 	Auth string
+	// AllowedOrigins 允许跨域访问的来源，为空表示不开启跨域支持
+	AllowedOrigins []string
+	// AllowedMethods 预检请求允许的方法，为空使用默认的方法列表
+	AllowedMethods   []string
+	AllowCredentials bool
+	// DefaultTTLSeconds 创建数据的请求中没有指定 ttl 时使用的过期时间，0 表示永不过期
+	DefaultTTLSeconds int64
+	// DefaultTTLOverrides 按照数据类型覆盖默认的过期时间，key 为 tables、records、variants、lists
+	DefaultTTLOverrides map[string]int64
+	// MaxNestingDepth 写入 table 和 record 时允许的最大嵌套层级，最外层的 map 深度为 1，0 表示不限制
+	MaxNestingDepth int
+	// MaxBodyBytes 请求体的最大字节数，超过返回 413，0 表示不限制，/admin/import 导入的文件同样受到限制
+	MaxBodyBytes int64
+	// LockTokenInHeader 创建锁和续约的时候通过 X-Lease-Token 响应头返回 token，响应体中不包含 token
+	LockTokenInHeader bool
+	// MaxLeaseRenewals 一把锁最多可以续租的次数，超过之后续租返回 409，客户端需要重新获取锁，0 表示不限制
+	MaxLeaseRenewals int
+	// BindAddress 监听的 IP 地址，为空默认 0.0.0.0，IPv6 环境可以设置为 :: 或者指定某个网卡的地址
+	BindAddress string
 	// CertMagic *tls.Config
 }
 
@@ -84,6 +107,18 @@ func (opt *Options) Validated() error {
 	if opt.Auth == "" || len(opt.Auth) < 16 {
 		return errors.New("HTTP server auth password illegal")
 	}
+
+	if opt.MaxBodyBytes < 0 {
+		return errors.New("HTTP server max body bytes must not be negative")
+	}
+
+	if opt.MaxLeaseRenewals < 0 {
+		return errors.New("HTTP server max lease renewals must not be negative")
+	}
+
+	if opt.BindAddress != "" && net.ParseIP(opt.BindAddress) == nil {
+		return errors.New("HTTP server bind address illegal")
+	}
 	return nil
 }
 
@@ -97,16 +132,28 @@ func New(opt *Options) (*HttpServer, error) {
 
 	pkgmut.Lock()
 	middleware.SetAuthPassword(opt.Auth)
+	middleware.SetCORSPolicy(opt.AllowedOrigins, opt.AllowedMethods, opt.AllowCredentials)
+	controller.SetDefaultTTL(opt.DefaultTTLSeconds, opt.DefaultTTLOverrides)
+	service.SetMaxNestingDepth(opt.MaxNestingDepth)
+	middleware.SetMaxBodyBytes(opt.MaxBodyBytes)
+	controller.SetLockTokenInHeader(opt.LockTokenInHeader)
+	service.SetMaxLeaseRenewals(opt.MaxLeaseRenewals)
 	pkgmut.Unlock()
 
+	bind := opt.BindAddress
+	if bind == "" {
+		bind = defaultBindAddress
+	}
+
 	hs := HttpServer{
 		serv: &http.Server{
 			Handler:      router.SetupRoutes(),
-			Addr:         net.JoinHostPort(ipv4, strconv.Itoa(int(opt.Port))),
+			Addr:         net.JoinHostPort(bind, strconv.Itoa(int(opt.Port))),
 			WriteTimeout: timeout,
 			ReadTimeout:  timeout,
 		},
 		port: opt.Port,
+		bind: bind,
 	}
 
 	hs.state.Store(int32(idle))
@@ -134,9 +181,25 @@ func (hs *HttpServer) Port() uint16 {
 	return hs.port
 }
 
-// IPv4 return local IPv4 address
-func (*HttpServer) IPv4() string {
-	return ipv4
+// IPv4 return local IP address
+//
+// Deprecated: the discovered address may be IPv6, use Address instead.
+func (hs *HttpServer) IPv4() string {
+	return hs.Address()
+}
+
+// Address 返回对外展示的服务器地址，监听在指定的地址上时直接返回这个地址，
+// 监听所有网卡（0.0.0.0 或者 ::）时返回探测到的本机地址，优先返回 IPv4。
+func (hs *HttpServer) Address() string {
+	if ip := net.ParseIP(hs.bind); ip != nil && !ip.IsUnspecified() {
+		return hs.bind
+	}
+	return address
+}
+
+// URL 返回服务器的访问地址，IPv6 地址会被方括号包裹
+func (hs *HttpServer) URL() string {
+	return "http://" + net.JoinHostPort(hs.Address(), strconv.Itoa(int(hs.port)))
 }
 
 // Startup blocking goroutine
@@ -191,10 +254,12 @@ func (hs *HttpServer) Shutdown() error {
 func closeStorage() error {
 	pkgmut.Lock()
 	defer pkgmut.Unlock()
+	controller.StopLockReaper()
 	if storage != nil {
 		// 先停止垃圾回收线程和检查点生成线程
 		storage.StopExpireLoop()
 		storage.StopCheckpoint()
+		storage.StopIndexSnapshot()
 		storage.StopCompactRegion()
 		err := storage.CloseFS()
 		if err != nil {
@@ -204,8 +269,9 @@ func closeStorage() error {
 	return nil
 }
 
-func detectIPv4(addrs []net.Interface) (string, error) {
-	var ip string
+// detectAddress 返回本机非回环的 IP 地址，优先返回 IPv4 地址，只有 IPv6 的环境返回全局单播的 IPv6 地址
+func detectAddress(addrs []net.Interface) (string, error) {
+	var ip, ip6 string
 	for _, face := range addrs {
 		adders, err := face.Addrs()
 		if err != nil {
@@ -218,8 +284,15 @@ func detectIPv4(addrs []net.Interface) (string, error) {
 					ip = ipNet.IP.String()
 					break
 				}
+				// 链路本地地址需要带上网卡名称才能访问，不适合作为对外展示的地址
+				if ip6 == "" && ipNet.IP.To16() != nil && ipNet.IP.IsGlobalUnicast() {
+					ip6 = ipNet.IP.String()
+				}
 			}
 		}
 	}
+	if ip == "" {
+		ip = ip6
+	}
 	return ip, nil
 }
@@ -17,6 +17,7 @@ package server
 import (
 	"io/fs"
 	"net"
+	"net/http"
 	"testing"
 	"time"
 
@@ -56,7 +57,7 @@ func TestHttpServer_Port(t *testing.T) {
 
 // 测试 Startup 方法（非阻塞）
 func TestHttpServer_Startup(t *testing.T) {
-	conf.Settings.Path = "./_temp/"
+	path := t.TempDir()
 	server, err := New(&Options{Port: 8081, Auth: "secret1234567890"})
 	assert.NoError(t, err)
 
@@ -64,7 +65,7 @@ func TestHttpServer_Startup(t *testing.T) {
 	go func() {
 		fss, err := vfs.OpenFS(&vfs.Options{
 			FSPerm:    fs.FileMode(0755),
-			Path:      conf.Settings.Path,
+			Path:      path,
 			Threshold: 3,
 		})
 		assert.NoError(t, err)
@@ -104,7 +105,7 @@ func TestHttpServer_SetupFS(t *testing.T) {
 
 	fss, err := vfs.OpenFS(&vfs.Options{
 		FSPerm:    fs.FileMode(0755),
-		Path:      conf.Settings.Path,
+		Path:      t.TempDir(),
 		Threshold: conf.Settings.Region.Threshold,
 	})
 	if err != nil {
@@ -135,7 +136,7 @@ func TestHttpServer_Shutdown(t *testing.T) {
 
 	fss, err := vfs.OpenFS(&vfs.Options{
 		FSPerm:    fs.FileMode(0755),
-		Path:      conf.Settings.Path,
+		Path:      t.TempDir(),
 		Threshold: conf.Settings.Region.Threshold,
 	})
 
@@ -164,35 +165,35 @@ func TestHttpServer_Shutdown(t *testing.T) {
 
 // 测试 getIPv4Address 函数
 func TestGetIPv4Address_EmptyInterfaces(t *testing.T) {
-	result, err := detectIPv4([]net.Interface{})
+	result, err := detectAddress([]net.Interface{})
 	assert.NoError(t, err)
 	assert.Equal(t, "", result)
 }
 
 func TestGetIPv4Address_RealInterfaces(t *testing.T) {
 	interfaces, _ := net.Interfaces()
-	result, err := detectIPv4(interfaces)
+	result, err := detectAddress(interfaces)
 	assert.NoError(t, err)
 	// 结果可能为空字符串
 	if result != "" {
 		ip := net.ParseIP(result)
 		assert.NotNil(t, ip)
-		assert.NotNil(t, ip.To4())
+		assert.NotNil(t, ip.To16())
 	}
 }
 
 // 测试 init 函数中的错误处理逻辑
 func TestInitIPv4Logic(t *testing.T) {
 	// 保存原始值
-	originalIPv4 := ipv4
+	originalAddress := address
 	defer func() {
-		ipv4 = originalIPv4
+		address = originalAddress
 	}()
 
 	// 测试正常情况
 	interfaces, err := net.Interfaces()
 	if err == nil {
-		result, err := detectIPv4(interfaces)
+		result, err := detectAddress(interfaces)
 		assert.NoError(t, err)
 		// 验证结果是有效的 IP 地址或空字符串
 		if result != "" {
@@ -201,3 +202,49 @@ func TestInitIPv4Logic(t *testing.T) {
 		}
 	}
 }
+
+func TestBindAddress(t *testing.T) {
+	hts, err := New(&Options{Port: 8080, Auth: "secret1234567890"})
+	assert.NoError(t, err)
+	assert.Equal(t, "0.0.0.0:8080", hts.serv.Addr)
+
+	_, err = New(&Options{Port: 8080, Auth: "secret1234567890", BindAddress: "localhost"})
+	assert.Error(t, err)
+
+	serve := func(bind string, port uint16) {
+		hts, err := New(&Options{Port: port, Auth: "secret1234567890", BindAddress: bind})
+		assert.NoError(t, err)
+		assert.Equal(t, bind, hts.Address())
+
+		ln, err := net.Listen("tcp", hts.serv.Addr)
+		if !assert.NoError(t, err) {
+			return
+		}
+		go hts.serv.Serve(ln)
+		defer hts.serv.Close()
+
+		req, err := http.NewRequest(http.MethodGet, hts.URL()+"/livez", nil)
+		assert.NoError(t, err)
+		req.Header.Set("Auth-Token", "secret1234567890")
+		resp, err := http.DefaultClient.Do(req)
+		if assert.NoError(t, err) {
+			resp.Body.Close()
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+		}
+	}
+
+	serve("127.0.0.1", 28681)
+
+	// 沙箱或者容器中可能没有开启 IPv6
+	ln, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skipf("IPv6 loopback is not available: %v", err)
+	}
+	ln.Close()
+
+	hts, err = New(&Options{Port: 28682, Auth: "secret1234567890", BindAddress: "::1"})
+	assert.NoError(t, err)
+	assert.Equal(t, "[::1]:28682", hts.serv.Addr)
+	assert.Equal(t, "http://[::1]:28682", hts.URL())
+	serve("::1", 28682)
+}
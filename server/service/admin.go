@@ -0,0 +1,135 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/auula/urnadb/vfs"
+)
+
+var (
+	ErrSegmentNotFound = errors.New("segment not found")
+	ErrRegionNotFound  = errors.New("region not found")
+	ErrInvalidArchive  = vfs.ErrInvalidArchive
+	// 没有开启 vfs.Options.TrackAccessStats 的时候查询热点 key 返回的错误
+	ErrAccessStatsDisabled = vfs.ErrAccessStatsDisabled
+	// 回收活跃的 region 或者已经有垃圾回收任务正在执行时返回的错误
+	ErrActiveRegion      = vfs.ErrActiveRegion
+	ErrCompactInProgress = vfs.ErrCompactInProgress
+	// 导入的数据超过了一个 region 能够容纳的大小
+	ErrSegmentTooLarge = vfs.ErrSegmentTooLarge
+	// 按照类型批量删除的时候类型名称不存在
+	ErrUnknownKind = vfs.ErrUnknownKind
+)
+
+// RawSegment 是单个 key 在存储层的原始信息，StoredSize 是经过压缩和加密之后实际写入 region 的大小
+type RawSegment struct {
+	Key              string  `json:"key"`
+	Type             string  `json:"type"`
+	Version          uint64  `json:"mvcc"`
+	StoredSize       int32   `json:"stored_size"`
+	RawSize          int     `json:"raw_size"`
+	CompressionRatio float64 `json:"compression_ratio"`
+}
+
+// AdminService 提供排查存储层问题的调试接口
+type AdminService struct {
+	storage *vfs.LogStructuredFS
+}
+
+func NewAdminService(storage *vfs.LogStructuredFS) *AdminService {
+	return &AdminService{storage: storage}
+}
+
+// DumpIndex 以 JSON Lines 格式输出 index.db 中的所有索引记录
+func (a *AdminService) DumpIndex(w io.Writer) error {
+	return a.storage.DumpIndex(w)
+}
+
+// RawSegment 返回 key 对应的 segment 在存储层的大小信息
+func (a *AdminService) RawSegment(key string) (*RawSegment, error) {
+	version, seg, err := a.storage.FetchSegment(key)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrSegmentNotFound, err)
+	}
+
+	return &RawSegment{
+		Key:              seg.KeyString(),
+		Type:             seg.TypeString(),
+		Version:          version,
+		StoredSize:       seg.ValueSize,
+		RawSize:          len(seg.Value),
+		CompressionRatio: seg.CompressionRatio(),
+	}, nil
+}
+
+// VerifyRegion 校验 region 中所有记录的 CRC32，返回正常和损坏的记录数
+func (a *AdminService) VerifyRegion(regionId int64) (*vfs.VerifyReport, error) {
+	report, err := a.storage.VerifyRegion(regionId)
+	if err != nil {
+		if errors.Is(err, vfs.ErrRegionNotFound) {
+			return nil, fmt.Errorf("%w: %d", ErrRegionNotFound, regionId)
+		}
+		return nil, err
+	}
+
+	return &report, nil
+}
+
+// CompactRegion 只回收一个 region，有效的数据迁移到活跃 region 之后删除这个 region 文件
+func (a *AdminService) CompactRegion(regionId int64) error {
+	err := a.storage.CompactRegion(regionId)
+	if errors.Is(err, vfs.ErrRegionNotFound) {
+		return fmt.Errorf("%w: %d", ErrRegionNotFound, regionId)
+	}
+	return err
+}
+
+// Export 把以 prefix 开头的存活 key 流式的写入 w，返回导出的 key 数量
+func (a *AdminService) Export(w io.Writer, prefix string) (int, error) {
+	return a.storage.Export(w, prefix)
+}
+
+// Import 导入 Export 生成的数据，返回导入的 key 数量
+func (a *AdminService) Import(r io.Reader) (int, error) {
+	return a.storage.Import(r)
+}
+
+// HotKeys 返回访问次数最多的 n 个 key，byReads 为 false 时按照写入次数排序
+func (a *AdminService) HotKeys(n int, byReads bool) ([]vfs.KeyStat, error) {
+	return a.storage.TopKeys(n, byReads)
+}
+
+// ShardStats 返回每个 index shard 获取锁的次数和等待的次数，用于判断是否需要增加 shard 的数量
+func (a *AdminService) ShardStats() []vfs.ShardStat {
+	return a.storage.ShardStats()
+}
+
+// SnapshotIndex 立即导出一次 index.db 索引快照，返回快照中的索引数量和文件大小
+func (a *AdminService) SnapshotIndex() (*vfs.SnapshotInfo, error) {
+	info, err := a.storage.SnapshotIndex()
+	if err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// DeleteKeysByType 删除所有类型为 typ 的 key，返回删除的数量
+func (a *AdminService) DeleteKeysByType(typ string) (int, error) {
+	return a.storage.DeleteByType(typ)
+}
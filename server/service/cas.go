@@ -0,0 +1,69 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"errors"
+	"math/rand"
+	"time"
+
+	"github.com/auula/urnadb/vfs"
+)
+
+const (
+	// casBackoffBase 第一次冲突之后等待的时长，之后每次冲突翻倍
+	casBackoffBase = 50 * time.Microsecond
+	// casBackoffMax 单次等待时长的上限
+	casBackoffMax = 5 * time.Millisecond
+)
+
+// retryCAS 重复执行一次读取-修改-CAS 写入的 attempt，attempt 返回 false 表示版本号冲突需要重试，
+// 冲突之后按照带随机抖动的指数退避等待，避免大量并发的写入者同时重试又同时冲突，
+// 超过 retries 次仍然冲突返回 conflict，attempt 返回的错误直接返回不会重试。
+func retryCAS(retries int, conflict error, attempt func() (bool, error)) error {
+	backoff := casBackoffBase
+	for i := 0; i < retries; i++ {
+		swapped, err := attempt()
+		if err != nil {
+			return err
+		}
+
+		if swapped {
+			return nil
+		}
+
+		time.Sleep(backoff/2 + time.Duration(rand.Int63n(int64(backoff))))
+		if backoff < casBackoffMax {
+			backoff *= 2
+		}
+	}
+
+	return conflict
+}
+
+// isMissing 判断 FetchSegment 返回的错误是否表示 key 不存在或者已经过期，只有这两种情况可以重新创建，
+// 其他的读取错误发生的时候 inode 仍然在索引中，PutSegmentIfAbsent 会一直失败，重试只会耗尽次数之后返回冲突。
+func isMissing(err error) bool {
+	return errors.Is(err, vfs.ErrSegmentNotFound) || errors.Is(err, vfs.ErrSegmentExpired)
+}
+
+// carryWriter 返回读取-修改-写入之后新 segment 的写入者，请求没有携带 X-Writer-Id 的时候沿用旧 segment 的写入者，
+// 避免追加或者修改数据的请求把创建时记录的写入者清空。
+func carryWriter(writer, previous string) string {
+	if writer != "" {
+		return writer
+	}
+	return previous
+}
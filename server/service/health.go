@@ -35,6 +35,11 @@ func NewHealthService(storage *vfs.LogStructuredFS) *HealthService {
 	return &HealthService{mem: mem, disk: diskUsage, storage: storage}
 }
 
+// IsReady 存储引擎已经初始化完成并且可以正常读写
+func (h *HealthService) IsReady() bool {
+	return h.storage != nil && h.storage.IsReady()
+}
+
 func (h *HealthService) RegionCompactStatus() uint8 {
 	return h.storage.GCState()
 }
@@ -43,6 +48,15 @@ func (h *HealthService) RegionInodeCount() uint64 {
 	return h.storage.RefreshInodeCount()
 }
 
+func (h *HealthService) CompressionRatio() float64 {
+	return h.storage.CompressionRatio()
+}
+
+// PipelineStatus 返回 value 编码管道中压缩和加密是否开启
+func (h *HealthService) PipelineStatus() vfs.PipelineStatus {
+	return h.storage.PipelineStatus()
+}
+
 func (h *HealthService) GetTotalSpaceUsed() uint64 {
 	return h.storage.GetTotalSpaceUsed()
 }
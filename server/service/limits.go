@@ -0,0 +1,44 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/auula/urnadb/utils"
+)
+
+// ErrNestingTooDeep 写入的 map 嵌套层级超过了 SetMaxNestingDepth 设置的上限
+var ErrNestingTooDeep = errors.New("payload nesting depth exceeds the limit")
+
+// maxNestingDepth 写入 table 和 record 时允许的最大嵌套层级，0 表示不限制，
+// 嵌套过深的数据会让之后的 SearchItem 和 DeepMerge 递归处理的开销变得不可控，所以在写入的时候就拒绝。
+var maxNestingDepth atomic.Int64
+
+// SetMaxNestingDepth 设置写入 table 和 record 时允许的最大嵌套层级，最外层的 map 深度为 1，0 表示不限制
+func SetMaxNestingDepth(depth int) {
+	maxNestingDepth.Store(int64(depth))
+}
+
+// checkNestingDepth 在写入之前预先扫描一遍数据，超过限制返回 ErrNestingTooDeep
+func checkNestingDepth(data map[string]any) error {
+	limit := int(maxNestingDepth.Load())
+	if utils.ExceedsDepth(data, limit) {
+		return fmt.Errorf("%w of %d", ErrNestingTooDeep, limit)
+	}
+	return nil
+}
@@ -0,0 +1,227 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/auula/urnadb/clog"
+	"github.com/auula/urnadb/types"
+	"github.com/auula/urnadb/vfs"
+)
+
+var (
+	ErrListNotFound       = errors.New("list not found")
+	ErrListExpired        = errors.New("list ttl is invalid or expired")
+	ErrListEmpty          = errors.New("list is empty")
+	ErrListUpdateConflict = errors.New("list is being updated concurrently, please retry")
+)
+
+// PopOrder 决定 Pop 弹出的是最后追加的元素还是最早追加的元素
+type PopOrder int8
+
+const (
+	PopLIFO PopOrder = iota // 后进先出，从尾部弹出
+	PopFIFO                 // 先进先出，从头部弹出
+)
+
+// listCASRetries 版本号冲突时最多重试的次数
+const listCASRetries = 128
+
+// List 的修改操作不使用服务层的锁，而是基于存储层的版本号做 CAS，
+// 版本号冲突的时候重新读取最新的数据再修改，这样并发的 Push 操作不会丢失其他请求追加的元素。
+// 只有整体覆盖的 CreateList 持有按 key 划分的锁，保证并发创建同一个列表的时候只有一个请求返回新创建。
+type ListsService interface {
+	// 根据列表名获取列表
+	GetList(name string) (*types.List, *Metadata, error)
+	// 创建一个名为 name 的列表，已经存在的列表会被覆盖
+	CreateList(name string, list *types.List, ttl int64, writer string) (bool, error)
+	// 删除一个名为 name 的列表
+	DeleteList(name string) error
+	// 追加元素到列表的尾部，列表不存在的时候使用 ttl 自动创建，返回追加之后的长度
+	Push(name string, values []any, ttl int64, writer string) (int, error)
+	// 按照 order 弹出一个元素
+	Pop(name string, order PopOrder) (any, error)
+}
+
+type ListsServiceImpl struct {
+	storage *vfs.LogStructuredFS
+	llock   sync.Map
+}
+
+func NewListsServiceImpl(storage *vfs.LogStructuredFS) ListsService {
+	return &ListsServiceImpl{
+		storage: storage,
+	}
+}
+
+func (s *ListsServiceImpl) GetList(name string) (*types.List, *Metadata, error) {
+	if !s.storage.IsActive(name) {
+		return nil, nil, ErrListNotFound
+	}
+
+	_, seg, err := s.storage.FetchSegment(name)
+	if err != nil {
+		clog.Errorf("[ListsService.GetList] %v", err)
+		return nil, nil, err
+	}
+
+	defer seg.ReleaseToPool()
+
+	list, err := seg.ToList()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return list, NewMetadata(seg), nil
+}
+
+// acquireListLock 获取 name 对应的列表锁，只有 CreateList 使用
+func (s *ListsServiceImpl) acquireListLock(name string) *sync.Mutex {
+	val, _ := s.llock.LoadOrStore(name, new(sync.Mutex))
+	return val.(*sync.Mutex)
+}
+
+func (s *ListsServiceImpl) CreateList(name string, list *types.List, ttl int64, writer string) (bool, error) {
+	mu := lockKey(&s.llock, name, s.acquireListLock)
+	defer mu.Unlock()
+
+	seg, err := vfs.AcquirePoolSegment(name, list, ttl)
+	if err != nil {
+		clog.Errorf("[ListsService.CreateList] %v", err)
+		return false, err
+	}
+
+	defer seg.ReleaseToPool()
+
+	seg.Writer = writer
+
+	// 持有列表锁的时候检查，并发创建同一个列表的请求只有一个会得到 true
+	created := !s.storage.IsActive(name)
+	return created, s.storage.PutSegment(name, seg)
+}
+
+func (s *ListsServiceImpl) DeleteList(name string) error {
+	if !s.storage.IsActive(name) {
+		return ErrListNotFound
+	}
+
+	return s.storage.DeleteSegment(name)
+}
+
+func (s *ListsServiceImpl) Push(name string, values []any, ttl int64, writer string) (int, error) {
+	// 列表不存在的时候原子的创建，创建失败说明被其他请求抢先创建了，走下面的 CAS 追加流程
+	if !s.storage.IsActive(name) {
+		list := types.NewList(values...)
+		seg, err := vfs.AcquirePoolSegment(name, list, ttl)
+		if err != nil {
+			clog.Errorf("[ListsService.Push] %v", err)
+			return 0, err
+		}
+
+		seg.Writer = writer
+		ok, err := s.storage.PutSegmentIfAbsent(name, seg)
+		seg.ReleaseToPool()
+		if err != nil {
+			return 0, err
+		}
+
+		if ok {
+			return list.Size(), nil
+		}
+	}
+
+	var size int
+	err := s.updateList(name, writer, func(list *types.List) error {
+		size = list.Push(values...)
+		return nil
+	})
+
+	return size, err
+}
+
+func (s *ListsServiceImpl) Pop(name string, order PopOrder) (any, error) {
+	var value any
+	err := s.updateList(name, "", func(list *types.List) error {
+		var ok bool
+		if order == PopFIFO {
+			value, ok = list.PopFront()
+		} else {
+			value, ok = list.PopBack()
+		}
+
+		if !ok {
+			return ErrListEmpty
+		}
+
+		return nil
+	})
+
+	return value, err
+}
+
+// updateList 通过 CAS 执行读取-修改-写入，写入时版本号已经变化说明有其他请求修改了列表，重新读取最新的数据重试，
+// writer 为空的时候沿用之前的写入者。
+func (s *ListsServiceImpl) updateList(name string, writer string, modify func(list *types.List) error) error {
+	return retryCAS(listCASRetries, ErrListUpdateConflict, func() (bool, error) {
+		if !s.storage.IsActive(name) {
+			return false, ErrListNotFound
+		}
+
+		version, seg, err := s.storage.FetchSegment(name)
+		if err != nil {
+			return false, err
+		}
+
+		list, err := seg.ToList()
+		if err != nil {
+			seg.ReleaseToPool()
+			return false, err
+		}
+
+		defer list.ReleaseToPool()
+
+		ttl, ok := seg.ExpiresIn()
+		previous := seg.Writer
+		seg.ReleaseToPool()
+		if !ok {
+			return false, ErrListExpired
+		}
+
+		err = modify(list)
+		if err != nil {
+			return false, err
+		}
+
+		seg, err = vfs.AcquirePoolSegment(name, list, ttl)
+		if err != nil {
+			clog.Errorf("[ListsService.updateList] %v", err)
+			return false, err
+		}
+
+		defer seg.ReleaseToPool()
+
+		seg.Writer = carryWriter(writer, previous)
+
+		swapped, err := s.storage.CompareAndSwapSegment(name, version, seg)
+		if err != nil {
+			clog.Errorf("[ListsService.updateList] %v", err)
+			return false, err
+		}
+
+		return swapped, nil
+	})
+}
@@ -16,7 +16,10 @@ package service
 
 import (
 	"errors"
+	"fmt"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/auula/urnadb/clog"
@@ -30,11 +33,23 @@ var (
 	ErrLockNotFound    = errors.New("resource lock not found")
 	ErrInvalidToken    = errors.New("invalid lock token")
 	ErrInvalidLeaseTTL = errors.New("lock lifetime must not be negative")
+	// ErrLeaseRenewalLimit 续租的次数达到了 SetMaxLeaseRenewals 设置的上限，客户端需要释放之后重新获取锁
+	ErrLeaseRenewalLimit = errors.New("lease renewal limit reached")
 )
 
+// maxLeaseRenewals 一把锁最多可以续租的次数，0 表示不限制，
+// 避免有问题的客户端不断续租永久持有锁，让租期的保护失去意义。
+var maxLeaseRenewals atomic.Int64
+
+// SetMaxLeaseRenewals 设置一把锁从获取之后最多可以续租的次数，0 表示不限制
+func SetMaxLeaseRenewals(n int) {
+	maxLeaseRenewals.Store(int64(n))
+}
+
 type LocksService interface {
 	ReleaseLock(name string, token string) error
 	AcquireLock(name string, ttl int64) (*types.LeaseLock, error)
+	AcquireLocks(names []string, ttl int64) (map[string]*types.LeaseLock, error)
 	DoLeaseLock(name string, token string) (*types.LeaseLock, error)
 }
 
@@ -60,11 +75,11 @@ func (s *LeaseLockService) ReleaseLock(name string, token string) error {
 		return ErrLockNotFound
 	}
 
-	s.acquireLeaseLock(name).Lock()
+	mu := lockKey(&s.atomicLeaseLocks, name, s.acquireLeaseLock)
 
 	_, seg, err := s.storage.FetchSegment(name)
 	if err != nil {
-		s.acquireLeaseLock(name).Unlock()
+		mu.Unlock()
 		clog.Errorf("[LocksService.ReleaseLock] %v", err)
 		return err
 	}
@@ -72,7 +87,7 @@ func (s *LeaseLockService) ReleaseLock(name string, token string) error {
 	slock, err := seg.ToLeaseLock()
 	if err != nil {
 		seg.ReleaseToPool()
-		s.acquireLeaseLock(name).Unlock()
+		mu.Unlock()
 		clog.Errorf("[LocksService.ReleaseLock] %v", err)
 		return err
 	}
@@ -80,19 +95,19 @@ func (s *LeaseLockService) ReleaseLock(name string, token string) error {
 	defer utils.ReleaseToPool(seg, slock)
 
 	if slock.Token != token {
-		s.acquireLeaseLock(name).Unlock()
+		mu.Unlock()
 		return ErrInvalidToken
 	}
 
 	err = s.storage.DeleteSegment(name)
 	if err != nil {
-		s.acquireLeaseLock(name).Unlock()
+		mu.Unlock()
 		clog.Errorf("[LocksService.ReleaseLock] %v", err)
 		return err
 	}
 
-	s.acquireLeaseLock(name).Unlock()
-	s.atomicLeaseLocks.Delete(name)
+	s.atomicLeaseLocks.CompareAndDelete(name, mu)
+	mu.Unlock()
 	return nil
 }
 
@@ -102,8 +117,8 @@ func (s *LeaseLockService) AcquireLock(name string, ttl int64) (*types.LeaseLock
 		return nil, ErrAlreadyLocked
 	}
 
-	s.acquireLeaseLock(name).Lock()
-	defer s.acquireLeaseLock(name).Unlock()
+	mu := lockKey(&s.atomicLeaseLocks, name, s.acquireLeaseLock)
+	defer mu.Unlock()
 
 	if ttl < 0 {
 		return nil, ErrInvalidLeaseTTL
@@ -121,8 +136,8 @@ func (s *LeaseLockService) AcquireLock(name string, ttl int64) (*types.LeaseLock
 		return nil, err
 	}
 
-	// 持久化这把租期锁
-	err = s.storage.PutSegment(name, seg)
+	// 持久化这把租期锁，锁的写入丢失会导致两个客户端都认为自己持有锁，所以必须 fsync 之后才能返回
+	err = s.storage.PutSegmentSync(name, seg)
 	if err != nil {
 		utils.ReleaseToPool(lease, seg)
 		clog.Errorf("[LocksService.AcquireLock] %v", err)
@@ -134,6 +149,80 @@ func (s *LeaseLockService) AcquireLock(name string, ttl int64) (*types.LeaseLock
 	return lease, nil
 }
 
+// AcquireLocks 原子性的获取多把锁，要么全部获取成功，要么一把都不持有。
+// 按照 key 排序之后依次加锁避免两个请求交叉持有对方需要的锁导致死锁，其中任意一把锁已经被持有的时候，
+// 把本次已经获取到的锁全部删除掉回滚，然后返回 ErrAlreadyLocked。
+func (s *LeaseLockService) AcquireLocks(names []string, ttl int64) (map[string]*types.LeaseLock, error) {
+	if ttl < 0 {
+		return nil, ErrInvalidLeaseTTL
+	}
+
+	keys := make([]string, 0, len(names))
+	seen := make(map[string]bool, len(names))
+	for _, name := range names {
+		if !seen[name] {
+			seen[name] = true
+			keys = append(keys, name)
+		}
+	}
+	sort.Strings(keys)
+
+	held := make([]*sync.Mutex, 0, len(keys))
+	for _, key := range keys {
+		held = append(held, lockKey(&s.atomicLeaseLocks, key, s.acquireLeaseLock))
+	}
+	defer func() {
+		for _, mu := range held {
+			mu.Unlock()
+		}
+	}()
+
+	leases := make(map[string]*types.LeaseLock, len(keys))
+	rollback := func() {
+		for key, lease := range leases {
+			err := s.storage.DeleteSegment(key)
+			if err != nil {
+				clog.Errorf("[LocksService.AcquireLocks] rollback %s: %v", key, err)
+			}
+			lease.ReleaseToPool()
+		}
+	}
+
+	for _, key := range keys {
+		lease := types.AcquireLeaseLock()
+		lease.Token = utils.NewULID()
+
+		seg, err := vfs.AcquirePoolSegment(key, lease, ttl)
+		if err != nil {
+			utils.ReleaseToPool(lease)
+			rollback()
+			clog.Errorf("[LocksService.AcquireLocks] %v", err)
+			return nil, err
+		}
+
+		// 存在性检查和写入在存储层的同一个临界区内完成，和单独加锁的请求之间也不会互相覆盖，
+		// 和单独加锁一样必须 fsync 之后才能返回
+		ok, err := s.storage.PutSegmentIfAbsentSync(key, seg)
+		seg.ReleaseToPool()
+		if err != nil {
+			utils.ReleaseToPool(lease)
+			rollback()
+			clog.Errorf("[LocksService.AcquireLocks] %v", err)
+			return nil, err
+		}
+
+		if !ok {
+			utils.ReleaseToPool(lease)
+			rollback()
+			return nil, fmt.Errorf("%w: %s", ErrAlreadyLocked, key)
+		}
+
+		leases[key] = lease
+	}
+
+	return leases, nil
+}
+
 // 续租一定要注意服务器中途宕机了，客户端还认为服务器还活着，客户端也要有一个超时，如果超时了客户端抛出异常准备回滚。
 // 正常续租成功了，应该更换客户端的 token 凭证，解锁的时候需要使用这个 token 作为凭证。
 func (s *LeaseLockService) DoLeaseLock(name string, token string) (*types.LeaseLock, error) {
@@ -141,8 +230,8 @@ func (s *LeaseLockService) DoLeaseLock(name string, token string) (*types.LeaseL
 		return nil, ErrLockNotFound
 	}
 
-	s.acquireLeaseLock(name).Lock()
-	defer s.acquireLeaseLock(name).Unlock()
+	mu := lockKey(&s.atomicLeaseLocks, name, s.acquireLeaseLock)
+	defer mu.Unlock()
 
 	_, seg, err := s.storage.FetchSegment(name)
 	if err != nil {
@@ -163,10 +252,15 @@ func (s *LeaseLockService) DoLeaseLock(name string, token string) (*types.LeaseL
 		return nil, ErrInvalidToken
 	}
 
+	if limit := maxLeaseRenewals.Load(); limit > 0 && int64(old.Renewals) >= limit {
+		return nil, fmt.Errorf("%w of %d", ErrLeaseRenewalLimit, limit)
+	}
+
 	// 创建一把新租期锁并且设置锁的租期，租期锁一定有存活时间的，默认是续租期 10s 秒
 	newlease := types.AcquireLeaseLock()
 	// 更换新的 Token 凭证
 	newlease.Token = utils.NewULID()
+	newlease.Renewals = old.Renewals + 1
 
 	newttl := int64(10)
 	if seg.ExpiredAt > 0 {
@@ -182,7 +276,8 @@ func (s *LeaseLockService) DoLeaseLock(name string, token string) (*types.LeaseL
 		return nil, err
 	}
 
-	err = s.storage.PutSegment(name, seg)
+	// 续租之后客户端只持有新的 token，写入丢失之后客户端会拿着一个不存在的凭证，所以同样需要 fsync
+	err = s.storage.PutSegmentSync(name, seg)
 	if err != nil {
 		clog.Errorf("[LocksService.DoLeaseLock] %v", err)
 		return nil, err
@@ -15,13 +15,72 @@
 package service
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/auula/urnadb/types"
+	"github.com/auula/urnadb/utils"
 	"github.com/auula/urnadb/vfs"
 )
 
+// Metadata 是从 Segment 头部中取出的元信息，查询数据的时候一起返回给上层，
+// 客户端可以根据创建时间自己计算数据的存活时长或者实现自己的过期淘汰逻辑。
+type Metadata struct {
+	CreatedAt int64
+	ExpiredAt int64
+	// ValueSize 是解码之后 value 的字节长度，StoredSize 是 value 经过压缩和加密之后写入磁盘的长度
+	ValueSize  uint32
+	StoredSize int32
+	// Writer 是写入时 X-Writer-Id 请求头中的写入者标识，没有设置的时候为空
+	Writer string
+}
+
+// NewMetadata 从 seg 中构建元信息，必须在 seg 归还到对象池之前调用
+func NewMetadata(seg *vfs.Segment) *Metadata {
+	createdAt, expiredAt := seg.GetExpiryMeta()
+	_, valueSize := seg.Payload()
+	return &Metadata{
+		CreatedAt:  createdAt,
+		ExpiredAt:  expiredAt,
+		ValueSize:  valueSize,
+		StoredSize: seg.ValueSize,
+		Writer:     seg.Writer,
+	}
+}
+
+// Created 返回数据的创建时间，存储层中保存的是 UnixMicro
+func (m *Metadata) Created() time.Time {
+	return time.UnixMicro(m.CreatedAt)
+}
+
+// Age 返回数据从创建到现在的存活时长，单位秒
+func (m *Metadata) Age() int64 {
+	return int64(time.Since(m.Created()).Seconds())
+}
+
 type QueryService interface {
 	QuerySegment(name string) (version uint64, seg *vfs.Segment, err error)
+	GetDecoded(name string) (*DecodedValue, error)
+	Version(name string) (uint64, bool)
+	VersionStamp(name string) (int64, uint64, bool)
+	ExpireKeys(ctx context.Context, keys []string, ttl int64) (int, error)
+	Exists(keys []string) map[string]bool
+	ExpiringKeys(ctx context.Context, within time.Duration) ([]vfs.KeyTTL, error)
+	History(name string, limit int) ([]vfs.SegmentVersion, error)
+	Swap(name string, kind string, value any, ttl int64, keepTTL bool) (*vfs.Segment, error)
+	DeleteIfEquals(name string, expected any) error
 }
 
+var (
+	// ErrInvalidSwapValue 请求中的值和声明的类型不一致
+	ErrInvalidSwapValue = errors.New("swap value does not match the declared type")
+	// ErrValueMismatch 条件删除时 key 当前的值和期望的值不一致
+	ErrValueMismatch = errors.New("current value does not match the expected value")
+)
+
 type QueryServiceImpl struct {
 	storage *vfs.LogStructuredFS
 }
@@ -35,3 +94,221 @@ func NewQueryServiceImpl(storage *vfs.LogStructuredFS) QueryService {
 func (q *QueryServiceImpl) QuerySegment(name string) (version uint64, seg *vfs.Segment, err error) {
 	return q.storage.FetchSegment(name)
 }
+
+// DecodedValue 是按照类型解码之后的值，Value 是 table、record 对应的 map，list 对应的切片或者 variant 的标量，
+// 不包含任何编码之后的字节数据，TTL 为剩余的存活秒数，-1 表示永不过期。
+type DecodedValue struct {
+	Type  string
+	Value any
+	TTL   int64
+	MVCC  uint64
+	Meta  *Metadata
+}
+
+// GetDecoded 读取 name 并且按照数据类型解码为原生的 Go 值，通用的查询接口不需要关心具体的数据类型
+func (q *QueryServiceImpl) GetDecoded(name string) (*DecodedValue, error) {
+	version, seg, err := q.storage.FetchSegment(name)
+	if err != nil {
+		// 只有不存在和已经过期的 key 返回 404，其他的读取错误保留原始错误，由控制器映射为对应的状态码
+		if isMissing(err) {
+			return nil, fmt.Errorf("%w: %v", ErrSegmentNotFound, err)
+		}
+		return nil, fmt.Errorf("failed to read %s: %w", name, err)
+	}
+
+	defer seg.ReleaseToPool()
+
+	value, err := DecodeValue(seg)
+	if err != nil {
+		return nil, err
+	}
+
+	ttl, _ := seg.ExpiresIn()
+
+	return &DecodedValue{
+		Type:  seg.TypeString(),
+		Value: value,
+		TTL:   ttl,
+		MVCC:  version,
+		Meta:  NewMetadata(seg),
+	}, nil
+}
+
+// Version 返回 name 当前的版本号，只查询内存索引，用于条件请求的快速判断
+func (q *QueryServiceImpl) Version(name string) (uint64, bool) {
+	return q.storage.Version(name)
+}
+
+// VersionStamp 返回 key 当前版本的创建时间和版本号，只查询内存索引
+func (q *QueryServiceImpl) VersionStamp(name string) (int64, uint64, bool) {
+	return q.storage.VersionStamp(name)
+}
+
+// Exists 批量判断 keys 是否存在并且没有过期，只查询内存索引，不读取任何值
+func (q *QueryServiceImpl) Exists(keys []string) map[string]bool {
+	return q.storage.HasSegments(keys)
+}
+
+// ExpireKeys 批量刷新 keys 的过期时间，返回实际更新的 key 数量
+func (q *QueryServiceImpl) ExpireKeys(ctx context.Context, keys []string, ttl int64) (int, error) {
+	return q.storage.ExpireMany(ctx, keys, ttl)
+}
+
+// ExpiringKeys 返回 within 时间窗口内即将过期的 key
+func (q *QueryServiceImpl) ExpiringKeys(ctx context.Context, within time.Duration) ([]vfs.KeyTTL, error) {
+	return q.storage.ExpiringWithin(ctx, within)
+}
+
+// History 返回 key 在垃圾回收之前残留在 region 中的历史版本，从新到旧排序
+func (q *QueryServiceImpl) History(name string, limit int) ([]vfs.SegmentVersion, error) {
+	return q.storage.History(name, limit)
+}
+
+// Swap 原子性的替换 name 的值并且返回替换之前的 segment，kind 为 variant、record 或者 list，name 不存在的时候返回 nil
+func (q *QueryServiceImpl) Swap(name string, kind string, value any, ttl int64, keepTTL bool) (*vfs.Segment, error) {
+	var (
+		seg *vfs.Segment
+		err error
+	)
+	switch kind {
+	case "variant":
+		variant := types.AcquireVariant()
+		defer variant.ReleaseToPool()
+		variant.Value = value
+		if !variant.IsVariant() {
+			return nil, ErrInvalidSwapValue
+		}
+		seg, err = vfs.AcquirePoolSegment(name, variant, ttl)
+	case "record":
+		items, ok := value.(map[string]any)
+		if !ok {
+			return nil, ErrInvalidSwapValue
+		}
+		record := types.AcquireRecord()
+		defer record.ReleaseToPool()
+		record.Record = items
+		seg, err = vfs.AcquirePoolSegment(name, record, ttl)
+	case "list":
+		items, ok := value.([]any)
+		if !ok {
+			return nil, ErrInvalidSwapValue
+		}
+		list := types.AcquireList()
+		defer list.ReleaseToPool()
+		list.List = items
+		seg, err = vfs.AcquirePoolSegment(name, list, ttl)
+	default:
+		return nil, ErrInvalidSwapValue
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	defer utils.ReleaseToPool(seg)
+
+	return q.storage.Swap(name, seg, keepTTL)
+}
+
+// DeleteIfEquals 只有在 name 当前的值和 expected 相同的时候才删除 name，值按照 JSON 的语义比较，
+// 和 GET /query/:key 返回的 value 一致，map 中字段的顺序不影响比较的结果。租约锁的值不对外暴露，不能通过这种方式删除。
+func (q *QueryServiceImpl) DeleteIfEquals(name string, expected any) error {
+	want, err := normalizeJSON(expected)
+	if err != nil {
+		return err
+	}
+
+	found := false
+	deleted, err := q.storage.DeleteIf(name, func(seg *vfs.Segment) (bool, error) {
+		found = true
+		if seg.TypeString() == "LEASELOCK" {
+			return false, nil
+		}
+
+		value, err := DecodeValue(seg)
+		if err != nil {
+			return false, err
+		}
+
+		current, err := normalizeJSON(value)
+		if err != nil {
+			return false, err
+		}
+
+		return reflect.DeepEqual(current, want), nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if !found {
+		return fmt.Errorf("%w: %s", ErrSegmentNotFound, name)
+	}
+
+	if !deleted {
+		return ErrValueMismatch
+	}
+
+	return nil
+}
+
+// normalizeJSON 把 v 转换为 JSON 解码之后的通用结构，消除数字类型和结构体之间的差异
+func normalizeJSON(v any) (any, error) {
+	data, err := types.MarshalJSON(v)
+	if err != nil {
+		return nil, err
+	}
+
+	var normalized any
+	err = types.UnmarshalJSON(data, &normalized)
+	if err != nil {
+		return nil, err
+	}
+
+	return normalized, nil
+}
+
+// DecodeValue 根据 segment 的类型把值完整的解码为对应的数据结构，这样通用的查询接口的客户端不需要提前知道数据的类型，
+// 租约锁的值就是释放锁的 token，不能通过查询接口泄露出去，所以直接返回 nil。
+func DecodeValue(seg *vfs.Segment) (any, error) {
+	switch seg.TypeString() {
+	case "VARIANT":
+		variant, err := seg.ToVariant()
+		if err != nil {
+			return nil, err
+		}
+		defer variant.ReleaseToPool()
+		return variant.Value, nil
+	case "RECORD":
+		record, err := seg.ToRecord()
+		if err != nil {
+			return nil, err
+		}
+		defer record.ReleaseToPool()
+		return record.Record, nil
+	case "TABLE":
+		table, err := seg.ToTable()
+		if err != nil {
+			return nil, err
+		}
+		defer table.ReleaseToPool()
+		return table.Table, nil
+	case "LIST":
+		list, err := seg.ToList()
+		if err != nil {
+			return nil, err
+		}
+		defer list.ReleaseToPool()
+		return list.List, nil
+	case "TIMESERIES":
+		ts, err := seg.ToTimeSeries()
+		if err != nil {
+			return nil, err
+		}
+		defer ts.ReleaseToPool()
+		return ts.Samples, nil
+	case "LEASELOCK":
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unsupported segment type: %s", seg.TypeString())
+	}
+}
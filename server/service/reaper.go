@@ -0,0 +1,158 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"sync"
+	"time"
+
+	"github.com/auula/urnadb/clog"
+	"github.com/auula/urnadb/vfs"
+)
+
+// KeyLockReaper 由持有按 key 划分的互斥锁的服务实现，ReapLocks 删除底层 key 已经不存在的锁，
+// 返回删除的数量和剩余的数量。
+type KeyLockReaper interface {
+	ReapLocks() (reaped, remaining int)
+}
+
+type tryLocker interface {
+	TryLock() bool
+	Unlock()
+}
+
+// reapKeyLocks 删除 locks 中 key 已经被删除或者过期的锁，正在被持有的锁不会被删除，
+// 删除时正在等待这把锁的请求拿到锁之后会通过 lockKey 发现它已经不在 locks 中并重新获取。
+func reapKeyLocks(locks *sync.Map, storage *vfs.LogStructuredFS) (reaped, remaining int) {
+	locks.Range(func(key, value any) bool {
+		name := key.(string)
+		if storage.IsActive(name) {
+			remaining++
+			return true
+		}
+
+		mu := value.(tryLocker)
+		if !mu.TryLock() {
+			remaining++
+			return true
+		}
+
+		// 加锁之后再检查一次，避免删除刚刚被其他请求创建的 key 对应的锁
+		if !storage.IsActive(name) && locks.CompareAndDelete(key, value) {
+			reaped++
+		} else {
+			remaining++
+		}
+		mu.Unlock()
+		return true
+	})
+	return reaped, remaining
+}
+
+// lockKey 对 acquire 返回的锁加写锁，等待期间这把锁可能已经被 reapKeyLocks 或者删除操作从 locks 中移除，
+// 这时候继续持有它就会和重新创建的锁的持有者并发执行，所以释放之后重新获取，直到加锁的仍然是 locks 中的那一把。
+// 调用者必须使用返回的锁解锁，不能再次调用 acquire。
+func lockKey[M sync.Locker](locks *sync.Map, name string, acquire func(string) M) M {
+	for {
+		mu := acquire(name)
+		mu.Lock()
+		if current, ok := locks.Load(name); ok && current == any(mu) {
+			return mu
+		}
+		mu.Unlock()
+	}
+}
+
+// rlockKey 和 lockKey 相同，加的是读锁
+func rlockKey(locks *sync.Map, name string, acquire func(string) *sync.RWMutex) *sync.RWMutex {
+	for {
+		mu := acquire(name)
+		mu.RLock()
+		if current, ok := locks.Load(name); ok && current == any(mu) {
+			return mu
+		}
+		mu.RUnlock()
+	}
+}
+
+func (s *LeaseLockService) ReapLocks() (int, int) {
+	return reapKeyLocks(&s.atomicLeaseLocks, s.storage)
+}
+
+func (s *ListsServiceImpl) ReapLocks() (int, int) {
+	return reapKeyLocks(&s.llock, s.storage)
+}
+
+func (rs *RecordsServiceImpl) ReapLocks() (int, int) {
+	return reapKeyLocks(&rs.rlock, rs.storage)
+}
+
+func (s *TablesServiceImpl) ReapLocks() (int, int) {
+	return reapKeyLocks(&s.tlock, s.storage)
+}
+
+func (vs *VariantsServiceImpl) ReapLocks() (int, int) {
+	return reapKeyLocks(&vs.vlock, vs.storage)
+}
+
+// LockReaper 在后台按照固定周期清理各个服务中遗留的 key 锁，
+// 被放弃的租约锁或者已经过期的记录只会从索引中删除，不清理的话锁表会无限增长。
+type LockReaper struct {
+	worker  *time.Ticker
+	done    chan struct{}
+	once    sync.Once
+	reapers []KeyLockReaper
+}
+
+func NewLockReaper(interval time.Duration, reapers ...KeyLockReaper) *LockReaper {
+	lr := &LockReaper{
+		worker:  time.NewTicker(interval),
+		done:    make(chan struct{}),
+		reapers: reapers,
+	}
+
+	go func() {
+		for {
+			select {
+			case <-lr.done:
+				return
+			case <-lr.worker.C:
+				reaped := lr.ReapOnce()
+				if reaped > 0 {
+					clog.Debugf("reaped %d orphan key locks", reaped)
+				}
+			}
+		}
+	}()
+
+	return lr
+}
+
+// ReapOnce 立即执行一次清理，返回所有服务中删除的锁的数量
+func (lr *LockReaper) ReapOnce() int {
+	total := 0
+	for _, r := range lr.reapers {
+		reaped, _ := r.ReapLocks()
+		total += reaped
+	}
+	return total
+}
+
+func (lr *LockReaper) Stop() {
+	lr.once.Do(func() {
+		lr.worker.Stop()
+		close(lr.done)
+	})
+}
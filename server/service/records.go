@@ -25,11 +25,17 @@ import (
 )
 
 var (
-	ErrRecordUpdateFailed = errors.New("failed to update record")
-	ErrRecordNotFound     = errors.New("record not found")
-	ErrRecordExpired      = errors.New("record ttl is invalid or expired")
+	ErrRecordUpdateFailed  = errors.New("failed to update record")
+	ErrRecordNotFound      = errors.New("record not found")
+	ErrRecordExpired       = errors.New("record ttl is invalid or expired")
+	ErrRecordAlreadyExists = errors.New("record already exists")
+	// ErrRecordUpdateConflict 修改记录中的字段的时候版本号冲突超过了重试次数
+	ErrRecordUpdateConflict = errors.New("record is being updated concurrently, please retry")
 )
 
+// recordCASRetries 修改记录中的字段的时候版本号冲突最多重试的次数
+const recordCASRetries = 128
+
 // Record 通常直接映射编程语言中的 class 的一条记录，
 // OOP 面向对象编程中的对象可以直接影响为 Record 记录，
 // Record 和 Tables 区别，Record 是一条整体记录，Tables 是一组 Record 组成集合，
@@ -41,16 +47,22 @@ type RecordsService interface {
 	// 删除一条名为 name 的记录
 	DeleteRecord(name string) error
 	// 根据记录名获取到这条记录
-	GetRecord(name string) (*types.Record, error)
+	GetRecord(name string) (*types.Record, *Metadata, error)
 	// Record 一段创建就不可以更改其内容，要更改直接 PUT 新 Record 和 RUW 操作
 	// // 更新记录中的某个字段
 	// PatchRows(name string, data map[string]any) error
 	// // 插入数据到一条记录里面
 	// InsertRows(name string, data map[string]any) error
-	// 创建一条名为 name 的记录
-	CreateRecord(name string, record *types.Record, ttl int64) error
-	// 根据字段搜索一条记录下的某个字段
-	SearchRows(name string, column string) (any, error)
+	// 创建一条名为 name 的记录，已经存在的记录会被覆盖，created 表示之前是否不存在
+	CreateRecord(name string, record *types.Record, ttl int64, writer string) (bool, error)
+	// 只有在记录不存在的时候才创建，已经存在返回 ErrRecordAlreadyExists
+	CreateRecordIfAbsent(name string, record *types.Record, ttl int64, writer string) error
+	// 创建一条不可变的记录，过期之前不能被覆盖或者删除，nx 为 true 的时候只在记录不存在的时候创建
+	CreateImmutableRecord(name string, record *types.Record, ttl int64, nx bool, writer string) (bool, error)
+	// 根据字段搜索一条记录下的某个字段，depth 为最大搜索深度，返回值中的 bool 表示搜索是否被深度限制截断
+	SearchRows(name string, column string, depth int) ([]any, bool, error)
+	// 原子的把记录中 field 指向的数值字段加上 delta，field 使用 . 分隔嵌套的字段，返回新的值
+	IncrementField(name string, field string, delta float64, writer string) (any, error)
 }
 
 type RecordsServiceImpl struct {
@@ -65,39 +77,123 @@ func (rs *RecordsServiceImpl) acquireRecordLock(name string) *sync.RWMutex {
 }
 
 // 创建记录
-func (rs *RecordsServiceImpl) CreateRecord(name string, record *types.Record, ttl int64) error {
-	rs.acquireRecordLock(name).Lock()
-	defer rs.acquireRecordLock(name).Unlock()
+func (rs *RecordsServiceImpl) CreateRecord(name string, record *types.Record, ttl int64, writer string) (bool, error) {
+	err := checkNestingDepth(record.Record)
+	if err != nil {
+		return false, err
+	}
+
+	mu := lockKey(&rs.rlock, name, rs.acquireRecordLock)
+	defer mu.Unlock()
 
 	seg, err := vfs.AcquirePoolSegment(name, record, ttl)
 	if err != nil {
 		clog.Errorf("[RecordsService.CreateRecord] %v", err)
+		return false, err
+	}
+
+	defer seg.ReleaseToPool()
+
+	seg.Writer = writer
+
+	// 持有记录锁的时候检查，通过这个服务写入同一个 key 的请求不会互相干扰
+	created := !rs.storage.IsActive(name)
+	return created, rs.storage.PutSegment(name, seg)
+}
+
+// 原子的创建记录，记录已经存在的时候不会覆盖
+func (rs *RecordsServiceImpl) CreateRecordIfAbsent(name string, record *types.Record, ttl int64, writer string) error {
+	err := checkNestingDepth(record.Record)
+	if err != nil {
+		return err
+	}
+
+	mu := lockKey(&rs.rlock, name, rs.acquireRecordLock)
+	defer mu.Unlock()
+
+	seg, err := vfs.AcquirePoolSegment(name, record, ttl)
+	if err != nil {
+		clog.Errorf("[RecordsService.CreateRecordIfAbsent] %v", err)
 		return err
 	}
 
 	defer seg.ReleaseToPool()
 
-	return rs.storage.PutSegment(name, seg)
+	seg.Writer = writer
+
+	ok, err := rs.storage.PutSegmentIfAbsent(name, seg)
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		return ErrRecordAlreadyExists
+	}
+
+	return nil
+}
+
+// 创建不可变的记录，之后的覆盖和删除都会返回 vfs.ErrImmutable，设置了 ttl 的记录过期之后仍然会被正常淘汰
+func (rs *RecordsServiceImpl) CreateImmutableRecord(name string, record *types.Record, ttl int64, nx bool, writer string) (bool, error) {
+	err := checkNestingDepth(record.Record)
+	if err != nil {
+		return false, err
+	}
+
+	mu := lockKey(&rs.rlock, name, rs.acquireRecordLock)
+	defer mu.Unlock()
+
+	seg, err := vfs.AcquirePoolSegment(name, record, ttl)
+	if err != nil {
+		clog.Errorf("[RecordsService.CreateImmutableRecord] %v", err)
+		return false, err
+	}
+
+	defer seg.ReleaseToPool()
+
+	seg.Immutable = true
+	seg.Writer = writer
+
+	if !nx {
+		created := !rs.storage.IsActive(name)
+		return created, rs.storage.PutSegment(name, seg)
+	}
+
+	ok, err := rs.storage.PutSegmentIfAbsent(name, seg)
+	if err != nil {
+		return false, err
+	}
+
+	if !ok {
+		return false, ErrRecordAlreadyExists
+	}
+
+	return true, nil
 }
 
 // 查询记录
-func (rs *RecordsServiceImpl) GetRecord(name string) (*types.Record, error) {
+func (rs *RecordsServiceImpl) GetRecord(name string) (*types.Record, *Metadata, error) {
 	if !rs.storage.IsActive(name) {
-		return nil, ErrRecordNotFound
+		return nil, nil, ErrRecordNotFound
 	}
 
-	rs.acquireRecordLock(name).Lock()
-	defer rs.acquireRecordLock(name).Unlock()
+	mu := lockKey(&rs.rlock, name, rs.acquireRecordLock)
+	defer mu.Unlock()
 
 	_, seg, err := rs.storage.FetchSegment(name)
 	if err != nil {
 		clog.Errorf("[RecordsService.GetRecord] %v", err)
-		return nil, err
+		return nil, nil, err
 	}
 
 	defer seg.ReleaseToPool()
 
-	return seg.ToRecord()
+	record, err := seg.ToRecord()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return record, NewMetadata(seg), nil
 }
 
 // 删除记录
@@ -106,46 +202,107 @@ func (rs *RecordsServiceImpl) DeleteRecord(name string) error {
 		return ErrRecordNotFound
 	}
 
-	rs.acquireRecordLock(name).Lock()
+	mu := lockKey(&rs.rlock, name, rs.acquireRecordLock)
 
 	err := rs.storage.DeleteSegment(name)
 	if err != nil {
-		rs.acquireRecordLock(name).Unlock()
+		mu.Unlock()
 		clog.Errorf("[RecordsService.DeleteRecord] %v", err)
 		return err
 	}
 
-	rs.acquireRecordLock(name).Unlock()
-	rs.rlock.Delete(name)
+	rs.rlock.CompareAndDelete(name, mu)
+	mu.Unlock()
 
 	return nil
 }
 
 // 根据条件查询字段（简单示例，只支持一层 map）
-func (rs *RecordsServiceImpl) SearchRows(name string, column string) (any, error) {
+func (rs *RecordsServiceImpl) SearchRows(name string, column string, depth int) ([]any, bool, error) {
 	if !rs.storage.IsActive(name) {
-		return nil, ErrRecordNotFound
+		return nil, false, ErrRecordNotFound
 	}
 
-	rs.acquireRecordLock(name).RLock()
-	defer rs.acquireRecordLock(name).RUnlock()
+	mu := rlockKey(&rs.rlock, name, rs.acquireRecordLock)
+	defer mu.RUnlock()
 
 	_, seg, err := rs.storage.FetchSegment(name)
 	if err != nil {
 		clog.Errorf("[RecordsService.SearchRows] %v", err)
-		return nil, err
+		return nil, false, err
 	}
 
 	record, err := seg.ToRecord()
 	if err != nil {
 		clog.Errorf("[RecordsService.SearchRows] %v", err)
-		return nil, err
+		return nil, false, err
 	}
 
 	defer utils.ReleaseToPool(seg, record)
 
 	// 递归深度搜索
-	return record.SearchItem(column), nil
+	results, exceeded := record.SearchItemDepth(column, depth)
+	return results, exceeded, nil
+}
+
+// IncrementField 通过 CAS 原子的修改记录中的一个数值字段，字段不存在的时候会被创建，记录的过期时间保持不变。
+// 持有记录锁避免和这个服务中覆盖整条记录的写入交错，CAS 检测其他路径的并发写入，例如事务提交。
+func (rs *RecordsServiceImpl) IncrementField(name string, field string, delta float64, writer string) (any, error) {
+	mu := lockKey(&rs.rlock, name, rs.acquireRecordLock)
+	defer mu.Unlock()
+
+	var result any
+	err := retryCAS(recordCASRetries, ErrRecordUpdateConflict, func() (bool, error) {
+		version, seg, err := rs.storage.FetchSegment(name)
+		if err != nil {
+			clog.Errorf("[RecordsService.IncrementField] %v", err)
+			if !isMissing(err) {
+				return false, err
+			}
+			if errors.Is(err, vfs.ErrSegmentExpired) {
+				return false, ErrRecordExpired
+			}
+			return false, ErrRecordNotFound
+		}
+
+		ttl, ok := seg.ExpiresIn()
+		if !ok {
+			seg.ReleaseToPool()
+			return false, ErrRecordExpired
+		}
+
+		previous := seg.Writer
+		record, err := seg.ToRecord()
+		seg.ReleaseToPool()
+		if err != nil {
+			clog.Errorf("[RecordsService.IncrementField] %v", err)
+			return false, err
+		}
+
+		defer record.ReleaseToPool()
+
+		result, err = record.IncrementField(field, delta)
+		if err != nil {
+			return false, err
+		}
+
+		seg, err = vfs.AcquirePoolSegment(name, record, ttl)
+		if err != nil {
+			clog.Errorf("[RecordsService.IncrementField] %v", err)
+			return false, err
+		}
+
+		defer seg.ReleaseToPool()
+
+		seg.Writer = carryWriter(writer, previous)
+
+		return rs.storage.CompareAndSwapSegment(name, version, seg)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
 }
 
 func NewRecordsService(storage *vfs.LogStructuredFS) RecordsService {
@@ -40,25 +40,38 @@ var (
 	ErrTableNotFound = errors.New("table not found")
 	// 表已存在
 	ErrTableAlreadyExists = errors.New("table already exists")
+	// 并发修改同一张表，重试之后仍然版本冲突
+	ErrTableUpdateConflict = errors.New("table is being updated concurrently, please retry")
 )
 
+// tableCASRetries 修改表的时候版本号冲突最多重试的次数
+const tableCASRetries = 128
+
 type TablesService interface {
 	// 返回存储层所有的表
 	AllTables() []*types.Table
 	// 根据表名获取到这种表
-	GetTable(name string) (*types.Table, error)
+	GetTable(name string) (*types.Table, *Metadata, error)
 	// 删除一张表名为 name 的表
 	DeleteTable(name string) error
 	// 删除一行记录，有条件的删除
 	RemoveRows(name string, condtitons map[string]any) error
 	// 创建一张表名为 name 的表
-	CreateTable(name string, table *types.Table, ttl int64) error
-	// 更新表中的某个记录，有条件的更新
-	PatchRows(name string, wheres, data map[string]any) error
-	// 插入一行数据到一张表里面
-	InsertRows(name string, rows map[string]any) (uint32, error)
+	CreateTable(name string, table *types.Table, ttl int64, writer string) error
+	// 返回已经存在的表，不存在的时候原子的创建一张空表，返回值中的 bool 表示本次是否创建了新表
+	EnsureTable(name string, ttl int64, writer string) (*types.Table, *Metadata, bool, error)
+	// 更新表中的某个记录，有条件的更新，upsert 为 true 时表不存在或者已过期会使用 ttl 重新创建一张空表
+	PatchRows(name string, wheres, data map[string]any, upsert bool, ttl int64, writer string) error
+	// 插入一行数据到一张表里面，upsert 为 true 时表不存在或者已过期会使用 ttl 重新创建一张空表
+	InsertRows(name string, rows map[string]any, upsert bool, ttl int64, writer string) (uint32, error)
+	// 按照 t_id 批量合并多行数据，已经存在的行深度合并，不存在的行直接添加，返回添加和合并的行数
+	UpsertRows(name string, rows map[uint32]map[string]any, upsert bool, ttl int64, writer string) (inserted, merged int, err error)
 	// 根据表名和子查询条件搜索表
-	QueryRows(name string, wheres map[string]any) ([]map[string]any, error)
+	QueryRows(name string, wheres map[string]any, withIDs bool) ([]map[string]any, error)
+	// 根据表名和子查询条件统计匹配的行数
+	CountRows(name string, wheres map[string]any) (int, error)
+	// 返回表的行数、下一个行号和过期时间等概要信息，不返回行数据
+	TableInfo(name string) (*TableInfo, *Metadata, error)
 	// 事务接口，暂时不支持
 	Transaction(mts []*TableMutation, serialization bool) error
 }
@@ -72,78 +85,57 @@ func (*TablesServiceImpl) AllTables() []*types.Table {
 	return nil
 }
 
-func (t *TablesServiceImpl) GetTable(name string) (*types.Table, error) {
-	t.acquireTablesLock(name).RLock()
-	defer t.acquireTablesLock(name).RUnlock()
+func (t *TablesServiceImpl) GetTable(name string) (*types.Table, *Metadata, error) {
+	mu := rlockKey(&t.tlock, name, t.acquireTablesLock)
+	defer mu.RUnlock()
 
 	_, seg, err := t.storage.FetchSegment(name)
 	if err != nil {
 		clog.Errorf("[TablesService.GetTable] %v", err)
-		return nil, ErrTableNotFound
+		return nil, nil, ErrTableNotFound
 	}
 
 	defer seg.ReleaseToPool()
 
-	return seg.ToTable()
+	table, err := seg.ToTable()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return table, NewMetadata(seg), nil
 }
 
 func (t *TablesServiceImpl) DeleteTable(name string) error {
-	t.acquireTablesLock(name).Lock()
+	mu := lockKey(&t.tlock, name, t.acquireTablesLock)
 
 	err := t.storage.DeleteSegment(name)
 	if err != nil {
-		t.acquireTablesLock(name).Unlock()
+		mu.Unlock()
 		clog.Errorf("[TablesService.DeleteTable] %v", err)
 		return err
 	}
 
-	t.acquireTablesLock(name).Unlock()
-	t.tlock.Delete(name)
+	t.tlock.CompareAndDelete(name, mu)
+	mu.Unlock()
 
 	return nil
 }
 
 func (s *TablesServiceImpl) RemoveRows(name string, condtitons map[string]any) error {
-	s.acquireTablesLock(name).Lock()
-	defer s.acquireTablesLock(name).Unlock()
-
-	_, seg, err := s.storage.FetchSegment(name)
-	if err != nil {
-		return err
-	}
-
-	tab, err := seg.ToTable()
-	if err != nil {
-		clog.Errorf("[TablesService.RemoveRows] %v", err)
-		return err
-	}
-
-	defer utils.ReleaseToPool(tab, seg)
-
-	// 从表里面删除一条记录
-	tab.RemoveRows(condtitons)
-
-	ttl, ok := seg.ExpiresIn()
-	if !ok {
-		return ErrTableExpired
-	}
-
-	seg, err = vfs.AcquirePoolSegment(name, tab, ttl)
-	if err != nil {
-		clog.Errorf("[TablesService.RemoveRows] %v", err)
-		return err
-	}
-
-	return s.storage.PutSegment(name, seg)
+	return s.updateTable(name, false, 0, "", func(tab *types.Table) error {
+		// 从表里面删除一条记录
+		tab.RemoveRows(condtitons)
+		return nil
+	})
 }
 
-func (s *TablesServiceImpl) CreateTable(name string, table *types.Table, ttl int64) error {
+func (s *TablesServiceImpl) CreateTable(name string, table *types.Table, ttl int64, writer string) error {
 	if s.storage.IsActive(name) {
 		return ErrTableAlreadyExists
 	}
 
-	s.acquireTablesLock(name).Lock()
-	defer s.acquireTablesLock(name).Unlock()
+	mu := lockKey(&s.tlock, name, s.acquireTablesLock)
+	defer mu.Unlock()
 
 	seg, err := vfs.AcquirePoolSegment(name, table, ttl)
 	if err != nil {
@@ -153,41 +145,80 @@ func (s *TablesServiceImpl) CreateTable(name string, table *types.Table, ttl int
 
 	defer utils.ReleaseToPool(table, seg)
 
+	seg.Writer = writer
+
 	return s.storage.PutSegment(name, seg)
 }
 
-func (s *TablesServiceImpl) InsertRows(name string, rows map[string]any) (uint32, error) {
-	s.acquireTablesLock(name).Lock()
-	defer s.acquireTablesLock(name).Unlock()
+// EnsureTable 基于 PutSegmentIfAbsent 实现，并发的多个请求只有一个会创建新表，其他请求读取到的都是同一张表，
+// 创建失败说明被其他请求抢先创建了，重新读取一次即可，key 已经被其他类型的数据占用时返回 vfs.ErrTypeMismatch。
+func (s *TablesServiceImpl) EnsureTable(name string, ttl int64, writer string) (*types.Table, *Metadata, bool, error) {
+	var (
+		tab     *types.Table
+		meta    *Metadata
+		created bool
+	)
+
+	err := retryCAS(tableCASRetries, ErrTableUpdateConflict, func() (bool, error) {
+		_, seg, err := s.storage.FetchSegment(name)
+		if err == nil {
+			defer seg.ReleaseToPool()
+
+			tab, err = seg.ToTable()
+			if err != nil {
+				return false, err
+			}
 
-	_, seg, err := s.storage.FetchSegment(name)
-	if err != nil {
-		return 0, err
-	}
+			meta = NewMetadata(seg)
+			return true, nil
+		}
 
-	tab, err := seg.ToTable()
-	if err != nil {
-		clog.Errorf("[TablesService.InsertRows] %v", err)
-		return 0, err
-	}
+		// 只有表不存在或者已经过期的时候才创建，其他的读取错误说明 inode 仍然存在，创建永远不会成功
+		if !isMissing(err) {
+			clog.Errorf("[TablesService.EnsureTable] %v", err)
+			return false, err
+		}
 
-	defer utils.ReleaseToPool(tab, seg)
+		empty := types.AcquireTable()
+		seg, err = vfs.AcquirePoolSegment(name, empty, ttl)
+		if err != nil {
+			empty.ReleaseToPool()
+			clog.Errorf("[TablesService.EnsureTable] %v", err)
+			return false, err
+		}
 
-	// 插入数据到表里面返回一个数据 ID
-	id := tab.AddRows(rows)
+		defer seg.ReleaseToPool()
 
-	ttl, ok := seg.ExpiresIn()
-	if !ok {
-		return 0, ErrTableExpired
+		seg.Writer = writer
+
+		ok, err := s.storage.PutSegmentIfAbsent(name, seg)
+		if err != nil || !ok {
+			empty.ReleaseToPool()
+			return false, err
+		}
+
+		tab, meta, created = empty, NewMetadata(seg), true
+		return true, nil
+	})
+	if err != nil {
+		return nil, nil, false, err
 	}
 
-	seg, err = vfs.AcquirePoolSegment(name, tab, ttl)
+	return tab, meta, created, nil
+}
+
+func (s *TablesServiceImpl) InsertRows(name string, rows map[string]any, upsert bool, ttl int64, writer string) (uint32, error) {
+	err := checkNestingDepth(rows)
 	if err != nil {
-		clog.Errorf("[TablesService.InsertRows] %v", err)
 		return 0, err
 	}
 
-	err = s.storage.PutSegment(name, seg)
+	var id uint32
+	err = s.updateTable(name, upsert, ttl, writer, func(tab *types.Table) error {
+		// 插入数据到表里面返回一个数据 ID
+		id = tab.AddRows(rows)
+		return nil
+	})
 	if err != nil {
 		clog.Errorf("[TablesService.InsertRows] %v", err)
 		return 0, err
@@ -196,47 +227,131 @@ func (s *TablesServiceImpl) InsertRows(name string, rows map[string]any) (uint32
 	return id, nil
 }
 
-func (s *TablesServiceImpl) PatchRows(name string, conditions, data map[string]any) error {
-	s.acquireTablesLock(name).Lock()
-	defer s.acquireTablesLock(name).Unlock()
-
-	_, seg, err := s.storage.FetchSegment(name)
-	if err != nil {
-		return err
+func (s *TablesServiceImpl) UpsertRows(name string, rows map[uint32]map[string]any, upsert bool, ttl int64, writer string) (int, int, error) {
+	for _, row := range rows {
+		err := checkNestingDepth(row)
+		if err != nil {
+			return 0, 0, err
+		}
 	}
 
-	tab, err := seg.ToTable()
+	var inserted, merged int
+	err := s.updateTable(name, upsert, ttl, writer, func(tab *types.Table) error {
+		// CAS 冲突之后会基于最新的表重新执行，所以每次都重新统计
+		inserted, merged = tab.UpsertRows(rows)
+		return nil
+	})
 	if err != nil {
-		clog.Errorf("[TablesService.PatchRows] %v", err)
-		return err
+		clog.Errorf("[TablesService.UpsertRows] %v", err)
+		return 0, 0, err
 	}
 
-	defer utils.ReleaseToPool(tab, seg)
+	return inserted, merged, nil
+}
 
-	// 根据条件来更新，可以是基于默认的 t_id 和类似于 SQL 条件的
-	err = tab.UpdateRows(conditions, data)
+func (s *TablesServiceImpl) PatchRows(name string, conditions, data map[string]any, upsert bool, ttl int64, writer string) error {
+	err := checkNestingDepth(data)
 	if err != nil {
-		clog.Errorf("[TablesService.PatchRows] %v", err)
 		return err
 	}
 
-	ttl, ok := seg.ExpiresIn()
-	if !ok {
-		return ErrTableExpired
+	return s.updateTable(name, upsert, ttl, writer, func(tab *types.Table) error {
+		// 根据条件来更新，可以是基于默认的 t_id 和类似于 SQL 条件的
+		err := tab.UpdateRows(conditions, data)
+		if err != nil {
+			clog.Errorf("[TablesService.PatchRows] %v", err)
+		}
+		return err
+	})
+}
+
+// updateTable 通过 CAS 执行表的读取-修改-写入，服务层的锁只能保护同一个进程内经过 TablesService 的写入，
+// 这里基于存储层的版本号检测其他路径的并发写入，冲突之后重新读取最新的表再执行 modify，所以 modify 可能会被调用多次。
+// FetchSegment 读到过期的表会直接删除索引，所以之后再写入只能看到表不存在，
+// upsert 为 true 的时候这两种情况都会原子的使用 ttl 创建一张新表，否则分别返回 ErrTableExpired 和 ErrTableNotFound。
+// writer 为空的时候重写的表沿用之前的写入者。
+func (s *TablesServiceImpl) updateTable(name string, upsert bool, ttl int64, writer string, modify func(tab *types.Table) error) error {
+	return retryCAS(tableCASRetries, ErrTableUpdateConflict, func() (bool, error) {
+		version, seg, err := s.storage.FetchSegment(name)
+		if err != nil {
+			if upsert && isMissing(err) {
+				return s.createTableIfAbsent(name, ttl, writer, modify)
+			}
+			clog.Errorf("[TablesService.updateTable] %v", err)
+			if !isMissing(err) {
+				return false, err
+			}
+			if errors.Is(err, vfs.ErrSegmentExpired) {
+				return false, ErrTableExpired
+			}
+			return false, ErrTableNotFound
+		}
+
+		remaining, ok := seg.ExpiresIn()
+		if !ok {
+			seg.ReleaseToPool()
+			if upsert {
+				return s.createTableIfAbsent(name, ttl, writer, modify)
+			}
+			return false, ErrTableExpired
+		}
+
+		previous := seg.Writer
+		tab, err := seg.ToTable()
+		seg.ReleaseToPool()
+		if err != nil {
+			clog.Errorf("[TablesService.updateTable] %v", err)
+			return false, err
+		}
+
+		defer tab.ReleaseToPool()
+
+		err = modify(tab)
+		if err != nil {
+			return false, err
+		}
+
+		seg, err = vfs.AcquirePoolSegment(name, tab, remaining)
+		if err != nil {
+			clog.Errorf("[TablesService.updateTable] %v", err)
+			return false, err
+		}
+
+		defer seg.ReleaseToPool()
+
+		seg.Writer = carryWriter(writer, previous)
+
+		return s.storage.CompareAndSwapSegment(name, version, seg)
+	})
+}
+
+// createTableIfAbsent 在表不存在的时候使用 ttl 创建一张新表并执行 modify，创建失败说明被其他写入者抢先创建了，返回 false 重试
+func (s *TablesServiceImpl) createTableIfAbsent(name string, ttl int64, writer string, modify func(tab *types.Table) error) (bool, error) {
+	tab := types.AcquireTable()
+	defer tab.ReleaseToPool()
+
+	err := modify(tab)
+	if err != nil {
+		return false, err
 	}
 
-	seg, err = vfs.AcquirePoolSegment(name, tab, ttl)
+	seg, err := vfs.AcquirePoolSegment(name, tab, ttl)
 	if err != nil {
-		clog.Errorf("[TablesService.PatchRows] %v", err)
-		return err
+		clog.Errorf("[TablesService.createTableIfAbsent] %v", err)
+		return false, err
 	}
 
-	return s.storage.PutSegment(name, seg)
+	defer seg.ReleaseToPool()
+
+	seg.Writer = writer
+
+	return s.storage.PutSegmentIfAbsent(name, seg)
 }
 
-func (s *TablesServiceImpl) QueryRows(name string, wheres map[string]any) ([]map[string]any, error) {
-	s.acquireTablesLock(name).RLock()
-	defer s.acquireTablesLock(name).RUnlock()
+// QueryRows 查询满足 wheres 条件的行，withIDs 为 true 的时候每一行都会带上 t_id 字段
+func (s *TablesServiceImpl) QueryRows(name string, wheres map[string]any, withIDs bool) ([]map[string]any, error) {
+	mu := rlockKey(&s.tlock, name, s.acquireTablesLock)
+	defer mu.RUnlock()
 
 	_, seg, err := s.storage.FetchSegment(name)
 	if err != nil {
@@ -253,9 +368,70 @@ func (s *TablesServiceImpl) QueryRows(name string, wheres map[string]any) ([]map
 	defer utils.ReleaseToPool(tab, seg)
 
 	// 类似于 SQL 的 AND 多条件查询一样
+	if withIDs {
+		return tab.SelectRowsWithIDs(wheres), nil
+	}
 	return tab.SelectRowsAll(wheres), nil
 }
 
+func (s *TablesServiceImpl) CountRows(name string, wheres map[string]any) (int, error) {
+	mu := rlockKey(&s.tlock, name, s.acquireTablesLock)
+	defer mu.RUnlock()
+
+	_, seg, err := s.storage.FetchSegment(name)
+	if err != nil {
+		clog.Errorf("[TablesService.CountRows] %v", err)
+		return 0, ErrTableNotFound
+	}
+
+	tab, err := seg.ToTable()
+	if err != nil {
+		clog.Errorf("[TablesService.CountRows] %v", err)
+		return 0, err
+	}
+
+	defer utils.ReleaseToPool(tab, seg)
+
+	return tab.CountRows(wheres), nil
+}
+
+// TableInfo 是一张表的概要信息，TTL 为剩余的存活秒数，-1 表示永不过期
+type TableInfo struct {
+	Size   int
+	NextID uint32
+	TTL    int64
+}
+
+func (s *TablesServiceImpl) TableInfo(name string) (*TableInfo, *Metadata, error) {
+	mu := rlockKey(&s.tlock, name, s.acquireTablesLock)
+	defer mu.RUnlock()
+
+	_, seg, err := s.storage.FetchSegment(name)
+	if err != nil {
+		clog.Errorf("[TablesService.TableInfo] %v", err)
+		return nil, nil, ErrTableNotFound
+	}
+
+	defer seg.ReleaseToPool()
+
+	ttl, ok := seg.ExpiresIn()
+	if !ok {
+		return nil, nil, ErrTableExpired
+	}
+
+	size, nextID, err := seg.TableSummary()
+	if err != nil {
+		clog.Errorf("[TablesService.TableInfo] %v", err)
+		return nil, nil, err
+	}
+
+	return &TableInfo{
+		Size:   size,
+		NextID: nextID,
+		TTL:    ttl,
+	}, NewMetadata(seg), nil
+}
+
 type TableMutation struct {
 	Name       string         // 事务涉及的表名列表
 	Operation  OperationType  // 操作类型，类似于 SQL 的 INSERT、UPDATE、REMOVE
@@ -267,6 +443,10 @@ func (ts *TablesServiceImpl) Transaction(mutations []*TableMutation, serializati
 	// 去重 key 不需要拿到重复的快照
 	keySet := make(map[string]struct{})
 	for _, mutation := range mutations {
+		err := checkNestingDepth(mutation.Data)
+		if err != nil {
+			return err
+		}
 		keySet[mutation.Name] = struct{}{}
 	}
 
@@ -279,8 +459,8 @@ func (ts *TablesServiceImpl) Transaction(mutations []*TableMutation, serializati
 	if serialization {
 		for _, name := range keys {
 			// 排序保证锁顺序一致
-			ts.acquireTablesLock(name).Lock()
-			defer ts.acquireTablesLock(name).Unlock()
+			mu := lockKey(&ts.tlock, name, ts.acquireTablesLock)
+			defer mu.Unlock()
 		}
 	}
 
@@ -382,6 +562,8 @@ func buildSnapshot(snap *vfs.Snapshot, tab *types.Table) (*vfs.Snapshot, error)
 		return nil, err
 	}
 
+	seg.Writer = snap.Writer
+
 	return vfs.NewSnapshot(seg, snap.Version()), nil
 }
 
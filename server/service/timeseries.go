@@ -0,0 +1,197 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"errors"
+	"time"
+
+	"github.com/auula/urnadb/clog"
+	"github.com/auula/urnadb/types"
+	"github.com/auula/urnadb/vfs"
+)
+
+var (
+	ErrTimeSeriesNotFound       = errors.New("timeseries not found")
+	ErrTimeSeriesExpired        = errors.New("timeseries ttl is invalid or expired")
+	ErrTimeSeriesUpdateConflict = errors.New("timeseries is being updated concurrently, please retry")
+)
+
+// timeSeriesCASRetries 版本号冲突时最多重试的次数
+const timeSeriesCASRetries = 128
+
+// Retention 时间序列的保留策略，0 表示不修改已经保存的策略
+type Retention struct {
+	MaxSamples int
+	MaxAge     int64
+}
+
+// 和 List 一样，时间序列的追加操作基于存储层的版本号做 CAS，并发追加的采样点不会丢失。
+type TimeSeriesService interface {
+	// 追加采样点，时间序列不存在的时候自动创建，返回追加之后的采样点数量
+	Append(name string, samples []types.Sample, retention Retention, ttl int64, writer string) (int, error)
+	// 返回 [from, to] 区间内的采样点
+	Range(name string, from, to int64) ([]types.Sample, error)
+	// 返回 [from, to] 区间内按照 bucket 毫秒分桶聚合之后的采样点
+	Downsample(name string, from, to, bucket int64, agg string) ([]types.Sample, error)
+	// 删除一个名为 name 的时间序列
+	DeleteTimeSeries(name string) error
+}
+
+type TimeSeriesServiceImpl struct {
+	storage *vfs.LogStructuredFS
+}
+
+func NewTimeSeriesServiceImpl(storage *vfs.LogStructuredFS) TimeSeriesService {
+	return &TimeSeriesServiceImpl{
+		storage: storage,
+	}
+}
+
+func (s *TimeSeriesServiceImpl) Append(name string, samples []types.Sample, retention Retention, ttl int64, writer string) (int, error) {
+	now := time.Now().UnixMilli()
+
+	// 时间序列不存在的时候原子的创建，创建失败说明被其他请求抢先创建了，走下面的 CAS 追加流程
+	if !s.storage.IsActive(name) {
+		ts := types.NewTimeSeries()
+		ts.MaxSamples, ts.MaxAge = retention.MaxSamples, retention.MaxAge
+		size := ts.Append(now, samples...)
+
+		seg, err := vfs.AcquirePoolSegment(name, ts, ttl)
+		if err != nil {
+			clog.Errorf("[TimeSeriesService.Append] %v", err)
+			return 0, err
+		}
+
+		seg.Writer = writer
+		ok, err := s.storage.PutSegmentIfAbsent(name, seg)
+		seg.ReleaseToPool()
+		if err != nil {
+			return 0, err
+		}
+
+		if ok {
+			return size, nil
+		}
+	}
+
+	var size int
+	err := retryCAS(timeSeriesCASRetries, ErrTimeSeriesUpdateConflict, func() (bool, error) {
+		version, seg, err := s.fetch(name)
+		if err != nil {
+			return false, err
+		}
+
+		ts, err := seg.ToTimeSeries()
+		if err != nil {
+			seg.ReleaseToPool()
+			return false, err
+		}
+
+		defer ts.ReleaseToPool()
+
+		ttl, ok := seg.ExpiresIn()
+		previous := seg.Writer
+		seg.ReleaseToPool()
+		if !ok {
+			return false, ErrTimeSeriesExpired
+		}
+
+		if retention.MaxSamples > 0 {
+			ts.MaxSamples = retention.MaxSamples
+		}
+		if retention.MaxAge > 0 {
+			ts.MaxAge = retention.MaxAge
+		}
+		size = ts.Append(now, samples...)
+
+		seg, err = vfs.AcquirePoolSegment(name, ts, ttl)
+		if err != nil {
+			clog.Errorf("[TimeSeriesService.Append] %v", err)
+			return false, err
+		}
+
+		defer seg.ReleaseToPool()
+
+		seg.Writer = carryWriter(writer, previous)
+
+		return s.storage.CompareAndSwapSegment(name, version, seg)
+	})
+
+	return size, err
+}
+
+func (s *TimeSeriesServiceImpl) Range(name string, from, to int64) ([]types.Sample, error) {
+	ts, err := s.get(name)
+	if err != nil {
+		return nil, err
+	}
+
+	defer ts.ReleaseToPool()
+
+	return ts.Range(from, to), nil
+}
+
+func (s *TimeSeriesServiceImpl) Downsample(name string, from, to, bucket int64, agg string) ([]types.Sample, error) {
+	ts, err := s.get(name)
+	if err != nil {
+		return nil, err
+	}
+
+	defer ts.ReleaseToPool()
+
+	return ts.Downsample(from, to, bucket, agg)
+}
+
+func (s *TimeSeriesServiceImpl) DeleteTimeSeries(name string) error {
+	if !s.storage.IsActive(name) {
+		return ErrTimeSeriesNotFound
+	}
+
+	return s.storage.DeleteSegment(name)
+}
+
+func (s *TimeSeriesServiceImpl) get(name string) (*types.TimeSeries, error) {
+	_, seg, err := s.fetch(name)
+	if err != nil {
+		return nil, err
+	}
+
+	defer seg.ReleaseToPool()
+
+	ts, err := seg.ToTimeSeries()
+	if err != nil {
+		return nil, err
+	}
+
+	// 没有新的写入时旧的采样点不会被淘汰，读取的时候也需要应用保留策略
+	ts.Retain(time.Now().UnixMilli())
+
+	return ts, nil
+}
+
+func (s *TimeSeriesServiceImpl) fetch(name string) (uint64, *vfs.Segment, error) {
+	if !s.storage.IsActive(name) {
+		return 0, nil, ErrTimeSeriesNotFound
+	}
+
+	version, seg, err := s.storage.FetchSegment(name)
+	if err != nil {
+		clog.Errorf("[TimeSeriesService.fetch] %v", err)
+		return 0, nil, err
+	}
+
+	return version, seg, nil
+}
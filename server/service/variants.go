@@ -33,8 +33,9 @@ var (
 // 如果 Number 类型要完成类似于 redis 的 increment 的操作，
 // 客户端只需要发生算数运输的偏移量即可，最终操作中服务器端完成运算和持久化。
 type VariantsService interface {
-	GetVariant(name string) (*types.Variant, error)
-	SetVariant(name string, value *types.Variant, ttl int64) error
+	GetVariant(name string) (*types.Variant, *Metadata, error)
+	SetVariant(name string, value *types.Variant, ttl int64, writer string) error
+	SetVariantIfAbsent(name string, value *types.Variant, ttl int64, writer string) error
 	Increment(name string, delta float64) (float64, error)
 	DeleteVariant(name string) error
 }
@@ -57,29 +58,34 @@ func NewVariantsServiceImpl(storage *vfs.LogStructuredFS) VariantsService {
 }
 
 // GetVariant 获取变量值
-func (vs *VariantsServiceImpl) GetVariant(name string) (*types.Variant, error) {
-	vs.acquireVariantLock(name).RLock()
-	defer vs.acquireVariantLock(name).RUnlock()
+func (vs *VariantsServiceImpl) GetVariant(name string) (*types.Variant, *Metadata, error) {
+	mu := rlockKey(&vs.vlock, name, vs.acquireVariantLock)
+	defer mu.RUnlock()
 
 	_, seg, err := vs.storage.FetchSegment(name)
 	if err != nil {
 		clog.Errorf("[VariantsService.GetVariant] %v", err)
-		return nil, err
+		return nil, nil, err
 	}
 
 	defer seg.ReleaseToPool()
 
-	return seg.ToVariant()
+	variant, err := seg.ToVariant()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return variant, NewMetadata(seg), nil
 }
 
 // SetVariant 设置变量值
-func (vs *VariantsServiceImpl) SetVariant(name string, value *types.Variant, ttl int64) error {
+func (vs *VariantsServiceImpl) SetVariant(name string, value *types.Variant, ttl int64, writer string) error {
 	if vs.storage.IsActive(name) {
 		return ErrVariantAlreadyExists
 	}
 
-	vs.acquireVariantLock(name).Lock()
-	defer vs.acquireVariantLock(name).Unlock()
+	mu := lockKey(&vs.vlock, name, vs.acquireVariantLock)
+	defer mu.Unlock()
 
 	seg, err := vfs.AcquirePoolSegment(name, value, ttl)
 	if err != nil {
@@ -89,17 +95,46 @@ func (vs *VariantsServiceImpl) SetVariant(name string, value *types.Variant, ttl
 
 	defer seg.ReleaseToPool()
 
+	seg.Writer = writer
+
 	return vs.storage.PutSegment(name, seg)
 }
 
+// SetVariantIfAbsent 原子的 setnx 操作，变量已经存在的时候返回 ErrVariantAlreadyExists
+func (vs *VariantsServiceImpl) SetVariantIfAbsent(name string, value *types.Variant, ttl int64, writer string) error {
+	mu := lockKey(&vs.vlock, name, vs.acquireVariantLock)
+	defer mu.Unlock()
+
+	seg, err := vfs.AcquirePoolSegment(name, value, ttl)
+	if err != nil {
+		clog.Errorf("[VariantsService.SetVariantIfAbsent] %v", err)
+		return err
+	}
+
+	defer seg.ReleaseToPool()
+
+	seg.Writer = writer
+
+	ok, err := vs.storage.PutSegmentIfAbsent(name, seg)
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		return ErrVariantAlreadyExists
+	}
+
+	return nil
+}
+
 // Increment 增量操作 - 只对数值类型有效
 func (vs *VariantsServiceImpl) Increment(name string, delta float64) (float64, error) {
 	if !vs.storage.IsActive(name) {
 		return 0, ErrVariantNotFound
 	}
 
-	vs.acquireVariantLock(name).Lock()
-	defer vs.acquireVariantLock(name).Unlock()
+	mu := lockKey(&vs.vlock, name, vs.acquireVariantLock)
+	defer mu.Unlock()
 
 	_, seg, err := vs.storage.FetchSegment(name)
 	if err != nil {
@@ -127,12 +162,15 @@ func (vs *VariantsServiceImpl) Increment(name string, delta float64) (float64, e
 
 	defer utils.ReleaseToPool(seg, variant)
 
+	previous := seg.Writer
 	seg, err = vfs.AcquirePoolSegment(name, variant, ttl)
 	if err != nil {
 		clog.Errorf("[VariantsService.Increment] %v", err)
 		return 0, err
 	}
 
+	seg.Writer = previous
+
 	err = vs.storage.PutSegment(name, seg)
 	if err != nil {
 		clog.Errorf("[VariantsService.Increment] %v", err)
@@ -147,17 +185,17 @@ func (vs *VariantsServiceImpl) DeleteVariant(name string) error {
 		return ErrVariantNotFound
 	}
 
-	vs.acquireVariantLock(name).Lock()
+	mu := lockKey(&vs.vlock, name, vs.acquireVariantLock)
 
 	err := vs.storage.DeleteSegment(name)
 	if err != nil {
-		vs.acquireVariantLock(name).Unlock()
+		mu.Unlock()
 		clog.Errorf("[VariantsService.DeleteVariant] %v", err)
 		return err
 	}
 
-	vs.acquireVariantLock(name).Unlock()
-	vs.vlock.Delete(name)
+	vs.vlock.CompareAndDelete(name, mu)
+	mu.Unlock()
 
 	return nil
 }
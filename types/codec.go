@@ -0,0 +1,59 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package types
+
+import (
+	"encoding/json"
+	"sync/atomic"
+)
+
+// jsonCodec 是 ToJSON 使用的 JSON 编码库
+type jsonCodec struct {
+	marshal   func(v any) ([]byte, error)
+	unmarshal func(data []byte, v any) error
+}
+
+var (
+	stdlibCodec = &jsonCodec{marshal: json.Marshal, unmarshal: json.Unmarshal}
+	// 使用包级变量而不是 init 保存默认的编码库，其他文件的 init 中调用 SetJSONCodec 不受初始化顺序的影响
+	currentCodec atomic.Pointer[jsonCodec]
+)
+
+// SetJSONCodec 替换所有类型的 ToJSON 使用的 JSON 编码库，例如 goccy/go-json 或者 jsoniter 的 Marshal 和 Unmarshal，
+// 不需要修改调用的地方，任意一个参数为 nil 的时候恢复为标准库。替换的编码库需要和标准库的输出保持一致，
+// 也可以使用 go_json 构建标签切换到 goccy/go-json，和 gin 的构建标签一样，响应体也会使用同一个编码库。
+func SetJSONCodec(marshal func(v any) ([]byte, error), unmarshal func(data []byte, v any) error) {
+	if marshal == nil || unmarshal == nil {
+		currentCodec.Store(nil)
+		return
+	}
+	currentCodec.Store(&jsonCodec{marshal: marshal, unmarshal: unmarshal})
+}
+
+func loadCodec() *jsonCodec {
+	if codec := currentCodec.Load(); codec != nil {
+		return codec
+	}
+	return stdlibCodec
+}
+
+// MarshalJSON 使用 SetJSONCodec 设置的编码库编码 v
+func MarshalJSON(v any) ([]byte, error) {
+	return loadCodec().marshal(v)
+}
+
+// UnmarshalJSON 使用 SetJSONCodec 设置的编码库把 data 解码到 v
+func UnmarshalJSON(data []byte, v any) error {
+	return loadCodec().unmarshal(data, v)
+}
@@ -0,0 +1,23 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//go:build go_json
+
+package types
+
+import gojson "github.com/goccy/go-json"
+
+// 使用 -tags go_json 构建的时候 gin 的响应体使用 goccy/go-json 编码，ToJSON 也切换到同一个编码库
+func init() {
+	SetJSONCodec(gojson.Marshal, gojson.Unmarshal)
+}
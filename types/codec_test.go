@@ -0,0 +1,111 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package types
+
+import (
+	"fmt"
+	"testing"
+
+	gojson "github.com/goccy/go-json"
+	"github.com/stretchr/testify/assert"
+)
+
+// largeTable 构造一个有 rows 行、每行带有嵌套字段的 table
+func largeTable(rows int) *Table {
+	table := NewTable()
+	for i := 0; i < rows; i++ {
+		table.AddRows(map[string]any{
+			"name":   fmt.Sprintf("user-%d", i),
+			"age":    i % 100,
+			"score":  float64(i) * 1.5,
+			"active": i%2 == 0,
+			"tags":   []any{"admin", "user", "<html>"},
+			"config": map[string]any{"theme": "dark", "font": 14},
+		})
+	}
+	return table
+}
+
+func TestSetJSONCodec(t *testing.T) {
+	t.Cleanup(func() { SetJSONCodec(nil, nil) })
+
+	table := largeTable(100)
+	expected, err := table.ToJSON()
+	assert.NoError(t, err)
+
+	// goccy/go-json 的输出和标准库保持一致
+	SetJSONCodec(gojson.Marshal, gojson.Unmarshal)
+	actual, err := table.ToJSON()
+	assert.NoError(t, err)
+	assert.Equal(t, string(expected), string(actual))
+
+	var decoded map[string]any
+	assert.NoError(t, UnmarshalJSON(actual, &decoded))
+	assert.Len(t, decoded, 100)
+
+	// 所有类型的 ToJSON 都经过设置的编码库
+	calls := 0
+	SetJSONCodec(func(v any) ([]byte, error) {
+		calls++
+		return gojson.Marshal(v)
+	}, gojson.Unmarshal)
+
+	for _, value := range []interface{ ToJSON() ([]byte, error) }{
+		table,
+		NewRecord(),
+		NewVariant("urnadb"),
+		NewLeaseLock(),
+		NewList(),
+		NewTimeSeries(),
+	} {
+		_, err := value.ToJSON()
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, 6, calls)
+
+	// 参数为 nil 的时候恢复为标准库
+	SetJSONCodec(nil, nil)
+	_, err = table.ToJSON()
+	assert.NoError(t, err)
+	assert.Equal(t, 6, calls)
+}
+
+func BenchmarkTableToJSON(b *testing.B) {
+	table := largeTable(10000)
+
+	codecs := []struct {
+		name      string
+		marshal   func(v any) ([]byte, error)
+		unmarshal func(data []byte, v any) error
+	}{
+		{"stdlib", nil, nil},
+		{"go-json", gojson.Marshal, gojson.Unmarshal},
+	}
+
+	for _, codec := range codecs {
+		b.Run(codec.name, func(b *testing.B) {
+			SetJSONCodec(codec.marshal, codec.unmarshal)
+			defer SetJSONCodec(nil, nil)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_, err := table.ToJSON()
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
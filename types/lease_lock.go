@@ -15,11 +15,9 @@
 package types
 
 import (
-	"encoding/json"
 	"sync"
 
 	"github.com/auula/urnadb/utils"
-	"github.com/vmihailenco/msgpack/v5"
 )
 
 const (
@@ -45,6 +43,8 @@ func init() {
 type LeaseLock struct {
 	// Token 是锁的唯一标识，解锁的时候客户端需要提供相同的 Token 才能解锁，除非锁已经过期。
 	Token string `json:"token" msgpack:"token"`
+	// Renewals 是这把锁从获取之后被续租的次数，重新获取锁的时候从 0 开始计数
+	Renewals uint32 `json:"renewals,omitempty" msgpack:"renewals,omitempty"`
 }
 
 // NewLeaseLock 创建一个新的 LeaseLock 实例带有唯一的 Token
@@ -62,6 +62,7 @@ func AcquireLeaseLock() *LeaseLock {
 // 放回对象池，清理数据
 func (ll *LeaseLock) Clear() {
 	ll.Token = nullString
+	ll.Renewals = 0
 }
 
 // 其实这样里方便的是 utils.ReleaseToPool 可以直接调用，
@@ -71,12 +72,31 @@ func (ll *LeaseLock) ReleaseToPool() {
 	leaseLockPools.Put(ll)
 }
 
-// ToBytes 是给 AcquirePoolSegment 内部使用
+// ToBytes 是给 AcquirePoolSegment 内部使用，没有续租过的锁只编码 Token，和之前写入的数据格式保持一致
 func (ll *LeaseLock) ToBytes() ([]byte, error) {
-	return msgpack.Marshal(&ll.Token)
+	if ll.Renewals == 0 {
+		return marshalValue(&ll.Token)
+	}
+	return marshalValue(ll)
+}
+
+// UnmarshalLeaseLock 解码 ToBytes 编码的数据，兼容只有 Token 的旧格式和带有续租次数的格式，
+// 有的格式把 map 解码到 string 的时候不会报错，所以先按照数据本身的结构判断是哪一种格式。
+func UnmarshalLeaseLock(c ValueCodec, data []byte, ll *LeaseLock) error {
+	var raw any
+	err := UnmarshalValue(c, data, &raw)
+	if err != nil {
+		return err
+	}
+
+	ll.Clear()
+	if _, ok := raw.(string); ok {
+		return UnmarshalValue(c, data, &ll.Token)
+	}
+	return UnmarshalValue(c, data, ll)
 }
 
 // ToJSON 是给 segment 内部类型转换使用
 func (ll *LeaseLock) ToJSON() ([]byte, error) {
-	return json.Marshal(&ll.Token)
+	return MarshalJSON(&ll.Token)
 }
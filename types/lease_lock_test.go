@@ -92,6 +92,32 @@ func TestLeaseLockToBytes(t *testing.T) {
 	assert.Equal(t, ll.Token, token)
 }
 
+func TestUnmarshalLeaseLock(t *testing.T) {
+	for _, c := range []ValueCodec{MsgpackValueCodec, JSONValueCodec, CBORValueCodec} {
+		assert.NoError(t, SetValueCodec(c))
+
+		// 没有续租过的锁仍然只编码 Token
+		ll := NewLeaseLock()
+		data, err := ll.ToBytes()
+		assert.NoError(t, err)
+
+		decoded := new(LeaseLock)
+		assert.NoError(t, UnmarshalLeaseLock(c, data, decoded))
+		assert.Equal(t, ll.Token, decoded.Token)
+		assert.Equal(t, uint32(0), decoded.Renewals)
+
+		ll.Renewals = 3
+		data, err = ll.ToBytes()
+		assert.NoError(t, err)
+
+		decoded = new(LeaseLock)
+		assert.NoError(t, UnmarshalLeaseLock(c, data, decoded), c.String())
+		assert.Equal(t, ll.Token, decoded.Token)
+		assert.Equal(t, uint32(3), decoded.Renewals)
+	}
+	assert.NoError(t, SetValueCodec(MsgpackValueCodec))
+}
+
 func TestLeaseLockToJSON(t *testing.T) {
 	ll := NewLeaseLock()
 
@@ -0,0 +1,100 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import (
+	"sync"
+)
+
+// List 是一个有序的列表，新的元素追加到列表的尾部
+type List struct {
+	List []any `json:"list" msgpack:"list"`
+}
+
+var listPools = sync.Pool{
+	New: func() any {
+		return NewList()
+	},
+}
+
+func init() {
+	// 预先填充池中的对象，把对象放入池中
+	for i := 0; i < 10; i++ {
+		listPools.Put(NewList())
+	}
+}
+
+// 从对象池获取一个 List
+func AcquireList() *List {
+	return listPools.Get().(*List)
+}
+
+// 释放 List 归还到对象池
+func (l *List) ReleaseToPool() {
+	// 清理数据，避免脏数据影响复用
+	l.Clear()
+	listPools.Put(l)
+}
+
+// 新建一个 List
+func NewList(values ...any) *List {
+	return &List{
+		List: append(make([]any, 0, len(values)), values...),
+	}
+}
+
+// Clear 清空 List，重新分配切片避免影响已经被引用出去的旧数据
+func (l *List) Clear() {
+	l.List = make([]any, 0)
+}
+
+// Push 把元素追加到列表的尾部，返回追加之后的长度
+func (l *List) Push(values ...any) int {
+	l.List = append(l.List, values...)
+	return len(l.List)
+}
+
+// PopFront 弹出列表头部的元素，也就是最早追加的元素
+func (l *List) PopFront() (any, bool) {
+	if len(l.List) == 0 {
+		return nil, false
+	}
+	value := l.List[0]
+	l.List = l.List[1:]
+	return value, true
+}
+
+// PopBack 弹出列表尾部的元素，也就是最后追加的元素
+func (l *List) PopBack() (any, bool) {
+	if len(l.List) == 0 {
+		return nil, false
+	}
+	value := l.List[len(l.List)-1]
+	l.List = l.List[:len(l.List)-1]
+	return value, true
+}
+
+// 获取 List 中的元素个数
+func (l *List) Size() int {
+	return len(l.List)
+}
+
+func (l *List) ToBytes() ([]byte, error) {
+	return marshalValue(&l.List)
+}
+
+func (l *List) ToJSON() ([]byte, error) {
+	return MarshalJSON(&l.List)
+}
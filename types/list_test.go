@@ -0,0 +1,83 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+func TestNewList(t *testing.T) {
+	list := NewList()
+	assert.NotNil(t, list.List)
+	assert.Equal(t, 0, list.Size())
+
+	list = NewList("a", "b")
+	assert.Equal(t, []any{"a", "b"}, list.List)
+}
+
+func TestAcquireList(t *testing.T) {
+	list := AcquireList()
+	assert.NotNil(t, list)
+	assert.Equal(t, 0, list.Size())
+	list.ReleaseToPool()
+}
+
+func TestList_PushAndPop(t *testing.T) {
+	list := NewList()
+	assert.Equal(t, 3, list.Push("a", "b", "c"))
+
+	value, ok := list.PopBack()
+	assert.True(t, ok)
+	assert.Equal(t, "c", value)
+
+	value, ok = list.PopFront()
+	assert.True(t, ok)
+	assert.Equal(t, "a", value)
+
+	assert.Equal(t, []any{"b"}, list.List)
+
+	_, _ = list.PopBack()
+	_, ok = list.PopFront()
+	assert.False(t, ok)
+	_, ok = list.PopBack()
+	assert.False(t, ok)
+}
+
+func TestList_Clear(t *testing.T) {
+	list := NewList("a", "b")
+	old := list.List
+
+	list.Clear()
+	assert.Equal(t, 0, list.Size())
+	assert.Equal(t, []any{"a", "b"}, old)
+}
+
+func TestList_ToBytes(t *testing.T) {
+	list := NewList("a", int64(1), true)
+
+	data, err := list.ToBytes()
+	assert.NoError(t, err)
+
+	var decoded []any
+	assert.NoError(t, msgpack.Unmarshal(data, &decoded))
+	assert.Equal(t, []any{"a", int64(1), true}, decoded)
+
+	json, err := list.ToJSON()
+	assert.NoError(t, err)
+	assert.JSONEq(t, `["a", 1, true]`, string(json))
+}
@@ -15,11 +15,20 @@
 package types
 
 import (
-	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
 	"sync"
 
 	"github.com/auula/urnadb/utils"
-	"github.com/vmihailenco/msgpack/v5"
+)
+
+var (
+	// ErrInvalidFieldPath 字段路径为空、包含空的段或者中间的字段不是对象
+	ErrInvalidFieldPath = errors.New("invalid record field path")
+	// ErrFieldNotNumber 需要自增的字段已经存在但是不是数值类型
+	ErrFieldNotNumber = errors.New("record field is not a number")
 )
 
 type Record struct {
@@ -74,11 +83,11 @@ func (rc *Record) Size() int {
 }
 
 func (rc *Record) ToBytes() ([]byte, error) {
-	return msgpack.Marshal(&rc.Record)
+	return marshalValue(&rc.Record)
 }
 
 func (rc *Record) ToJSON() ([]byte, error) {
-	return json.Marshal(&rc.Record)
+	return MarshalJSON(&rc.Record)
 }
 
 // DeepMerge 合并新的数据到 Record 中
@@ -88,16 +97,98 @@ func (rc *Record) DeepMerge(news map[string]interface{}) {
 
 // 从 Tables 查找出键为目标 key 的值，包括所有值中值
 func (rc *Record) SearchItem(key string) any {
-	var results []any
-	if items, exists := rc.Record[key]; exists {
-		results = append(results, items)
+	results, _ := rc.SearchItemDepth(key, utils.DefaultSearchDepth)
+	return results
+}
+
+// SearchItemDepth 和 SearchItem 一样递归查找 key，嵌套层级超过 maxDepth 的部分不会被搜索，第二个返回值表示是否被截断
+func (rc *Record) SearchItemDepth(key string, maxDepth int) ([]any, bool) {
+	return utils.SearchInMapDepth(rc.Record, key, maxDepth)
+}
+
+// IncrementField 把 path 指向的数值字段加上 delta 并且返回新的值，path 使用 . 分隔嵌套的字段，例如 stats.views，
+// 不存在的字段和中间对象会被创建。原来的值和 delta 都是整数的时候结果保存为 int64，否则保存为 float64。
+func (rc *Record) IncrementField(path string, delta float64) (any, error) {
+	fields := strings.Split(path, ".")
+	for _, field := range fields {
+		if field == "" {
+			return nil, fmt.Errorf("%w: %q", ErrInvalidFieldPath, path)
+		}
 	}
 
-	for _, item := range rc.Record {
-		if innerMap, ok := item.(map[string]any); ok {
-			results = append(results, utils.SearchInMap(innerMap, key)...)
+	parent := rc.Record
+	for _, field := range fields[:len(fields)-1] {
+		next, ok := parent[field]
+		if !ok {
+			child := make(map[string]any)
+			parent[field] = child
+			parent = child
+			continue
 		}
+
+		child, ok := next.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("%w: %q is not an object", ErrInvalidFieldPath, field)
+		}
+		parent = child
 	}
 
-	return results
+	last := fields[len(fields)-1]
+	integral := delta == math.Trunc(delta)
+
+	current, ok := parent[last]
+	if !ok {
+		if integral {
+			parent[last] = int64(delta)
+		} else {
+			parent[last] = delta
+		}
+		return parent[last], nil
+	}
+
+	switch n := current.(type) {
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		i := toInt64(n)
+		if integral {
+			parent[last] = i + int64(delta)
+		} else {
+			parent[last] = float64(i) + delta
+		}
+	case float32:
+		parent[last] = float64(n) + delta
+	case float64:
+		// JSON 解码的整数也是 float64，整数相加之后仍然是整数，序列化的时候不会出现小数点
+		parent[last] = n + delta
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrFieldNotNumber, path)
+	}
+
+	return parent[last], nil
+}
+
+// toInt64 把任意宽度的整数转换为 int64，调用者需要保证 v 是整数类型
+func toInt64(v any) int64 {
+	switch n := v.(type) {
+	case int:
+		return int64(n)
+	case int8:
+		return int64(n)
+	case int16:
+		return int64(n)
+	case int32:
+		return int64(n)
+	case int64:
+		return n
+	case uint:
+		return int64(n)
+	case uint8:
+		return int64(n)
+	case uint16:
+		return int64(n)
+	case uint32:
+		return int64(n)
+	case uint64:
+		return int64(n)
+	}
+	return 0
 }
@@ -145,6 +145,26 @@ func TestRecord_SearchItem(t *testing.T) {
 	assert.Empty(t, results)
 }
 
+func TestRecord_SearchItemDepth(t *testing.T) {
+	record := NewRecord()
+
+	nested := map[string]any{"name": "leaf"}
+	for i := 0; i < 100; i++ {
+		nested = map[string]any{"name": i, "next": nested}
+	}
+	record.AddRecord("root", nested)
+
+	assert.NotPanics(t, func() {
+		results, exceeded := record.SearchItemDepth("name", 10)
+		assert.True(t, exceeded)
+		assert.Len(t, results, 9)
+	})
+
+	results, exceeded := record.SearchItemDepth("name", 1000)
+	assert.False(t, exceeded)
+	assert.Len(t, results, 101)
+}
+
 func TestRecord_ReleaseToPool(t *testing.T) {
 	record := AcquireRecord()
 	record.AddRecord("test", "value")
@@ -152,3 +172,41 @@ func TestRecord_ReleaseToPool(t *testing.T) {
 	record.ReleaseToPool()
 	assert.Equal(t, 0, record.Size())
 }
+
+func TestRecord_IncrementField(t *testing.T) {
+	record := NewRecord()
+	record.Record = map[string]any{
+		"count": 1,
+		"score": 1.5,
+		"name":  "urnadb",
+	}
+
+	value, err := record.IncrementField("count", 2)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), value)
+
+	value, err = record.IncrementField("count", 0.5)
+	assert.NoError(t, err)
+	assert.Equal(t, 3.5, value)
+
+	value, err = record.IncrementField("score", -1)
+	assert.NoError(t, err)
+	assert.Equal(t, 0.5, value)
+
+	// 不存在的字段和中间的对象都会被创建
+	value, err = record.IncrementField("stats.views.total", 1)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), value)
+	assert.Equal(t, map[string]any{"views": map[string]any{"total": int64(1)}}, record.Record["stats"])
+
+	_, err = record.IncrementField("name", 1)
+	assert.ErrorIs(t, err, ErrFieldNotNumber)
+
+	_, err = record.IncrementField("name.length", 1)
+	assert.ErrorIs(t, err, ErrInvalidFieldPath)
+
+	for _, path := range []string{"", ".", "stats..views", "count."} {
+		_, err = record.IncrementField(path, 1)
+		assert.ErrorIs(t, err, ErrInvalidFieldPath, path)
+	}
+}
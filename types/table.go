@@ -15,13 +15,12 @@
 package types
 
 import (
-	"encoding/json"
 	"errors"
 	"reflect"
+	"sort"
 	"sync"
 
 	"github.com/auula/urnadb/utils"
-	"github.com/vmihailenco/msgpack/v5"
 )
 
 type Table struct {
@@ -102,25 +101,57 @@ func (tab *Table) SelectRowsAll(wheres map[string]any) []map[string]any {
 	var results []map[string]any
 
 	for _, row := range tab.Table {
-		match := true
-		for key, value := range wheres {
-			v, ok := row[key]
-			if !ok {
-				match = false
-				break
-			}
-			if !reflect.DeepEqual(v, value) {
-				match = false
-				break
+		if matchRow(row, wheres) {
+			results = append(results, row)
+		}
+	}
+
+	return results
+}
+
+// SelectRowsWithIDs 和 SelectRowsAll 的匹配规则一致，按照 t_id 从小到大返回匹配的行，
+// 每一行都是浅拷贝并且注入了行的 t_id，不会修改表中原来的行，客户端可以直接用 t_id 更新或者删除匹配的行
+func (tab *Table) SelectRowsWithIDs(wheres map[string]any) []map[string]any {
+	var results []map[string]any
+
+	tab.RangeRows(func(id uint32, row map[string]any) bool {
+		if matchRow(row, wheres) {
+			copied := make(map[string]any, len(row)+1)
+			for k, v := range row {
+				copied[k] = v
 			}
+			copied["t_id"] = id
+			results = append(results, copied)
 		}
+		return true
+	})
 
-		if match {
-			results = append(results, row)
+	return results
+}
+
+// CountRows 返回满足 wheres 条件的行数，匹配规则和 SelectRowsAll 一致，但是不需要收集匹配的行
+func (tab *Table) CountRows(wheres map[string]any) int {
+	count := 0
+	for _, row := range tab.Table {
+		if matchRow(row, wheres) {
+			count++
 		}
 	}
+	return count
+}
 
-	return results
+// matchRow 判断一行数据是否满足 wheres 中的所有条件，类似于 SQL 的 AND 多条件查询
+func matchRow(row map[string]any, wheres map[string]any) bool {
+	for key, value := range wheres {
+		v, ok := row[key]
+		if !ok {
+			return false
+		}
+		if !reflect.DeepEqual(v, value) {
+			return false
+		}
+	}
+	return true
 }
 
 func (tab *Table) UpdateRows(wheres, data map[string]any) error {
@@ -160,19 +191,56 @@ func (tab *Table) UpdateRows(wheres, data map[string]any) error {
 	return nil
 }
 
+// RangeRows 按照 t_id 从小到大的顺序遍历所有行，fn 返回 false 的时候停止遍历
+func (tab *Table) RangeRows(fn func(id uint32, row map[string]any) bool) {
+	ids := make([]uint32, 0, len(tab.Table))
+	for id := range tab.Table {
+		ids = append(ids, id)
+	}
+
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i] < ids[j]
+	})
+
+	for _, id := range ids {
+		if !fn(id, tab.Table[id]) {
+			return
+		}
+	}
+}
+
 // 获取 Table 中的元素个数
 func (tab *Table) Size() int {
 	return len(tab.Table)
 }
 
 func (tab *Table) ToBytes() ([]byte, error) {
-	return msgpack.Marshal(&tab)
+	return marshalValue(&tab)
 }
 
 func (tab *Table) ToJSON() ([]byte, error) {
-	return json.Marshal(&tab.Table)
+	return MarshalJSON(&tab.Table)
 }
 
 func (tab *Table) DeepMerge(id uint32, news map[string]any) {
 	utils.DeepMergeMaps(tab.Table[id], news)
 }
+
+// UpsertRows 按照 t_id 把 rows 合并到 Table 中，已经存在的行通过 DeepMerge 深度合并，不存在的行直接添加，
+// rows 中没有出现的行保持不变。添加的 t_id 大于 NextID 的时候同步推进 NextID，之后 AddRows 分配的 t_id 不会和它冲突。
+func (tab *Table) UpsertRows(rows map[uint32]map[string]any) (inserted, merged int) {
+	for id, row := range rows {
+		if exist, ok := tab.Table[id]; ok && exist != nil {
+			tab.DeepMerge(id, row)
+			merged++
+			continue
+		}
+
+		tab.Table[id] = row
+		if id > tab.NextID {
+			tab.NextID = id
+		}
+		inserted++
+	}
+	return inserted, merged
+}
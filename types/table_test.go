@@ -89,6 +89,51 @@ func TestTable_SelectRowsAll(t *testing.T) {
 	assert.Equal(t, 1, len(results))
 }
 
+func TestTable_SelectRowsWithIDs(t *testing.T) {
+	table := NewTable()
+	table.AddRows(map[string]any{"name": "test1", "age": 25})
+	table.AddRows(map[string]any{"name": "test2", "age": 30})
+	table.AddRows(map[string]any{"name": "test3", "age": 25})
+
+	results := table.SelectRowsWithIDs(map[string]any{"age": 25})
+	if assert.Len(t, results, 2) {
+		assert.Equal(t, uint32(1), results[0]["t_id"])
+		assert.Equal(t, "test1", results[0]["name"])
+		assert.Equal(t, uint32(3), results[1]["t_id"])
+		assert.Equal(t, "test3", results[1]["name"])
+	}
+
+	// 表中原来的行不会被注入 t_id
+	_, ok := table.GetRows(1).(map[string]any)["t_id"]
+	assert.False(t, ok)
+
+	// 返回的 t_id 可以直接用来更新匹配的行
+	for _, row := range results {
+		err := table.UpdateRows(map[string]any{"t_id": row["t_id"]}, map[string]any{"age": 26})
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, 26, table.GetRows(1).(map[string]any)["age"])
+	assert.Equal(t, 30, table.GetRows(2).(map[string]any)["age"])
+	assert.Equal(t, 26, table.GetRows(3).(map[string]any)["age"])
+	assert.Empty(t, table.SelectRowsWithIDs(map[string]any{"age": 25}))
+}
+
+func TestTable_CountRows(t *testing.T) {
+	table := NewTable()
+	table.AddRows(map[string]any{"name": "test1", "age": 25})
+	table.AddRows(map[string]any{"name": "test2", "age": 25})
+	table.AddRows(map[string]any{"name": "test3", "age": 30})
+
+	for _, wheres := range []map[string]any{
+		nil,
+		{"age": 25},
+		{"age": 25, "name": "test2"},
+		{"nonexistent": "value"},
+	} {
+		assert.Equal(t, len(table.SelectRowsAll(wheres)), table.CountRows(wheres))
+	}
+}
+
 func TestTable_UpdateRows(t *testing.T) {
 	table := NewTable()
 	id := table.AddRows(map[string]any{"name": "test", "age": 25})
@@ -178,3 +223,56 @@ func TestTable_DeepMerge(t *testing.T) {
 	assert.Equal(t, 25, user["age"])
 	assert.Equal(t, "test@example.com", user["email"])
 }
+
+func TestTable_RangeRows(t *testing.T) {
+	table := NewTable()
+	for i := 0; i < 100; i++ {
+		table.AddRows(map[string]any{"seq": i})
+	}
+	table.RemoveRows(map[string]any{"seq": 50})
+
+	var ids []uint32
+	table.RangeRows(func(id uint32, row map[string]any) bool {
+		ids = append(ids, id)
+		return true
+	})
+
+	assert.Len(t, ids, 99)
+	for i := 1; i < len(ids); i++ {
+		assert.Less(t, ids[i-1], ids[i])
+	}
+
+	// 返回 false 提前结束遍历
+	count := 0
+	table.RangeRows(func(id uint32, row map[string]any) bool {
+		count++
+		return count < 10
+	})
+	assert.Equal(t, 10, count)
+}
+
+func TestTable_UpsertRows(t *testing.T) {
+	table := NewTable()
+	first := table.AddRows(map[string]any{"name": "alice", "profile": map[string]any{"age": 20}})
+	second := table.AddRows(map[string]any{"name": "bob"})
+
+	inserted, merged := table.UpsertRows(map[uint32]map[string]any{
+		first: {"profile": map[string]any{"city": "shanghai"}},
+		10:    {"name": "carol"},
+	})
+	assert.Equal(t, 1, inserted)
+	assert.Equal(t, 1, merged)
+	assert.Equal(t, 3, table.Size())
+
+	row := table.GetRows(first).(map[string]any)
+	assert.Equal(t, "alice", row["name"])
+	profile := row["profile"].(map[string]any)
+	assert.Equal(t, 20, profile["age"])
+	assert.Equal(t, "shanghai", profile["city"])
+
+	// 没有出现在 rows 中的行保持不变
+	assert.Equal(t, map[string]any{"name": "bob"}, table.GetRows(second))
+
+	// 新分配的 t_id 不会覆盖 upsert 添加的行
+	assert.Equal(t, uint32(11), table.AddRows(map[string]any{"name": "dave"}))
+}
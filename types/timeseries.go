@@ -0,0 +1,194 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"sync"
+)
+
+var ErrUnknownAggregation = errors.New("aggregation must be avg, max or min")
+
+// Sample 是时间序列中的一个采样点，TS 为 Unix 毫秒时间戳
+type Sample struct {
+	TS    int64   `json:"ts" msgpack:"ts"`
+	Value float64 `json:"value" msgpack:"v"`
+}
+
+// TimeSeries 按照时间戳升序保存采样点，乱序写入的采样点会插入到正确的位置，相同时间戳的采样点会被覆盖，
+// MaxSamples 和 MaxAge 控制保留策略，0 表示不限制，MaxAge 的单位和时间戳一样是毫秒。
+type TimeSeries struct {
+	Samples    []Sample `json:"samples" msgpack:"samples"`
+	MaxSamples int      `json:"max_samples" msgpack:"max_samples"`
+	MaxAge     int64    `json:"max_age" msgpack:"max_age"`
+}
+
+var timeSeriesPools = sync.Pool{
+	New: func() any {
+		return NewTimeSeries()
+	},
+}
+
+func init() {
+	// 预先填充池中的对象，把对象放入池中
+	for i := 0; i < 10; i++ {
+		timeSeriesPools.Put(NewTimeSeries())
+	}
+}
+
+// 从对象池获取一个 TimeSeries
+func AcquireTimeSeries() *TimeSeries {
+	return timeSeriesPools.Get().(*TimeSeries)
+}
+
+// 释放 TimeSeries 归还到对象池
+func (ts *TimeSeries) ReleaseToPool() {
+	// 清理数据，避免脏数据影响复用
+	ts.Clear()
+	timeSeriesPools.Put(ts)
+}
+
+// 新建一个 TimeSeries
+func NewTimeSeries() *TimeSeries {
+	return &TimeSeries{
+		Samples: make([]Sample, 0),
+	}
+}
+
+// Clear 清空 TimeSeries，重新分配切片避免影响已经被引用出去的旧数据
+func (ts *TimeSeries) Clear() {
+	ts.Samples = make([]Sample, 0)
+	ts.MaxSamples = 0
+	ts.MaxAge = 0
+}
+
+// Append 按照时间戳插入采样点，now 为当前的 Unix 毫秒时间戳，用于按照 MaxAge 淘汰旧的采样点，返回插入之后的采样点数量
+func (ts *TimeSeries) Append(now int64, samples ...Sample) int {
+	for _, sample := range samples {
+		i := sort.Search(len(ts.Samples), func(i int) bool {
+			return ts.Samples[i].TS >= sample.TS
+		})
+
+		if i < len(ts.Samples) && ts.Samples[i].TS == sample.TS {
+			ts.Samples[i].Value = sample.Value
+			continue
+		}
+
+		ts.Samples = append(ts.Samples, Sample{})
+		copy(ts.Samples[i+1:], ts.Samples[i:])
+		ts.Samples[i] = sample
+	}
+
+	ts.Retain(now)
+
+	return len(ts.Samples)
+}
+
+// Retain 按照保留策略丢弃最旧的采样点，now 为当前的 Unix 毫秒时间戳
+func (ts *TimeSeries) Retain(now int64) {
+	if ts.MaxAge > 0 {
+		cutoff := now - ts.MaxAge
+		i := sort.Search(len(ts.Samples), func(i int) bool {
+			return ts.Samples[i].TS >= cutoff
+		})
+		ts.Samples = ts.Samples[i:]
+	}
+
+	if ts.MaxSamples > 0 && len(ts.Samples) > ts.MaxSamples {
+		ts.Samples = ts.Samples[len(ts.Samples)-ts.MaxSamples:]
+	}
+}
+
+// Range 返回时间戳在 [from, to] 闭区间内的采样点
+func (ts *TimeSeries) Range(from, to int64) []Sample {
+	lo := sort.Search(len(ts.Samples), func(i int) bool {
+		return ts.Samples[i].TS >= from
+	})
+	hi := sort.Search(len(ts.Samples), func(i int) bool {
+		return ts.Samples[i].TS > to
+	})
+
+	if lo >= hi {
+		return []Sample{}
+	}
+
+	samples := make([]Sample, hi-lo)
+	copy(samples, ts.Samples[lo:hi])
+
+	return samples
+}
+
+// Downsample 把 [from, to] 区间内的采样点按照 bucket 毫秒分桶，每个桶使用 agg 聚合为一个采样点，
+// 聚合之后采样点的时间戳是桶的起始时间，agg 支持 avg、max 和 min，没有采样点的桶不会出现在结果中。
+func (ts *TimeSeries) Downsample(from, to, bucket int64, agg string) ([]Sample, error) {
+	var reduce func(acc, value float64, count int) float64
+	switch agg {
+	case "avg":
+		reduce = func(acc, value float64, count int) float64 {
+			return acc + (value-acc)/float64(count)
+		}
+	case "max":
+		reduce = func(acc, value float64, _ int) float64 {
+			return math.Max(acc, value)
+		}
+	case "min":
+		reduce = func(acc, value float64, _ int) float64 {
+			return math.Min(acc, value)
+		}
+	default:
+		return nil, ErrUnknownAggregation
+	}
+
+	buckets := make([]Sample, 0)
+	count := 0
+	for _, sample := range ts.Range(from, to) {
+		start := floorDiv(sample.TS, bucket) * bucket
+		if count == 0 || buckets[len(buckets)-1].TS != start {
+			buckets = append(buckets, Sample{TS: start, Value: sample.Value})
+			count = 1
+			continue
+		}
+
+		count++
+		last := &buckets[len(buckets)-1]
+		last.Value = reduce(last.Value, sample.Value, count)
+	}
+
+	return buckets, nil
+}
+
+// floorDiv 向下取整的除法，保证负数时间戳也能落到正确的桶中
+func floorDiv(a, b int64) int64 {
+	q := a / b
+	if a%b != 0 && (a < 0) != (b < 0) {
+		q--
+	}
+	return q
+}
+
+// 获取 TimeSeries 中的采样点个数
+func (ts *TimeSeries) Size() int {
+	return len(ts.Samples)
+}
+
+func (ts *TimeSeries) ToBytes() ([]byte, error) {
+	return marshalValue(ts)
+}
+
+func (ts *TimeSeries) ToJSON() ([]byte, error) {
+	return MarshalJSON(ts)
+}
@@ -0,0 +1,100 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+func TestTimeSeries_AppendOutOfOrder(t *testing.T) {
+	ts := NewTimeSeries()
+	size := ts.Append(0, Sample{TS: 30, Value: 3}, Sample{TS: 10, Value: 1}, Sample{TS: 20, Value: 2})
+	assert.Equal(t, 3, size)
+
+	// 相同时间戳的采样点会被覆盖
+	ts.Append(0, Sample{TS: 5, Value: 0}, Sample{TS: 20, Value: 22})
+	assert.Equal(t, []Sample{{5, 0}, {10, 1}, {20, 22}, {30, 3}}, ts.Samples)
+}
+
+func TestTimeSeries_Range(t *testing.T) {
+	ts := NewTimeSeries()
+	for i := int64(0); i < 10; i++ {
+		ts.Append(0, Sample{TS: i * 10, Value: float64(i)})
+	}
+
+	assert.Equal(t, []Sample{{20, 2}, {30, 3}, {40, 4}}, ts.Range(20, 40))
+	assert.Len(t, ts.Range(-100, 1000), 10)
+	assert.Empty(t, ts.Range(41, 49))
+	assert.Empty(t, ts.Range(50, 40))
+}
+
+func TestTimeSeries_Retention(t *testing.T) {
+	ts := NewTimeSeries()
+	ts.MaxSamples = 3
+	for i := int64(1); i <= 5; i++ {
+		ts.Append(0, Sample{TS: i, Value: float64(i)})
+	}
+	assert.Equal(t, []Sample{{3, 3}, {4, 4}, {5, 5}}, ts.Samples)
+
+	ts = NewTimeSeries()
+	ts.MaxAge = 100
+	ts.Append(1000, Sample{TS: 850}, Sample{TS: 900}, Sample{TS: 950})
+	assert.Equal(t, []Sample{{900, 0}, {950, 0}}, ts.Samples)
+
+	ts.Retain(1040)
+	assert.Equal(t, []Sample{{950, 0}}, ts.Samples)
+}
+
+func TestTimeSeries_Downsample(t *testing.T) {
+	ts := NewTimeSeries()
+	ts.Append(0,
+		Sample{TS: 0, Value: 1}, Sample{TS: 5, Value: 3},
+		Sample{TS: 10, Value: 10}, Sample{TS: 19, Value: 20},
+		Sample{TS: 30, Value: 7},
+	)
+
+	for agg, expected := range map[string][]Sample{
+		"avg": {{0, 2}, {10, 15}, {30, 7}},
+		"max": {{0, 3}, {10, 20}, {30, 7}},
+		"min": {{0, 1}, {10, 10}, {30, 7}},
+	} {
+		samples, err := ts.Downsample(0, 100, 10, agg)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, samples, agg)
+	}
+
+	samples, err := ts.Downsample(10, 19, 10, "avg")
+	assert.NoError(t, err)
+	assert.Equal(t, []Sample{{10, 15}}, samples)
+
+	_, err = ts.Downsample(0, 100, 10, "sum")
+	assert.ErrorIs(t, err, ErrUnknownAggregation)
+}
+
+func TestTimeSeries_ToBytes(t *testing.T) {
+	ts := NewTimeSeries()
+	ts.MaxSamples = 10
+	ts.Append(0, Sample{TS: 1, Value: 1.5})
+
+	bytes, err := ts.ToBytes()
+	assert.NoError(t, err)
+
+	decoded := NewTimeSeries()
+	assert.NoError(t, msgpack.Unmarshal(bytes, decoded))
+	assert.Equal(t, ts, decoded)
+}
@@ -0,0 +1,112 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package types
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sync/atomic"
+
+	"github.com/ugorji/go/codec"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// ValueCodec 是 value 写入磁盘时使用的序列化格式，编号保存在 segment 的头部中，
+// 读取的时候按照头部记录的格式解码，所以同一个目录中可以混合存放不同格式写入的数据。
+type ValueCodec uint8
+
+const (
+	// MsgpackValueCodec 默认的格式，之前写入的数据都是这个格式
+	MsgpackValueCodec ValueCodec = iota
+	// JSONValueCodec 使用 MarshalJSON 编码，直接查看数据文件的时候方便调试
+	JSONValueCodec
+	// CBORValueCodec 用于和其他使用 CBOR 的系统互通
+	CBORValueCodec
+)
+
+var ErrUnknownValueCodec = errors.New("unknown value codec")
+
+var valueCodecNames = map[ValueCodec]string{
+	MsgpackValueCodec: "msgpack",
+	JSONValueCodec:    "json",
+	CBORValueCodec:    "cbor",
+}
+
+func (c ValueCodec) String() string {
+	if name, ok := valueCodecNames[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("codec(%d)", uint8(c))
+}
+
+// cborHandle 嵌套的 map 解码为 map[string]any，整数解码为有符号整数，和 msgpack 解码之后的结构保持一致
+var cborHandle = func() *codec.CborHandle {
+	h := new(codec.CborHandle)
+	h.MapType = reflect.TypeOf(map[string]any(nil))
+	h.SignedInteger = true
+	return h
+}()
+
+// currentValueCodec 是所有类型的 ToBytes 使用的格式，零值就是 msgpack
+var currentValueCodec atomic.Uint32
+
+// SetValueCodec 设置之后新写入的 value 使用的序列化格式，已经写入的数据不受影响，这是进程级别的配置
+func SetValueCodec(c ValueCodec) error {
+	if _, ok := valueCodecNames[c]; !ok {
+		return fmt.Errorf("%w: %d", ErrUnknownValueCodec, uint8(c))
+	}
+	currentValueCodec.Store(uint32(c))
+	return nil
+}
+
+// CurrentValueCodec 返回 ToBytes 当前使用的序列化格式
+func CurrentValueCodec() ValueCodec {
+	return ValueCodec(currentValueCodec.Load())
+}
+
+// MarshalValue 使用 c 指定的格式编码 v
+func MarshalValue(c ValueCodec, v any) ([]byte, error) {
+	switch c {
+	case MsgpackValueCodec:
+		return msgpack.Marshal(v)
+	case JSONValueCodec:
+		return MarshalJSON(v)
+	case CBORValueCodec:
+		var data []byte
+		err := codec.NewEncoderBytes(&data, cborHandle).Encode(v)
+		return data, err
+	default:
+		return nil, fmt.Errorf("%w: %d", ErrUnknownValueCodec, uint8(c))
+	}
+}
+
+// UnmarshalValue 使用 c 指定的格式把 data 解码到 v 中
+func UnmarshalValue(c ValueCodec, data []byte, v any) error {
+	switch c {
+	case MsgpackValueCodec:
+		return msgpack.Unmarshal(data, v)
+	case JSONValueCodec:
+		return UnmarshalJSON(data, v)
+	case CBORValueCodec:
+		return codec.NewDecoderBytes(data, cborHandle).Decode(v)
+	default:
+		return fmt.Errorf("%w: %d", ErrUnknownValueCodec, uint8(c))
+	}
+}
+
+// marshalValue 使用 SetValueCodec 设置的格式编码 v，所有类型的 ToBytes 都通过这里序列化
+func marshalValue(v any) ([]byte, error) {
+	return MarshalValue(CurrentValueCodec(), v)
+}
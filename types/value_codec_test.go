@@ -0,0 +1,78 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package types
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValueCodecRoundTrip(t *testing.T) {
+	t.Cleanup(func() { _ = SetValueCodec(MsgpackValueCodec) })
+
+	for _, codec := range []ValueCodec{MsgpackValueCodec, JSONValueCodec, CBORValueCodec} {
+		t.Run(codec.String(), func(t *testing.T) {
+			assert.NoError(t, SetValueCodec(codec))
+			assert.Equal(t, codec, CurrentValueCodec())
+
+			record := NewRecord()
+			record.Record = map[string]any{"name": "urnadb", "tags": []any{"db"}}
+			data, err := record.ToBytes()
+			assert.NoError(t, err)
+
+			var decoded map[string]any
+			assert.NoError(t, UnmarshalValue(codec, data, &decoded))
+			assert.Equal(t, "urnadb", decoded["name"])
+			assert.Equal(t, []any{"db"}, decoded["tags"])
+
+			table := NewTable()
+			table.AddRows(map[string]any{"name": "leon"})
+			data, err = table.ToBytes()
+			assert.NoError(t, err)
+
+			restored := NewTable()
+			assert.NoError(t, UnmarshalValue(codec, data, restored))
+			assert.Equal(t, uint32(1), restored.NextID)
+			assert.Equal(t, "leon", restored.Table[1]["name"])
+
+			variant := NewVariant(int64(42))
+			data, err = variant.ToBytes()
+			assert.NoError(t, err)
+
+			decodedVariant := AcquireVariant()
+			defer decodedVariant.ReleaseToPool()
+			assert.NoError(t, decodedVariant.FromBytesWithCodec(codec, data))
+			assert.EqualValues(t, 42, decodedVariant.Value)
+		})
+	}
+}
+
+func TestValueCodecFormat(t *testing.T) {
+	t.Cleanup(func() { _ = SetValueCodec(MsgpackValueCodec) })
+
+	list := NewList("a", "b")
+
+	assert.NoError(t, SetValueCodec(JSONValueCodec))
+	data, err := list.ToBytes()
+	assert.NoError(t, err)
+	assert.JSONEq(t, `["a","b"]`, string(data))
+
+	// 使用其他格式解码 JSON 数据会失败，解码必须使用写入时的格式
+	var decoded []any
+	assert.Error(t, UnmarshalValue(MsgpackValueCodec, data, &decoded))
+
+	assert.ErrorIs(t, SetValueCodec(ValueCodec(9)), ErrUnknownValueCodec)
+	assert.Equal(t, JSONValueCodec, CurrentValueCodec())
+}
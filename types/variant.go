@@ -15,10 +15,8 @@
 package types
 
 import (
-	"encoding/json"
+	"strconv"
 	"sync"
-
-	"github.com/vmihailenco/msgpack/v5"
 )
 
 var variantPools = sync.Pool{
@@ -130,12 +128,31 @@ func (v *Variant) Bool() bool {
 	return v.Value.(bool)
 }
 
+// RoundFloat 把浮点数按照 precision 位小数四舍五入，只用于响应中的展示，例如 0.1+0.2 返回 0.3，
+// precision 为负数或者不是浮点数的时候原样返回，存储的值始终保持完整的精度
+func RoundFloat(value any, precision int) any {
+	f, ok := value.(float64)
+	if !ok || precision < 0 {
+		return value
+	}
+	rounded, err := strconv.ParseFloat(strconv.FormatFloat(f, 'f', precision, 64), 64)
+	if err != nil {
+		return value
+	}
+	return rounded
+}
+
+// Rounded 返回按照 precision 位小数四舍五入之后的值，不会修改 Variant 中的值
+func (v *Variant) Rounded(precision int) any {
+	return RoundFloat(v.Value, precision)
+}
+
 func (v *Variant) ToBytes() ([]byte, error) {
-	return msgpack.Marshal(&v.Value)
+	return marshalValue(&v.Value)
 }
 
 func (v *Variant) ToJSON() ([]byte, error) {
-	return json.Marshal(&v.Value)
+	return MarshalJSON(&v.Value)
 }
 
 func (v *Variant) IsVariant() bool {
@@ -150,14 +167,19 @@ func (v *Variant) IsVariant() bool {
 
 // fix bug: msgpack: Decode(non-pointer float64)
 func (v *Variant) FromBytesSafe(data []byte) error {
+	return v.FromBytesWithCodec(MsgpackValueCodec, data)
+}
+
+// FromBytesWithCodec 和 FromBytesSafe 一样解码 data，但是使用 segment 头部中记录的序列化格式
+func (v *Variant) FromBytesWithCodec(c ValueCodec, data []byte) error {
 	var raw any
-	err := msgpack.Unmarshal(data, &raw)
+	err := UnmarshalValue(c, data, &raw)
 	if err != nil {
 		return err
 	}
 
 	switch val := raw.(type) {
-	case int, int8, int16, int32, int64, float32, float64:
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64:
 		v.Value = val
 	case string:
 		v.Value = val
@@ -224,6 +224,40 @@ func TestVariant_ToJSON(t *testing.T) {
 	}
 }
 
+func TestVariant_Rounded(t *testing.T) {
+	// 常量表达式 0.1 + 0.2 在编译期是精确的 0.3，这里需要运行时的浮点数加法
+	a, b := 0.1, 0.2
+	sum := a + b
+
+	tests := []struct {
+		name      string
+		input     any
+		precision int
+		expected  any
+	}{
+		{"sum of decimals", sum, 2, 0.3},
+		{"round half up", 2.675001, 2, 2.68},
+		{"zero places", 3.6, 0, 4.0},
+		{"negative keeps precision", sum, -1, sum},
+		{"int64 unchanged", int64(100), 2, int64(100)},
+		{"string unchanged", "0.123", 1, "0.123"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			variant := NewVariant(tt.input)
+			assert.Equal(t, tt.expected, variant.Rounded(tt.precision))
+			// 只影响展示，Variant 中的值保持不变
+			assert.Equal(t, tt.input, variant.Value)
+		})
+	}
+
+	variant := NewVariant(sum)
+	data, err := MarshalJSON(variant.Rounded(2))
+	assert.NoError(t, err)
+	assert.Equal(t, "0.3", string(data))
+}
+
 func TestVariant_SerializationRoundtrip(t *testing.T) {
 	tests := []struct {
 		name  string
@@ -39,8 +39,14 @@ func IsDir(path string) bool {
 	return s.IsDir()
 }
 
+// Flusher 是可以刷盘并且关闭的文件，*os.File 实现了这个接口
+type Flusher interface {
+	Sync() error
+	Close() error
+}
+
 // FlushToDisk 封装了文件的 Sync 和 Close 操作，减少重复代码
-func FlushToDisk(fd *os.File) error {
+func FlushToDisk(fd Flusher) error {
 	err := fd.Sync()
 	if err != nil {
 		return fmt.Errorf("failed to flush to disk: %w", err)
@@ -32,19 +32,74 @@ func DeepMergeMaps(base, news map[string]interface{}) {
 	}
 }
 
+// DefaultSearchDepth 是递归搜索嵌套 map 默认的最大深度，最外层的 map 深度为 1
+const DefaultSearchDepth = 32
+
 func SearchInMap(m map[string]any, key string) []any {
+	results, _ := SearchInMapDepth(m, key, DefaultSearchDepth)
+	return results
+}
+
+// SearchInMapDepth 递归查找嵌套 map 中所有键为 key 的值，超过 maxDepth 的嵌套层级不会继续搜索，
+// 返回已经找到的部分结果，并且第二个返回值为 true 表示搜索被深度限制截断了，避免层级过深或者循环引用的 map 导致栈溢出。
+func SearchInMapDepth(m map[string]any, key string, maxDepth int) ([]any, bool) {
 	var results []any
+	exceeded := searchInMap(m, key, 1, maxDepth, &results)
+	return results, exceeded
+}
+
+func searchInMap(m map[string]any, key string, depth, maxDepth int, results *[]any) bool {
+	if depth > maxDepth {
+		return true
+	}
+
 	if item, exists := m[key]; exists {
-		results = append(results, item)
+		*results = append(*results, item)
 	}
 
+	exceeded := false
 	// 遍历 map，查找是否有嵌套的 map 类型
 	for _, value := range m {
 		if nestedMap, ok := value.(map[string]any); ok {
 			// 递归查找嵌套的 map
-			results = append(results, SearchInMap(nestedMap, key)...)
+			if searchInMap(nestedMap, key, depth+1, maxDepth, results) {
+				exceeded = true
+			}
 		}
 	}
 
-	return results
+	return exceeded
+}
+
+// ExceedsDepth 判断 v 的嵌套层级是否超过了 maxDepth，map 和切片都算作一层，最外层的 map 深度为 1，
+// 发现超过之后立即返回，不会遍历剩下的数据，maxDepth <= 0 表示不限制。
+func ExceedsDepth(v any, maxDepth int) bool {
+	if maxDepth <= 0 {
+		return false
+	}
+	return exceedsDepth(v, 1, maxDepth)
+}
+
+func exceedsDepth(v any, depth, maxDepth int) bool {
+	switch value := v.(type) {
+	case map[string]any:
+		if depth > maxDepth {
+			return true
+		}
+		for _, item := range value {
+			if exceedsDepth(item, depth+1, maxDepth) {
+				return true
+			}
+		}
+	case []any:
+		if depth > maxDepth {
+			return true
+		}
+		for _, item := range value {
+			if exceedsDepth(item, depth+1, maxDepth) {
+				return true
+			}
+		}
+	}
+	return false
 }
@@ -88,3 +88,65 @@ func TestDeepMergeMaps(t *testing.T) {
 		})
 	}
 }
+
+func TestSearchInMapDepth(t *testing.T) {
+	// 构造一个 10000 层嵌套的 map，每一层都有一个 id 字段
+	root := map[string]any{"id": 0}
+	current := root
+	for i := 1; i < 10000; i++ {
+		next := map[string]any{"id": i}
+		current["child"] = next
+		current = next
+	}
+
+	results, exceeded := SearchInMapDepth(root, "id", 5)
+	if !exceeded {
+		t.Errorf("expected depth limit to be exceeded")
+	}
+	if len(results) != 5 {
+		t.Errorf("expected 5 partial results, got %d", len(results))
+	}
+
+	results, exceeded = SearchInMapDepth(root, "id", 10000)
+	if exceeded || len(results) != 10000 {
+		t.Errorf("expected all 10000 results without exceeding, got %d (exceeded=%v)", len(results), exceeded)
+	}
+
+	// 循环引用的 map 也会在深度限制处停止
+	cyclic := map[string]any{"id": "cyclic"}
+	cyclic["self"] = cyclic
+	results = SearchInMap(cyclic, "id")
+	if len(results) != DefaultSearchDepth {
+		t.Errorf("expected %d results from cyclic map, got %d", DefaultSearchDepth, len(results))
+	}
+}
+
+func TestExceedsDepth(t *testing.T) {
+	nested := map[string]any{
+		"a": map[string]any{
+			"b": []any{
+				map[string]any{"c": 1},
+			},
+		},
+	}
+
+	if ExceedsDepth(nested, 0) {
+		t.Errorf("expected no limit when maxDepth is 0")
+	}
+	if ExceedsDepth(nested, 4) {
+		t.Errorf("expected depth 4 to be within the limit")
+	}
+	if !ExceedsDepth(nested, 3) {
+		t.Errorf("expected depth 4 to exceed the limit of 3")
+	}
+	if ExceedsDepth(map[string]any{"a": 1}, 1) {
+		t.Errorf("expected a flat map to have depth 1")
+	}
+
+	// 循环引用的 map 会在超过限制的时候停止
+	cyclic := map[string]any{}
+	cyclic["self"] = cyclic
+	if !ExceedsDepth(cyclic, 100) {
+		t.Errorf("expected cyclic map to exceed the limit")
+	}
+}
@@ -0,0 +1,175 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vfs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	ErrReadOnly           = errors.New("storage is opened read-only")
+	ErrCheckpointNotFound = errors.New("no checkpoint found before the given timestamp")
+)
+
+// readOnlyFile 是只读实例的 active region，所有的写入都会返回 ErrReadOnly
+type readOnlyFile struct {
+	File
+}
+
+func (readOnlyFile) Write([]byte) (int, error) {
+	return 0, ErrReadOnly
+}
+
+// OpenFSAtCheckpoint 以只读的方式打开 checkpointTimestamp（unix 秒）之前最近的一个检查点时的数据库状态，用于调试或者按时间点读取。
+// 索引直接从检查点恢复，不会重放检查点之后的写入，只打开检查点生成时已经存在的 region，所有的写入、垃圾回收和快照导出都会返回 ErrReadOnly。
+// 检查点之后被垃圾回收删除的 region 无法再读取，对应的 key 读取的时候会返回 ErrRegionUnavailable。
+func OpenFSAtCheckpoint(opt *Options, checkpointTimestamp int64) (*LogStructuredFS, error) {
+	ext, index, err := opt.fileNames()
+	if err != nil {
+		return nil, err
+	}
+
+	fsys := opt.FS
+	if fsys == nil {
+		fsys = OSFilesystem{}
+	}
+
+	ckpts, err := globFiles(fsys, opt.Path, ckptExtension)
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan checkpoint files: %w", err)
+	}
+
+	path, pauseId, err := selectCheckpoint(ckpts, checkpointTimestamp)
+	if err != nil {
+		return nil, err
+	}
+
+	stat, err := fsys.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get checkpoint file info: %w", err)
+	}
+
+	storage := &LogStructuredFS{
+		indexs:          make([]*indexMap, shard),
+		regions:         make(map[int64]*Region, 10),
+		directory:       opt.Path,
+		gcstate:         _GC_INIT,
+		fsPerm:          opt.FSPerm,
+		fsys:            fsys,
+		regionThreshold: int64(opt.Threshold) * gb,
+		readOnly:        true,
+		fileExtension:   ext,
+		indexFileName:   index,
+	}
+
+	// 检查点中的索引数量是确定的，按照实际的数量分配，不需要像 OpenFS 一样预留大量的内存
+	size := stat.Size() / _INDEX_SEGMENT_SIZE / int64(shard)
+	for i := 0; i < shard; i++ {
+		storage.indexs[i] = &indexMap{
+			index:    make(map[uint64]*inode, size),
+			capacity: int(size),
+		}
+	}
+
+	err = storage.openRegionsReadOnly(pauseId)
+	if err != nil {
+		_ = storage.CloseFS()
+		return nil, fmt.Errorf("failed to open data regions: %w", err)
+	}
+
+	err = recoveryCheckpointIndex(fsys, path, storage.indexs)
+	if err != nil {
+		_ = storage.CloseFS()
+		return nil, err
+	}
+
+	if opt.OrderedKeys {
+		storage.ordered = new(orderedKeys)
+		err = storage.rebuildOrderedKeys()
+		if err != nil {
+			_ = storage.CloseFS()
+			return nil, fmt.Errorf("failed to rebuild ordered keys: %w", err)
+		}
+	}
+
+	storage.ready.Store(true)
+
+	return storage, nil
+}
+
+// openRegionsReadOnly 以只读的方式打开 ID 不大于 upto 的 region，检查点的索引不会引用之后创建的 region。
+// 所有的 region 都通过 ReaderAt 读取，active 指向最新的 region 但是不能写入。
+func (lfs *LogStructuredFS) openRegionsReadOnly(upto int64) error {
+	files, err := lfs.fsys.ReadDir(lfs.directory)
+	if err != nil {
+		return fmt.Errorf("failed to read directory: %w", err)
+	}
+
+	lfs.regionId = -1
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), lfs.fileExtension) || !strings.HasPrefix(file.Name(), "0") {
+			continue
+		}
+
+		if truncated, err := isTruncatedRegion(file); err != nil || truncated {
+			continue
+		}
+
+		regionId, err := parseDataFileName(file.Name(), lfs.fileExtension)
+		if err != nil {
+			return fmt.Errorf("failed to get region id: %w", err)
+		}
+
+		if regionId > upto {
+			continue
+		}
+
+		fd, err := lfs.fsys.OpenFile(filepath.Join(lfs.directory, file.Name()), os.O_RDONLY, lfs.fsPerm)
+		if err != nil {
+			return fmt.Errorf("failed to open data file: %w", err)
+		}
+
+		reader, err := openReaderAt(lfs.fsys, filepath.Join(lfs.directory, file.Name()))
+		if err != nil {
+			_ = fd.Close()
+			return fmt.Errorf("failed to mmap data file: %w", err)
+		}
+
+		lfs.regions[regionId] = &Region{Fd: fd, ReaderAt: reader}
+		if regionId > lfs.regionId {
+			lfs.regionId = regionId
+		}
+	}
+
+	if lfs.regionId < 0 {
+		return fmt.Errorf("%w: no data region before checkpoint region %d", ErrRegionNotFound, upto)
+	}
+
+	active := lfs.regions[lfs.regionId].Fd
+	offset, err := active.Seek(0, io.SeekEnd)
+	if err != nil {
+		return fmt.Errorf("failed to get region file offset: %w", err)
+	}
+
+	lfs.active = readOnlyFile{File: active}
+	lfs.offset = offset
+
+	return nil
+}
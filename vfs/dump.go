@@ -0,0 +1,112 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vfs
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+)
+
+// IndexEntry 是索引文件中的一条记录，DumpIndex 以 JSON Lines 的格式输出，
+// 校验失败的记录只有 Offset 和 Error 字段是有效的。
+type IndexEntry struct {
+	Offset    int64  `json:"offset"`
+	Inum      uint64 `json:"inum"`
+	RegionId  int64  `json:"region_id"`
+	Position  int64  `json:"position"`
+	Length    int32  `json:"length"`
+	CreatedAt int64  `json:"created_at"`
+	ExpiredAt int64  `json:"expired_at"`
+	Key       string `json:"key,omitempty"`
+	Type      string `json:"type,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// DumpIndex 把数据目录下的 index.db 索引快照以可读的 JSON Lines 格式写入 w，用于排查启动恢复的问题
+func (lfs *LogStructuredFS) DumpIndex(w io.Writer) error {
+	return lfs.DumpIndexFile(filepath.Join(lfs.directory, lfs.indexFileName), w)
+}
+
+// DumpIndexFile 和 DumpIndex 一样，但是可以指定索引文件的路径，例如 .ckpt 检查点文件。
+// 每条记录都会校验 CRC32，校验失败的记录输出错误信息之后继续处理后面的记录，
+// 记录的数据类型需要从 region 中读取 segment 的头部，region 已经被回收或者读取失败的时候类型为空。
+func (lfs *LogStructuredFS) DumpIndexFile(path string, w io.Writer) error {
+	reader, err := openReaderAt(lfs.fsys, path)
+	if err != nil {
+		return fmt.Errorf("failed to open index file: %w", err)
+	}
+	defer reader.Close()
+
+	encoder := json.NewEncoder(w)
+	buf := make([]byte, _INDEX_SEGMENT_SIZE)
+
+	for offset := int64(len(dataFileMetadata)); offset < int64(reader.Len()); {
+		entry := IndexEntry{Offset: offset}
+
+		record, err := readIndexRecord(reader, offset, buf)
+		if err != nil {
+			// 记录的长度是不确定的，读取失败之后无法定位下一条记录的位置
+			entry.Error = fmt.Sprintf("failed to read index node: %v", err)
+			err = encoder.Encode(&entry)
+			if err != nil {
+				return fmt.Errorf("failed to write index entry: %w", err)
+			}
+			return nil
+		}
+
+		buf = record
+		offset += int64(len(record))
+
+		inum, inode, err := deserializedIndex(record)
+		if err != nil {
+			entry.Error = err.Error()
+		} else {
+			entry.Inum = inum
+			entry.RegionId = inode.RegionId
+			entry.Position = inode.Position
+			entry.Length = inode.Length
+			entry.CreatedAt = inode.CreatedAt
+			entry.ExpiredAt = inode.ExpiredAt
+			entry.Key = inode.key
+			entry.Type = lfs.segmentType(inode)
+		}
+
+		err = encoder.Encode(&entry)
+		if err != nil {
+			return fmt.Errorf("failed to write index entry: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// segmentType 读取 inode 指向的 segment 的数据类型，快照中保存了 key 的时候直接使用记录中的类型
+func (lfs *LogStructuredFS) segmentType(inode *inode) string {
+	if inode.key != "" {
+		return kindToString[inode.kind]
+	}
+
+	lfs.mu.RLock()
+	defer lfs.mu.RUnlock()
+
+	_, seg, err := lfs.readInode(inode)
+	if err != nil {
+		return ""
+	}
+
+	return seg.TypeString()
+}
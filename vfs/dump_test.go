@@ -0,0 +1,120 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vfs
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/auula/urnadb/conf"
+	"github.com/auula/urnadb/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDumpIndex(t *testing.T) {
+	fss, err := OpenFS(&Options{
+		FSPerm:    conf.FSPerm,
+		Path:      t.TempDir(),
+		Threshold: 1,
+	})
+	assert.NoError(t, err)
+	defer fss.StopExpireLoop()
+
+	values := map[string]Serializable{
+		"dump-variant": types.NewVariant("value"),
+		"dump-record":  types.NewRecord(),
+		"dump-table":   types.NewTable(),
+		"dump-list":    types.NewList("a"),
+	}
+	expected := map[string]string{
+		"dump-variant": "VARIANT",
+		"dump-record":  "RECORD",
+		"dump-table":   "TABLE",
+		"dump-list":    "LIST",
+	}
+
+	for key, value := range values {
+		seg, err := NewSegment(key, value, 60)
+		assert.NoError(t, err)
+		assert.NoError(t, fss.PutSegment(key, seg))
+	}
+
+	// index.db 还没有生成
+	assert.Error(t, fss.DumpIndex(new(bytes.Buffer)))
+
+	assert.NoError(t, fss.ExportSnapshotIndex())
+
+	dump := func() []IndexEntry {
+		var out bytes.Buffer
+		assert.NoError(t, fss.DumpIndex(&out))
+
+		var entries []IndexEntry
+		scanner := bufio.NewScanner(&out)
+		for scanner.Scan() {
+			var entry IndexEntry
+			assert.NoError(t, json.Unmarshal(scanner.Bytes(), &entry))
+			entries = append(entries, entry)
+		}
+		return entries
+	}
+
+	entries := dump()
+	assert.Len(t, entries, len(values))
+
+	for key, kind := range expected {
+		inum := keyHash(key)
+		node := fss.indexs[inum%uint64(shard)].index[inum]
+
+		var found bool
+		for _, entry := range entries {
+			if entry.Inum != inum {
+				continue
+			}
+			found = true
+			assert.Empty(t, entry.Error)
+			assert.Equal(t, kind, entry.Type)
+			assert.Equal(t, node.RegionId, entry.RegionId)
+			assert.Equal(t, node.Position, entry.Position)
+			assert.Equal(t, node.Length, entry.Length)
+			assert.Equal(t, node.CreatedAt, entry.CreatedAt)
+			assert.Equal(t, node.ExpiredAt, entry.ExpiredAt)
+		}
+		assert.True(t, found, key)
+	}
+
+	// 损坏第二条记录，校验失败的记录单独报告，其他记录不受影响
+	path := filepath.Join(fss.directory, defaultIndexFileName)
+	data, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	data[len(dataFileMetadata)+_INDEX_SEGMENT_SIZE+10] ^= 0xFF
+	assert.NoError(t, os.WriteFile(path, data, conf.FSPerm))
+
+	entries = dump()
+	assert.Len(t, entries, len(values))
+
+	var corrupted int
+	for _, entry := range entries {
+		if entry.Error != "" {
+			corrupted++
+			assert.Equal(t, int64(len(dataFileMetadata)+_INDEX_SEGMENT_SIZE), entry.Offset)
+			assert.Contains(t, entry.Error, "checksum mismatch")
+		}
+	}
+	assert.Equal(t, 1, corrupted)
+}
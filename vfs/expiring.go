@@ -0,0 +1,129 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vfs
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// scanCheckInterval 扫描索引的时候每处理这么多个 inode 检查一次 ctx 是否已经被取消
+const scanCheckInterval = 1024
+
+// KeyTTL 是即将过期的 key 和它剩余的存活时长
+type KeyTTL struct {
+	Inum uint64        `json:"inum"`
+	Key  string        `json:"key"`
+	TTL  time.Duration `json:"ttl"`
+}
+
+// ExpiringWithin 返回过期时间在 (now, now+d] 区间内的 key，按照剩余时长从短到长排序。
+// 过期时间直接使用索引中的字段判断，只有命中的 key 才会从 region 中读取 segment 头部和 key，不会读取 value。
+// 扫描期间会定期检查 ctx，调用方取消或者超时之后立即返回 ctx 的错误。
+func (lfs *LogStructuredFS) ExpiringWithin(ctx context.Context, d time.Duration) ([]KeyTTL, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UnixMicro()
+	deadline := now + d.Microseconds()
+
+	// 读取 region 需要持有 lfs.mu 的读锁，锁的顺序和写入时保持一致
+	lfs.mu.RLock()
+	defer lfs.mu.RUnlock()
+
+	var (
+		keys    []KeyTTL
+		scanned int
+	)
+	for _, imap := range lfs.indexs {
+		imap.mu.RLock()
+		for inum, inode := range imap.index {
+			scanned++
+			if scanned%scanCheckInterval == 0 && ctx.Err() != nil {
+				imap.mu.RUnlock()
+				return nil, ctx.Err()
+			}
+
+			expiredAt := atomic.LoadInt64(&inode.ExpiredAt)
+			if expiredAt <= now || expiredAt > deadline {
+				continue
+			}
+
+			key, err := lfs.readInodeKey(inode)
+			if err != nil {
+				imap.mu.RUnlock()
+				return nil, fmt.Errorf("failed to read key (inum: %d): %w", inum, err)
+			}
+
+			keys = append(keys, KeyTTL{
+				Inum: inum,
+				Key:  key,
+				TTL:  time.Duration(expiredAt-now) * time.Microsecond,
+			})
+		}
+		imap.mu.RUnlock()
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].TTL < keys[j].TTL
+	})
+
+	return keys, nil
+}
+
+// readInodeKey 只读取 segment 的头部和 key 部分，不会读取 value
+func (lfs *LogStructuredFS) readInodeKey(inode *inode) (string, error) {
+	key, _, err := lfs.readInodeMeta(inode)
+	return key, err
+}
+
+// readInodeMeta 只读取 segment 的头部和 key 部分，头部中第 1 个字节是类型，KLEN 位于第 18 个字节开始的 4 个字节，
+// inode 中保存了 key 的时候直接返回，不需要读取 region
+func (lfs *LogStructuredFS) readInodeMeta(inode *inode) (string, kind, error) {
+	if inode.key != "" {
+		return inode.key, inode.kind, nil
+	}
+
+	region, ok := lfs.regions[atomic.LoadInt64(&inode.RegionId)]
+	if !ok {
+		return "", 0, fmt.Errorf("data region with ID %d not found", inode.RegionId)
+	}
+
+	var reader io.ReaderAt = region.Fd
+	if region.ReaderAt != nil {
+		reader = region.ReaderAt
+	}
+
+	position := atomic.LoadInt64(&inode.Position)
+	header := make([]byte, _SEGMENT_PADDING)
+	_, err := reader.ReadAt(header, position)
+	if err != nil {
+		return "", 0, err
+	}
+
+	key := make([]byte, binary.LittleEndian.Uint32(header[18:22]))
+	_, err = reader.ReadAt(key, position+_SEGMENT_PADDING)
+	if err != nil {
+		return "", 0, err
+	}
+
+	return string(key), kind(header[1]), nil
+}
@@ -0,0 +1,170 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vfs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/auula/urnadb/types"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// archiveMagic 是导出文件的第一个值，用来识别文件格式和版本
+const archiveMagic = "urnadb-export/1"
+
+var ErrInvalidArchive = errors.New("invalid export archive")
+
+// archiveEntry 是导出文件中的一条记录，Value 是经过 pipeline 解码之后的原始数据，
+// 导入的时候使用目标实例自己的 pipeline 重新编码，所以两边的压缩和加密配置可以不一样。
+type archiveEntry struct {
+	Key       string `msgpack:"k"`
+	Type      string `msgpack:"t"`
+	Value     []byte `msgpack:"v"`
+	CreatedAt int64  `msgpack:"c"`
+	ExpiredAt int64  `msgpack:"e"`
+	// Codec 是 Value 的序列化格式，旧版本导出的文件没有这个字段，解码之后就是 msgpack
+	Codec types.ValueCodec `msgpack:"f,omitempty"`
+	// Writer 是写入者标识，没有的时候不导出
+	Writer string `msgpack:"w,omitempty"`
+	// Immutable 标记不可变的 key，导入之后仍然不能被覆盖或者删除
+	Immutable bool `msgpack:"i,omitempty"`
+}
+
+// Export 把所有以 prefix 开头的存活 key 以 msgpack 流的格式写入 w，返回导出的 key 数量，prefix 为空表示导出全部。
+// 每次只读取一个 key 的数据写出去，不会把整个数据集缓存在内存中，已经过期和删除的 key 不会被导出，
+// 过期时间按照绝对时间导出，导入之后剩余的存活时间保持不变。
+func (lfs *LogStructuredFS) Export(w io.Writer, prefix string) (int, error) {
+	enc := msgpack.NewEncoder(w)
+	err := enc.EncodeString(archiveMagic)
+	if err != nil {
+		return 0, err
+	}
+
+	var (
+		count     int
+		exportErr error
+	)
+	err = lfs.ScanMeta(func(key string, _ string, _, _ int64) bool {
+		if !strings.HasPrefix(key, prefix) {
+			return true
+		}
+
+		_, seg, err := lfs.FetchSegment(key)
+		if err != nil {
+			// 扫描之后被删除或者过期的 key 直接跳过
+			return true
+		}
+
+		// 索引使用的是 key 的哈希值，需要排除哈希冲突的情况
+		if seg.KeyString() != key {
+			return true
+		}
+
+		exportErr = enc.Encode(&archiveEntry{
+			Key:       key,
+			Type:      seg.TypeString(),
+			Value:     seg.Value,
+			CreatedAt: seg.CreatedAt,
+			ExpiredAt: seg.ExpiredAt,
+			Codec:     seg.Codec,
+			Writer:    seg.Writer,
+			Immutable: seg.Immutable,
+		})
+		if exportErr != nil {
+			return false
+		}
+
+		count++
+		return true
+	})
+	if err != nil {
+		return count, err
+	}
+
+	return count, exportErr
+}
+
+// Import 读取 Export 导出的数据并写入当前实例，已经存在的 key 会被覆盖，导入时已经过期的记录会被跳过，返回导入的 key 数量
+func (lfs *LogStructuredFS) Import(r io.Reader) (int, error) {
+	dec := msgpack.NewDecoder(r)
+	magic, err := dec.DecodeString()
+	if err != nil || magic != archiveMagic {
+		return 0, ErrInvalidArchive
+	}
+
+	count := 0
+	for {
+		var entry archiveEntry
+		err := dec.Decode(&entry)
+		if errors.Is(err, io.EOF) {
+			return count, nil
+		}
+		if err != nil {
+			return count, fmt.Errorf("%w: %v", ErrInvalidArchive, err)
+		}
+
+		if isExpired(entry.ExpiredAt) {
+			continue
+		}
+
+		seg, err := newArchiveSegment(&entry)
+		if err != nil {
+			return count, err
+		}
+
+		err = lfs.PutSegment(entry.Key, seg)
+		if err != nil {
+			return count, err
+		}
+
+		count++
+	}
+}
+
+func newArchiveSegment(entry *archiveEntry) (*Segment, error) {
+	var t kind = _UNKNOWN
+	for k, name := range kindToString {
+		if name == entry.Type {
+			t = k
+			break
+		}
+	}
+
+	if t == _UNKNOWN {
+		return nil, fmt.Errorf("%w: unknown type %q of key %s", ErrInvalidArchive, entry.Type, entry.Key)
+	}
+
+	encodedata, err := pipeline.Encode(entry.Value)
+	if err != nil {
+		return nil, fmt.Errorf("pipeline encode: %w", err)
+	}
+
+	return &Segment{
+		Type:      t,
+		Tombstone: 0,
+		Codec:     entry.Codec,
+		Writer:    entry.Writer,
+		Immutable: entry.Immutable,
+		CreatedAt: entry.CreatedAt,
+		ExpiredAt: entry.ExpiredAt,
+		KeySize:   int32(len(entry.Key)),
+		ValueSize: int32(len(encodedata)),
+		Key:       []byte(entry.Key),
+		Value:     encodedata,
+	}, nil
+}
@@ -0,0 +1,121 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vfs
+
+import (
+	"bytes"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/auula/urnadb/conf"
+	"github.com/auula/urnadb/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExportImportRoundTrip(t *testing.T) {
+	source, err := OpenFS(&Options{
+		FSPerm:    conf.FSPerm,
+		Path:      t.TempDir(),
+		Threshold: 1,
+	})
+	assert.NoError(t, err)
+
+	values := map[string]Serializable{
+		"tenant-a:variant": types.NewVariant("value"),
+		"tenant-a:record":  &types.Record{Record: map[string]any{"name": "urnadb"}},
+		"tenant-a:list":    types.NewList("x", "y"),
+		"tenant-a:deleted": types.NewVariant("gone"),
+		"tenant-a:expired": types.NewVariant("gone"),
+		"tenant-b:variant": types.NewVariant("other"),
+	}
+	for key, value := range values {
+		ttl := int64(0)
+		if key == "tenant-a:record" {
+			ttl = 3600
+		}
+		seg, err := NewSegment(key, value, ttl)
+		assert.NoError(t, err)
+		assert.NoError(t, source.PutSegment(key, seg))
+	}
+
+	immutable, err := NewSegment("tenant-a:immutable", types.NewList("audit"), 0)
+	assert.NoError(t, err)
+	immutable.Immutable = true
+	assert.NoError(t, source.PutSegment("tenant-a:immutable", immutable))
+
+	assert.NoError(t, source.DeleteSegment("tenant-a:deleted"))
+	inum := keyHash("tenant-a:expired")
+	atomic.StoreInt64(&source.indexs[inum%uint64(shard)].index[inum].ExpiredAt, time.Now().Add(-time.Second).UnixMicro())
+
+	expected := make(map[string]*Segment)
+	for _, key := range []string{"tenant-a:variant", "tenant-a:record", "tenant-a:list", "tenant-a:immutable"} {
+		_, seg, err := source.FetchSegment(key)
+		assert.NoError(t, err)
+		expected[key] = seg
+	}
+
+	var archive bytes.Buffer
+	count, err := source.Export(&archive, "tenant-a:")
+	assert.NoError(t, err)
+	assert.Equal(t, 4, count)
+
+	source.StopExpireLoop()
+	assert.NoError(t, source.CloseFS())
+
+	target, err := OpenFS(&Options{
+		FSPerm:    conf.FSPerm,
+		Path:      t.TempDir(),
+		Threshold: 1,
+	})
+	assert.NoError(t, err)
+	defer target.StopExpireLoop()
+
+	count, err = target.Import(&archive)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, count)
+
+	for key, want := range expected {
+		_, got, err := target.FetchSegment(key)
+		if !assert.NoError(t, err, key) {
+			continue
+		}
+		assert.Equal(t, want.Type, got.Type, key)
+		assert.Equal(t, want.Value, got.Value, key)
+		assert.Equal(t, want.CreatedAt, got.CreatedAt, key)
+		assert.Equal(t, want.ExpiredAt, got.ExpiredAt, key)
+		assert.Equal(t, want.Immutable, got.Immutable, key)
+	}
+
+	// 导入之后不可变的 key 仍然不能被覆盖或者删除
+	assert.ErrorIs(t, target.DeleteSegment("tenant-a:immutable"), ErrImmutable)
+
+	for _, key := range []string{"tenant-a:deleted", "tenant-a:expired", "tenant-b:variant"} {
+		assert.False(t, target.IsActive(key), key)
+	}
+}
+
+func TestImportInvalidArchive(t *testing.T) {
+	fss, err := OpenFS(&Options{
+		FSPerm:    conf.FSPerm,
+		Path:      t.TempDir(),
+		Threshold: 1,
+	})
+	assert.NoError(t, err)
+	defer fss.StopExpireLoop()
+
+	_, err = fss.Import(bytes.NewReader([]byte("not an archive")))
+	assert.ErrorIs(t, err, ErrInvalidArchive)
+}
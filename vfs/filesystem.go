@@ -0,0 +1,250 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vfs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/exp/mmap"
+)
+
+// File 是存储引擎对单个文件需要的操作集合，默认实现就是 *os.File
+type File interface {
+	io.Reader
+	io.ReaderAt
+	io.Writer
+	io.Seeker
+	io.Closer
+	Name() string
+	Stat() (fs.FileInfo, error)
+	Sync() error
+}
+
+// Filesystem 把存储引擎对文件系统的操作抽象出来，默认实现直接包装 os 包，
+// 通过 Options.FS 可以替换为只读挂载的快照、内存文件系统或者对象存储等自定义的后端。
+type Filesystem interface {
+	Open(name string) (File, error)
+	OpenFile(name string, flag int, perm fs.FileMode) (File, error)
+	ReadDir(name string) ([]fs.DirEntry, error)
+	Stat(name string) (fs.FileInfo, error)
+	Remove(name string) error
+	Rename(oldpath, newpath string) error
+	MkdirAll(path string, perm fs.FileMode) error
+}
+
+// ReaderAt 是只读 region 和索引文件的读取接口，默认的文件系统使用 mmap 实现
+type ReaderAt interface {
+	io.ReaderAt
+	io.Closer
+	Len() int
+}
+
+// ErrReadTimeout 读取 region 超过了 Options.ReadTimeout 还没有返回，一般是网络文件系统挂起或者磁盘故障导致的
+var ErrReadTimeout = errors.New("storage read timed out")
+
+// timeoutReaderAt 在单独的 goroutine 中执行 ReadAt，超过 timeout 还没有返回的时候直接返回 ErrReadTimeout，
+// 卡住的 goroutine 会一直等到底层的读取返回才退出，读取的数据先写入自己的缓冲区，超时之后不会再修改调用者的 p。
+type timeoutReaderAt struct {
+	reader  io.ReaderAt
+	timeout time.Duration
+}
+
+func (r *timeoutReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	type result struct {
+		n   int
+		err error
+	}
+
+	buf := make([]byte, len(p))
+	done := make(chan result, 1)
+	go func() {
+		n, err := r.reader.ReadAt(buf, off)
+		done <- result{n: n, err: err}
+	}()
+
+	timer := time.NewTimer(r.timeout)
+	defer timer.Stop()
+
+	select {
+	case res := <-done:
+		copy(p, buf[:res.n])
+		return res.n, res.err
+	case <-timer.C:
+		return 0, fmt.Errorf("%w after %s", ErrReadTimeout, r.timeout)
+	}
+}
+
+// _RECOVERY_READAHEAD 开启 Options.RecoveryReadahead 之后启动恢复每次从 region 中顺序读取的大小
+const _RECOVERY_READAHEAD = 4 << 20
+
+// readaheadReaderAt 用于启动恢复的时候顺序扫描 region，每次从底层按照 _RECOVERY_READAHEAD 读取一大块数据缓存下来，
+// 之后落在缓存中的 ReadAt 直接从内存中拷贝，把解析 segment 时大量的小 ReadAt 变成少量的顺序读取。
+// 只适合偏移量单调递增的读取，超过缓存大小的读取直接交给底层，不是并发安全的。
+type readaheadReaderAt struct {
+	reader io.ReaderAt
+	buf    []byte
+	start  int64 // buf[0] 在文件中的偏移量
+}
+
+func newReadaheadReaderAt(reader io.ReaderAt, size int) *readaheadReaderAt {
+	return &readaheadReaderAt{reader: reader, buf: make([]byte, 0, size)}
+}
+
+func (r *readaheadReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off >= r.start && off+int64(len(p)) <= r.start+int64(len(r.buf)) {
+		return copy(p, r.buf[off-r.start:]), nil
+	}
+
+	if len(p) > cap(r.buf) {
+		return r.reader.ReadAt(p, off)
+	}
+
+	n, err := r.reader.ReadAt(r.buf[:cap(r.buf)], off)
+	r.buf, r.start = r.buf[:n], off
+
+	// 读到文件末尾的时候缓冲区读不满，只要覆盖了 p 就不算错误
+	if n >= len(p) && (err == nil || errors.Is(err, io.EOF)) {
+		return copy(p, r.buf), nil
+	}
+	if err == nil {
+		err = io.ErrUnexpectedEOF
+	}
+	return copy(p, r.buf), err
+}
+
+// OSFilesystem 是基于 os 包的默认文件系统实现
+type OSFilesystem struct{}
+
+// 这里不能直接返回 os.Open 的结果，否则失败时会得到一个值为 nil 但是类型不为 nil 的接口
+func (OSFilesystem) Open(name string) (File, error) {
+	fd, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return fd, nil
+}
+
+func (OSFilesystem) OpenFile(name string, flag int, perm fs.FileMode) (File, error) {
+	fd, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return fd, nil
+}
+
+func (OSFilesystem) ReadDir(name string) ([]fs.DirEntry, error) {
+	return os.ReadDir(name)
+}
+
+func (OSFilesystem) Stat(name string) (fs.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (OSFilesystem) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (OSFilesystem) Rename(oldpath, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
+
+func (OSFilesystem) MkdirAll(path string, perm fs.FileMode) error {
+	return os.MkdirAll(path, perm)
+}
+
+// fileReaderAt 是非 os 文件系统下的只读文件读取器，文件长度在打开的时候就固定下来了
+type fileReaderAt struct {
+	File
+	size int
+}
+
+func (r *fileReaderAt) Len() int {
+	return r.size
+}
+
+// openReaderAt 打开一个只读文件，默认的文件系统使用 mmap 映射，其他的文件系统直接使用 File 的 ReadAt 读取
+func openReaderAt(fsys Filesystem, name string) (ReaderAt, error) {
+	if _, ok := fsys.(OSFilesystem); ok {
+		reader, err := mmap.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		return reader, nil
+	}
+
+	fd, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	stat, err := fd.Stat()
+	if err != nil {
+		_ = fd.Close()
+		return nil, err
+	}
+
+	return &fileReaderAt{File: fd, size: int(stat.Size())}, nil
+}
+
+// syncDir 把目录中 Rename 之类的元数据修改刷到磁盘，保证系统崩溃之后新的文件名仍然可见。
+// 只有默认的文件系统可以打开目录刷盘，其他的文件系统由实现自己保证元数据的持久化。
+func syncDir(fsys Filesystem, dir string) error {
+	if _, ok := fsys.(OSFilesystem); !ok {
+		return nil
+	}
+
+	fd, err := fsys.Open(dir)
+	if err != nil {
+		return err
+	}
+
+	err = fd.Sync()
+	if err != nil {
+		_ = fd.Close()
+		return err
+	}
+
+	return fd.Close()
+}
+
+// isExist 检查文件或者目录是否存在，和 utils.IsExist 的语义一致，其他错误也认为是存在的
+func isExist(fsys Filesystem, name string) bool {
+	_, err := fsys.Stat(name)
+	return !(err != nil && errors.Is(err, fs.ErrNotExist))
+}
+
+// globFiles 返回目录下所有以 ext 为后缀的文件完整路径
+func globFiles(fsys Filesystem, dir, ext string) ([]string, error) {
+	entries, err := fsys.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []string
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), ext) {
+			files = append(files, filepath.Join(dir, entry.Name()))
+		}
+	}
+
+	return files, nil
+}
@@ -0,0 +1,1063 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vfs
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/auula/urnadb/conf"
+	"github.com/auula/urnadb/types"
+	"github.com/stretchr/testify/assert"
+)
+
+// memFS 是一个只用于测试的内存文件系统实现
+type memFS struct {
+	mu    sync.Mutex
+	files map[string]*memData
+	dirs  map[string]bool
+}
+
+type memData struct {
+	mu   sync.RWMutex
+	data []byte
+}
+
+type memInfo struct {
+	name string
+	size int64
+	dir  bool
+}
+
+func (i *memInfo) Name() string       { return i.name }
+func (i *memInfo) Size() int64        { return i.size }
+func (i *memInfo) ModTime() time.Time { return time.Time{} }
+func (i *memInfo) IsDir() bool        { return i.dir }
+func (i *memInfo) Sys() any           { return nil }
+func (i *memInfo) Mode() fs.FileMode {
+	if i.dir {
+		return fs.ModeDir | 0755
+	}
+	return 0644
+}
+
+type memFile struct {
+	name   string
+	flag   int
+	offset int64
+	closed bool
+	data   *memData
+}
+
+func newMemFS() *memFS {
+	return &memFS{
+		files: make(map[string]*memData),
+		dirs:  map[string]bool{"/": true},
+	}
+}
+
+func (m *memFS) Open(name string) (File, error) {
+	return m.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (m *memFS) OpenFile(name string, flag int, _ fs.FileMode) (File, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	name = filepath.Clean(name)
+	data, ok := m.files[name]
+	switch {
+	case ok && flag&os.O_EXCL != 0:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrExist}
+	case !ok && flag&os.O_CREATE == 0:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	case !ok:
+		if !m.dirs[filepath.Dir(name)] {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+		}
+		data = new(memData)
+		m.files[name] = data
+	}
+
+	if flag&os.O_TRUNC != 0 {
+		data.mu.Lock()
+		data.data = nil
+		data.mu.Unlock()
+	}
+
+	return &memFile{name: name, flag: flag, data: data}, nil
+}
+
+func (m *memFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	name = filepath.Clean(name)
+	if !m.dirs[name] {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	}
+
+	var entries []fs.DirEntry
+	for path, data := range m.files {
+		if filepath.Dir(path) == name {
+			data.mu.RLock()
+			entries = append(entries, fs.FileInfoToDirEntry(&memInfo{name: filepath.Base(path), size: int64(len(data.data))}))
+			data.mu.RUnlock()
+		}
+	}
+
+	for path := range m.dirs {
+		if path != name && filepath.Dir(path) == name {
+			entries = append(entries, fs.FileInfoToDirEntry(&memInfo{name: filepath.Base(path), dir: true}))
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+
+	return entries, nil
+}
+
+func (m *memFS) Stat(name string) (fs.FileInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	name = filepath.Clean(name)
+	if m.dirs[name] {
+		return &memInfo{name: filepath.Base(name), dir: true}, nil
+	}
+
+	if data, ok := m.files[name]; ok {
+		data.mu.RLock()
+		defer data.mu.RUnlock()
+		return &memInfo{name: filepath.Base(name), size: int64(len(data.data))}, nil
+	}
+
+	return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+}
+
+func (m *memFS) Remove(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	name = filepath.Clean(name)
+	if _, ok := m.files[name]; ok {
+		delete(m.files, name)
+		return nil
+	}
+
+	if m.dirs[name] {
+		delete(m.dirs, name)
+		return nil
+	}
+
+	return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+}
+
+func (m *memFS) Rename(oldpath, newpath string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	oldpath, newpath = filepath.Clean(oldpath), filepath.Clean(newpath)
+	data, ok := m.files[oldpath]
+	if !ok {
+		return &fs.PathError{Op: "rename", Path: oldpath, Err: fs.ErrNotExist}
+	}
+
+	delete(m.files, oldpath)
+	m.files[newpath] = data
+
+	return nil
+}
+
+func (m *memFS) MkdirAll(path string, _ fs.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for path = filepath.Clean(path); ; path = filepath.Dir(path) {
+		m.dirs[path] = true
+		if path == filepath.Dir(path) {
+			return nil
+		}
+	}
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+	n, err := f.ReadAt(p, f.offset)
+	f.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		return n, nil
+	}
+	return n, err
+}
+
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+
+	f.data.mu.RLock()
+	defer f.data.mu.RUnlock()
+
+	if off >= int64(len(f.data.data)) {
+		return 0, io.EOF
+	}
+
+	n := copy(p, f.data.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+
+	return n, nil
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+
+	f.data.mu.Lock()
+	defer f.data.mu.Unlock()
+
+	if f.flag&os.O_APPEND != 0 {
+		f.offset = int64(len(f.data.data))
+	}
+
+	if end := f.offset + int64(len(p)); end > int64(len(f.data.data)) {
+		f.data.data = append(f.data.data, make([]byte, end-int64(len(f.data.data)))...)
+	}
+
+	n := copy(f.data.data[f.offset:], p)
+	f.offset += int64(n)
+
+	return n, nil
+}
+
+func (f *memFile) Seek(offset int64, whence int) (int64, error) {
+	f.data.mu.RLock()
+	size := int64(len(f.data.data))
+	f.data.mu.RUnlock()
+
+	switch whence {
+	case io.SeekStart:
+		f.offset = offset
+	case io.SeekCurrent:
+		f.offset += offset
+	case io.SeekEnd:
+		f.offset = size + offset
+	}
+
+	return f.offset, nil
+}
+
+func (f *memFile) Close() error {
+	if f.closed {
+		return os.ErrClosed
+	}
+	f.closed = true
+	return nil
+}
+
+func (f *memFile) Sync() error {
+	if f.closed {
+		return os.ErrClosed
+	}
+	return nil
+}
+
+func (f *memFile) Name() string {
+	return f.name
+}
+
+func (f *memFile) Stat() (fs.FileInfo, error) {
+	f.data.mu.RLock()
+	defer f.data.mu.RUnlock()
+	return &memInfo{name: filepath.Base(f.name), size: int64(len(f.data.data))}, nil
+}
+
+func TestOpenFSWithMemoryFilesystem(t *testing.T) {
+	memfs := newMemFS()
+	path := filepath.Join(t.TempDir(), "memfs")
+
+	fss, err := OpenFS(&Options{
+		FS:        memfs,
+		FSPerm:    conf.FSPerm,
+		Path:      path,
+		Threshold: 1,
+	})
+	assert.NoError(t, err)
+
+	for i := 0; i < 10; i++ {
+		seg, err := NewSegment(fmt.Sprintf("mem-key-%d", i), types.NewVariant(int64(i)), 0)
+		assert.NoError(t, err)
+		assert.NoError(t, fss.PutSegment(seg.KeyString(), seg))
+	}
+
+	assert.NoError(t, fss.DeleteSegment("mem-key-0"))
+
+	_, seg, err := fss.FetchSegment("mem-key-1")
+	if assert.NoError(t, err) {
+		variant, err := seg.ToVariant()
+		assert.NoError(t, err)
+		assert.Equal(t, int64(1), variant.Value)
+	}
+
+	fss.StopExpireLoop()
+	assert.NoError(t, fss.CloseFS())
+
+	// 所有的文件都只在内存文件系统中，真实的磁盘上不应该有任何数据
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+
+	_, err = memfs.Stat(filepath.Join(path, defaultIndexFileName))
+	assert.NoError(t, err)
+
+	// 重新打开之后从内存文件系统中的 index.db 恢复索引
+	recovered, err := OpenFS(&Options{
+		FS:        memfs,
+		FSPerm:    conf.FSPerm,
+		Path:      path,
+		Threshold: 1,
+	})
+	assert.NoError(t, err)
+	defer recovered.StopExpireLoop()
+
+	assert.False(t, recovered.IsActive("mem-key-0"))
+	for i := 1; i < 10; i++ {
+		_, seg, err := recovered.FetchSegment(fmt.Sprintf("mem-key-%d", i))
+		if assert.NoError(t, err) {
+			variant, err := seg.ToVariant()
+			assert.NoError(t, err)
+			assert.Equal(t, int64(i), variant.Value)
+		}
+	}
+}
+
+func TestMemoryFilesystemMultipleRegions(t *testing.T) {
+	memfs := newMemFS()
+	path := "/urnadb-memfs"
+
+	fss, err := OpenFS(&Options{
+		FS:        memfs,
+		FSPerm:    conf.FSPerm,
+		Path:      path,
+		Threshold: 1,
+	})
+	assert.NoError(t, err)
+	defer fss.StopExpireLoop()
+
+	// 缩小 region 的阈值，让旧的 region 使用非 mmap 的方式读取
+	fss.regionThreshold = 256
+
+	for i := 0; i < 50; i++ {
+		seg, err := NewSegment(fmt.Sprintf("region-key-%d", i), types.NewVariant(int64(i)), 0)
+		assert.NoError(t, err)
+		assert.NoError(t, fss.PutSegment(seg.KeyString(), seg))
+	}
+
+	assert.Greater(t, len(fss.regions), 1)
+
+	for i := 0; i < 50; i++ {
+		_, seg, err := fss.FetchSegment(fmt.Sprintf("region-key-%d", i))
+		if assert.NoError(t, err) {
+			variant, err := seg.ToVariant()
+			assert.NoError(t, err)
+			assert.Equal(t, int64(i), variant.Value)
+		}
+	}
+
+	// 不调用 CloseFS 模拟崩溃，重新打开的时候全局扫描内存文件系统中的 region 恢复索引
+	recovered, err := OpenFS(&Options{
+		FS:        memfs,
+		FSPerm:    conf.FSPerm,
+		Path:      path,
+		Threshold: 1,
+	})
+	assert.NoError(t, err)
+	defer recovered.StopExpireLoop()
+
+	for i := 0; i < 50; i++ {
+		assert.True(t, recovered.IsActive(fmt.Sprintf("region-key-%d", i)))
+	}
+}
+
+// shortWriteFS 模拟磁盘写满之类的故障，新创建的文件只能写入部分数据
+type shortWriteFS struct {
+	*memFS
+}
+
+type shortWriteFile struct {
+	File
+}
+
+func (s *shortWriteFS) OpenFile(name string, flag int, perm fs.FileMode) (File, error) {
+	fd, err := s.memFS.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &shortWriteFile{File: fd}, nil
+}
+
+func (f *shortWriteFile) Write(p []byte) (int, error) {
+	return f.File.Write(p[:len(p)/2])
+}
+
+func TestCreateActiveRegionPartialMetadata(t *testing.T) {
+	memfs := newMemFS()
+	path := "/urnadb-partial-region"
+
+	fss, err := OpenFS(&Options{
+		FS:        memfs,
+		FSPerm:    conf.FSPerm,
+		Path:      path,
+		Threshold: 1,
+	})
+	assert.NoError(t, err)
+	defer fss.StopExpireLoop()
+
+	regionId := fss.regionId
+	fss.fsys = &shortWriteFS{memFS: memfs}
+	assert.Error(t, fss.createActiveRegion())
+	fss.fsys = memfs
+
+	// 写了一半的 region 文件被删除，region id 也没有被占用
+	assert.Equal(t, regionId, fss.regionId)
+	name, err := fss.toStringFileName(regionId + 1)
+	assert.NoError(t, err)
+	_, err = memfs.Stat(filepath.Join(path, name))
+	assert.True(t, os.IsNotExist(err))
+
+	recovered, err := OpenFS(&Options{
+		FS:        memfs,
+		FSPerm:    conf.FSPerm,
+		Path:      path,
+		Threshold: 1,
+	})
+	assert.NoError(t, err)
+	recovered.StopExpireLoop()
+}
+
+func TestRegionRollFailureRecovers(t *testing.T) {
+	memfs := newMemFS()
+	path := "/urnadb-roll-failure"
+
+	fss, err := OpenFS(&Options{
+		FS:        memfs,
+		FSPerm:    conf.FSPerm,
+		Path:      path,
+		Threshold: 1,
+	})
+	assert.NoError(t, err)
+	defer fss.StopExpireLoop()
+
+	// 切换 region 的时候新文件只能写入一半的文件头，超过阈值之后的写入都会触发切换失败
+	regionId := fss.regionId
+	fss.fsys = &shortWriteFS{memFS: memfs}
+	fss.regionThreshold = 256
+
+	for i := 0; i < 10; i++ {
+		seg, err := NewSegment(fmt.Sprintf("roll-key-%d", i), types.NewVariant(int64(i)), 0)
+		assert.NoError(t, err)
+		assert.NoError(t, fss.PutSegment(seg.KeyString(), seg))
+	}
+
+	// 仍然写入在原来的 region 中，并且可以正常读取
+	assert.Equal(t, regionId, fss.regionId)
+	assert.True(t, fss.offset > fss.regionThreshold)
+	for i := 0; i < 10; i++ {
+		_, seg, err := fss.FetchSegment(fmt.Sprintf("roll-key-%d", i))
+		assert.NoError(t, err)
+		v, err := seg.ToVariant()
+		assert.NoError(t, err)
+		assert.EqualValues(t, i, v.Value)
+	}
+
+	// 故障恢复之后下一次写入完成切换
+	fss.fsys = memfs
+	seg, err := NewSegment("roll-key-10", types.NewVariant(int64(10)), 0)
+	assert.NoError(t, err)
+	assert.NoError(t, fss.PutSegment(seg.KeyString(), seg))
+	assert.Equal(t, regionId+1, fss.regionId)
+
+	for i := 0; i <= 10; i++ {
+		assert.True(t, fss.IsActive(fmt.Sprintf("roll-key-%d", i)))
+		_, _, err := fss.FetchSegment(fmt.Sprintf("roll-key-%d", i))
+		assert.NoError(t, err)
+	}
+}
+
+func TestAutoRecreateDir(t *testing.T) {
+	for _, enabled := range []bool{true, false} {
+		t.Run(fmt.Sprintf("enabled=%v", enabled), func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "data")
+
+			fss, err := OpenFS(&Options{
+				FSPerm:          conf.FSPerm,
+				Path:            path,
+				Threshold:       1,
+				AutoRecreateDir: enabled,
+			})
+			assert.NoError(t, err)
+			defer fss.StopExpireLoop()
+
+			seg, err := NewSegment("before-remove", types.NewVariant("lost"), 0)
+			assert.NoError(t, err)
+			assert.NoError(t, fss.PutSegment(seg.KeyString(), seg))
+
+			// 运行期间整个数据目录被删除，超过阈值之后切换 region 时无法创建新的文件
+			regionId := fss.regionId
+			assert.NoError(t, os.RemoveAll(path))
+			fss.regionThreshold = 256
+
+			for i := 0; i < 10; i++ {
+				seg, err := NewSegment(fmt.Sprintf("after-remove-%d", i), types.NewVariant(int64(i)), 0)
+				assert.NoError(t, err)
+				assert.NoError(t, fss.PutSegment(seg.KeyString(), seg))
+			}
+
+			if !enabled {
+				assert.Equal(t, regionId, fss.regionId)
+				assert.NoDirExists(t, path)
+				return
+			}
+
+			// 目录重新创建之后写入到新的 region 文件中
+			assert.Greater(t, fss.regionId, regionId)
+			name, err := fss.toStringFileName(fss.regionId)
+			assert.NoError(t, err)
+			assert.FileExists(t, filepath.Join(path, name))
+
+			for i := 0; i < 10; i++ {
+				_, seg, err := fss.FetchSegment(fmt.Sprintf("after-remove-%d", i))
+				assert.NoError(t, err)
+				v, err := seg.ToVariant()
+				assert.NoError(t, err)
+				assert.EqualValues(t, i, v.Value)
+			}
+
+			// 目录中原来的数据已经不存在了，只有重新创建之后的 region 文件
+			name, err = fss.toStringFileName(regionId)
+			assert.NoError(t, err)
+			assert.NoFileExists(t, filepath.Join(path, name))
+		})
+	}
+}
+
+func TestOpenFSWithTruncatedRegionHeader(t *testing.T) {
+	memfs := newMemFS()
+	path := "/urnadb-truncated-region"
+
+	fss, err := OpenFS(&Options{
+		FS:        memfs,
+		FSPerm:    conf.FSPerm,
+		Path:      path,
+		Threshold: 1,
+	})
+	assert.NoError(t, err)
+	defer fss.StopExpireLoop()
+
+	for i := 0; i < 10; i++ {
+		seg, err := NewSegment(fmt.Sprintf("truncated-key-%d", i), types.NewVariant(int64(i)), 0)
+		assert.NoError(t, err)
+		assert.NoError(t, fss.PutSegment(seg.KeyString(), seg))
+	}
+
+	// 模拟创建新 region 的过程中崩溃，留下一个空文件和一个文件头不完整的文件
+	var truncated []string
+	for i, data := range [][]byte{nil, dataFileMetadata[:2]} {
+		name, err := fss.toStringFileName(fss.regionId + int64(i) + 1)
+		assert.NoError(t, err)
+
+		fd, err := memfs.OpenFile(filepath.Join(path, name), os.O_CREATE|os.O_WRONLY, conf.FSPerm)
+		assert.NoError(t, err)
+		_, err = fd.Write(data)
+		assert.NoError(t, err)
+		assert.NoError(t, fd.Close())
+
+		truncated = append(truncated, name)
+	}
+
+	recovered, err := OpenFS(&Options{
+		FS:        memfs,
+		FSPerm:    conf.FSPerm,
+		Path:      path,
+		Threshold: 1,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer recovered.StopExpireLoop()
+
+	for _, name := range truncated {
+		_, err := memfs.Stat(filepath.Join(path, name))
+		assert.True(t, os.IsNotExist(err))
+	}
+
+	for i := 0; i < 10; i++ {
+		_, seg, err := recovered.FetchSegment(fmt.Sprintf("truncated-key-%d", i))
+		if assert.NoError(t, err) {
+			variant, err := seg.ToVariant()
+			assert.NoError(t, err)
+			assert.Equal(t, int64(i), variant.Value)
+		}
+	}
+
+	seg, err := NewSegment("after-recovery", types.NewVariant("ok"), 0)
+	assert.NoError(t, err)
+	assert.NoError(t, recovered.PutSegment(seg.KeyString(), seg))
+}
+
+// slowWriteFS 模拟磁盘卡顿，每一次写入都会等待 delay 之后才返回
+type slowWriteFS struct {
+	*memFS
+	delay time.Duration
+}
+
+type slowWriteFile struct {
+	File
+	delay time.Duration
+}
+
+func (s *slowWriteFS) OpenFile(name string, flag int, perm fs.FileMode) (File, error) {
+	fd, err := s.memFS.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &slowWriteFile{File: fd, delay: s.delay}, nil
+}
+
+func (f *slowWriteFile) Write(p []byte) (int, error) {
+	time.Sleep(f.delay)
+	return f.File.Write(p)
+}
+
+func TestSlowOpLog(t *testing.T) {
+	var slow []string
+	defer func(fn func(op, key string, elapsed time.Duration)) { logSlowOp = fn }(logSlowOp)
+	logSlowOp = func(op, key string, elapsed time.Duration) {
+		slow = append(slow, op+":"+key)
+	}
+
+	fss, err := OpenFS(&Options{
+		FS:              &slowWriteFS{memFS: newMemFS(), delay: 5 * time.Millisecond},
+		FSPerm:          conf.FSPerm,
+		Path:            "/urnadb-slow-op",
+		Threshold:       1,
+		SlowOpThreshold: time.Millisecond,
+	})
+	assert.NoError(t, err)
+	defer fss.StopExpireLoop()
+
+	seg, err := NewSegment("slow-key", types.NewVariant("value"), 0)
+	assert.NoError(t, err)
+	assert.NoError(t, fss.PutSegment("slow-key", seg))
+
+	version, _, err := fss.FetchSegment("slow-key")
+	assert.NoError(t, err)
+	ok, err := fss.CompareAndSwapSegment("slow-key", version, seg)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	assert.Contains(t, slow, "PutSegment:slow-key")
+	assert.Contains(t, slow, "CompareAndSwapSegment:slow-key")
+}
+
+// stallReadFS 模拟挂起的磁盘，stall 为 true 的时候每一次读取都会等待 delay 之后才返回
+type stallReadFS struct {
+	*memFS
+	delay time.Duration
+	stall atomic.Bool
+}
+
+type stallReadFile struct {
+	File
+	fs *stallReadFS
+}
+
+func (s *stallReadFS) OpenFile(name string, flag int, perm fs.FileMode) (File, error) {
+	fd, err := s.memFS.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &stallReadFile{File: fd, fs: s}, nil
+}
+
+func (f *stallReadFile) ReadAt(p []byte, off int64) (int, error) {
+	if f.fs.stall.Load() {
+		time.Sleep(f.fs.delay)
+	}
+	return f.File.ReadAt(p, off)
+}
+
+func TestReadTimeout(t *testing.T) {
+	fsys := &stallReadFS{memFS: newMemFS(), delay: 500 * time.Millisecond}
+	fss, err := OpenFS(&Options{
+		FS:          fsys,
+		FSPerm:      conf.FSPerm,
+		Path:        "/urnadb-read-timeout",
+		Threshold:   1,
+		ReadTimeout: 50 * time.Millisecond,
+	})
+	assert.NoError(t, err)
+	defer fss.StopExpireLoop()
+
+	seg, err := NewSegment("stall-key", types.NewVariant("value"), 0)
+	assert.NoError(t, err)
+	assert.NoError(t, fss.PutSegment("stall-key", seg))
+
+	_, fetched, err := fss.FetchSegment("stall-key")
+	assert.NoError(t, err)
+	variant, err := fetched.ToVariant()
+	assert.NoError(t, err)
+	assert.Equal(t, "value", variant.Value)
+
+	// 磁盘挂起的时候读取在超时之后返回，而不是一直等待
+	fsys.stall.Store(true)
+	start := time.Now()
+	_, _, err = fss.FetchSegment("stall-key")
+	assert.ErrorIs(t, err, ErrReadTimeout)
+	assert.Less(t, time.Since(start), fsys.delay)
+
+	// 磁盘恢复之后可以继续读取
+	fsys.stall.Store(false)
+	_, _, err = fss.FetchSegment("stall-key")
+	assert.NoError(t, err)
+}
+
+// failReaderFS 模拟 mmap 映射失败，fail 为 true 的时候以只读方式打开文件都会失败
+type failReaderFS struct {
+	*memFS
+	fail atomic.Bool
+}
+
+func (f *failReaderFS) Open(name string) (File, error) {
+	if f.fail.Load() {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrPermission}
+	}
+	return f.memFS.Open(name)
+}
+
+func TestCompactUnmappedRegions(t *testing.T) {
+	fsys := &failReaderFS{memFS: newMemFS()}
+	fss, err := OpenFS(&Options{
+		FS:        fsys,
+		FSPerm:    conf.FSPerm,
+		Path:      "/urnadb-unmapped",
+		Threshold: 1,
+	})
+	assert.NoError(t, err)
+	defer fss.StopExpireLoop()
+
+	fss.regionThreshold = 256
+
+	// 切换 region 的时候映射失败，写满的 region 继续通过 Fd 读取，ReaderAt 为 nil
+	fsys.fail.Store(true)
+	for i := 0; i < 24; i++ {
+		key := fmt.Sprintf("unmapped-key-%d", i)
+		seg, err := NewSegment(key, types.NewVariant(key), 0)
+		assert.NoError(t, err)
+		assert.NoError(t, fss.PutSegment(key, seg))
+	}
+	fsys.fail.Store(false)
+
+	var first int64 = math.MaxInt64
+	unmapped := 0
+	for id, reg := range fss.regions {
+		if id != fss.regionId && reg.ReaderAt == nil {
+			unmapped++
+			first = min(first, id)
+		}
+	}
+	assert.Greater(t, unmapped, 2)
+
+	// 垃圾回收遇到这些 region 的时候不能 panic，数据迁移之后仍然可以读取
+	assert.NoError(t, fss.CompactRegion(first))
+	assert.NotContains(t, fss.regions, first)
+
+	fss.regionThreshold = 1 << 20
+	before := len(fss.regions)
+	assert.NoError(t, fss.MergeRegions())
+	assert.Less(t, len(fss.regions), before)
+
+	for i := 0; i < 24; i++ {
+		key := fmt.Sprintf("unmapped-key-%d", i)
+		_, seg, err := fss.FetchSegment(key)
+		if assert.NoError(t, err) {
+			variant, err := seg.ToVariant()
+			assert.NoError(t, err)
+			assert.Equal(t, key, variant.Value)
+		}
+	}
+}
+
+// traceFS 记录文件的刷盘和重命名顺序，以及每个文件读取 metadata 之后的数据的次数
+type traceFS struct {
+	*memFS
+	mu     sync.Mutex
+	events []string
+	reads  map[string]int
+}
+
+type traceFile struct {
+	File
+	fs *traceFS
+}
+
+func (t *traceFS) Open(name string) (File, error) {
+	return t.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (t *traceFS) OpenFile(name string, flag int, perm fs.FileMode) (File, error) {
+	fd, err := t.memFS.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &traceFile{File: fd, fs: t}, nil
+}
+
+func (t *traceFS) Rename(oldpath, newpath string) error {
+	t.record("rename:" + filepath.Base(newpath))
+	return t.memFS.Rename(oldpath, newpath)
+}
+
+func (t *traceFS) Remove(name string) error {
+	t.record("remove:" + filepath.Base(name))
+	return t.memFS.Remove(name)
+}
+
+func (t *traceFS) record(event string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.events = append(t.events, event)
+}
+
+func (f *traceFile) Sync() error {
+	f.fs.record("sync:" + filepath.Base(f.Name()))
+	return f.File.Sync()
+}
+
+func (f *traceFile) ReadAt(p []byte, off int64) (int, error) {
+	if off >= int64(len(dataFileMetadata)) {
+		f.fs.mu.Lock()
+		f.fs.reads[filepath.Base(f.Name())]++
+		f.fs.mu.Unlock()
+	}
+	return f.File.ReadAt(p, off)
+}
+
+func TestIndexSnapshotDurableRecovery(t *testing.T) {
+	fsys := &traceFS{memFS: newMemFS(), reads: make(map[string]int)}
+	path := "/urnadb-snapshot-recovery"
+	open := func() *LogStructuredFS {
+		fss, err := OpenFS(&Options{
+			FS:        fsys,
+			FSPerm:    conf.FSPerm,
+			Path:      path,
+			Threshold: 1,
+		})
+		assert.NoError(t, err)
+		return fss
+	}
+
+	fss := open()
+	defer fss.StopExpireLoop()
+	fss.regionThreshold = 256
+
+	for i := 0; i < 30; i++ {
+		seg, err := NewSegment(fmt.Sprintf("snap-key-%d", i), types.NewVariant(int64(i)), 0)
+		assert.NoError(t, err)
+		assert.NoError(t, fss.PutSegment(seg.KeyString(), seg))
+	}
+	assert.Greater(t, len(fss.regions), 2)
+
+	fsys.events = nil
+	_, err := fss.SnapshotIndex()
+	assert.NoError(t, err)
+	latest := latestRegionId(fss.indexs)
+	assert.Greater(t, latest, int64(2))
+
+	// 活跃 region 和临时文件都要在重命名之前落盘，index.db 才不会引用还没有持久化的数据
+	active := formatDataFileName(fss.regionId, defaultFileExtension)
+	assert.Equal(t, []string{
+		"sync:" + active,
+		"sync:" + tempIndexFile,
+		"rename:" + defaultIndexFileName,
+	}, fsys.events)
+
+	seg, err := NewSegment("snap-key-after", types.NewVariant("after"), 0)
+	assert.NoError(t, err)
+	assert.NoError(t, fss.PutSegment("snap-key-after", seg))
+	assert.NoError(t, fss.DeleteSegment("snap-key-0"))
+
+	// 模拟崩溃，不调用 CloseFS 直接重新打开，只重放快照中引用的最新的 region 及其之后的 region，之前的 region 一次都不会被读取
+	fsys.reads = make(map[string]int)
+	recovered := open()
+	defer recovered.StopExpireLoop()
+
+	for id := range recovered.regions {
+		name := formatDataFileName(id, defaultFileExtension)
+		if id < latest {
+			assert.Zero(t, fsys.reads[name], "region %d should not be replayed", id)
+		}
+	}
+	assert.NotZero(t, fsys.reads[formatDataFileName(latest, defaultFileExtension)])
+
+	assert.False(t, recovered.IsActive("snap-key-0"))
+	assert.True(t, recovered.IsActive("snap-key-after"))
+	for i := 1; i < 30; i++ {
+		assert.True(t, recovered.IsActive(fmt.Sprintf("snap-key-%d", i)))
+	}
+}
+
+func TestCompactRegionDurableSnapshot(t *testing.T) {
+	fsys := &traceFS{memFS: newMemFS(), reads: make(map[string]int)}
+	fss, err := OpenFS(&Options{
+		FS:        fsys,
+		FSPerm:    conf.FSPerm,
+		Path:      "/urnadb-compact-snapshot",
+		Threshold: 1,
+	})
+	assert.NoError(t, err)
+	defer fss.StopExpireLoop()
+	fss.regionThreshold = 256
+
+	for i := 0; i < 24; i++ {
+		seg, err := NewSegment(fmt.Sprintf("compact-key-%d", i), types.NewVariant(int64(i)), 0)
+		assert.NoError(t, err)
+		assert.NoError(t, fss.PutSegment(seg.KeyString(), seg))
+	}
+	assert.Greater(t, len(fss.regions), 2)
+
+	first := slices.Min(slices.Collect(maps.Keys(fss.regions)))
+	fsys.events = nil
+	assert.NoError(t, fss.CompactRegion(first))
+
+	// 迁移到活跃 region 的数据和新的 index.db 都落盘之后才能删除旧的 region 文件，迁移期间切换 region 也会刷盘
+	active := formatDataFileName(fss.regionId, defaultFileExtension)
+	if !assert.GreaterOrEqual(t, len(fsys.events), 4) {
+		return
+	}
+	assert.Equal(t, []string{
+		"sync:" + active,
+		"sync:" + tempIndexFile,
+		"rename:" + defaultIndexFileName,
+		"remove:" + formatDataFileName(first, defaultFileExtension),
+	}, fsys.events[len(fsys.events)-4:])
+}
+
+func TestReadaheadReaderAt(t *testing.T) {
+	data := make([]byte, 1000)
+	for i := range data {
+		data[i] = byte(i)
+	}
+
+	source := strings.NewReader(string(data))
+	reader := newReadaheadReaderAt(source, 64)
+
+	// 顺序读取的时候每一块数据都和直接读取的结果一致，包括跨越缓冲区边界和超过缓冲区大小的读取
+	var off int64
+	for _, size := range []int{26, 5, 40, 1, 100, 64, 26, 300} {
+		p := make([]byte, size)
+		n, err := reader.ReadAt(p, off)
+		assert.NoError(t, err)
+		assert.Equal(t, size, n)
+		assert.Equal(t, data[off:off+int64(size)], p)
+		off += int64(size)
+	}
+
+	// 读到文件末尾的时候和 io.ReaderAt 的语义一致
+	p := make([]byte, 26)
+	n, err := reader.ReadAt(p, 990)
+	assert.ErrorIs(t, err, io.EOF)
+	assert.Equal(t, 10, n)
+	assert.Equal(t, data[990:], p[:n])
+
+	n, err = reader.ReadAt(p, 974)
+	assert.NoError(t, err)
+	assert.Equal(t, 26, n)
+	assert.Equal(t, data[974:], p)
+}
+
+func TestRecoveryReadahead(t *testing.T) {
+	path := t.TempDir()
+	fss, err := OpenFS(&Options{
+		FSPerm:    conf.FSPerm,
+		Path:      path,
+		Threshold: 1,
+	})
+	assert.NoError(t, err)
+
+	fss.regionThreshold = 4 * kb
+	for i := 0; i < 200; i++ {
+		key := fmt.Sprintf("readahead-key-%d", i%120)
+		seg, err := NewSegment(key, types.NewVariant(strings.Repeat("v", i)), 0)
+		assert.NoError(t, err)
+		assert.NoError(t, fss.PutSegment(key, seg))
+	}
+	for i := 0; i < 120; i += 7 {
+		assert.NoError(t, fss.DeleteSegment(fmt.Sprintf("readahead-key-%d", i)))
+	}
+	assert.Greater(t, len(fss.regions), 2)
+
+	// 写满之后切换出去的 region 的文件描述符已经关闭了，CloseFS 同步这些文件的时候会返回错误，这里不关心
+	fss.StopExpireLoop()
+	_ = fss.CloseFS()
+
+	// 删除索引快照，启动的时候只能通过全局扫描 region 恢复
+	recovered := func(readahead bool) map[uint64]inode {
+		err := os.Remove(filepath.Join(path, defaultIndexFileName))
+		if !os.IsNotExist(err) {
+			assert.NoError(t, err)
+		}
+
+		fss, err := OpenFS(&Options{
+			FSPerm:            conf.FSPerm,
+			Path:              path,
+			Threshold:         1,
+			RecoveryReadahead: readahead,
+		})
+		assert.NoError(t, err)
+		defer func() {
+			fss.StopExpireLoop()
+			assert.NoError(t, fss.CloseFS())
+		}()
+
+		inodes := make(map[uint64]inode)
+		for _, imap := range fss.indexs {
+			for inum, node := range imap.index {
+				inodes[inum] = *node
+			}
+		}
+		return inodes
+	}
+
+	// 顺序预读恢复出来的索引和逐个 ReadAt 恢复出来的完全一致
+	expected := recovered(false)
+	assert.Len(t, expected, 120-18)
+	assert.Equal(t, expected, recovered(true))
+}
@@ -0,0 +1,143 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vfs
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+)
+
+// SegmentVersion 是 key 在 region 中残留的一个历史版本，Segment 中的 value 已经解码
+type SegmentVersion struct {
+	RegionId  int64
+	Position  int64
+	CreatedAt int64
+	ExpiredAt int64
+	Deleted   bool
+	Segment   *Segment
+}
+
+// History 从最新的 region 开始往前扫描，按照从新到旧的顺序返回 key 的历史版本，最多返回 limit 个，limit <= 0 表示不限制。
+// 日志是追加写入的，旧版本只是在索引中不可见了，在被垃圾回收清理之前仍然保留在 region 中，
+// 所以这里能找到多少个版本取决于上一次压缩的时间，删除操作写入的 tombstone 记录也会作为一个版本返回。
+// 只在开始的时候持有 lfs.mu 的读锁记录活跃 region 当前写到的位置，扫描期间不会阻塞写入，之后追加的版本不会返回。
+func (lfs *LogStructuredFS) History(key string, limit int) ([]SegmentVersion, error) {
+	lfs.mu.RLock()
+	activeId, tail := lfs.regionId, lfs.offset
+	lfs.regmux.RLock()
+	regionIds := make([]int64, 0, len(lfs.regions))
+	for id := range lfs.regions {
+		if id <= activeId {
+			regionIds = append(regionIds, id)
+		}
+	}
+	lfs.regmux.RUnlock()
+	lfs.mu.RUnlock()
+
+	sort.Slice(regionIds, func(i, j int) bool {
+		return regionIds[i] > regionIds[j]
+	})
+
+	var versions []SegmentVersion
+	for _, id := range regionIds {
+		// 活跃 region 只扫描到开始时记录的位置，之后的数据可能还没有写完
+		length := int64(-1)
+		if id == activeId {
+			length = tail
+		}
+
+		found, err := lfs.scanKeyVersions(id, length, key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan region %d: %w", id, err)
+		}
+
+		// 同一个 region 中后写入的记录更新
+		for i := len(found) - 1; i >= 0; i-- {
+			versions = append(versions, found[i])
+			if limit > 0 && len(versions) >= limit {
+				return versions, nil
+			}
+		}
+	}
+
+	return versions, nil
+}
+
+// scanKeyVersions 按照写入顺序遍历 region，先只读取 segment 头部和 key 比较，命中之后才读取完整的 segment，
+// length 小于 0 的时候扫描整个 region。扫描期间持有 regmux 的读锁，保证 region 不会被垃圾回收关闭和删除，
+// region 已经被删除的时候说明其中的数据都已经迁移走了，直接跳过。
+func (lfs *LogStructuredFS) scanKeyVersions(regionId int64, length int64, key string) ([]SegmentVersion, error) {
+	lfs.regmux.RLock()
+	defer lfs.regmux.RUnlock()
+
+	region, ok := lfs.regions[regionId]
+	if !ok {
+		return nil, nil
+	}
+
+	reader, size, err := regionReader(region)
+	if err != nil {
+		return nil, err
+	}
+
+	if length < 0 || length > size {
+		length = size
+	}
+
+	var (
+		versions []SegmentVersion
+		header   = make([]byte, _SEGMENT_PADDING)
+		offset   = int64(len(dataFileMetadata))
+	)
+	for offset < length {
+		_, err := reader.ReadAt(header, offset)
+		if err != nil {
+			return nil, err
+		}
+
+		klen := binary.LittleEndian.Uint32(header[18:22])
+		vlen := binary.LittleEndian.Uint32(header[22:26])
+		size := _SEGMENT_PADDING + int64(klen) + int64(vlen) + 4
+
+		if int(klen) == len(key) {
+			kbuf := make([]byte, klen)
+			_, err := reader.ReadAt(kbuf, offset+_SEGMENT_PADDING)
+			if err != nil {
+				return nil, err
+			}
+
+			if string(kbuf) == key {
+				_, seg, err := readSegment(reader, offset, _SEGMENT_PADDING)
+				if err != nil {
+					return nil, err
+				}
+
+				versions = append(versions, SegmentVersion{
+					RegionId:  regionId,
+					Position:  offset,
+					CreatedAt: seg.CreatedAt,
+					ExpiredAt: seg.ExpiredAt,
+					Deleted:   seg.IsTombstone(),
+					Segment:   seg,
+				})
+			}
+		}
+
+		offset += size
+	}
+
+	return versions, nil
+}
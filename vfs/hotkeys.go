@@ -0,0 +1,128 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vfs
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+var ErrAccessStatsDisabled = errors.New("access statistics are disabled")
+
+// accessStats 一个 key 自从进程启动以来的读写次数
+type accessStats struct {
+	reads  atomic.Uint64
+	writes atomic.Uint64
+}
+
+// KeyStat 是 TopKeys 返回的一个 key 的访问统计
+type KeyStat struct {
+	Key    string `json:"key"`
+	Reads  uint64 `json:"reads"`
+	Writes uint64 `json:"writes"`
+}
+
+// setInode 使用 node 替换 inum 对应的 inode，开启访问统计的时候继承旧 inode 的计数器并记录一次写入，
+// 开启 Options.StoreKeysInIndex 的时候把 seg 的 key 和类型保存到 node 中，调用者需要持有 lfs.mu 和 imap.mu 的写锁。
+func (lfs *LogStructuredFS) setInode(imap *indexMap, inum uint64, node *inode, seg *Segment) {
+	if lfs.storeKeysInIndex {
+		node.key = seg.KeyString()
+		node.kind = seg.Type
+	}
+	if lfs.trackAccessStats {
+		if old, ok := imap.index[inum]; ok && old.stats != nil {
+			node.stats = old.stats
+		} else {
+			node.stats = new(accessStats)
+		}
+		node.stats.writes.Add(1)
+	}
+	lfs.markSuperseded(node.RegionId, imap.put(inum, node))
+}
+
+// TopKeys 返回访问次数最多的 n 个 key，byReads 为 true 时按照读取次数排序，否则按照写入次数排序，
+// 没有开启 Options.TrackAccessStats 的时候返回 ErrAccessStatsDisabled。删除的 key 的计数器会一起被删除，已经过期的 key 不会出现在结果中。
+func (lfs *LogStructuredFS) TopKeys(n int, byReads bool) ([]KeyStat, error) {
+	if !lfs.trackAccessStats {
+		return nil, ErrAccessStatsDisabled
+	}
+
+	if n <= 0 {
+		return []KeyStat{}, nil
+	}
+
+	type candidate struct {
+		node   *inode
+		reads  uint64
+		writes uint64
+	}
+
+	// 读取 region 需要持有 lfs.mu 的读锁，锁的顺序和写入时保持一致
+	lfs.mu.RLock()
+	defer lfs.mu.RUnlock()
+
+	now := time.Now().UnixMicro()
+	var candidates []candidate
+	for _, imap := range lfs.indexs {
+		imap.mu.RLock()
+		for _, node := range imap.index {
+			if node.stats == nil {
+				continue
+			}
+
+			expiredAt := atomic.LoadInt64(&node.ExpiredAt)
+			if expiredAt > 0 && expiredAt <= now {
+				continue
+			}
+			candidates = append(candidates, candidate{
+				node:   node,
+				reads:  node.stats.reads.Load(),
+				writes: node.stats.writes.Load(),
+			})
+		}
+		imap.mu.RUnlock()
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		if byReads {
+			return candidates[i].reads > candidates[j].reads
+		}
+		return candidates[i].writes > candidates[j].writes
+	})
+
+	if len(candidates) > n {
+		candidates = candidates[:n]
+	}
+
+	// 只有排在前面的 n 个 key 需要从 region 中读取名称，inode 中的位置是不可变的，释放 shard 锁之后仍然指向有效的数据
+	stats := make([]KeyStat, 0, len(candidates))
+	for _, c := range candidates {
+		key, _, err := lfs.readInodeMeta(c.node)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read segment meta: %w", err)
+		}
+
+		stats = append(stats, KeyStat{
+			Key:    key,
+			Reads:  c.reads,
+			Writes: c.writes,
+		})
+	}
+
+	return stats, nil
+}
@@ -0,0 +1,122 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vfs
+
+import "sync/atomic"
+
+// minShrinkCapacity 容量小于这个值的 map 占用的内存很少，重建带来的收益不值得阻塞 shard 的读写
+const minShrinkCapacity = 4096
+
+// CompactIndex 把每个 shard 的 map 重建为只包含当前存活 inode 的新 map，Go 的 map 删除元素之后不会释放已经分配的桶，
+// 大量删除或者过期之后调用可以回收这部分内存。每个 shard 依次重建，重建期间只阻塞当前 shard 的读写，返回释放的 inode 容量。
+func (lfs *LogStructuredFS) CompactIndex() int {
+	released := 0
+	for _, imap := range lfs.indexs {
+		imap.mu.Lock()
+		released += max(imap.capacity, len(imap.index)) - len(imap.index)
+		imap.shrink()
+		imap.mu.Unlock()
+	}
+	return released
+}
+
+// sparse 判断存活的 inode 数量是否已经低于 map 容量的 ratio，调用者需要持有 shard 锁
+func (imap *indexMap) sparse(ratio float64) bool {
+	return imap.capacity >= minShrinkCapacity &&
+		float64(len(imap.index)) < float64(imap.capacity)*ratio
+}
+
+// shrink 使用当前存活的 inode 重建 map，调用者需要持有 shard 的写锁
+func (imap *indexMap) shrink() {
+	index := make(map[uint64]*inode, len(imap.index))
+	for inum, node := range imap.index {
+		index[inum] = node
+	}
+	imap.index = index
+	imap.capacity = len(index)
+}
+
+// put 使用 node 替换 inum 对应的 inode 并且更新 region 的引用计数，返回被替换的 inode，调用者需要持有 shard 的写锁
+func (imap *indexMap) put(inum uint64, node *inode) *inode {
+	old := imap.remove(inum)
+	if imap.live == nil {
+		imap.live = make(map[int64]int)
+	}
+	imap.live[atomic.LoadInt64(&node.RegionId)]++
+	imap.index[inum] = node
+	return old
+}
+
+// remove 删除 inum 对应的 inode 并且更新 region 的引用计数，返回被删除的 inode，调用者需要持有 shard 的写锁
+func (imap *indexMap) remove(inum uint64) *inode {
+	old, ok := imap.index[inum]
+	if !ok {
+		return nil
+	}
+
+	regionId := atomic.LoadInt64(&old.RegionId)
+	imap.live[regionId]--
+	if imap.live[regionId] <= 0 {
+		delete(imap.live, regionId)
+	}
+	delete(imap.index, inum)
+	return old
+}
+
+// ShardStat 是一个 index shard 的锁统计，Contended 是近似值，只统计获取锁时已经被其他 goroutine 持有的次数
+type ShardStat struct {
+	Shard        int    `json:"shard"`
+	Keys         int    `json:"keys"`
+	Acquisitions uint64 `json:"acquisitions"`
+	Contended    uint64 `json:"contended"`
+}
+
+// ShardStats 返回每个 index shard 自从进程启动以来在写入、条件写入、FetchSegment 和 DeleteSegment 中获取锁的次数，
+// 如果少数几个 shard 的等待次数明显偏高，说明需要增加 shard 的数量或者 key 的分布不均匀。
+func (lfs *LogStructuredFS) ShardStats() []ShardStat {
+	stats := make([]ShardStat, 0, len(lfs.indexs))
+	for i, imap := range lfs.indexs {
+		// 读取 key 数量不经过 rLock，避免统计本身被计入
+		imap.mu.RLock()
+		keys := len(imap.index)
+		imap.mu.RUnlock()
+
+		stats = append(stats, ShardStat{
+			Shard:        i,
+			Keys:         keys,
+			Acquisitions: imap.acquisitions.Load(),
+			Contended:    imap.contended.Load(),
+		})
+	}
+	return stats
+}
+
+// lock 获取 shard 的写锁并记录一次获取，TryLock 失败说明锁已经被持有，记为一次等待
+func (imap *indexMap) lock() {
+	imap.acquisitions.Add(1)
+	if !imap.mu.TryLock() {
+		imap.contended.Add(1)
+		imap.mu.Lock()
+	}
+}
+
+// rLock 获取 shard 的读锁，统计方式和 lock 相同，只有写锁被持有或者有写者在等待的时候 TryRLock 才会失败
+func (imap *indexMap) rLock() {
+	imap.acquisitions.Add(1)
+	if !imap.mu.TryRLock() {
+		imap.contended.Add(1)
+		imap.mu.RLock()
+	}
+}
@@ -23,6 +23,7 @@ import (
 	"hash/crc32"
 	"io"
 	"io/fs"
+	"math"
 	"os"
 	"path/filepath"
 	"sort"
@@ -33,10 +34,11 @@ import (
 	"time"
 
 	"github.com/auula/urnadb/clog"
+	"github.com/auula/urnadb/types"
 	"github.com/auula/urnadb/utils"
 	"github.com/robfig/cron/v3"
+	"github.com/shirou/gopsutil/v3/disk"
 	"github.com/spaolacci/murmur3"
-	"golang.org/x/exp/mmap"
 )
 
 const (
@@ -56,6 +58,26 @@ const (
 	_SEGMENT_PADDING    = 26
 	_INDEX_SEGMENT_SIZE = 48
 	_PAGE_SIZE_4KB      = 4 << 10
+	_INDEX_MAP_CAPACITY = 1e6
+)
+
+// defaultCheckpointMinRegions 没有设置 Options.CheckpointMinRegions 时生成和使用检查点需要的最少 region 数量
+const defaultCheckpointMinRegions = 2
+
+// _INDEX_IMMUTABLE 是索引快照记录中 LEN 字段的最高位，记录 inode 对应的 key 是否是不可变的
+const _INDEX_IMMUTABLE uint32 = 1 << 31
+
+// _INDEX_KEYED 是索引快照记录中 LEN 字段的次高位，设置的时候固定长度的记录后面跟着保存 key 的扩展部分
+const _INDEX_KEYED uint32 = 1 << 30
+
+// _INDEX_KEY_HEADER 是 key 扩展部分中 KIND 和 KLEN 的长度
+const _INDEX_KEY_HEADER = 5
+
+const (
+	// defaultFileExtension 没有设置 Options.FileExtension 时 region 数据文件的扩展名
+	defaultFileExtension = ".db"
+	// defaultIndexFileName 没有设置 Options.IndexFileName 时索引快照的文件名
+	defaultIndexFileName = "index.db"
 )
 
 var (
@@ -63,17 +85,136 @@ var (
 	pipeline         = NewPipeline()
 	txnDirName       = "txns"
 	txnExtension     = ".txn"
-	fileExtension    = ".db"
 	ckptExtension    = ".ckpt"
-	mainIndexFile    = "index.db"
 	tempIndexFile    = "index.tmp"
-	dataFileMetadata = []byte{0xDB, 0x00, 0x01, 0x01}
+	dataFileMetadata = []byte{0xDB, 0x00, 0x01, 0x03}
+	// 版本 1 的数据文件中所有 segment 的 CRC32 都包含 key，版本 2 的 segment 中没有写入者标识，新版本仍然可以读取
+	legacyFileMetadata = [][]byte{
+		{0xDB, 0x00, 0x01, 0x01},
+		{0xDB, 0x00, 0x01, 0x02},
+	}
 )
 
 type Options struct {
 	Path      string
 	FSPerm    os.FileMode
 	Threshold uint8
+	// IndexSnapshotInterval 大于 0 时会按照这个周期在后台生成完整的 index.db 索引快照，
+	// 这样即使进程非正常退出，下次启动也不需要全局扫描所有的 region 文件。
+	IndexSnapshotInterval time.Duration
+	// CompactCallback 每次 region 垃圾回收结束之后都会被调用，用于观察回收的耗时和效果
+	CompactCallback func(stats CompactStats)
+	// FS 存储引擎使用的文件系统，为空的时候默认使用 OSFilesystem
+	FS Filesystem
+	// TombstoneGracePeriod 垃圾回收时会跳过小于这个时长的 tombstone 不回收，
+	// 给 CDC 或者复制等下游的消费者留出观察删除操作的时间窗口。
+	TombstoneGracePeriod time.Duration
+	// ValueChecksum 开启之后新写入的 segment 的 CRC32 只覆盖 header 和 value，读取大 key 的记录时不需要再对 key 做校验，
+	// key 的完整性在 FetchSegment 时通过索引中的哈希值校验。这是进程级别的配置，最后一次 OpenFS 的设置生效。
+	ValueChecksum bool
+	// RecoveryWorkers 大于 1 时启动恢复会使用多个 goroutine 并行读取 region 文件，
+	// 合并到索引中的顺序仍然是 region ID 的升序，tombstone 和新版本的覆盖关系不受影响。
+	RecoveryWorkers int
+	// OrderedKeys 开启之后会额外维护一份按照字典序排列的 key 集合，用于 ScanRange 范围扫描，
+	// 代价是每次写入都需要在有序集合中插入 key，并且启动的时候需要从 region 中读取 key 重建集合。
+	OrderedKeys bool
+	// MaxValueAge 大于 0 时所有创建时间早于这个时长的数据都视为已经过期，和 key 自己的 TTL 无关，
+	// 用于数据保留期限之类的合规要求，后台过期检查和 FetchSegment 都会按照这个策略淘汰数据。
+	MaxValueAge time.Duration
+	// MaxValueAgeLocks 为 true 时 MaxValueAge 同样作用于租约锁，默认租约锁只受自己的租约时长控制
+	MaxValueAgeLocks bool
+	// SkipCRCOnRead 开启之后运行期间读取 segment 不再校验 CRC32，磁盘上损坏的数据会被当作正常数据返回给上层，
+	// 只适合部署在带有 ECC 和校验能力的可信存储上、并且读多写少的场景，默认关闭。启动恢复和 index.db 快照始终会校验，
+	// 这是进程级别的配置，最后一次 OpenFS 的设置生效。
+	SkipCRCOnRead bool
+	// CompactWhenFreeDiskBelowBytes 大于 0 时后台会定期检查数据目录所在磁盘的可用空间，
+	// 低于这个值并且没有正在执行的垃圾回收时立即执行一次 CompactNow，不需要等到 cron 调度的时间。
+	CompactWhenFreeDiskBelowBytes uint64
+	// DiskPressureInterval 检查磁盘可用空间的周期，为空的时候默认 30 秒
+	DiskPressureInterval time.Duration
+	// DiskFree 返回 path 所在磁盘的可用空间，为空的时候使用 gopsutil 读取，
+	// 容器的磁盘配额和实际的磁盘大小不一致的时候可以替换为自定义的实现。
+	DiskFree func(path string) (uint64, error)
+	// DisableSegmentPool 关闭 segment 的对象池，AcquirePoolSegment 每次都分配新的对象并且 ReleaseToPool 不再回收，
+	// 用于调试依赖对象池复用行为的逻辑错误，这是进程级别的配置，最后一次 OpenFS 的设置生效。
+	DisableSegmentPool bool
+	// VerifyOnOpen 开启之后 OpenFS 会在恢复索引之前校验所有 region 中每一条记录的 CRC32，发现损坏的记录时返回 ErrCorruptRegion，
+	// 让磁盘上的损坏在启动的时候就暴露出来，而不是等到之后读取的时候。需要读取全部的数据文件，启动会明显变慢，默认关闭。
+	VerifyOnOpen bool
+	// TrackAccessStats 开启之后会记录每个 key 的读写次数，通过 TopKeys 找出访问最频繁的热点 key，
+	// 每个 key 需要额外的计数器内存，并且读写都要多一次原子操作，默认关闭。计数器只保存在内存中，重启之后清零。
+	TrackAccessStats bool
+	// ReclaimExpiredRegions 开启之后后台过期检查删除过期的 inode 之后，会直接删除已经没有任何有效数据的旧 region，
+	// 大量短 TTL 的 key 过期之后不需要等到定时的垃圾回收才释放磁盘空间，覆盖了更早的 region 中仍然存在的旧版本的 region 仍然交给垃圾回收处理。
+	ReclaimExpiredRegions bool
+	// SlowOpThreshold 大于 0 时 PutSegment、FetchSegment 和 CompareAndSwapSegment 耗时超过这个时长会输出一条 Debug 日志，
+	// 包含 key 和实际的耗时，用于排查磁盘卡顿之类的延迟问题，为 0 的时候不做任何计时。
+	SlowOpThreshold time.Duration
+	// CheckpointMinRegions region 文件的数量达到这个值之后检查点任务才会生成检查点，启动恢复也只有在达到这个值的时候才使用检查点，
+	// 小于等于 0 的时候默认为 2。很少滚动 region 的部署可以设置为 1，只有一个 region 的数据库也能通过检查点加快启动恢复。
+	CheckpointMinRegions int
+	// AutoRecreateDir 开启之后运行期间数据目录被误删除时，写入失败或者切换 region 失败的时候会重新创建目录和新的活跃 region，
+	// 之后的写入可以继续进行，目录中原来的数据已经无法找回，重启之后也不会再出现在索引中。默认关闭，写入直接返回错误。
+	AutoRecreateDir bool
+	// CompactIndexRatio 大于 0 时后台过期检查结束之后，存活的 inode 数量低于 shard 的 map 容量的这个比例时会重建这个 shard 的 map，
+	// 释放大量删除或者过期之后 map 仍然占用的内存，也包括启动时预分配但是没有用到的容量，重建期间这个 shard 的读写会被阻塞。
+	CompactIndexRatio float64
+	// ValueCodec 新写入的 value 使用的序列化格式，默认是 msgpack，也可以设置为 JSON 方便调试或者 CBOR 方便和其他系统互通。
+	// 格式记录在每个 segment 的头部中，切换之后旧的数据仍然可以读取，这是进程级别的配置，最后一次 OpenFS 的设置生效。
+	ValueCodec types.ValueCodec
+	// StoreKeysInIndex 开启之后内存索引和 index.db 快照中会保存原始的 key 和数据类型，ScanMeta、ExpiringWithin 之类列出 key 的操作
+	// 不需要再从 region 中读取 segment 的头部和 key，代价是索引占用更多的内存，快照文件也会变大。
+	// 启动的时候没有 key 的 inode 会从 region 中读取一次补齐，关闭之后写入的快照和旧版本的格式保持一致。
+	StoreKeysInIndex bool
+	// ReadTimeout 大于 0 时每一次读取 region 最多等待这个时长，超时之后返回 ErrReadTimeout，
+	// 避免网络文件系统挂起或者磁盘故障的时候请求一直卡在 ReadAt 上。卡住的读取会在后台继续等待底层返回，
+	// 每一次读取都需要额外的 goroutine 和内存拷贝，为 0 的时候直接读取，默认关闭。
+	ReadTimeout time.Duration
+	// FileExtension region 数据文件的扩展名，必须以 . 开头，为空的时候默认是 .db。
+	// 和其他工具共用一个目录的时候可以换成不冲突的扩展名，已经存在的数据目录修改之后旧的 region 不会再被识别。
+	FileExtension string
+	// IndexFileName 索引快照的文件名，为空的时候默认是 index.db，不能包含路径分隔符
+	IndexFileName string
+	// MergeSmallRegions 开启之后每次垃圾回收结束之后还会执行一次 MergeRegions，把最旧的一段连续的小 region 合并到活跃 region 中，
+	// 减少大量短 TTL 的 key 过期之后留下的小文件和打开的文件描述符，代价是合并的时候需要重新写入这些 region 中的有效数据。
+	MergeSmallRegions bool
+	// RecoveryReadahead 开启之后启动恢复重放 region 的时候每次顺序读取一大块数据到内存中再解析 segment，
+	// 不再对每个 segment 发起多次分散的 ReadAt，适合机械硬盘和网络文件系统这类随机读取很慢的存储，代价是每个恢复中的 region 多占用 4MB 内存。
+	RecoveryReadahead bool
+}
+
+// fileNames 返回 region 数据文件的扩展名和索引快照的文件名，没有设置的时候使用默认值
+func (opt *Options) fileNames() (string, string, error) {
+	ext, index := opt.FileExtension, opt.IndexFileName
+	if ext == "" {
+		ext = defaultFileExtension
+	}
+	if index == "" {
+		index = defaultIndexFileName
+	}
+
+	if len(ext) < 2 || ext[0] != '.' || strings.ContainsAny(ext, `/\`) {
+		return "", "", fmt.Errorf("invalid region file extension: %q", ext)
+	}
+
+	// 数字开头并且带有 region 扩展名的索引文件会被当作 region 打开
+	if strings.ContainsAny(index, `/\`) || index == tempIndexFile ||
+		(strings.HasPrefix(index, "0") && strings.HasSuffix(index, ext)) {
+		return "", "", fmt.Errorf("invalid index file name: %q", index)
+	}
+
+	return ext, index, nil
+}
+
+// CompactStats 一次 region 垃圾回收的统计信息
+type CompactStats struct {
+	RecordsScanned     uint64        // 扫描过的 segment 数量
+	RecordsMigrated    uint64        // 迁移到活跃 region 中的有效 segment 数量
+	BytesReclaimed     int64         // 回收的磁盘空间大小
+	RegionsRemoved     int           // 被删除的 region 文件数量
+	RegionsMerged      int           // 被合并到活跃 region 中的小 region 数量
+	TombstonesRetained uint64        // 宽限期内被保留下来的 tombstone 数量
+	Duration           time.Duration // 本次回收的耗时
 }
 
 // inode represents a file system node with metadata.
@@ -84,41 +225,120 @@ type inode struct {
 	CreatedAt int64  // Creation time of the inode (UNIX timestamp in nano seconds)
 	mvcc      uint64 // Multi-version concurrency ID
 	Length    int32  // Data record length
+	immutable bool   // 对应 segment 头部的 _IMMUTABLE 标记，没有过期之前不能被覆盖或者删除
+	// key 和 kind 只有开启 Options.StoreKeysInIndex 之后才会保存，key 为空的时候需要从 region 中读取
+	key  string
+	kind kind
+	// stats 开启 Options.TrackAccessStats 之后才会分配，覆盖写入和垃圾回收迁移生成的新 inode 共用同一个计数器
+	stats *accessStats
+}
+
+// relocate 返回一个指向新位置的 inode 副本，其他元数据保持不变
+func (n *inode) relocate(regionId, position int64) *inode {
+	return &inode{
+		RegionId:  regionId,
+		Position:  position,
+		Length:    n.Length,
+		CreatedAt: n.CreatedAt,
+		ExpiredAt: atomic.LoadInt64(&n.ExpiredAt),
+		mvcc:      atomic.LoadUint64(&n.mvcc),
+		immutable: n.immutable,
+		key:       n.key,
+		kind:      n.kind,
+		stats:     n.stats,
+	}
 }
 
 type indexMap struct {
 	mu    sync.RWMutex
 	index map[uint64]*inode
+	// capacity 是分配 map 时的容量或者之后观察到的最大长度，Go 的 map 删除元素之后不会缩容，用来估算 map 实际占用的空间
+	capacity int
+	// acquisitions 和 contended 是读写路径上获取 shard 锁的次数和其中需要等待的次数，用来评估 shard 的数量是否足够
+	acquisitions atomic.Uint64
+	contended    atomic.Uint64
+	// live 是这个 shard 的索引在每个 region 中引用的 inode 数量，索引的插入、替换和删除都通过 put 和 remove 维护
+	live map[int64]int
 }
 
 type Region struct {
-	Fd *os.File
-	*mmap.ReaderAt
+	Fd File
+	ReaderAt
 }
 
 // LogStructuredFS represents the virtual file storage system.
 type LogStructuredFS struct {
-	mu               sync.RWMutex
-	regmux           sync.Mutex
-	offset           int64
-	regionId         int64
-	directory        string
-	fsPerm           os.FileMode
-	indexs           []*indexMap
-	active           *os.File
-	regions          map[int64]*Region
-	gcstate          _GC_STATE
-	compactTask      *cron.Cron
-	dirtyRegions     []*Region
-	regionThreshold  int64
-	checkpointWorker *time.Ticker
-	expireLoopWorker *time.Ticker
+	mu                   sync.RWMutex
+	regmux               sync.RWMutex
+	offset               int64
+	regionId             int64
+	directory            string
+	fsPerm               os.FileMode
+	fsys                 Filesystem
+	indexs               []*indexMap
+	active               File
+	regions              map[int64]*Region
+	gcstate              _GC_STATE
+	compactTask          *cron.Cron
+	dirtyRegions         []*Region
+	regionThreshold      int64
+	checkpointWorker     *time.Ticker
+	checkpointDone       chan struct{}
+	expireLoopWorker     *time.Ticker
+	expireLoopDone       chan struct{}
+	snapshotWorker       *time.Ticker
+	snapshotDone         chan struct{}
+	snapmux              sync.Mutex
+	lastSnapshotAt       atomic.Int64
+	compactCallback      func(stats CompactStats)
+	tombstoneGracePeriod time.Duration
+	ordered              *orderedKeys
+	ready                atomic.Bool
+	recoveryWorkers      int
+	maxValueAge          int64
+	maxValueAgeLocks     bool
+	trackAccessStats     bool
+	reclaimExpired       bool
+	// supersedes 是打开之后创建的每个 region 中的数据替换或者删除过的最早的 region，由 lfs.mu 保护
+	supersedes           map[int64]int64
+	readOnly             bool
+	slowOpThreshold      time.Duration
+	checkpointMinRegions int
+	compactIndexRatio    float64
+	autoRecreateDir      bool
+	storeKeysInIndex     bool
+	readTimeout          time.Duration
+	fileExtension        string
+	indexFileName        string
+	mergeSmallRegions    bool
+	recoveryReadahead    bool
+	diskPressureWorker   *time.Ticker
+	diskPressureDone     chan struct{}
 }
 
 // PutSegment inserts a Segment record into the LogStructuredFS virtual file system.
 func (lfs *LogStructuredFS) PutSegment(key string, seg *Segment) error {
+	if lfs.slowOpThreshold > 0 {
+		defer lfs.traceSlowOp("PutSegment", key, time.Now())
+	}
+	return lfs.putSegment(key, seg, false)
+}
+
+// PutSegmentSync 和 PutSegment 一样写入 seg，但是在更新索引之前先把 active region fsync 到磁盘，
+// 返回的时候数据一定已经持久化了，用于租约锁这类写入丢失之后会导致正确性问题的数据，普通的写入不需要付出 fsync 的开销。
+func (lfs *LogStructuredFS) PutSegmentSync(key string, seg *Segment) error {
+	return lfs.putSegment(key, seg, true)
+}
+
+func (lfs *LogStructuredFS) putSegment(key string, seg *Segment, durable bool) error {
 	inum := keyHash(key)
-	bytes, err := seg.Serialize()
+	buf, err := seg.serializePooled()
+	if err != nil {
+		return err
+	}
+	defer releaseSerializeBuffer(buf)
+
+	err = lfs.checkSegmentSize(buf.Len())
 	if err != nil {
 		return err
 	}
@@ -126,26 +346,44 @@ func (lfs *LogStructuredFS) PutSegment(key string, seg *Segment) error {
 	lfs.mu.Lock()
 	defer lfs.mu.Unlock()
 
+	// Select an index shard based on the hash function and update it.
+	// To avoid locking the entire index, only the relevant shard is locked.
+	imap, err := lfs.lockShard(inum)
+	if err != nil {
+		return err
+	}
+	defer imap.mu.Unlock()
+
+	err = lfs.checkMutable(imap, inum)
+	if err != nil {
+		return err
+	}
+
 	// Append data to the active region with a lock.
-	err = appendToActiveRegion(lfs.active, bytes)
+	err = lfs.appendActive(buf.Bytes())
 	if err != nil {
 		return err
 	}
 
-	// Select an index shard based on the hash function and update it.
-	// To avoid locking the entire index, only the relevant shard is locked.
-	imap := lfs.indexs[inum%uint64(shard)]
-	imap.mu.Lock()
+	if durable {
+		err = lfs.active.Sync()
+		if err != nil {
+			return fmt.Errorf("failed to sync active region: %w", err)
+		}
+	}
+
 	// Update the inode metadata within a critical section.
-	imap.index[inum] = &inode{
+	lfs.setInode(imap, inum, &inode{
 		RegionId:  lfs.regionId,
 		Position:  lfs.offset,
 		Length:    seg.Size(),
 		CreatedAt: seg.CreatedAt,
 		ExpiredAt: seg.ExpiredAt,
 		mvcc:      0,
-	}
-	imap.mu.Unlock()
+		immutable: seg.Immutable,
+	}, seg)
+
+	lfs.trackKey(key)
 
 	lfs.offset += int64(seg.Size()) // uint32 to uint64 is always safe
 
@@ -156,6 +394,217 @@ func (lfs *LogStructuredFS) PutSegment(key string, seg *Segment) error {
 	return nil
 }
 
+// PutSegmentIfAbsent 只有在 key 不存在或者已经过期的时候才会写入 seg，返回值表示本次是否写入成功。
+// 存在性检查和写入在同一个临界区内完成，并发的多个 setnx 操作只会有一个成功。
+func (lfs *LogStructuredFS) PutSegmentIfAbsent(key string, seg *Segment) (bool, error) {
+	return lfs.putSegmentIfAbsent(key, seg, false)
+}
+
+// PutSegmentIfAbsentSync 和 PutSegmentIfAbsent 一样只在 key 不存在的时候写入 seg，和 PutSegmentSync 一样在更新索引之前先 fsync，
+// 用于同时获取多把租约锁这类既需要存在性检查又不能丢失的写入。
+func (lfs *LogStructuredFS) PutSegmentIfAbsentSync(key string, seg *Segment) (bool, error) {
+	return lfs.putSegmentIfAbsent(key, seg, true)
+}
+
+func (lfs *LogStructuredFS) putSegmentIfAbsent(key string, seg *Segment, durable bool) (bool, error) {
+	inum := keyHash(key)
+	buf, err := seg.serializePooled()
+	if err != nil {
+		return false, err
+	}
+	defer releaseSerializeBuffer(buf)
+
+	err = lfs.checkSegmentSize(buf.Len())
+	if err != nil {
+		return false, err
+	}
+
+	lfs.mu.Lock()
+	defer lfs.mu.Unlock()
+
+	// 整个检查和写入过程都持有 shard 锁，避免检查之后被其他写入者抢先
+	imap, err := lfs.lockShard(inum)
+	if err != nil {
+		return false, err
+	}
+	defer imap.mu.Unlock()
+
+	if _, ok := lfs.liveInode(imap, inum); ok {
+		return false, nil
+	}
+
+	err = lfs.appendActive(buf.Bytes())
+	if err != nil {
+		return false, err
+	}
+
+	if durable {
+		err = lfs.active.Sync()
+		if err != nil {
+			return false, fmt.Errorf("failed to sync active region: %w", err)
+		}
+	}
+
+	lfs.setInode(imap, inum, &inode{
+		RegionId:  lfs.regionId,
+		Position:  lfs.offset,
+		Length:    seg.Size(),
+		CreatedAt: seg.CreatedAt,
+		ExpiredAt: seg.ExpiredAt,
+		mvcc:      0,
+		immutable: seg.Immutable,
+	}, seg)
+
+	lfs.trackKey(key)
+
+	lfs.offset += int64(seg.Size())
+
+	if lfs.offset >= lfs.regionThreshold {
+		return true, lfs.changeRegions()
+	}
+
+	return true, nil
+}
+
+// CompareAndSwapSegment 只有在 key 存在、没有过期并且当前的版本号等于 version 的时候才会写入 seg，返回值表示本次是否写入成功。
+// 写入成功之后版本号加一，并发的读取-修改-写入操作可以通过 FetchSegment 返回的版本号重试，不会丢失其他写入者的修改。
+func (lfs *LogStructuredFS) CompareAndSwapSegment(key string, version uint64, seg *Segment) (bool, error) {
+	if lfs.slowOpThreshold > 0 {
+		defer lfs.traceSlowOp("CompareAndSwapSegment", key, time.Now())
+	}
+
+	inum := keyHash(key)
+	buf, err := seg.serializePooled()
+	if err != nil {
+		return false, err
+	}
+	defer releaseSerializeBuffer(buf)
+
+	err = lfs.checkSegmentSize(buf.Len())
+	if err != nil {
+		return false, err
+	}
+
+	lfs.mu.Lock()
+	defer lfs.mu.Unlock()
+
+	imap, err := lfs.lockShard(inum)
+	if err != nil {
+		return false, err
+	}
+	defer imap.mu.Unlock()
+
+	old, ok := lfs.liveInode(imap, inum)
+	if !ok || atomic.LoadUint64(&old.mvcc) != version {
+		return false, nil
+	}
+
+	if old.immutable {
+		return false, ErrImmutable
+	}
+
+	err = lfs.appendActive(buf.Bytes())
+	if err != nil {
+		return false, err
+	}
+
+	lfs.setInode(imap, inum, &inode{
+		RegionId:  lfs.regionId,
+		Position:  lfs.offset,
+		Length:    seg.Size(),
+		CreatedAt: seg.CreatedAt,
+		ExpiredAt: seg.ExpiredAt,
+		mvcc:      version + 1,
+		immutable: seg.Immutable,
+	}, seg)
+
+	lfs.offset += int64(seg.Size())
+
+	if lfs.offset >= lfs.regionThreshold {
+		return true, lfs.changeRegions()
+	}
+
+	return true, nil
+}
+
+// Swap 原子性的把 key 的值替换为 seg 并且返回替换之前的值，key 不存在或者已经过期的时候返回 nil，类似于 Redis 的 GETSET。
+// keepTTL 为 true 的时候新值沿用旧值的过期时间，否则使用 seg 自己的过期时间，新值和旧值的类型不一致的时候返回 ErrTypeMismatch。
+func (lfs *LogStructuredFS) Swap(key string, seg *Segment, keepTTL bool) (*Segment, error) {
+	inum := keyHash(key)
+
+	lfs.mu.Lock()
+	defer lfs.mu.Unlock()
+
+	imap, err := lfs.lockShard(inum)
+	if err != nil {
+		return nil, err
+	}
+	defer imap.mu.Unlock()
+
+	var (
+		previous *Segment
+		version  uint64
+	)
+	if old, ok := lfs.liveInode(imap, inum); ok {
+		if old.immutable {
+			return nil, ErrImmutable
+		}
+
+		_, oldseg, err := lfs.readInode(old)
+		if err != nil {
+			return nil, err
+		}
+
+		if oldseg.Type != seg.Type {
+			return nil, typeMismatch(seg.Type, oldseg.Type)
+		}
+
+		if keepTTL {
+			seg.ExpiredAt = atomic.LoadInt64(&old.ExpiredAt)
+		}
+
+		previous = oldseg
+		version = atomic.LoadUint64(&old.mvcc) + 1
+	}
+
+	// 过期时间是 segment 头部的一部分，必须在确定了过期时间之后再序列化
+	buf, err := seg.serializePooled()
+	if err != nil {
+		return nil, err
+	}
+	defer releaseSerializeBuffer(buf)
+
+	err = lfs.checkSegmentSize(buf.Len())
+	if err != nil {
+		return nil, err
+	}
+
+	err = lfs.appendActive(buf.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	lfs.setInode(imap, inum, &inode{
+		RegionId:  lfs.regionId,
+		Position:  lfs.offset,
+		Length:    seg.Size(),
+		CreatedAt: seg.CreatedAt,
+		ExpiredAt: seg.ExpiredAt,
+		mvcc:      version,
+		immutable: seg.Immutable,
+	}, seg)
+
+	lfs.trackKey(key)
+
+	lfs.offset += int64(seg.Size())
+
+	if lfs.offset >= lfs.regionThreshold {
+		return previous, lfs.changeRegions()
+	}
+
+	return previous, nil
+}
+
 func (lfs *LogStructuredFS) BatchFetchSegments(keys ...string) ([]*Segment, error) {
 	var segs []*Segment
 	for _, key := range keys {
@@ -173,16 +622,37 @@ func (lfs *LogStructuredFS) CommitTxns(snapshots map[string]*Snapshot) error {
 		return errors.New("unexpected empty snapshot")
 	}
 
+	// 事务中的任何一个 segment 超过大小限制都不能写入，避免只提交了一部分
+	for _, snapshot := range snapshots {
+		err := lfs.checkSegmentSize(int(snapshot.Size()))
+		if err != nil {
+			return err
+		}
+	}
+
 	lfs.mu.Lock()
 	defer lfs.mu.Unlock()
 
+	// 和大小检查一样，任何一个 key 是不可变的时候整个事务都不能提交
+	for _, snapshot := range snapshots {
+		inum := keyHash(snapshot.KeyString())
+		imap := lfs.indexs[inum%uint64(shard)]
+
+		imap.mu.RLock()
+		err := lfs.checkMutable(imap, inum)
+		imap.mu.RUnlock()
+		if err != nil {
+			return err
+		}
+	}
+
 	for _, snapshot := range snapshots {
 		bytes, err := snapshot.Serialize()
 		if err != nil {
 			return err
 		}
 
-		err = appendToActiveRegion(lfs.active, bytes)
+		err = lfs.appendActive(bytes)
 		if err != nil {
 			return err
 		}
@@ -191,16 +661,19 @@ func (lfs *LogStructuredFS) CommitTxns(snapshots map[string]*Snapshot) error {
 		imap := lfs.indexs[inum%uint64(shard)]
 
 		imap.mu.Lock()
-		imap.index[inum] = &inode{
+		lfs.setInode(imap, inum, &inode{
 			RegionId:  lfs.regionId,
 			Position:  lfs.offset,
 			Length:    snapshot.Size(),
 			CreatedAt: snapshot.CreatedAt,
 			ExpiredAt: snapshot.ExpiredAt,
 			mvcc:      snapshot.mvcc + 1,
-		}
+			immutable: snapshot.Immutable,
+		}, snapshot.Segment)
 		imap.mu.Unlock()
 
+		lfs.trackKey(snapshot.KeyString())
+
 		lfs.offset += int64(snapshot.Size())
 	}
 
@@ -232,15 +705,17 @@ func (lfs *LogStructuredFS) RollbackTxns(keys []string, snapshots map[string]*Sn
 			return err
 		}
 
-		err = appendToActiveRegion(lfs.active, bytes)
+		err = lfs.appendActive(bytes)
 		if err != nil {
 			return err
 		}
 
 		imap.mu.Lock()
-		delete(imap.index, inum)
+		lfs.markSuperseded(lfs.regionId, imap.remove(inum))
 		imap.mu.Unlock()
 
+		lfs.untrackKey(key)
+
 		lfs.offset += int64(seg.Size())
 	}
 
@@ -250,7 +725,7 @@ func (lfs *LogStructuredFS) RollbackTxns(keys []string, snapshots map[string]*Sn
 			return err
 		}
 
-		err = appendToActiveRegion(lfs.active, bytes)
+		err = lfs.appendActive(bytes)
 		if err != nil {
 			return err
 		}
@@ -259,16 +734,19 @@ func (lfs *LogStructuredFS) RollbackTxns(keys []string, snapshots map[string]*Sn
 		imap := lfs.indexs[inum%uint64(shard)]
 
 		imap.mu.Lock()
-		imap.index[inum] = &inode{
+		lfs.setInode(imap, inum, &inode{
 			RegionId:  lfs.regionId,
 			Position:  lfs.offset,
 			Length:    snapshot.Size(),
 			CreatedAt: snapshot.CreatedAt,
 			ExpiredAt: snapshot.ExpiredAt,
 			mvcc:      snapshot.mvcc,
-		}
+			immutable: snapshot.Immutable,
+		}, snapshot.Segment)
 		imap.mu.Unlock()
 
+		lfs.trackKey(snapshot.KeyString())
+
 		lfs.offset += int64(snapshot.Size())
 	}
 
@@ -286,28 +764,241 @@ func (lfs *LogStructuredFS) DeleteSegment(key string) error {
 		return err
 	}
 
+	inum := keyHash(key)
+	imap := lfs.indexs[inum%uint64(shard)]
+	if imap == nil {
+		return fmt.Errorf("inode index shard for %d not found", inum)
+	}
+
 	// 写入和更新 offset 应该是一个整体操作
 	lfs.mu.Lock()
-	err = appendToActiveRegion(lfs.active, bytes)
+	imap.rLock()
+	err = lfs.checkMutable(imap, inum)
+	imap.mu.RUnlock()
+	if err != nil {
+		lfs.mu.Unlock()
+		return err
+	}
+
+	err = lfs.appendActive(bytes)
 	if err != nil {
 		lfs.mu.Unlock()
 		return err
 	}
 
 	lfs.offset += int64(seg.Size())
+
+	// tombstone 所在的 region 覆盖了旧 inode 所在的 region，需要在持有 lfs.mu 的时候记录
+	imap.lock()
+	lfs.markSuperseded(lfs.regionId, imap.remove(inum))
+	imap.mu.Unlock()
 	lfs.mu.Unlock()
 
+	lfs.untrackKey(key)
+
+	return nil
+}
+
+// DeleteIf 在持有 shard 锁的情况下读取 key 当前的 segment，只有 match 返回 true 的时候才写入 tombstone 删除 key，
+// 返回值表示是否删除成功，key 不存在或者已经过期的时候返回 false。比较和删除之间不会有其他写入者修改 key。
+func (lfs *LogStructuredFS) DeleteIf(key string, match func(seg *Segment) (bool, error)) (bool, error) {
 	inum := keyHash(key)
+
+	lfs.mu.Lock()
+	defer lfs.mu.Unlock()
+
 	imap := lfs.indexs[inum%uint64(shard)]
 	if imap == nil {
-		return fmt.Errorf("inode index shard for %d not found", inum)
+		return false, fmt.Errorf("inode index shard for %d not found", inum)
 	}
 
 	imap.mu.Lock()
-	delete(imap.index, inum)
-	imap.mu.Unlock()
+	defer imap.mu.Unlock()
 
-	return nil
+	// 超过 MaxValueAge 的 key 读取的时候已经不存在了，和其他的条件写入一样不能再按照旧值删除
+	old, ok := lfs.liveInode(imap, inum)
+	if !ok {
+		return false, nil
+	}
+
+	if old.immutable {
+		return false, ErrImmutable
+	}
+
+	_, current, err := lfs.readInode(old)
+	if err != nil {
+		return false, err
+	}
+
+	matched, err := match(current)
+	if err != nil || !matched {
+		return false, err
+	}
+
+	tombstone := NewTombstoneSegment(key)
+	buf, err := tombstone.serializePooled()
+	if err != nil {
+		return false, err
+	}
+	defer releaseSerializeBuffer(buf)
+
+	err = lfs.appendActive(buf.Bytes())
+	if err != nil {
+		return false, err
+	}
+
+	lfs.offset += int64(tombstone.Size())
+	lfs.markSuperseded(lfs.regionId, imap.remove(inum))
+	lfs.untrackKey(key)
+
+	return true, nil
+}
+
+// DeleteIfEquals 只有在 key 当前经过 pipeline 解码之后的 value 和 expected 完全相同的时候才删除 key，
+// 用于避免删除一个在客户端读取之后已经被其他人修改过的 key。
+func (lfs *LogStructuredFS) DeleteIfEquals(key string, expected []byte) (bool, error) {
+	return lfs.DeleteIf(key, func(seg *Segment) (bool, error) {
+		return bytes.Equal(seg.Value, expected), nil
+	})
+}
+
+// Expire 刷新单个 key 的过期时间，返回 key 是否存在
+func (lfs *LogStructuredFS) Expire(key string, ttl int64) (bool, error) {
+	n, err := lfs.ExpireMany(context.Background(), []string{key}, ttl)
+	return n == 1, err
+}
+
+// ExpireMany 批量刷新多个 key 的过期时间，ttl 小于等于 0 表示永不过期，返回实际更新的 key 数量。
+// 不存在或者已经过期的 key 直接跳过，遇到不可变的 key 返回 ErrImmutable，整个批次只获取一次 lfs.mu，每个 key 只锁住它所在的 shard。
+// 过期时间保存在 segment 的头部中，所以需要把带有新过期时间的 segment 追加到活跃 region 中，保留原来的创建时间和版本号。
+// ctx 被取消的时候返回已经更新的数量和 ctx 的错误。
+func (lfs *LogStructuredFS) ExpireMany(ctx context.Context, keys []string, ttl int64) (int, error) {
+	expiredAt := int64(ImmortalTTL)
+	if ttl > 0 {
+		expiredAt = time.Now().Add(time.Second * time.Duration(ttl)).UnixMicro()
+	}
+
+	lfs.mu.Lock()
+	defer lfs.mu.Unlock()
+
+	updated := 0
+	for _, key := range keys {
+		// 调用方取消之后不再处理剩下的 key，已经更新的 key 不会回滚
+		if err := ctx.Err(); err != nil {
+			return updated, err
+		}
+
+		inum := keyHash(key)
+		imap := lfs.indexs[inum%uint64(shard)]
+		if imap == nil {
+			return updated, fmt.Errorf("inode index shard for %d not found", inum)
+		}
+
+		ok, err := func() (bool, error) {
+			imap.mu.Lock()
+			defer imap.mu.Unlock()
+
+			old, ok := lfs.liveInode(imap, inum)
+			if !ok {
+				return false, nil
+			}
+
+			// 修改不可变 key 的过期时间和删除它没有区别，ttl 很短的时候马上就会被淘汰
+			if old.immutable {
+				return false, ErrImmutable
+			}
+
+			_, seg, err := lfs.readInode(old)
+			if err != nil {
+				return false, err
+			}
+
+			// 索引使用的是 key 的哈希值，需要排除哈希冲突的情况
+			if seg.KeyString() != key {
+				return false, nil
+			}
+
+			seg.ExpiredAt = expiredAt
+			bytes, err := seg.Serialize()
+			if err != nil {
+				return false, err
+			}
+
+			err = lfs.appendActive(bytes)
+			if err != nil {
+				return false, err
+			}
+
+			lfs.setInode(imap, inum, &inode{
+				RegionId:  lfs.regionId,
+				Position:  lfs.offset,
+				Length:    seg.Size(),
+				CreatedAt: seg.CreatedAt,
+				ExpiredAt: seg.ExpiredAt,
+				mvcc:      atomic.LoadUint64(&old.mvcc),
+				immutable: seg.Immutable,
+			}, seg)
+
+			lfs.offset += int64(seg.Size())
+
+			return true, nil
+		}()
+		if err != nil {
+			return updated, err
+		}
+
+		if ok {
+			updated++
+		}
+
+		if lfs.offset >= lfs.regionThreshold {
+			err = lfs.changeRegions()
+			if err != nil {
+				return updated, err
+			}
+		}
+	}
+
+	return updated, nil
+}
+
+// readRegion 从 inode 指向的 region 中读取 segment，region 只有在同时持有 lfs.mu 和 regmux 写锁的时候才会被修改，
+// 所以调用者需要持有 lfs.mu 或者 regmux 其中一个的读锁
+func (lfs *LogStructuredFS) readRegion(inode *inode) (uint64, *Segment, error) {
+	regionId := atomic.LoadInt64(&inode.RegionId)
+	region, ok := lfs.regions[regionId]
+	if !ok {
+		return 0, nil, fmt.Errorf("%w: data region with ID %d not found", ErrRegionUnavailable, regionId)
+	}
+
+	// 如果是 Active Region 它的 ReaderAt 为 nil，直接读取不需要使用 mmap
+	if region.ReaderAt == nil {
+		hash, segment, err := readSegment(lfs.timeoutReader(region.Fd), atomic.LoadInt64(&inode.Position), _SEGMENT_PADDING)
+		if err != nil {
+			return 0, nil, fmt.Errorf("failed to read segment from active region: %w", err)
+		}
+		return hash, segment, nil
+	}
+
+	hash, segment, err := readSegment(lfs.timeoutReader(region.ReaderAt), atomic.LoadInt64(&inode.Position), _SEGMENT_PADDING)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to read segment from mmap: %w", err)
+	}
+
+	return hash, segment, nil
+}
+
+// timeoutReader 设置了 Options.ReadTimeout 的时候给 reader 加上读取的超时时间，否则原样返回
+func (lfs *LogStructuredFS) timeoutReader(reader io.ReaderAt) io.ReaderAt {
+	if lfs.readTimeout <= 0 {
+		return reader
+	}
+	return &timeoutReaderAt{reader: reader, timeout: lfs.readTimeout}
+}
+
+// readInode 从 inode 指向的 region 中读取 segment，调用者需要持有 lfs.mu 的读锁
+func (lfs *LogStructuredFS) readInode(inode *inode) (uint64, *Segment, error) {
+	return lfs.readRegion(inode)
 }
 
 func (lfs *LogStructuredFS) IsActive(key string) bool {
@@ -324,7 +1015,49 @@ func (lfs *LogStructuredFS) IsActive(key string) bool {
 		return false
 	}
 
-	return (inode != nil && inode.ExpiredAt == ImmortalTTL) || (inode.ExpiredAt > 0 && time.Now().UnixMicro() < inode.ExpiredAt)
+	return !isExpired(atomic.LoadInt64(&inode.ExpiredAt))
+}
+
+// HasSegments 只通过内存索引批量判断 keys 是否存在，不需要读取磁盘上的数据，
+// 已经过期但是还没有被清理的 key 和不存在的 key 一样返回 false，重复的 key 只会出现一次。
+func (lfs *LogStructuredFS) HasSegments(keys []string) map[string]bool {
+	exists := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		exists[key] = lfs.IsActive(key)
+	}
+	return exists
+}
+
+// Version 只通过内存索引返回 key 当前的版本号，不需要读取磁盘，key 不存在或者已经过期的时候返回 false。
+// 版本号只有 CompareAndSwapSegment 和事务提交会递增，普通的 PutSegment 写入之后版本号重置为 0。
+func (lfs *LogStructuredFS) Version(key string) (uint64, bool) {
+	_, version, ok := lfs.VersionStamp(key)
+	return version, ok
+}
+
+// VersionStamp 和 Version 一样只读取内存索引，同时返回当前版本写入时的创建时间，
+// 每一次写入都会生成新的创建时间，和版本号一起可以区分普通 PUT 覆盖写入之后版本号都是 0 的不同版本。
+func (lfs *LogStructuredFS) VersionStamp(key string) (int64, uint64, bool) {
+	inum := keyHash(key)
+	imap := lfs.indexs[inum%uint64(shard)]
+	if imap == nil {
+		return 0, 0, false
+	}
+
+	imap.mu.RLock()
+	defer imap.mu.RUnlock()
+
+	inode, ok := imap.index[inum]
+	if !ok {
+		return 0, 0, false
+	}
+
+	expiredAt := atomic.LoadInt64(&inode.ExpiredAt)
+	if isExpired(expiredAt) {
+		return 0, 0, false
+	}
+
+	return inode.CreatedAt, atomic.LoadUint64(&inode.mvcc), true
 }
 
 func (lfs *LogStructuredFS) visible(key string) (uint64, bool) {
@@ -346,44 +1079,73 @@ func (lfs *LogStructuredFS) visible(key string) (uint64, bool) {
 }
 
 func (lfs *LogStructuredFS) FetchSegment(key string) (uint64, *Segment, error) {
+	if lfs.slowOpThreshold > 0 {
+		defer lfs.traceSlowOp("FetchSegment", key, time.Now())
+	}
+
+	version, seg, err := lfs.fetchSegment(key)
+	if errors.Is(err, ErrRegionUnavailable) {
+		// inode 指向的 region 已经被垃圾回收删除，说明读取的是迁移之前的 inode，重新读取索引中迁移之后的位置重试一次
+		return lfs.fetchSegment(key)
+	}
+	return version, seg, err
+}
+
+// logSlowOp 输出慢操作日志，测试中可以替换掉它来观察慢操作
+var logSlowOp = func(op, key string, elapsed time.Duration) {
+	clog.Debugf("slow %s (key: %s) took %s", op, key, elapsed)
+}
+
+// traceSlowOp 在操作结束的时候通过 defer 调用，耗时超过 SlowOpThreshold 时输出慢操作日志
+func (lfs *LogStructuredFS) traceSlowOp(op, key string, start time.Time) {
+	if elapsed := time.Since(start); elapsed >= lfs.slowOpThreshold {
+		logSlowOp(op, key, elapsed)
+	}
+}
+
+func (lfs *LogStructuredFS) fetchSegment(key string) (uint64, *Segment, error) {
 	inum := keyHash(key)
 	imap := lfs.indexs[inum%uint64(shard)]
 	if imap == nil {
 		return 0, nil, fmt.Errorf("inode index shard for %d not found", inum)
 	}
 
-	imap.mu.RLock()
+	imap.rLock()
 	inode, ok := imap.index[inum]
-	imap.mu.RUnlock()
 	if !ok {
-		return 0, nil, fmt.Errorf("inode index for %d not found", inum)
+		imap.mu.RUnlock()
+		return 0, nil, fmt.Errorf("inode index for %d %w", inum, ErrSegmentNotFound)
 	}
 
 	if atomic.LoadInt64(&inode.ExpiredAt) <= time.Now().UnixMicro() &&
 		atomic.LoadInt64(&inode.ExpiredAt) > 0 {
-		imap.mu.Lock()
-		delete(imap.index, inum)
-		imap.mu.Unlock()
-		return 0, nil, fmt.Errorf("inode index for %d has expired", inum)
+		imap.mu.RUnlock()
+		lfs.evictInode(imap, inum, inode)
+		return 0, nil, fmt.Errorf("inode index for %d: %w", inum, ErrSegmentExpired)
 	}
 
-	region, ok := lfs.regions[atomic.LoadInt64(&inode.RegionId)]
-	if !ok {
-		return 0, nil, fmt.Errorf("data region with ID %d not found", inode.RegionId)
+	// 读取期间持有 regmux 的读锁，垃圾回收先在 shard 锁内把 inode 替换为迁移之后的位置，再持有写锁删除 region，
+	// 这里在释放 shard 锁之前拿到读锁，保证读到的 inode 指向的 region 在读取完成之前不会被关闭和删除。
+	lfs.regmux.RLock()
+	imap.mu.RUnlock()
+	hash, segment, err := lfs.readRegion(inode)
+	lfs.regmux.RUnlock()
+	if err != nil {
+		return 0, nil, err
 	}
 
-	// 如果是 Active Region 它的 ReaderAt 为 nil，直接读取不需要使用 mmap
-	if region.ReaderAt == nil {
-		_, segment, err := readSegment(region.Fd, atomic.LoadInt64(&inode.Position), _SEGMENT_PADDING)
-		if err != nil {
-			return 0, nil, fmt.Errorf("failed to read segment from active region: %w", err)
-		}
-		return atomic.LoadUint64(&inode.mvcc), segment, nil
+	// 只校验 value 的 segment 读取时没有校验 key，这里通过索引的哈希值确认 key 没有损坏
+	if hash != inum {
+		return 0, nil, fmt.Errorf("failed to verify key in segment: %d", inum)
 	}
 
-	_, segment, err := readSegment(region.ReaderAt, atomic.LoadInt64(&inode.Position), _SEGMENT_PADDING)
-	if err != nil {
-		return 0, nil, fmt.Errorf("failed to read segment from mmap: %w", err)
+	if lfs.exceedsMaxAge(segment.CreatedAt, segment.Type) {
+		lfs.evictInode(imap, inum, inode)
+		return 0, nil, fmt.Errorf("inode index for %d: %w", inum, ErrSegmentExpired)
+	}
+
+	if inode.stats != nil {
+		inode.stats.reads.Add(1)
 	}
 
 	// Return the fetched segment and multi-version concurrency ID
@@ -411,7 +1173,7 @@ func (lfs *LogStructuredFS) RefreshInodeCount() uint64 {
 			// Clean expired inode
 			imap.mu.Lock()
 			if inode.ExpiredAt <= time.Now().UnixMicro() && inode.ExpiredAt > 0 {
-				delete(imap.index, key)
+				imap.remove(key)
 			} else {
 				inodes += 1
 			}
@@ -421,27 +1183,246 @@ func (lfs *LogStructuredFS) RefreshInodeCount() uint64 {
 	return inodes
 }
 
-func (lfs *LogStructuredFS) StopExpireLoop() {
-	lfs.mu.Lock()
-	defer lfs.mu.Unlock()
-
-	if lfs.expireLoopWorker != nil {
-		lfs.expireLoopWorker.Stop()
+func (lfs *LogStructuredFS) StopExpireLoop() {
+	lfs.mu.Lock()
+	defer lfs.mu.Unlock()
+
+	if lfs.expireLoopWorker != nil {
+		lfs.expireLoopWorker.Stop()
+		// Ticker.Stop 不会关闭 channel，需要通知后台协程退出，否则整个存储实例都无法被回收
+		close(lfs.expireLoopDone)
+		lfs.expireLoopWorker = nil
+	}
+}
+
+func (lfs *LogStructuredFS) cleanupExpired(worker *time.Ticker, done <-chan struct{}) {
+	for {
+		select {
+		case <-done:
+			return
+		case <-worker.C:
+			lfs.sweepExpired()
+			if lfs.reclaimExpired {
+				err := lfs.reclaimDeadRegions()
+				if err != nil {
+					clog.Warnf("failed to reclaim expired regions: %v", err)
+				}
+			}
+		}
+	}
+}
+
+// sweepExpired 从索引中删除已经过期或者超过 MaxValueAge 的 inode
+func (lfs *LogStructuredFS) sweepExpired() {
+	// 按照 MaxValueAge 淘汰数据时需要读取 region 判断是否是租约锁，必须先持有 lfs.mu 的读锁
+	if lfs.maxValueAge > 0 {
+		lfs.mu.RLock()
+		defer lfs.mu.RUnlock()
+	}
+	for _, imap := range lfs.indexs {
+		imap.mu.Lock()
+		imap.capacity = max(imap.capacity, len(imap.index))
+		for key, inode := range imap.index {
+			if inode.ExpiredAt > 0 && inode.ExpiredAt <= time.Now().UnixMicro() {
+				imap.remove(key)
+				continue
+			}
+			if lfs.inodeExceedsMaxAge(inode) {
+				imap.remove(key)
+			}
+		}
+		if lfs.compactIndexRatio > 0 && imap.sparse(lfs.compactIndexRatio) {
+			imap.shrink()
+		}
+		imap.mu.Unlock()
+	}
+}
+
+// reclaimDeadRegions 删除已经没有任何 inode 引用的旧 region。写入和迁移只会追加到活跃 region，
+// 统计之前已经存在的旧 region 只会减少引用，不会增加，所以引用计数为 0 的 region 可以直接删除，不需要迁移数据。
+// 一个 region 中过期或者被删除的数据可能覆盖了更早的 region 中的旧版本，tombstone 也是一样，
+// 更早的 region 还存在的时候删除它，没有索引快照的全量恢复会让旧版本重新出现，所以这样的 region 留给垃圾回收处理。
+func (lfs *LogStructuredFS) reclaimDeadRegions() error {
+	lfs.mu.Lock()
+	if lfs.gcstate == _GC_ACTIVE {
+		lfs.mu.Unlock()
+		return nil
+	}
+	lfs.gcstate = _GC_ACTIVE
+	// 统计之前记录活跃 region，统计期间切换出来的 region 可能还有没有被统计到的写入
+	active := lfs.regionId
+	supersedes := make(map[int64]int64, len(lfs.supersedes))
+	for id, earliest := range lfs.supersedes {
+		if id < active {
+			supersedes[id] = earliest
+		}
+	}
+	lfs.mu.Unlock()
+
+	defer func() {
+		lfs.mu.Lock()
+		lfs.gcstate = _GC_INACTIVE
+		lfs.mu.Unlock()
+	}()
+
+	live := make(map[int64]int)
+	for _, imap := range lfs.indexs {
+		imap.mu.RLock()
+		for id, n := range imap.live {
+			live[id] += n
+		}
+		imap.mu.RUnlock()
+	}
+
+	start := time.Now()
+	stats := new(CompactStats)
+
+	lfs.regmux.RLock()
+	ids := make([]int64, 0, len(lfs.regions))
+	for id := range lfs.regions {
+		if id < active {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	// 从最早的 region 开始检查，kept 是目前为止保留下来的最新的 region，
+	// 一个 region 覆盖过的最早的 region 比 kept 更新的时候，它覆盖的旧版本都已经随着更早的 region 一起删除了
+	var (
+		dead    []int64
+		kept    int64
+		hasKept bool
+	)
+	for _, id := range ids {
+		earliest, ok := supersedes[id]
+		if !ok {
+			// 打开之前就已经存在的 region 不知道覆盖过哪些 region，只有之前的 region 都被删除之后才能删除
+			earliest = math.MinInt64
+		}
+
+		reg := lfs.regions[id]
+		if live[id] > 0 || reg.ReaderAt == nil || (hasKept && kept >= earliest) {
+			kept, hasKept = id, true
+			continue
+		}
+
+		dead = append(dead, id)
+		stats.BytesReclaimed += int64(reg.Len())
+	}
+	lfs.regmux.RUnlock()
+
+	if len(dead) == 0 {
+		return nil
+	}
+
+	err := lfs.snapshotBeforeRemove()
+	if err != nil {
+		return err
+	}
+
+	for _, id := range dead {
+		lfs.removeRegion(id, stats)
+	}
+	stats.Duration = time.Since(start)
+
+	clog.Debugf("reclaimed %d expired regions", stats.RegionsRemoved)
+
+	if lfs.compactCallback != nil {
+		lfs.compactCallback(*stats)
+	}
+
+	return nil
+}
+
+// markSuperseded 记录 regionId 中新写入的数据替换或者删除了 old，old 为 nil 的时候什么都不做，
+// 调用者需要持有 lfs.mu 的写锁。
+func (lfs *LogStructuredFS) markSuperseded(regionId int64, old *inode) {
+	if old != nil {
+		lfs.supersede(regionId, atomic.LoadInt64(&old.RegionId))
+	}
+}
+
+// supersede 把 regionId 覆盖过的最早的 region 更新为 earliest，打开之前就已经存在的 region 不会被记录
+func (lfs *LogStructuredFS) supersede(regionId, earliest int64) {
+	if current, ok := lfs.supersedes[regionId]; ok && earliest < current {
+		lfs.supersedes[regionId] = earliest
+	}
+}
+
+// exceedsMaxAge 判断数据的创建时间是否已经超过了 Options.MaxValueAge，没有开启 MaxValueAgeLocks 时租约锁不受影响
+func (lfs *LogStructuredFS) exceedsMaxAge(createdAt int64, t kind) bool {
+	if lfs.maxValueAge <= 0 || time.Now().UnixMicro()-createdAt < lfs.maxValueAge {
+		return false
+	}
+	return lfs.maxValueAgeLocks || t != _LEASELOCK
+}
+
+// inodeExceedsMaxAge 先通过 inode 中的创建时间过滤，只有超过期限并且需要区分租约锁的时候才读取 segment 的类型，
+// 调用方必须持有 lfs.mu 的读锁。
+func (lfs *LogStructuredFS) inodeExceedsMaxAge(inode *inode) bool {
+	createdAt := atomic.LoadInt64(&inode.CreatedAt)
+	if lfs.maxValueAge <= 0 || time.Now().UnixMicro()-createdAt < lfs.maxValueAge {
+		return false
+	}
+
+	if lfs.maxValueAgeLocks {
+		return true
+	}
+
+	_, seg, err := lfs.readInode(inode)
+	if err != nil {
+		return false
+	}
+
+	return lfs.exceedsMaxAge(createdAt, seg.Type)
+}
+
+// evictInode 删除读取时发现已经过期的 inode，删除之前确认索引没有被并发的写入替换
+func (lfs *LogStructuredFS) evictInode(imap *indexMap, inum uint64, old *inode) {
+	imap.mu.Lock()
+	defer imap.mu.Unlock()
+	if imap.index[inum] == old {
+		imap.remove(inum)
+	}
+}
+
+// checkSegmentSize 单个 segment 必须能够完整的写入一个新的 region，超过 region 阈值的数据会破坏按照大小切换 region 的约定，
+// 写入之前直接拒绝，不会在 region 中留下任何数据。
+func (lfs *LogStructuredFS) checkSegmentSize(size int) error {
+	limit := lfs.regionThreshold - int64(len(dataFileMetadata))
+	if int64(size) > limit {
+		return fmt.Errorf("%w: %d bytes exceeds the limit of %d bytes", ErrSegmentTooLarge, size, limit)
+	}
+	return nil
+}
+
+// checkMutable 检查 inum 当前的 inode 是否允许被覆盖或者删除，存活的不可变 key 返回 ErrImmutable，调用者需要持有 lfs.mu 和 shard 锁
+func (lfs *LogStructuredFS) checkMutable(imap *indexMap, inum uint64) error {
+	if old, ok := lfs.liveInode(imap, inum); ok && old.immutable {
+		return ErrImmutable
+	}
+	return nil
+}
+
+// lockShard 返回 inum 所在的 shard 并且持有它的写锁，写入路径都通过它加锁，shard 的竞争统计才能覆盖每一种写入，
+// 调用者负责释放 imap.mu。
+func (lfs *LogStructuredFS) lockShard(inum uint64) (*indexMap, error) {
+	imap := lfs.indexs[inum%uint64(shard)]
+	if imap == nil {
+		return nil, fmt.Errorf("inode index shard for %d not found", inum)
 	}
+	imap.lock()
+	return imap, nil
 }
 
-func (lfs *LogStructuredFS) cleanupExpired() {
-	for range lfs.expireLoopWorker.C {
-		for _, imap := range lfs.indexs {
-			imap.mu.Lock()
-			for key, inode := range imap.index {
-				if inode.ExpiredAt > 0 && inode.ExpiredAt <= time.Now().UnixMicro() {
-					delete(imap.index, key)
-				}
-			}
-			imap.mu.Unlock()
-		}
+// liveInode 返回 inum 当前存活的 inode，已经过期或者超过 MaxValueAge 的 inode 和不存在一样，和读取时的判断保持一致，
+// 调用者需要持有 lfs.mu 和 shard 锁。
+func (lfs *LogStructuredFS) liveInode(imap *indexMap, inum uint64) (*inode, bool) {
+	old, ok := imap.index[inum]
+	if !ok || isExpired(atomic.LoadInt64(&old.ExpiredAt)) || lfs.inodeExceedsMaxAge(old) {
+		return nil, false
 	}
+	return old, true
 }
 
 func keyHash(key string) uint64 {
@@ -452,52 +1433,123 @@ func (lfs *LogStructuredFS) changeRegions() error {
 	lfs.regmux.Lock()
 	defer lfs.regmux.Unlock()
 
-	err := utils.FlushToDisk(lfs.active)
+	err := lfs.active.Sync()
 	if err != nil {
 		return fmt.Errorf("failed to change active regions: %w", err)
 	}
 
+	// 先创建新的 active region，失败的时候继续写入当前已经超过阈值的 region，下一次写入时再重试切换。
+	// 触发切换的数据已经写入并且建立了索引，不能因为切换失败让这次写入返回错误，
+	// 也不能提前关闭当前 region 或者把它映射为只读，否则之后追加的数据无法写入和读取。
+	prev, prevId := lfs.active, lfs.regionId
+	err = lfs.createActiveRegion()
+	if err != nil && lfs.recreateDirectory(err) {
+		err = lfs.createActiveRegion()
+	}
+	if err != nil {
+		clog.Warnf("failed to roll active region %d, retrying on next write: %v", prevId, err)
+		return nil
+	}
+
 	// 重新以只读的方式打开这个文件，并且设置 mmap 映射
-	name, err := toStringFileName(lfs.regionId)
+	name, err := lfs.toStringFileName(prevId)
 	if err != nil {
 		return fmt.Errorf("failed to active region name to string: %w", err)
 	}
 
-	// 写满了就映射为 mmap 的方式读取
-	reader, err := mmap.Open(filepath.Join(lfs.directory, name))
+	// 写满了就映射为 mmap 的方式读取，映射失败的时候保留原来的 Fd 继续读取
+	reader, err := openReaderAt(lfs.fsys, filepath.Join(lfs.directory, name))
 	if err != nil {
-		return fmt.Errorf("failed to mmap data file: %w", err)
+		clog.Warnf("failed to mmap region %d, reading through file descriptor: %v", prevId, err)
+		return nil
 	}
 
-	lfs.regions[lfs.regionId].ReaderAt = reader
+	lfs.regions[prevId].ReaderAt = reader
 
-	err = lfs.createActiveRegion()
+	err = prev.Close()
 	if err != nil {
-		return fmt.Errorf("failed to chanage active regions: %w", err)
+		return fmt.Errorf("failed to close region %d: %w", prevId, err)
 	}
 
 	return nil
 }
 
+// appendActive 把 bytes 追加到活跃 region 中，调用者需要持有 lfs.mu 的写锁。开启 Options.AutoRecreateDir 的时候，
+// 如果写入失败是因为数据目录被删除了，重新创建目录和活跃 region 之后再写入一次。
+func (lfs *LogStructuredFS) appendActive(bytes []byte) error {
+	err := appendToActiveRegion(lfs.active, bytes)
+	if err == nil {
+		return nil
+	}
+
+	lfs.regmux.Lock()
+	recreated := lfs.recreateDirectory(err)
+	if recreated {
+		err = lfs.createActiveRegion()
+	}
+	lfs.regmux.Unlock()
+
+	if !recreated {
+		return err
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to recreate active region: %w", err)
+	}
+
+	return appendToActiveRegion(lfs.active, bytes)
+}
+
+// recreateDirectory 在开启 Options.AutoRecreateDir 并且数据目录已经不存在的时候重新创建数据目录，
+// 返回 true 表示目录已经重新创建，调用者需要接着创建新的活跃 region，调用者需要持有 lfs.mu 和 lfs.regmux 的写锁。
+func (lfs *LogStructuredFS) recreateDirectory(cause error) bool {
+	if !lfs.autoRecreateDir || isExist(lfs.fsys, lfs.directory) {
+		return false
+	}
+
+	clog.Warnf("data directory %s was removed at runtime, recreating it, data written before is lost: %v", lfs.directory, cause)
+
+	err := checkFileSystem(lfs.fsys, lfs.directory, lfs.fsPerm, lfs.fileExtension, lfs.indexFileName)
+	if err != nil {
+		clog.Errorf("failed to recreate data directory %s: %v", lfs.directory, err)
+		return false
+	}
+
+	return true
+}
+
 func (lfs *LogStructuredFS) createActiveRegion() error {
 	lfs.regionId += 1
-	name, err := toStringFileName(lfs.regionId)
+	name, err := lfs.toStringFileName(lfs.regionId)
 	if err != nil {
 		return fmt.Errorf("failed to new active region name: %w", err)
 	}
 
-	fd, err := os.OpenFile(filepath.Join(lfs.directory, name), appendOnlyLog, lfs.fsPerm)
+	path := filepath.Join(lfs.directory, name)
+	fd, err := lfs.fsys.OpenFile(path, appendOnlyLog, lfs.fsPerm)
 	if err != nil {
+		lfs.regionId -= 1
 		return fmt.Errorf("failed to create active region: %w", err)
 	}
 
 	n, err := fd.Write(dataFileMetadata)
+	if err == nil && n != len(dataFileMetadata) {
+		err = errors.New("failed to active region metadata write")
+	}
+
 	if err != nil {
+		// 元数据没有完整写入的 region 文件在下次启动的时候无法通过文件头校验，需要立即清理掉，
+		// 否则整个数据库都会因为这个半成品文件而无法打开。
+		_ = fd.Close()
+		if rerr := lfs.fsys.Remove(path); rerr != nil {
+			clog.Warnf("failed to remove partial active region %s: %v", name, rerr)
+		}
+		lfs.regionId -= 1
 		return fmt.Errorf("failed to write active region metadata: %w", err)
 	}
 
-	if n != len(dataFileMetadata) {
-		return errors.New("failed to active region metadata write")
+	if lfs.supersedes != nil {
+		lfs.supersedes[lfs.regionId] = lfs.regionId
 	}
 
 	lfs.active = fd
@@ -510,15 +1562,15 @@ func (lfs *LogStructuredFS) createActiveRegion() error {
 
 func (lfs *LogStructuredFS) redoPendingTxns() error {
 	txnDirPath := filepath.Join(lfs.directory, txnDirName)
-	if !utils.IsExist(txnDirPath) {
-		err := os.MkdirAll(txnDirPath, lfs.fsPerm)
+	if !isExist(lfs.fsys, txnDirPath) {
+		err := lfs.fsys.MkdirAll(txnDirPath, lfs.fsPerm)
 		if err != nil {
 			return fmt.Errorf("failed to create transaction directory: %w", err)
 		}
 		return nil
 	}
 
-	txns, err := os.ReadDir(txnDirPath)
+	txns, err := lfs.fsys.ReadDir(txnDirPath)
 	if err != nil {
 		return fmt.Errorf("failed to read transaction directory: %w", err)
 	}
@@ -546,7 +1598,7 @@ func (lfs *LogStructuredFS) redoPendingTxns() error {
 	// 存在 txn 文件说明上次运行过程中有事物未能成功执行，Redo 这些未提交的事务来恢复数据的一致性和安全性。
 	for _, txn := range pendingTxns {
 		txnFilePath := filepath.Join(txnDirPath, fmt.Sprintf("%d%s", txn, txnExtension))
-		fd, err := os.OpenFile(txnFilePath, os.O_RDWR, lfs.fsPerm)
+		fd, err := lfs.fsys.OpenFile(txnFilePath, os.O_RDWR, lfs.fsPerm)
 		if err != nil {
 			return fmt.Errorf("failed to open pending transaction file: %w", err)
 		}
@@ -582,7 +1634,7 @@ func (lfs *LogStructuredFS) redoPendingTxns() error {
 			// 上次事物中中途添加的 key 需要回滚到没有到状态，所以需要把它写成一个 tombstone 记录，
 			// 这样在后续的读取过程中就会被正确地识别为已删除的 key ，避免数据不一致的问题。
 			if seg.IsTombstone() {
-				delete(imap.index, inum)
+				imap.remove(inum)
 				lfs.offset += int64(seg.Size())
 				continue
 			}
@@ -597,14 +1649,15 @@ func (lfs *LogStructuredFS) redoPendingTxns() error {
 				return fmt.Errorf("failed to append to active region: %w", err)
 			}
 
-			imap.index[inum] = &inode{
+			imap.put(inum, &inode{
 				mvcc:      0,
 				Length:    seg.Size(),
 				Position:  lfs.offset,
 				RegionId:  lfs.regionId,
 				CreatedAt: seg.CreatedAt,
 				ExpiredAt: seg.ExpiredAt,
-			}
+				immutable: seg.Immutable,
+			})
 
 			lfs.offset += int64(seg.Size())
 
@@ -617,7 +1670,7 @@ func (lfs *LogStructuredFS) redoPendingTxns() error {
 			}
 		}
 
-		err = os.Remove(txnFilePath)
+		err = lfs.fsys.Remove(txnFilePath)
 		if err != nil {
 			return fmt.Errorf("failed to delete pending transaction file %s: %w", txnFilePath, err)
 		}
@@ -628,25 +1681,30 @@ func (lfs *LogStructuredFS) redoPendingTxns() error {
 
 func (lfs *LogStructuredFS) scanAndRecoverRegions() error {
 	// Single-thread recovery does not require locking
-	files, err := os.ReadDir(lfs.directory)
+	files, err := lfs.fsys.ReadDir(lfs.directory)
 	if err != nil {
 		return fmt.Errorf("failed to read directory: %w", err)
 	}
 
 	for _, file := range files {
-		if !file.IsDir() && strings.HasSuffix(file.Name(), fileExtension) {
+		if !file.IsDir() && strings.HasSuffix(file.Name(), lfs.fileExtension) {
 			if strings.HasPrefix(file.Name(), "0") {
-				fd, err := os.OpenFile(filepath.Join(lfs.directory, file.Name()), os.O_RDWR, lfs.fsPerm)
+				// 文件头都不完整的 region 里面不可能有数据，直接跳过
+				if truncated, err := isTruncatedRegion(file); err != nil || truncated {
+					continue
+				}
+
+				fd, err := lfs.fsys.OpenFile(filepath.Join(lfs.directory, file.Name()), os.O_RDWR, lfs.fsPerm)
 				if err != nil {
 					return fmt.Errorf("failed to open data file: %w", err)
 				}
 
-				reader, err := mmap.Open(filepath.Join(lfs.directory, file.Name()))
+				reader, err := openReaderAt(lfs.fsys, filepath.Join(lfs.directory, file.Name()))
 				if err != nil {
 					return fmt.Errorf("failed to mmap data file: %w", err)
 				}
 
-				regionId, err := parseDataFileName(file.Name())
+				regionId, err := parseDataFileName(file.Name(), lfs.fileExtension)
 				if err != nil {
 					return fmt.Errorf("failed to get region id: %w", err)
 				}
@@ -715,10 +1773,10 @@ func (lfs *LogStructuredFS) scanAndRecoverRegions() error {
 //     to reconstruct the index file.
 func (lfs *LogStructuredFS) scanAndRecoverIndexs() error {
 	// Construct the full file path
-	path := filepath.Join(lfs.directory, mainIndexFile)
-	if utils.IsExist(path) {
+	path := filepath.Join(lfs.directory, lfs.indexFileName)
+	if isExist(lfs.fsys, path) {
 		// If the index file exists, restore it
-		reader, err := mmap.Open(path)
+		reader, err := openReaderAt(lfs.fsys, path)
 		if err != nil {
 			return fmt.Errorf("failed to mmap index file: %w", err)
 		}
@@ -729,20 +1787,22 @@ func (lfs *LogStructuredFS) scanAndRecoverIndexs() error {
 			return fmt.Errorf("failed to recover index mapping: %w", err)
 		}
 
-		return nil
+		// index.db 可能是后台定时生成的快照，快照之后的写入都落在快照中最新的 region 及其之后的 region 里，
+		// 从这个 region 开始重放一遍就能补齐快照之后的数据，正常关闭的情况下重放的结果和快照是一致的。
+		return replayRegions(tailRegionIds(lfs.regions, latestRegionId(lfs.indexs)), lfs.regions, lfs.indexs, lfs.recoveryWorkers, lfs.recoveryReadahead)
 	}
 
-	// 只有数据文件大于 2 并且有检查点文件才加快启动恢复
-	ckpts, _ := filepath.Glob(filepath.Join(lfs.directory, "*.ckpt"))
-	if len(lfs.regions) >= 2 && len(ckpts) > 0 {
-		return scanAndRecoveryCheckpoint(ckpts, lfs.regions, lfs.indexs)
+	// 只有数据文件达到 checkpointMinRegions 并且有检查点文件才加快启动恢复，和生成检查点的条件保持一致
+	ckpts, _ := globFiles(lfs.fsys, lfs.directory, ckptExtension)
+	if len(lfs.regions) >= lfs.checkpointMinRegions && len(ckpts) > 0 {
+		return scanAndRecoveryCheckpoint(lfs.fsys, ckpts, lfs.regions, lfs.indexs, lfs.recoveryWorkers, lfs.recoveryReadahead)
 	}
 
 	// If the index file does not exist, recover by globally scanning the regions files
 	// If the data files are very large and numerous, recovery time increases significantly.
 	// Frequent garbage collection reduces the size of data files and speeds up startup time.
 	// However, frequent garbage collection may negatively impact overall read/write performance.
-	return crashRecoveryAllIndex(lfs.regions, lfs.indexs)
+	return crashRecoveryAllIndex(lfs.regions, lfs.indexs, lfs.recoveryWorkers, lfs.recoveryReadahead)
 }
 
 func (*LogStructuredFS) SetCompressor(compressor Compressor) {
@@ -753,158 +1813,428 @@ func (*LogStructuredFS) SetEncryptor(encryptor Encryptor, secret []byte) error {
 	return pipeline.SetEncryptor(encryptor, secret)
 }
 
+// PipelineStatus 是 value 编码管道当前的状态，用于确认压缩和加密是否生效
+type PipelineStatus struct {
+	EncryptionEnabled  bool
+	CompressionEnabled bool
+	Compressor         string // 没有开启压缩的时候为空
+}
+
+// PipelineStatus 返回进程级别的 value 编码管道的状态，所有的实例共用同一个管道
+func (*LogStructuredFS) PipelineStatus() PipelineStatus {
+	return PipelineStatus{
+		EncryptionEnabled:  pipeline.IsEncryptionEnabled(),
+		CompressionEnabled: pipeline.IsCompressionEnabled(),
+		Compressor:         pipeline.CompressorName(),
+	}
+}
+
+// ResetPipeline 关闭压缩和加密，之后写入的 value 不再编码，已经编码写入的数据需要重新开启相同的配置才能读取
+func (*LogStructuredFS) ResetPipeline() {
+	pipeline.DisableAll()
+}
+
+// CompressionRatio 返回进程启动以来所有写入的 value 编码之后和编码之前的总大小比值，越小说明压缩效果越好
+func (*LogStructuredFS) CompressionRatio() float64 {
+	return compressionRatio(compressionStats.rawBytes.Load(), compressionStats.encodedBytes.Load())
+}
+
 func (lfs *LogStructuredFS) RunCheckpoint(second uint32) {
-	func() {
-		lfs.mu.Lock()
-		defer lfs.mu.Unlock()
-		if lfs.checkpointWorker != nil {
-			return
+	if lfs.readOnly {
+		return
+	}
+
+	lfs.mu.Lock()
+	if lfs.checkpointWorker != nil {
+		lfs.mu.Unlock()
+		return
+	}
+	// 设置 checkpoint 异步生成周期
+	lfs.checkpointWorker = time.NewTicker(time.Duration(second) * time.Second)
+	lfs.checkpointDone = make(chan struct{})
+	worker, done := lfs.checkpointWorker, lfs.checkpointDone
+	lfs.mu.Unlock()
+
+	var chkptState bool = false
+
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-worker.C:
+			}
+
+			// 上一个检查点还在生成就跳过本次的
+			if chkptState {
+				continue
+			}
+
+			// 本周期内已经生成过完整的索引快照，就没必要再生成检查点了
+			if time.Since(time.UnixMicro(lfs.lastSnapshotAt.Load())) < time.Duration(second)*time.Second {
+				continue
+			}
+
+			// Toggle checkpoint state
+			chkptState = !chkptState
+
+			// 只有数据文件达到 checkpointMinRegions 个，才生成快速恢复的检查点
+			if len(lfs.regions) >= lfs.checkpointMinRegions {
+				newckpt, err := lfs.writeCheckpoint(checkpointFileName(lfs.regionId))
+				if err != nil {
+					clog.Errorf("failed to generate index checkpoint file: %v", err)
+					chkptState = !chkptState
+					continue
+				}
+
+				clog.Infof("generated checkpoint file (%s) successfully", newckpt)
+
+				// 滚动 checkpoint 文件确保只保留 1 份快照
+				err = cleanupDirtyCheckpoint(lfs.fsys, lfs.directory, newckpt)
+				if err != nil {
+					clog.Warnf("failed to cleanup old checkpoint file: %v", err)
+				}
+
+				// Toggle checkpoint state
+				chkptState = !chkptState
+
+			} else {
+				clog.Warnf("regions (%d%%) does not meet generated checkpoint status", len(lfs.regions)/10)
+			}
 		}
-		// 设置 checkpoint 异步生成周期
-		lfs.checkpointWorker = time.NewTicker(time.Duration(second) * time.Second)
 	}()
+}
 
-	var chkptState bool = false
+// writeCheckpoint 把当前的内存索引写入名为 ckpt 的临时文件，刷盘之后重命名为 .ckpt 后缀的检查点文件，返回检查点的文件名
+func (lfs *LogStructuredFS) writeCheckpoint(ckpt string) (string, error) {
+	fd, err := lfs.fsys.OpenFile(filepath.Join(lfs.directory, ckpt), os.O_CREATE|os.O_WRONLY, lfs.fsPerm)
+	if err != nil {
+		return "", err
+	}
+
+	// 先写入 metadata
+	n, err := fd.Write(dataFileMetadata)
+	if err != nil {
+		_ = utils.FlushToDisk(fd)
+		return "", fmt.Errorf("failed to write checkpoint file metadata: %w", err)
+	}
+	if n != len(dataFileMetadata) {
+		_ = utils.FlushToDisk(fd)
+		return "", errors.New("checkpoint file metadata write incomplete")
+	}
+
+	// 创建一个 buf 缓冲区方便服用内存
+	buf := bytes.NewBuffer(make([]byte, 48))
+
+	// 遍历 indexs 确保锁的粒度更小
+	for _, imap := range lfs.indexs {
+		imap.mu.RLock()
+		// 遍历复制的数据，进行序列化写入
+		for inum, inode := range imap.index {
+			bytes, err := serializedIndex(buf, inum, inode)
+			if err != nil {
+				clog.Warnf("failed to serialize index (inum: %d): %v", inum, err)
+				continue
+			}
+
+			_, err = fd.Write(bytes)
+			if err != nil {
+				clog.Errorf("failed to write serialized index (inum: %d): %v", inum, err)
+				continue
+			}
+		}
+		imap.mu.RUnlock()
+	}
+
+	// 确保文件正确刷盘关闭之后才能重命名为检查点文件
+	err = utils.FlushToDisk(fd)
+	if err != nil {
+		return "", err
+	}
+
+	// 使用 strings.TrimSuffix 去掉 .tmp 后缀，然后加上 .ckpt 后缀
+	newckpt := strings.TrimSuffix(ckpt, ".tmp") + ckptExtension
+	err = lfs.fsys.Rename(filepath.Join(lfs.directory, ckpt), filepath.Join(lfs.directory, newckpt))
+	if err != nil {
+		return "", fmt.Errorf("failed to rename checkpoint temp file: %w", err)
+	}
+
+	return newckpt, nil
+}
+
+// runIndexSnapshot 按照 interval 周期在后台导出完整的 index.db 索引快照，
+// 和 checkpoint 不同的是它不受 region 数量的限制，单个 region 的数据库也能快速恢复。
+// 导出期间持有 lfs.mu 读锁阻塞写入，保证快照之后的写入都落在快照中最新的 region 及其之后。
+// 这意味着每次导出的时候所有的写入都要等待 fsync 活跃 region 加上序列化和 fsync 完整索引的时间，
+// 耗时和 key 的数量成正比，key 很多的时候 interval 不宜设置得太短。
+// 不能在导出期间放开写入：已经导出的 shard 会漏掉之后写入到旧 region 中的数据，
+// 而这期间切换出来的新 region 又会出现在之后导出的 shard 中，恢复时从这个更新的 region 开始重放会丢失前面的写入。
+func (lfs *LogStructuredFS) runIndexSnapshot(interval time.Duration) {
+	lfs.mu.Lock()
+	if lfs.snapshotWorker != nil {
+		lfs.mu.Unlock()
+		return
+	}
+	lfs.snapshotWorker = time.NewTicker(interval)
+	lfs.snapshotDone = make(chan struct{})
+	worker, done := lfs.snapshotWorker, lfs.snapshotDone
+	lfs.mu.Unlock()
+
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-worker.C:
+				lfs.mu.RLock()
+				err := lfs.ExportSnapshotIndex()
+				lfs.mu.RUnlock()
+				if err != nil {
+					clog.Errorf("failed to generate index snapshot: %v", err)
+					continue
+				}
+				clog.Debugf("generated index snapshot file (%s) successfully", lfs.indexFileName)
+			}
+		}
+	}()
+}
+
+func (lfs *LogStructuredFS) StopIndexSnapshot() {
+	lfs.mu.Lock()
+	defer lfs.mu.Unlock()
+
+	if lfs.snapshotWorker != nil {
+		lfs.snapshotWorker.Stop()
+		close(lfs.snapshotDone)
+		lfs.snapshotWorker = nil
+	}
+}
+
+func (lfs *LogStructuredFS) StopCheckpoint() {
+	lfs.mu.Lock()
+	defer lfs.mu.Unlock()
+
+	if lfs.checkpointWorker != nil {
+		lfs.checkpointWorker.Stop()
+		close(lfs.checkpointDone)
+		lfs.checkpointWorker = nil
+	}
+}
+
+// RunCompactRegion 使用 robfig/cron 调度垃圾回收
+func (lfs *LogStructuredFS) RunCompactRegion(schedule string) error {
+	lfs.mu.Lock()
+	if lfs.compactTask != nil {
+		lfs.mu.Unlock()
+		return fmt.Errorf("region compact is already running: %v", lfs.gcstate)
+	}
+
+	// 初始化 cron 任务
+	lfs.compactTask = cron.New(cron.WithSeconds())
+	lfs.mu.Unlock()
+
+	// 添加定时任务
+	_, err := lfs.compactTask.AddFunc(schedule, func() {
+		err := lfs.compactRegions()
+		if err != nil {
+			clog.Warnf("failed to compact dirty region: %v", err)
+		}
+	})
+
+	if err != nil {
+		return err
+	}
+
+	// 启动定时清理 Region 区域的任务
+	lfs.compactTask.Start()
+	return nil
+}
+
+var (
+	ErrCompactInProgress = errors.New("region compact is already in progress")
+	ErrActiveRegion      = errors.New("active region can not be compacted")
+)
+
+// CompactNow 手动立即执行一次 region 垃圾回收，和定时任务一样会触发 CompactCallback
+func (lfs *LogStructuredFS) CompactNow() error {
+	return lfs.compactRegions()
+}
+
+// CompactRegion 只回收 regionId 对应的一个 region，把其中有效的数据迁移到活跃 region 之后删除这个 region 文件，其他的 region 不受影响。
+// 用于定向回收已知大部分都是垃圾数据的 region，不能回收活跃的 region，和其他垃圾回收任务互斥，同样会触发 CompactCallback。
+func (lfs *LogStructuredFS) CompactRegion(regionId int64) error {
+	if lfs.readOnly {
+		return ErrReadOnly
+	}
+
+	lfs.mu.Lock()
+	if lfs.gcstate == _GC_ACTIVE {
+		lfs.mu.Unlock()
+		return ErrCompactInProgress
+	}
+
+	reg, ok := lfs.regions[regionId]
+	if !ok {
+		lfs.mu.Unlock()
+		return fmt.Errorf("%w: %d", ErrRegionNotFound, regionId)
+	}
+
+	if regionId == lfs.regionId {
+		lfs.mu.Unlock()
+		return ErrActiveRegion
+	}
+
+	lfs.gcstate = _GC_ACTIVE
+	lfs.mu.Unlock()
+
+	start := time.Now()
+	stats := new(CompactStats)
+	err := lfs.migrateRegion(reg, stats)
+	if err == nil {
+		err = lfs.snapshotBeforeRemove()
+	}
+	if err == nil {
+		lfs.removeRegion(regionId, stats)
+	}
+	stats.Duration = time.Since(start)
+
+	lfs.mu.Lock()
+	lfs.gcstate = _GC_INACTIVE
+	lfs.mu.Unlock()
+
+	if lfs.compactCallback != nil {
+		lfs.compactCallback(*stats)
+	}
+
+	return err
+}
+
+// MergeRegions 手动执行一次小 region 的合并，把最旧的一段连续的、合并之后仍然小于阈值的 region 中的有效数据迁移到活跃 region 中，
+// 然后删除这些 region 文件。和其他垃圾回收任务互斥，同样会触发 CompactCallback，没有可以合并的 region 的时候什么都不做。
+func (lfs *LogStructuredFS) MergeRegions() error {
+	if lfs.readOnly {
+		return ErrReadOnly
+	}
+
+	lfs.mu.Lock()
+	if lfs.gcstate == _GC_ACTIVE {
+		lfs.mu.Unlock()
+		return ErrCompactInProgress
+	}
+	lfs.gcstate = _GC_ACTIVE
+	lfs.mu.Unlock()
+
+	start := time.Now()
+	stats := new(CompactStats)
+	err := lfs.mergeRegions(stats)
+	stats.Duration = time.Since(start)
+
+	lfs.mu.Lock()
+	lfs.gcstate = _GC_INACTIVE
+	lfs.mu.Unlock()
+
+	if lfs.compactCallback != nil {
+		lfs.compactCallback(*stats)
+	}
+
+	return err
+}
+
+// compactRegions 执行一次垃圾回收并且把统计信息回调给使用者，同一时刻只允许一个回收任务执行
+func (lfs *LogStructuredFS) compactRegions() error {
+	if lfs.readOnly {
+		return ErrReadOnly
+	}
+
+	lfs.mu.Lock()
+	if lfs.gcstate == _GC_ACTIVE {
+		lfs.mu.Unlock()
+		return ErrCompactInProgress
+	}
+	lfs.gcstate = _GC_ACTIVE
+	lfs.mu.Unlock()
 
-	go func() {
-		for range lfs.checkpointWorker.C {
-			// 上一个检查点还在生成就跳过本次的
-			if chkptState {
-				continue
-			}
+	start := time.Now()
+	stats, err := lfs.cleanupDirtyRegions()
+	stats.Duration = time.Since(start)
 
-			// Toggle checkpoint state
-			chkptState = !chkptState
+	lfs.mu.Lock()
+	lfs.gcstate = _GC_INACTIVE
+	lfs.mu.Unlock()
 
-			// 只有数据文件大于 2 个，才生成快速恢复的检查点
-			if len(lfs.regions) >= 2 {
-				ckpt := checkpointFileName(lfs.regionId)
-				fd, err := os.OpenFile(filepath.Join(lfs.directory, ckpt), os.O_CREATE|os.O_WRONLY, lfs.fsPerm)
-				if err != nil {
-					clog.Errorf("failed to generate index checkpoint file: %v", err)
-					chkptState = !chkptState
-					continue
-				}
+	if lfs.compactCallback != nil {
+		lfs.compactCallback(*stats)
+	}
 
-				// 先写入 metadata
-				n, err := fd.Write(dataFileMetadata)
-				if err != nil {
-					clog.Errorf("failed to write checkpoint file metadata: %v", err)
-					chkptState = !chkptState
-					_ = utils.FlushToDisk(fd)
-					continue
-				}
-				if n != len(dataFileMetadata) {
-					clog.Warnf("checkpoint file metadata write incomplete")
-					chkptState = !chkptState
-					_ = utils.FlushToDisk(fd)
-					continue
-				}
+	return err
+}
 
-				// 创建一个 buf 缓冲区方便服用内存
-				buf := bytes.NewBuffer(make([]byte, 48))
+// runDiskPressureMonitor 按照 interval 周期检查磁盘的可用空间，低于 threshold 的时候触发一次垃圾回收，
+// 这样垃圾回收的时机取决于实际的磁盘压力，而不只是固定的 cron 调度。
+func (lfs *LogStructuredFS) runDiskPressureMonitor(threshold uint64, interval time.Duration, free func(path string) (uint64, error)) {
+	if interval <= 0 {
+		interval = 30 * time.Second
+	}
 
-				// 遍历 indexs 确保锁的粒度更小
-				for _, imap := range lfs.indexs {
-					imap.mu.RLock()
-					// 遍历复制的数据，进行序列化写入
-					for inum, inode := range imap.index {
-						bytes, err := serializedIndex(buf, inum, inode)
-						if err != nil {
-							clog.Warnf("failed to serialize index (inum: %d): %v", inum, err)
-							continue
-						}
+	if free == nil {
+		free = func(path string) (uint64, error) {
+			usage, err := disk.Usage(path)
+			if err != nil {
+				return 0, err
+			}
+			return usage.Free, nil
+		}
+	}
 
-						_, err = fd.Write(bytes)
-						if err != nil {
-							clog.Errorf("failed to write serialized index (inum: %d): %v", inum, err)
-							continue
-						}
-					}
-					imap.mu.RUnlock()
-				}
+	lfs.mu.Lock()
+	if lfs.diskPressureWorker != nil {
+		lfs.mu.Unlock()
+		return
+	}
+	lfs.diskPressureWorker = time.NewTicker(interval)
+	lfs.diskPressureDone = make(chan struct{})
+	worker, done := lfs.diskPressureWorker, lfs.diskPressureDone
+	lfs.mu.Unlock()
 
-				// 确保文件在当前循环结束时正确刷盘关闭
-				err = utils.FlushToDisk(fd)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-worker.C:
+				available, err := free(lfs.directory)
 				if err != nil {
-					clog.Errorf("failed to generated checkpoint file: %v", err)
-					chkptState = !chkptState
+					clog.Warnf("failed to get free disk space: %v", err)
 					continue
 				}
 
-				// 使用 strings.TrimSuffix 去掉 .tmp 后缀，然后加上 .ckpt 后缀
-				newckpt := strings.TrimSuffix(ckpt, ".tmp") + ckptExtension
-				err = os.Rename(filepath.Join(lfs.directory, ckpt), filepath.Join(lfs.directory, newckpt))
-				if err != nil {
-					clog.Errorf("failed to rename checkpoint temp file: %v", err)
-					chkptState = !chkptState
-					_ = utils.FlushToDisk(fd)
+				lfs.mu.RLock()
+				running := lfs.gcstate == _GC_ACTIVE
+				lfs.mu.RUnlock()
+
+				if available >= threshold || running {
 					continue
 				}
 
-				clog.Infof("generated checkpoint file (%s) successfully", newckpt)
-
-				// 滚动 checkpoint 文件确保只保留 1 份快照
-				err = cleanupDirtyCheckpoint(lfs.directory, newckpt)
+				clog.Warnf("free disk space %d bytes is below %d bytes, compacting regions", available, threshold)
+				err = lfs.compactRegions()
 				if err != nil {
-					clog.Warnf("failed to cleanup old checkpoint file: %v", err)
+					clog.Warnf("failed to compact dirty region: %v", err)
 				}
-
-				// Toggle checkpoint state
-				chkptState = !chkptState
-
-			} else {
-				clog.Warnf("regions (%d%%) does not meet generated checkpoint status", len(lfs.regions)/10)
 			}
 		}
 	}()
 }
 
-func (lfs *LogStructuredFS) StopCheckpoint() {
+func (lfs *LogStructuredFS) StopDiskPressureMonitor() {
 	lfs.mu.Lock()
 	defer lfs.mu.Unlock()
 
-	if lfs.checkpointWorker != nil {
-		lfs.checkpointWorker.Stop()
-		lfs.checkpointWorker = nil
-	}
-}
-
-// RunCompactRegion 使用 robfig/cron 调度垃圾回收
-func (lfs *LogStructuredFS) RunCompactRegion(schedule string) error {
-	lfs.mu.Lock()
-	if lfs.compactTask != nil {
-		lfs.mu.Unlock()
-		return fmt.Errorf("region compact is already running: %v", lfs.gcstate)
-	}
-
-	// 初始化 cron 任务
-	lfs.compactTask = cron.New(cron.WithSeconds())
-	lfs.mu.Unlock()
-
-	// 添加定时任务
-	_, err := lfs.compactTask.AddFunc(schedule, func() {
-		lfs.mu.Lock()
-		lfs.gcstate = _GC_ACTIVE
-		lfs.mu.Unlock()
-
-		err := lfs.cleanupDirtyRegions()
-		if err != nil {
-			clog.Warnf("failed to compact dirty region: %v", err)
-		}
-
-		lfs.mu.Lock()
-		lfs.gcstate = _GC_INACTIVE
-		lfs.mu.Unlock()
-	})
-
-	if err != nil {
-		return err
+	if lfs.diskPressureWorker != nil {
+		lfs.diskPressureWorker.Stop()
+		close(lfs.diskPressureDone)
+		lfs.diskPressureWorker = nil
 	}
-
-	// 启动定时清理 Region 区域的任务
-	lfs.compactTask.Start()
-	return nil
 }
 
 // StopCompactRegion 关闭垃圾回收
@@ -925,12 +2255,46 @@ func (lfs *LogStructuredFS) GCState() uint8 {
 	return uint8(lfs.gcstate)
 }
 
+// IsReady 存储引擎完成了 region 和索引的恢复并且还没有被关闭，同时垃圾回收的状态是已知的状态
+func (lfs *LogStructuredFS) IsReady() bool {
+	if !lfs.ready.Load() {
+		return false
+	}
+
+	switch lfs.GCState() {
+	case _GC_INIT, _GC_ACTIVE, _GC_INACTIVE:
+		return true
+	default:
+		return false
+	}
+}
+
 func OpenFS(opt *Options) (*LogStructuredFS, error) {
 	if opt.Threshold <= 0 {
 		return nil, fmt.Errorf("single region threshold size limit is too small")
 	}
 
-	err := checkFileSystem(opt.Path, opt.FSPerm)
+	err := types.SetValueCodec(opt.ValueCodec)
+	if err != nil {
+		return nil, err
+	}
+
+	valueChecksum.Store(opt.ValueChecksum)
+	segmentPoolDisabled.Store(opt.DisableSegmentPool)
+	// 启动恢复的时候始终校验 CRC32，避免把写了一半的 segment 恢复到索引中，恢复完成之后才按照配置跳过
+	skipCRCOnRead.Store(false)
+
+	ext, index, err := opt.fileNames()
+	if err != nil {
+		return nil, err
+	}
+
+	fsys := opt.FS
+	if fsys == nil {
+		fsys = OSFilesystem{}
+	}
+
+	err = checkFileSystem(fsys, opt.Path, opt.FSPerm, ext, index)
 	if err != nil {
 		return nil, err
 	}
@@ -943,16 +2307,40 @@ func OpenFS(opt *Options) (*LogStructuredFS, error) {
 		directory: opt.Path,
 		gcstate:   _GC_INIT,
 		fsPerm:    opt.FSPerm,
+		fsys:      fsys,
 		// Single region max size = 255GB
-		regionThreshold:  int64(opt.Threshold) * gb,
-		compactTask:      nil,
-		checkpointWorker: nil,
-		expireLoopWorker: time.NewTicker(time.Duration(120) * time.Second),
+		regionThreshold:      int64(opt.Threshold) * gb,
+		compactTask:          nil,
+		compactCallback:      opt.CompactCallback,
+		tombstoneGracePeriod: opt.TombstoneGracePeriod,
+		recoveryWorkers:      opt.RecoveryWorkers,
+		maxValueAge:          opt.MaxValueAge.Microseconds(),
+		maxValueAgeLocks:     opt.MaxValueAgeLocks,
+		trackAccessStats:     opt.TrackAccessStats,
+		reclaimExpired:       opt.ReclaimExpiredRegions,
+		slowOpThreshold:      opt.SlowOpThreshold,
+		checkpointMinRegions: opt.CheckpointMinRegions,
+		compactIndexRatio:    opt.CompactIndexRatio,
+		autoRecreateDir:      opt.AutoRecreateDir,
+		storeKeysInIndex:     opt.StoreKeysInIndex,
+		readTimeout:          opt.ReadTimeout,
+		fileExtension:        ext,
+		indexFileName:        index,
+		mergeSmallRegions:    opt.MergeSmallRegions,
+		recoveryReadahead:    opt.RecoveryReadahead,
+		checkpointWorker:     nil,
+		expireLoopWorker:     time.NewTicker(time.Duration(120) * time.Second),
+		expireLoopDone:       make(chan struct{}),
+	}
+
+	if storage.checkpointMinRegions <= 0 {
+		storage.checkpointMinRegions = defaultCheckpointMinRegions
 	}
 
 	for i := 0; i < shard; i++ {
 		storage.indexs[i] = &indexMap{
-			index: make(map[uint64]*inode, 1e6),
+			index:    make(map[uint64]*inode, _INDEX_MAP_CAPACITY),
+			capacity: _INDEX_MAP_CAPACITY,
 		}
 	}
 
@@ -962,6 +2350,13 @@ func OpenFS(opt *Options) (*LogStructuredFS, error) {
 		return nil, fmt.Errorf("failed to recover data regions: %w", err)
 	}
 
+	if opt.VerifyOnOpen {
+		err = storage.verifyRegions()
+		if err != nil {
+			return nil, fmt.Errorf("failed to verify data regions: %w", err)
+		}
+	}
+
 	err = storage.scanAndRecoverIndexs()
 	if err != nil {
 		return nil, fmt.Errorf("failed to recover regions index: %w", err)
@@ -978,8 +2373,37 @@ func OpenFS(opt *Options) (*LogStructuredFS, error) {
 		storage.regions[storage.regionId].ReaderAt = nil
 	}
 
+	err = storage.syncIndexKeys()
+	if err != nil {
+		return nil, fmt.Errorf("failed to sync index keys: %w", err)
+	}
+
+	if opt.OrderedKeys {
+		storage.ordered = new(orderedKeys)
+		err = storage.rebuildOrderedKeys()
+		if err != nil {
+			return nil, fmt.Errorf("failed to rebuild ordered keys: %w", err)
+		}
+	}
+
+	// 恢复期间写入的 region 不知道覆盖过哪些 region，从这里开始创建的 region 才记录
+	storage.supersedes = make(map[int64]int64)
+
 	// 120 秒执行一次过期 keys 的检查，防止已经过期 key 一直存储在内存中
-	go storage.cleanupExpired()
+	go storage.cleanupExpired(storage.expireLoopWorker, storage.expireLoopDone)
+
+	if opt.IndexSnapshotInterval > 0 {
+		storage.runIndexSnapshot(opt.IndexSnapshotInterval)
+	}
+
+	skipCRCOnRead.Store(opt.SkipCRCOnRead)
+
+	if opt.CompactWhenFreeDiskBelowBytes > 0 {
+		storage.runDiskPressureMonitor(opt.CompactWhenFreeDiskBelowBytes, opt.DiskPressureInterval, opt.DiskFree)
+	}
+
+	// 所有的恢复工作都已经完成，可以开始对外提供服务
+	storage.ready.Store(true)
 
 	// Singleton pattern, but other packages can still create an instance with new(LogStructuredFS), which makes this ineffective
 	return storage, nil
@@ -990,6 +2414,8 @@ func OpenFS(opt *Options) (*LogStructuredFS, error) {
 func (lfs *LogStructuredFS) CloseFS() error {
 	lfs.mu.Lock()
 	defer lfs.mu.Unlock()
+
+	lfs.ready.Store(false)
 	for _, reg := range lfs.regions {
 		if reg.ReaderAt != nil {
 			err := reg.ReaderAt.Close()
@@ -1008,6 +2434,10 @@ func (lfs *LogStructuredFS) CloseFS() error {
 		}
 	}
 
+	if lfs.readOnly {
+		return nil
+	}
+
 	// If there is a snapshot of the index file, recover from the snapshot.
 	// otherwise, perform a global scan.
 	return lfs.ExportSnapshotIndex()
@@ -1026,21 +2456,96 @@ func (lfs *LogStructuredFS) GetDirectory() string {
 // as it consumes a significant amount of virtual memory space and may lead to
 // swapping memory pages to disk.
 func (lfs *LogStructuredFS) ExportSnapshotIndex() error {
+	_, err := lfs.exportSnapshotIndex()
+	return err
+}
+
+// SnapshotInfo 是一次导出的 index.db 索引快照的信息
+type SnapshotInfo struct {
+	Entries int   `json:"entries"`
+	Size    int64 `json:"size"`
+}
+
+// SnapshotIndex 在运行期间立即导出一次 index.db 索引快照，导出期间持有 lfs.mu 读锁阻塞写入但是不阻塞读取，
+// 和关闭时以及后台定时导出的快照串行执行，返回快照中的索引数量和文件大小。
+func (lfs *LogStructuredFS) SnapshotIndex() (SnapshotInfo, error) {
+	lfs.mu.RLock()
+	defer lfs.mu.RUnlock()
+	return lfs.exportSnapshotIndex()
+}
+
+func (lfs *LogStructuredFS) exportSnapshotIndex() (SnapshotInfo, error) {
+	var info SnapshotInfo
+
+	// 只读实例的索引是历史状态，不能覆盖当前的 index.db
+	if lfs.readOnly {
+		return info, ErrReadOnly
+	}
+
+	// 关闭时导出和后台定时导出共用一个临时文件，需要串行执行
+	lfs.snapmux.Lock()
+	defer lfs.snapmux.Unlock()
+
+	// 快照中的 inode 指向的数据必须先于 index.db 落盘，否则系统崩溃之后 inode 可能指向 region 文件末尾之后的位置，
+	// 恢复时又只从快照中最新的 region 开始重放，之前的 region 中丢失的数据再也找不回来了。
+	// CloseFS 在导出之前已经关闭并且刷盘了所有的 region，这个时候 active 不能再使用。
+	if lfs.ready.Load() {
+		err := lfs.active.Sync()
+		if err != nil {
+			return info, fmt.Errorf("failed to sync active region before index snapshot: %w", err)
+		}
+	}
+
 	tmpIndexPath := filepath.Join(lfs.directory, tempIndexFile)
-	fd, err := os.OpenFile(tmpIndexPath, os.O_CREATE|os.O_RDWR|os.O_TRUNC, lfs.fsPerm)
+	fd, err := lfs.fsys.OpenFile(tmpIndexPath, os.O_CREATE|os.O_RDWR|os.O_TRUNC, lfs.fsPerm)
+	if err != nil {
+		return info, fmt.Errorf("failed to generate index snapshot file: %w", err)
+	}
+
+	info, err = writeSnapshotIndex(fd, lfs.indexs)
+	if err != nil {
+		_ = fd.Close()
+		_ = lfs.fsys.Remove(tmpIndexPath)
+		return info, err
+	}
+
+	// 重命名之前临时文件的内容必须已经落盘，否则系统崩溃之后可能看到一个不完整的 index.db
+	err = utils.FlushToDisk(fd)
+	if err != nil {
+		_ = lfs.fsys.Remove(tmpIndexPath)
+		return info, fmt.Errorf("failed to flush index snapshot file: %w", err)
+	}
+
+	// 防止 index.db 写入不完整，导致二次启动使用脏数据构建的索引
+	err = lfs.fsys.Rename(tmpIndexPath, filepath.Join(lfs.directory, lfs.indexFileName))
+	if err != nil {
+		_ = lfs.fsys.Remove(tmpIndexPath)
+		return info, fmt.Errorf("failed to rename index snapshot file: %w", err)
+	}
+
+	err = syncDir(lfs.fsys, lfs.directory)
 	if err != nil {
-		return fmt.Errorf("failed to generate index snapshot file: %w", err)
+		return info, fmt.Errorf("failed to sync data directory after index snapshot: %w", err)
 	}
-	defer utils.FlushToDisk(fd)
+
+	lfs.lastSnapshotAt.Store(time.Now().UnixMicro())
+
+	return info, nil
+}
+
+// writeSnapshotIndex 把所有 shard 中的索引序列化写入 fd，返回写入的索引数量和字节数
+func writeSnapshotIndex(fd File, indexs []*indexMap) (SnapshotInfo, error) {
+	var info SnapshotInfo
 
 	n, err := fd.Write(dataFileMetadata)
 	if err != nil {
-		return fmt.Errorf("failed to write index file metadata: %w", err)
+		return info, fmt.Errorf("failed to write index file metadata: %w", err)
 	}
 
 	if n != len(dataFileMetadata) {
-		return errors.New("index file metadata write incomplete")
+		return info, errors.New("index file metadata write incomplete")
 	}
+	info.Size = int64(n)
 
 	// 创建一个 buf 缓冲区方便服用内存
 	buf := new(bytes.Buffer)
@@ -1049,7 +2554,7 @@ func (lfs *LogStructuredFS) ExportSnapshotIndex() error {
 	// 索引序列化不需要考虑有序的
 	// 但是存在并发写一个文件的竞争的问题，最后还是放弃并发方案
 	// 可以考虑多开几个文件并行导出，解决了单一文件写入的问题
-	for _, imap := range lfs.indexs {
+	for _, imap := range indexs {
 		if err := func() error {
 			imap.mu.RLock()
 			defer imap.mu.RUnlock()
@@ -1058,28 +2563,23 @@ func (lfs *LogStructuredFS) ExportSnapshotIndex() error {
 				if err != nil {
 					return fmt.Errorf("failed to serialized index (inum: %d): %w", inum, err)
 				}
-				_, err = fd.Write(bytes)
+				n, err := fd.Write(bytes)
 				if err != nil {
 					return fmt.Errorf("failed to write serialized index (inum: %d): %w", inum, err)
 				}
+				info.Entries++
+				info.Size += int64(n)
 			}
 			return nil
 		}(); err != nil {
-			return fmt.Errorf("failed to export snapshot index file: %w", err)
+			return info, fmt.Errorf("failed to export snapshot index file: %w", err)
 		}
 	}
 
-	// 防止 index.db 写入不完整，导致二次启动使用脏数据构建的索引
-	err = os.Rename(tmpIndexPath, filepath.Join(lfs.directory, mainIndexFile))
-	if err != nil {
-		_ = os.Remove(tmpIndexPath)
-		return fmt.Errorf("failed to rename index snapshot file: %w", err)
-	}
-
-	return nil
+	return info, nil
 }
 
-func recoveryIndex(reader *mmap.ReaderAt, indexs []*indexMap) error {
+func recoveryIndex(reader ReaderAt, indexs []*indexMap) error {
 	offset := int64(len(dataFileMetadata))
 
 	type index struct {
@@ -1109,7 +2609,7 @@ func recoveryIndex(reader *mmap.ReaderAt, indexs []*indexMap) error {
 			default:
 			}
 
-			_, err := reader.ReadAt(buf, offset)
+			record, err := readIndexRecord(reader, offset, buf)
 			if err != nil {
 				select {
 				case equeue <- fmt.Errorf("failed to read index node: %w", err):
@@ -1119,9 +2619,10 @@ func recoveryIndex(reader *mmap.ReaderAt, indexs []*indexMap) error {
 				return
 			}
 
-			offset += _INDEX_SEGMENT_SIZE
+			buf = record
+			offset += int64(len(record))
 
-			inum, inode, err := deserializedIndex(buf)
+			inum, inode, err := deserializedIndex(record)
 			if err != nil {
 				select {
 				case equeue <- fmt.Errorf("failed to deserialize index (inum: %d): %w", inum, err):
@@ -1166,7 +2667,7 @@ func recoveryIndex(reader *mmap.ReaderAt, indexs []*indexMap) error {
 					return
 				}
 
-				imap.index[node.inum] = node.inode
+				imap.put(node.inum, node.inode)
 			}
 		}
 	}()
@@ -1189,68 +2690,185 @@ func recoveryIndex(reader *mmap.ReaderAt, indexs []*indexMap) error {
 // 4. If DEL is 1, the corresponding entry is deleted from the in-memory index.
 // 5. Otherwise, the disk metadata is reconstructed into the index.
 // | DEL 1 | KIND 1 | EAT 8 | CAT 8 | KLEN 4 | VLEN 4 | KEY ? | VALUE ? | CRC32 4 |
-func crashRecoveryAllIndex(regions map[int64]*Region, indexs []*indexMap) error {
+func crashRecoveryAllIndex(regions map[int64]*Region, indexs []*indexMap, workers int, readahead bool) error {
+	return replayRegions(tailRegionIds(regions, 0), regions, indexs, workers, readahead)
+}
+
+// tailRegionIds 返回 ID 大于等于 from 的所有 region ID，并且按照升序排列
+func tailRegionIds(regions map[int64]*Region, from int64) []int64 {
 	var regionIds []int64
 	for id := range regions {
-		regionIds = append(regionIds, id)
+		if id >= from {
+			regionIds = append(regionIds, id)
+		}
 	}
 
 	sort.Slice(regionIds, func(i, j int) bool {
 		return regionIds[i] < regionIds[j]
 	})
 
-	for _, regionId := range regionIds {
-		reg, ok := regions[regionId]
-		if !ok {
-			return fmt.Errorf("data file does not exist regions id: %d", regionId)
+	return regionIds
+}
+
+// latestRegionId 返回索引中引用到的最大 region ID
+func latestRegionId(indexs []*indexMap) int64 {
+	var latest int64
+	for _, imap := range indexs {
+		for _, inode := range imap.index {
+			if inode.RegionId > latest {
+				latest = inode.RegionId
+			}
 		}
+	}
+	return latest
+}
 
-		stat, err := reg.Fd.Stat()
-		if err != nil {
-			return err
+// replayRegions 按照 regionIds 的顺序重放 region 中的 segment 记录到内存索引中，
+// 重放的顺序必须是 region 创建的先后顺序，这样后写入的记录和 tombstone 才能覆盖之前的记录。
+// workers 大于 1 时并行读取和解析多个 region，但是仍然按照 region ID 的升序合并到索引中，readahead 为 true 时顺序预读 region。
+func replayRegions(regionIds []int64, regions map[int64]*Region, indexs []*indexMap, workers int, readahead bool) error {
+	if workers <= 1 || len(regionIds) <= 1 {
+		for _, regionId := range regionIds {
+			err := scanRegion(regionId, regions, readahead, func(entry replayEntry) error {
+				return applyReplayEntry(entry, indexs)
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	type result struct {
+		entries []replayEntry
+		err     error
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	results := make([]chan result, len(regionIds))
+	for i := range results {
+		results[i] = make(chan result, 1)
+	}
+
+	// 合并完一个 region 才释放一个名额，已经解析但还没有合并的 region 最多只有 workers 个，避免占用过多的内存
+	sem := make(chan struct{}, workers)
+
+	go func() {
+		for i, regionId := range regionIds {
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+
+			go func(i int, regionId int64) {
+				var entries []replayEntry
+				err := scanRegion(regionId, regions, readahead, func(entry replayEntry) error {
+					entries = append(entries, entry)
+					return nil
+				})
+				results[i] <- result{entries: entries, err: err}
+			}(i, regionId)
 		}
+	}()
 
-		offset := int64(len(dataFileMetadata))
+	for i := range regionIds {
+		res := <-results[i]
+		if res.err != nil {
+			return res.err
+		}
 
-		for offset < stat.Size() {
-			inum, segment, err := readSegment(reg.Fd, offset, _SEGMENT_PADDING)
+		for _, entry := range res.entries {
+			err := applyReplayEntry(entry, indexs)
 			if err != nil {
-				return fmt.Errorf("failed to parse data file segment: %w", err)
+				return err
 			}
+		}
 
-			imap := indexs[inum%uint64(shard)]
-			if imap != nil {
-				if segment.IsTombstone() {
-					delete(imap.index, inum)
-					offset += int64(segment.Size())
-					continue
-				}
+		<-sem
+	}
 
-				if segment.ExpiredAt > 0 && segment.ExpiredAt <= time.Now().UnixMicro() {
-					offset += int64(segment.Size())
-					continue
-				}
+	return nil
+}
 
-				imap.index[inum] = &inode{
-					RegionId:  regionId,
-					Position:  offset,
-					Length:    segment.Size(),
-					CreatedAt: segment.CreatedAt,
-					ExpiredAt: segment.ExpiredAt,
-					mvcc:      0,
-				}
+// replayEntry 是从 region 中解析出来的一条需要重放的记录，tombstone 记录的 inode 为 nil
+type replayEntry struct {
+	inum      uint64
+	tombstone bool
+	inode     *inode
+}
 
-				offset += int64(segment.Size())
-			} else {
-				return errors.New("no corresponding index shard")
+// scanRegion 按照写入顺序读取 region 中的所有 segment，已经过期的记录和 tombstone 一样删除之前的版本，
+// readahead 为 true 时通过 readaheadReaderAt 顺序读取，segment 的解析和校验和直接读取完全一样。
+func scanRegion(regionId int64, regions map[int64]*Region, readahead bool, fn func(entry replayEntry) error) error {
+	reg, ok := regions[regionId]
+	if !ok {
+		return fmt.Errorf("data file does not exist regions id: %d", regionId)
+	}
+
+	stat, err := reg.Fd.Stat()
+	if err != nil {
+		return err
+	}
+
+	var reader io.ReaderAt = reg.Fd
+	if readahead {
+		reader = newReadaheadReaderAt(reg.Fd, _RECOVERY_READAHEAD)
+	}
+
+	offset := int64(len(dataFileMetadata))
+
+	for offset < stat.Size() {
+		inum, segment, err := readSegment(reader, offset, _SEGMENT_PADDING)
+		if err != nil {
+			return fmt.Errorf("failed to parse data file segment: %w", err)
+		}
+
+		// 已经过期的 segment 和 tombstone 一样删除之前的版本，直接跳过的话被它覆盖的更早的版本会重新出现
+		expired := segment.ExpiredAt > 0 && segment.ExpiredAt <= time.Now().UnixMicro()
+		entry := replayEntry{inum: inum, tombstone: segment.IsTombstone() || expired}
+		if !entry.tombstone {
+			entry.inode = &inode{
+				RegionId:  regionId,
+				Position:  offset,
+				Length:    segment.Size(),
+				CreatedAt: segment.CreatedAt,
+				ExpiredAt: segment.ExpiredAt,
+				mvcc:      0,
+				immutable: segment.Immutable,
 			}
 		}
+
+		offset += int64(segment.Size())
+
+		err = fn(entry)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func applyReplayEntry(entry replayEntry, indexs []*indexMap) error {
+	imap := indexs[entry.inum%uint64(shard)]
+	if imap == nil {
+		return errors.New("no corresponding index shard")
+	}
+
+	if entry.tombstone {
+		imap.remove(entry.inum)
+		return nil
 	}
 
+	imap.put(entry.inum, entry.inode)
+
 	return nil
 }
 
-func validateFileHeader(fd *os.File) error {
+func validateFileHeader(fd File) error {
 	var fileHeader [4]byte
 	n, err := fd.Read(fileHeader[:])
 	if err != nil {
@@ -1261,32 +2879,63 @@ func validateFileHeader(fd *os.File) error {
 		return errors.New("file is too short to contain valid signature")
 	}
 
-	if !bytes.Equal(fileHeader[:], dataFileMetadata) {
-		return fmt.Errorf("unsupported data file version: %v", fd.Name())
+	if bytes.Equal(fileHeader[:], dataFileMetadata) {
+		return nil
+	}
+
+	for _, legacy := range legacyFileMetadata {
+		if bytes.Equal(fileHeader[:], legacy) {
+			return nil
+		}
 	}
 
-	return nil
+	return fmt.Errorf("unsupported data file version: %v", fd.Name())
+}
+
+// isTruncatedRegion 判断 region 文件的长度是否连文件头都放不下
+func isTruncatedRegion(file fs.DirEntry) (bool, error) {
+	info, err := file.Info()
+	if err != nil {
+		return false, err
+	}
+	return info.Size() < int64(len(dataFileMetadata)), nil
 }
 
-func checkFileSystem(path string, fsPerm fs.FileMode) error {
-	if !utils.IsExist(path) {
-		err := os.MkdirAll(path, fsPerm)
+func checkFileSystem(fsys Filesystem, path string, fsPerm fs.FileMode, ext, index string) error {
+	if !isExist(fsys, path) {
+		err := fsys.MkdirAll(path, fsPerm)
 		if err != nil {
 			return err
 		}
 		return nil
 	}
 
-	files, err := os.ReadDir(path)
+	files, err := fsys.ReadDir(path)
 	if err != nil {
 		return fmt.Errorf("failed to read directory: %w", err)
 	}
 
 	if len(files) > 0 {
 		for _, file := range files {
-			if !file.IsDir() && strings.HasSuffix(file.Name(), fileExtension) {
+			if !file.IsDir() && strings.HasSuffix(file.Name(), ext) {
 				if strings.HasPrefix(file.Name(), "0") {
-					fd, err := os.Open(filepath.Join(path, file.Name()))
+					// 创建 region 的过程中崩溃会留下空文件或者文件头不完整的文件，这样的文件里面不可能有数据，
+					// 直接删除掉而不是让整个数据库因为文件头校验失败而无法启动。
+					truncated, err := isTruncatedRegion(file)
+					if err != nil {
+						return fmt.Errorf("failed to check data file: %w", err)
+					}
+
+					if truncated {
+						clog.Warnf("removing truncated region file: %s", file.Name())
+						err := fsys.Remove(filepath.Join(path, file.Name()))
+						if err != nil {
+							return fmt.Errorf("failed to remove truncated data file: %w", err)
+						}
+						continue
+					}
+
+					fd, err := fsys.Open(filepath.Join(path, file.Name()))
 					if err != nil {
 						return fmt.Errorf("failed to check data file: %w", err)
 					}
@@ -1299,8 +2948,8 @@ func checkFileSystem(path string, fsPerm fs.FileMode) error {
 				}
 			}
 
-			if !file.IsDir() && file.Name() == mainIndexFile {
-				fd, err := os.Open(filepath.Join(path, file.Name()))
+			if !file.IsDir() && file.Name() == index {
+				fd, err := fsys.Open(filepath.Join(path, file.Name()))
 				if err != nil {
 					return fmt.Errorf("failed to check index file: %w", err)
 				}
@@ -1314,14 +2963,14 @@ func checkFileSystem(path string, fsPerm fs.FileMode) error {
 
 			// 递归检查子目录中的事物数据文件，确保它们的格式正确
 			if file.IsDir() && file.Name() == txnDirName {
-				txns, err := os.ReadDir(filepath.Join(path, txnDirName))
+				txns, err := fsys.ReadDir(filepath.Join(path, txnDirName))
 				if err != nil {
 					return fmt.Errorf("failed to read txn directory: %w", err)
 				}
 
 				for _, txn := range txns {
 					if !txn.IsDir() && strings.HasSuffix(txn.Name(), txnExtension) {
-						fd, err := os.Open(filepath.Join(path, txnDirName, txn.Name()))
+						fd, err := fsys.Open(filepath.Join(path, txnDirName, txn.Name()))
 						if err != nil {
 							return fmt.Errorf("failed to check transaction file: %w", err)
 						}
@@ -1341,6 +2990,8 @@ func checkFileSystem(path string, fsPerm fs.FileMode) error {
 }
 
 // | DEL 1 | KIND 1 | EAT 8 | CAT 8 | KLEN 4 | VLEN 4 | KEY ? | VALUE ? | CRC32 4 |
+// DEL 字节中带有 _VALUE_CHECKSUM 标记时 CRC32 不包含 key，_IMMUTABLE 标记解析到 Segment.Immutable 中，
+// _CODEC_MASK 中的序列化格式解析到 Segment.Codec 中，带有 _WRITER 标记时从 VALUE 的末尾拆分出 Segment.Writer
 func readSegment(reader io.ReaderAt, offset, bufsize int64) (uint64, *Segment, error) {
 	buf := make([]byte, bufsize)
 
@@ -1352,8 +3003,11 @@ func readSegment(reader io.ReaderAt, offset, bufsize int64) (uint64, *Segment, e
 	var seg Segment
 	readOffset := 0
 
-	// Parse Tombstone (1 byte)
-	seg.Tombstone = int8(buf[readOffset])
+	// Parse Tombstone and checksum flags (1 byte)
+	flags := int8(buf[readOffset])
+	seg.Tombstone = flags &^ (_VALUE_CHECKSUM | _IMMUTABLE | _CODEC_MASK | _WRITER)
+	seg.Immutable = flags&_IMMUTABLE != 0
+	seg.Codec = types.ValueCodec(flags & _CODEC_MASK >> _CODEC_SHIFT)
 	readOffset++
 
 	// Parse Type (1 byte)
@@ -1402,13 +3056,20 @@ func readSegment(reader io.ReaderAt, offset, bufsize int64) (uint64, *Segment, e
 	}
 
 	// Verify checksum
-	checksum := binary.LittleEndian.Uint32(checksumBuf)
-
-	buf = append(buf, keybuf...)
-	buf = append(buf, valuebuf...)
+	if !skipCRCOnRead.Load() {
+		checksum := binary.LittleEndian.Uint32(checksumBuf)
+		if checksum != segmentChecksum(buf, keybuf, valuebuf) {
+			return 0, nil, fmt.Errorf("failed to crc32 checksum mismatch: %d", checksum)
+		}
+	}
 
-	if checksum != crc32.ChecksumIEEE(buf) {
-		return 0, nil, fmt.Errorf("failed to crc32 checksum mismatch: %d", checksum)
+	// 写入者标识不经过 pipeline 编码，ValueSize 只保留 value 本身的大小
+	if flags&_WRITER != 0 {
+		valuebuf, seg.Writer, err = splitWriter(valuebuf)
+		if err != nil {
+			return 0, nil, fmt.Errorf("failed to parse writer in segment: %w", err)
+		}
+		seg.ValueSize = int32(len(valuebuf))
 	}
 
 	// Update Segment data fields with the read valuebuf and process it through Transformer before use
@@ -1419,12 +3080,38 @@ func readSegment(reader io.ReaderAt, offset, bufsize int64) (uint64, *Segment, e
 
 	seg.Key = keybuf
 	seg.Value = decodedData
+	seg.decoded = true
 
 	return keyHash(string(keybuf)), &seg, nil
 }
 
-func toStringFileName(regionId int64) (string, error) {
-	name := formatDataFileName(regionId)
+// segmentChecksum 根据头部中的标志位计算 segment 期望的 CRC32 校验码
+func segmentChecksum(header, key, value []byte) uint32 {
+	if int8(header[0])&_VALUE_CHECKSUM != 0 {
+		return checksumWithoutKey(header, value)
+	}
+
+	checksum := crc32.ChecksumIEEE(header)
+	checksum = crc32.Update(checksum, crc32.IEEETable, key)
+	return crc32.Update(checksum, crc32.IEEETable, value)
+}
+
+// regionReader 返回读取 region 使用的 ReaderAt 和 region 的长度，旧的 region 切换之后 Fd 已经关闭了，只能通过 mmap 读取
+func regionReader(region *Region) (io.ReaderAt, int64, error) {
+	if region.ReaderAt != nil {
+		return region.ReaderAt, int64(region.ReaderAt.Len()), nil
+	}
+
+	stat, err := region.Fd.Stat()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return region.Fd, stat.Size(), nil
+}
+
+func (lfs *LogStructuredFS) toStringFileName(regionId int64) (string, error) {
+	name := formatDataFileName(regionId, lfs.fileExtension)
 	// Verify if regionId starts with 0 (valid only for 8 digits)
 	if strings.HasPrefix(name, "0") {
 		return name, nil
@@ -1434,14 +3121,14 @@ func toStringFileName(regionId int64) (string, error) {
 }
 
 // parseDataFileName converts the numeric part of the file name (e.g., 0000001.wdb) to uint64
-func parseDataFileName(name string) (int64, error) {
-	parts := strings.Split(name, ".")
-	if len(parts) != 2 {
+func parseDataFileName(name, ext string) (int64, error) {
+	base, ok := strings.CutSuffix(name, ext)
+	if !ok || base == "" {
 		return 0, fmt.Errorf("invalid file name format: %s", name)
 	}
 
 	// Convert to uint64
-	number, err := strconv.ParseInt(parts[0], 10, 64)
+	number, err := strconv.ParseInt(base, 10, 64)
 	if err != nil {
 		return 0, fmt.Errorf("failed to parse number from file name: %w", err)
 	}
@@ -1450,8 +3137,8 @@ func parseDataFileName(name string) (int64, error) {
 }
 
 // formatDataFileName converts uint64 to file name format (e.g., 1 to 0000001.wdb)
-func formatDataFileName(number int64) string {
-	return fmt.Sprintf("%010d%s", number, fileExtension)
+func formatDataFileName(number int64, ext string) string {
+	return fmt.Sprintf("%010d%s", number, ext)
 }
 
 func checkpointFileName(regionId int64) string {
@@ -1460,6 +3147,9 @@ func checkpointFileName(regionId int64) string {
 
 // serializedIndex serializes the index to a recoverable file snapshot record format:
 // | INUM 8 | RID 8  | POS 8 | EAT 8 | CAT 8 |  LEN 4 | CRC32 4 | = len(48 bytes)
+// LEN 的最高位保存 inode 的 immutable 标记，segment 的长度不会超过 int32 的范围，旧的快照中这一位总是 0。
+// inode 保存了 key 的时候 LEN 的次高位为 1，固定长度的记录后面跟着 key 的扩展部分，扩展部分有自己的 CRC32：
+// | KIND 1 | KLEN 4 | KEY ? | CRC32 4 |
 func serializedIndex(buf *bytes.Buffer, inum uint64, inode *inode) ([]byte, error) {
 	// reset a byte buffer
 	buf.Reset()
@@ -1470,7 +3160,14 @@ func serializedIndex(buf *bytes.Buffer, inum uint64, inode *inode) ([]byte, erro
 	binary.Write(buf, binary.LittleEndian, inode.Position)
 	binary.Write(buf, binary.LittleEndian, inode.ExpiredAt)
 	binary.Write(buf, binary.LittleEndian, inode.CreatedAt)
-	binary.Write(buf, binary.LittleEndian, inode.Length)
+	length := uint32(inode.Length)
+	if inode.immutable {
+		length |= _INDEX_IMMUTABLE
+	}
+	if inode.key != "" {
+		length |= _INDEX_KEYED
+	}
+	binary.Write(buf, binary.LittleEndian, length)
 
 	// Calculate CRC32 checksum
 	checksum := crc32.ChecksumIEEE(buf.Bytes())
@@ -1478,6 +3175,13 @@ func serializedIndex(buf *bytes.Buffer, inum uint64, inode *inode) ([]byte, erro
 	// Write CRC32 checksum to byte buffer (4 bytes)
 	binary.Write(buf, binary.LittleEndian, checksum)
 
+	if inode.key != "" {
+		buf.WriteByte(byte(inode.kind))
+		binary.Write(buf, binary.LittleEndian, uint32(len(inode.key)))
+		buf.WriteString(inode.key)
+		binary.Write(buf, binary.LittleEndian, crc32.ChecksumIEEE(buf.Bytes()[_INDEX_SEGMENT_SIZE:]))
+	}
+
 	// Return byte slice containing CRC32 checksum
 	return buf.Bytes(), nil
 }
@@ -1514,10 +3218,13 @@ func deserializedIndex(data []byte) (uint64, *inode, error) {
 		return 0, nil, err
 	}
 
-	err = binary.Read(buf, binary.LittleEndian, &inode.Length)
+	var length uint32
+	err = binary.Read(buf, binary.LittleEndian, &length)
 	if err != nil {
 		return 0, nil, err
 	}
+	inode.Length = int32(length &^ (_INDEX_IMMUTABLE | _INDEX_KEYED))
+	inode.immutable = length&_INDEX_IMMUTABLE != 0
 
 	// Deserialize and verify CRC32 checksum
 	var checksum uint32
@@ -1527,13 +3234,76 @@ func deserializedIndex(data []byte) (uint64, *inode, error) {
 	}
 
 	// Calculate CRC32 checksum of data, return an error if checksum does not match
-	if checksum != crc32.ChecksumIEEE(data[:len(data)-4]) {
+	if checksum != crc32.ChecksumIEEE(data[:_INDEX_SEGMENT_SIZE-4]) {
 		return 0, nil, fmt.Errorf("failed to crc32 checksum mismatch: %d", checksum)
 	}
 
+	if length&_INDEX_KEYED != 0 {
+		inode.kind, inode.key, err = deserializedIndexKey(data[_INDEX_SEGMENT_SIZE:])
+		if err != nil {
+			return 0, nil, err
+		}
+	}
+
 	return inum, &inode, nil
 }
 
+// deserializedIndexKey 解析索引记录中 key 的扩展部分：| KIND 1 | KLEN 4 | KEY ? | CRC32 4 |
+func deserializedIndexKey(data []byte) (kind, string, error) {
+	if len(data) < _INDEX_KEY_HEADER+4 {
+		return 0, "", errors.New("index key extension is truncated")
+	}
+
+	klen := binary.LittleEndian.Uint32(data[1:_INDEX_KEY_HEADER])
+	if uint64(len(data)) != _INDEX_KEY_HEADER+uint64(klen)+4 {
+		return 0, "", errors.New("index key extension length mismatch")
+	}
+
+	checksum := binary.LittleEndian.Uint32(data[len(data)-4:])
+	if checksum != crc32.ChecksumIEEE(data[:len(data)-4]) {
+		return 0, "", fmt.Errorf("failed to crc32 checksum mismatch: %d", checksum)
+	}
+
+	return kind(data[0]), string(data[_INDEX_KEY_HEADER : len(data)-4]), nil
+}
+
+// readIndexRecord 从 offset 开始读取一条完整的索引记录，包括可能存在的 key 扩展部分，
+// buf 的容量不够的时候会重新分配，返回的记录在下一次使用 buf 之前有效，调用者通过记录的长度计算下一条记录的位置。
+func readIndexRecord(reader io.ReaderAt, offset int64, buf []byte) ([]byte, error) {
+	if cap(buf) < _INDEX_SEGMENT_SIZE {
+		buf = make([]byte, _INDEX_SEGMENT_SIZE)
+	}
+
+	record := buf[:_INDEX_SEGMENT_SIZE]
+	_, err := reader.ReadAt(record, offset)
+	if err != nil {
+		return nil, err
+	}
+
+	if binary.LittleEndian.Uint32(record[40:44])&_INDEX_KEYED == 0 {
+		return record, nil
+	}
+
+	var header [_INDEX_KEY_HEADER]byte
+	_, err = reader.ReadAt(header[:], offset+_INDEX_SEGMENT_SIZE)
+	if err != nil {
+		return nil, err
+	}
+
+	size := _INDEX_SEGMENT_SIZE + _INDEX_KEY_HEADER + int(binary.LittleEndian.Uint32(header[1:])) + 4
+	if cap(buf) < size {
+		buf = append(buf[:_INDEX_SEGMENT_SIZE], make([]byte, size-_INDEX_SEGMENT_SIZE)...)
+	}
+
+	record = buf[:size]
+	_, err = reader.ReadAt(record[_INDEX_SEGMENT_SIZE:], offset+_INDEX_SEGMENT_SIZE)
+	if err != nil {
+		return nil, err
+	}
+
+	return record, nil
+}
+
 // Garbage Collection Compressor
 // Steps:
 // 1. If no index snapshot exists on disk, perform a global scan to restore the index.
@@ -1545,31 +3315,37 @@ func deserializedIndex(data []byte) (uint64, *inode, error) {
 // 7. Note: The key point is reverse scanning. Use keys from the disk data files to locate and compare records in memory.
 // 8. If the in-memory index is used to locate records, it becomes impossible to determine if a file has been fully scanned.
 // 9. This is because records in the in-memory index may be distributed across multiple data files on disk.
-func (lfs *LogStructuredFS) cleanupDirtyRegions() error {
-	if len(lfs.regions) >= 5 {
-		var regionIds, dirtyIds []int64
-		for id := range lfs.regions {
-			regionIds = append(regionIds, id)
-		}
+func (lfs *LogStructuredFS) cleanupDirtyRegions() (*CompactStats, error) {
+	stats := new(CompactStats)
+
+	// 前台写入切换 region 的时候会修改 regions，遍历的时候需要持有读锁
+	lfs.regmux.RLock()
+	total := len(lfs.regions)
+	regionIds := make([]int64, 0, total)
+	for id := range lfs.regions {
+		regionIds = append(regionIds, id)
+	}
+	lfs.regmux.RUnlock()
+
+	if total >= 5 {
+		var dirtyIds []int64
 
 		sort.Slice(regionIds, func(i, j int) bool {
 			return regionIds[i] < regionIds[j]
 		})
 
 		// find 40% dirty regions
+		lfs.regmux.RLock()
 		for i := 0; i < 4 && i < len(regionIds); i++ {
-			lfs.regmux.Lock()
-			exclude := regionIds[i] == lfs.regionId
-			lfs.regmux.Unlock()
-
 			// 排除活跃的文件
-			if exclude {
+			if regionIds[i] == lfs.regionId {
 				continue
 			}
 
 			dirtyIds = append(dirtyIds, regionIds[i])
 			lfs.dirtyRegions = append(lfs.dirtyRegions, lfs.regions[regionIds[i]])
 		}
+		lfs.regmux.RUnlock()
 
 		// Cleanup dirty region
 		defer func() {
@@ -1578,102 +3354,277 @@ func (lfs *LogStructuredFS) cleanupDirtyRegions() error {
 		}()
 
 		for _, reg := range lfs.dirtyRegions {
+			err := lfs.migrateRegion(reg, stats)
+			if err != nil {
+				return stats, err
+			}
+		}
 
-			readOffset := int64(len(dataFileMetadata))
+		err := lfs.snapshotBeforeRemove()
+		if err != nil {
+			return stats, err
+		}
 
-			for readOffset < int64(reg.Len()) {
-				inum, segment, err := readSegment(reg.ReaderAt, readOffset, _SEGMENT_PADDING)
-				if err != nil {
-					return err
-				}
+		// delete dirty region file
+		for _, id := range dirtyIds {
+			lfs.removeRegion(id, stats)
+		}
 
-				imap := lfs.indexs[inum%uint64(shard)]
-				if imap != nil {
-					imap.mu.RLock()
-					inode, ok := imap.index[inum]
-					imap.mu.RUnlock()
+	} else {
+		clog.Warnf("dirty regions (%d%%) does not meet garbage collection status", len(lfs.regions)/10)
+	}
 
-					if !ok {
-						continue
-					}
+	if lfs.mergeSmallRegions {
+		err := lfs.mergeRegions(stats)
+		if err != nil {
+			return stats, err
+		}
+	}
 
-					if isValid(segment, inode) {
-						bytes, err := segment.Serialize()
-						if err != nil {
-							return err
-						}
+	return stats, nil
+}
 
-						// 缩小锁的颗粒度
-						if err := func() error {
-							lfs.mu.Lock()
-							defer lfs.mu.Unlock()
+// mergeRegions 从最旧的 region 开始选出一段连续的、小于阈值并且合并之后仍然小于阈值的非活跃 region，
+// 把其中的有效数据依次迁移到活跃 region 中之后删除这些文件。迁移和垃圾回收使用同一个流程，超过宽限期的 tombstone 会被丢弃，
+// 只合并最旧的一段连续的 region 保证被丢弃的 tombstone 删除的旧版本也在这些 region 中被一起删除，
+// 不会在没有 index.db 全局重放的时候重新出现。遇到活跃 region 或者大 region 就停止，后面的小 region 等前面的 region 回收之后再合并。
+func (lfs *LogStructuredFS) mergeRegions(stats *CompactStats) error {
+	lfs.regmux.RLock()
+	regionIds := tailRegionIds(lfs.regions, 0)
+
+	var (
+		combined int64
+		merged   []int64
+		regions  []*Region
+	)
+	for _, id := range regionIds {
+		if id == lfs.regionId {
+			break
+		}
 
-							err := appendToActiveRegion(lfs.active, bytes)
-							if err != nil {
-								return err
-							}
+		// mmap 映射失败的 region 仍然通过 Fd 读取，ReaderAt 为 nil，需要通过 regionReader 获取长度
+		reg := lfs.regions[id]
+		_, length, err := regionReader(reg)
+		if err != nil {
+			lfs.regmux.RUnlock()
+			return fmt.Errorf("failed to stat region %d: %w", id, err)
+		}
 
-							inode.Position = lfs.offset
-							inode.RegionId = lfs.regionId
+		if combined+length >= lfs.regionThreshold {
+			break
+		}
+		combined += length
+		merged = append(merged, id)
+		regions = append(regions, reg)
+	}
+	lfs.regmux.RUnlock()
 
-							lfs.offset += int64(segment.Size())
+	// 只有一个小 region 的时候合并不会减少文件的数量
+	if len(merged) < 2 {
+		return nil
+	}
 
-							return nil
-						}(); err != nil {
-							return err
-						}
+	for _, reg := range regions {
+		err := lfs.migrateRegion(reg, stats)
+		if err != nil {
+			return err
+		}
+	}
 
-						readOffset += int64(segment.Size())
+	err := lfs.snapshotBeforeRemove()
+	if err != nil {
+		return err
+	}
 
-					} else {
-						// next segment
-						readOffset += int64(segment.Size())
-						continue
+	for _, id := range merged {
+		lfs.removeRegion(id, stats)
+	}
+	stats.RegionsMerged += len(merged)
+
+	clog.Debugf("merged %d small regions (%d bytes) into active region %d", len(merged), combined, lfs.regionId)
+	return nil
+}
+
+// migrateRegion 把 reg 中仍然有效的 segment 迁移到活跃 region 中，并且把 inode 替换为迁移之后的位置，
+// 宽限期内的 tombstone 也会被保留下来，迁移完成之后 reg 中已经没有被索引引用的数据，可以直接删除。
+func (lfs *LogStructuredFS) migrateRegion(reg *Region, stats *CompactStats) error {
+	reader, length, err := regionReader(reg)
+	if err != nil {
+		return err
+	}
+
+	readOffset := int64(len(dataFileMetadata))
+	stats.BytesReclaimed += length
+
+	for readOffset < length {
+		inum, segment, err := readSegment(reader, readOffset, _SEGMENT_PADDING)
+		if err != nil {
+			return err
+		}
+
+		stats.RecordsScanned++
+
+		// 迁移的时候 Value 会重新编码，Size 会变成重新编码之后的大小，读取下一个 segment 需要使用磁盘上原来的大小
+		size := int64(segment.Size())
+
+		imap := lfs.indexs[inum%uint64(shard)]
+		if imap != nil {
+			imap.mu.RLock()
+			inode, ok := imap.index[inum]
+			imap.mu.RUnlock()
+
+			// 索引中已经不存在的 key 直接跳过，继续读取下一个 segment
+			if !ok {
+				// 宽限期内的 tombstone 需要迁移到活跃 region 中保留，确保下游的消费者能观察到删除操作
+				if lfs.withinTombstoneGrace(segment) {
+					retained, err := lfs.retainTombstone(imap, inum, segment)
+					if err != nil {
+						return err
 					}
+					if retained {
+						stats.TombstonesRetained++
+						stats.BytesReclaimed -= int64(segment.Size())
+					}
+				}
+				readOffset += size
+				continue
+			}
 
-				} else {
-					return fmt.Errorf("imap is nil for inum = %d", inum)
+			if isValid(segment, inode) {
+				bytes, err := segment.Serialize()
+				if err != nil {
+					return err
 				}
 
-				if atomic.LoadInt64(&lfs.offset) >= lfs.regionThreshold {
-					err = lfs.changeRegions()
+				// 缩小锁的颗粒度
+				if err := func() error {
+					lfs.mu.Lock()
+					defer lfs.mu.Unlock()
+
+					err := appendToActiveRegion(lfs.active, bytes)
 					if err != nil {
-						return fmt.Errorf("failed to close active migrate region: %w", err)
+						return err
+					}
+
+					// 不能原地修改 inode，并发的读取者可能读到新的 RegionId 和旧的 Position，
+					// 在 shard 锁内替换为新的 inode，期间 key 被重新写入的话保留新写入的 inode。
+					imap.mu.Lock()
+					if imap.index[inum] == inode {
+						lfs.markSuperseded(lfs.regionId, imap.put(inum, inode.relocate(lfs.regionId, lfs.offset)))
+					}
+					imap.mu.Unlock()
+
+					lfs.offset += int64(segment.Size())
+
+					// 切换 region 会修改 lfs.active 和 regions，和前台写入一样需要在 lfs.mu 内完成
+					if lfs.offset >= lfs.regionThreshold {
+						return lfs.changeRegions()
 					}
+
+					return nil
+				}(); err != nil {
+					return err
 				}
 
+				stats.RecordsMigrated++
+				stats.BytesReclaimed -= int64(segment.Size())
+				readOffset += size
+
+			} else {
+				// next segment
+				readOffset += size
+				continue
 			}
 
+		} else {
+			return fmt.Errorf("imap is nil for inum = %d", inum)
 		}
 
-		// delete dirty region file
-		for _, id := range dirtyIds {
-			func(id int64) {
-				lfs.regmux.Lock()
-				defer lfs.regmux.Unlock()
-				reg, ok := lfs.regions[id]
-				if ok {
-					_ = os.Remove(filepath.Join(lfs.directory, reg.Fd.Name()))
-					delete(lfs.regions, id)
-				}
-			}(id)
-		}
+	}
 
-	} else {
-		clog.Warnf("dirty regions (%d%%) does not meet garbage collection status", len(lfs.regions)/10)
+	return nil
+}
+
+// snapshotBeforeRemove 在删除 region 文件之前导出一次完整的索引快照，迁移完成之后索引中已经没有指向这些 region 的 inode，
+// 否则删除文件之后、下一次快照之前进程崩溃，启动时加载的旧 index.db 会引用已经不存在的 region。
+// 导出失败的时候不删除任何 region，旧文件留在磁盘上不影响恢复，下一次垃圾回收会重新处理。
+// 导出的时候会先把迁移到活跃 region 中的数据落盘，删除文件之前 index.db 和它引用的数据都已经持久化了。
+func (lfs *LogStructuredFS) snapshotBeforeRemove() error {
+	lfs.mu.RLock()
+	defer lfs.mu.RUnlock()
+
+	err := lfs.ExportSnapshotIndex()
+	if err != nil {
+		return fmt.Errorf("failed to export index snapshot before removing regions: %w", err)
 	}
 
 	return nil
 }
 
+// removeRegion 关闭并且删除 region 文件，所有有效的 segment 都已经迁移并且替换了 inode，这里同时持有 lfs.mu 和 regmux 的写锁，
+// 等待所有还在读取旧 region 的读取者完成之后才关闭和删除文件。
+func (lfs *LogStructuredFS) removeRegion(id int64, stats *CompactStats) {
+	lfs.mu.Lock()
+	defer lfs.mu.Unlock()
+	lfs.regmux.Lock()
+	defer lfs.regmux.Unlock()
+	reg, ok := lfs.regions[id]
+	if ok {
+		// Fd 是使用完整路径打开的，这里直接使用 Fd.Name() 删除
+		_ = reg.Fd.Close()
+		_ = lfs.fsys.Remove(reg.Fd.Name())
+		delete(lfs.regions, id)
+		delete(lfs.supersedes, id)
+		stats.RegionsRemoved++
+	}
+}
+
+// withinTombstoneGrace 判断 tombstone 是否还在宽限期内，宽限期从 tombstone 的 CreatedAt 开始计算
+func (lfs *LogStructuredFS) withinTombstoneGrace(seg *Segment) bool {
+	return seg.IsTombstone() && lfs.tombstoneGracePeriod > 0 &&
+		time.Since(time.UnixMicro(seg.CreatedAt)) < lfs.tombstoneGracePeriod
+}
+
+// retainTombstone 把 tombstone 追加到活跃 region 中，如果这个 key 在删除之后又被重新写入了，
+// 那么这个 tombstone 已经没有意义了，而且追加到新数据之后会导致重放的时候把新数据删除，所以直接丢弃。
+func (lfs *LogStructuredFS) retainTombstone(imap *indexMap, inum uint64, seg *Segment) (bool, error) {
+	bytes, err := seg.Serialize()
+	if err != nil {
+		return false, err
+	}
+
+	lfs.mu.Lock()
+	defer lfs.mu.Unlock()
+
+	imap.mu.RLock()
+	_, exists := imap.index[inum]
+	imap.mu.RUnlock()
+	if exists {
+		return false, nil
+	}
+
+	err = appendToActiveRegion(lfs.active, bytes)
+	if err != nil {
+		return false, err
+	}
+
+	// 不知道 tombstone 删除的数据在哪个 region 中，按照覆盖了之前所有的 region 处理
+	lfs.supersede(lfs.regionId, math.MinInt64)
+	lfs.offset += int64(seg.Size())
+
+	return true, nil
+}
+
 func isValid(seg *Segment, inode *inode) bool {
+	// 刷新过期时间会追加一个创建时间相同的新 segment，旧的 segment 需要通过过期时间区分
 	return !seg.IsTombstone() &&
 		seg.CreatedAt == inode.CreatedAt &&
-		(seg.ExpiredAt == ImmortalTTL || time.Now().UnixMicro() < seg.ExpiredAt)
+		seg.ExpiredAt == atomic.LoadInt64(&inode.ExpiredAt) &&
+		!isExpired(seg.ExpiredAt)
 }
 
 // Start serializing little-endian data, needs to compress seg before writing.
-func appendToActiveRegion(fd *os.File, bytes []byte) error {
+func appendToActiveRegion(fd File, bytes []byte) error {
 	// Write the byte stream to the file
 	n, err := fd.Write(bytes)
 	if err != nil {
@@ -1690,22 +3641,22 @@ func appendToActiveRegion(fd *os.File, bytes []byte) error {
 	return nil
 }
 
-func cleanupDirtyCheckpoint(directory, nckpt string) error {
-	files, err := filepath.Glob(filepath.Join(directory, "*.ckpt"))
+func cleanupDirtyCheckpoint(fsys Filesystem, directory, nckpt string) error {
+	files, err := globFiles(fsys, directory, ckptExtension)
 	if err != nil {
 		return err
 	}
 
 	for _, file := range files {
 		if filepath.Base(file) != nckpt {
-			err := os.Remove(file)
+			err := fsys.Remove(file)
 			if err != nil {
 				return fmt.Errorf("deleted old checkpoint file: %s", err)
 			}
 		}
 	}
 
-	tmps, err := filepath.Glob(filepath.Join(directory, "*.tmp"))
+	tmps, err := globFiles(fsys, directory, ".tmp")
 	if err != nil {
 		return err
 	}
@@ -1714,7 +3665,7 @@ func cleanupDirtyCheckpoint(directory, nckpt string) error {
 		if filepath.Base(file) == tempIndexFile {
 			continue
 		}
-		err := os.Remove(file)
+		err := fsys.Remove(file)
 		if err != nil {
 			return fmt.Errorf("deleted old temp checkpoint file: %s", err)
 		}
@@ -1723,30 +3674,63 @@ func cleanupDirtyCheckpoint(directory, nckpt string) error {
 	return nil
 }
 
-func scanAndRecoveryCheckpoint(files []string, regions map[int64]*Region, indexs []*indexMap) error {
+func scanAndRecoveryCheckpoint(fsys Filesystem, files []string, regions map[int64]*Region, indexs []*indexMap, workers int, readahead bool) error {
+	path, pauseId, err := selectCheckpoint(files, 0)
+	if err != nil {
+		return err
+	}
+
+	err = recoveryCheckpointIndex(fsys, path, indexs)
+	if err != nil {
+		return err
+	}
+
+	// 由于检查点不是实时的索引快照，再从检查点之后数据文件进行恢复完整数据
+	return replayRegions(tailRegionIds(regions, pauseId), regions, indexs, workers, readahead)
+}
+
+// selectCheckpoint 从检查点文件中选出时间戳不晚于 before 的最新的一个，before 小于等于 0 表示不限制，
+// 返回检查点的路径和生成检查点时的 active region ID，检查点文件名的格式为 mem.<unix>.<regionId>.ckpt。
+func selectCheckpoint(files []string, before int64) (string, int64, error) {
 	var (
-		ckpt    int
+		ckpt    int64 = -1
 		path    string
-		pauseId string
+		pauseId int64
 	)
 
 	for _, file := range files {
-		parts := strings.Split(file, ".")
+		parts := strings.Split(filepath.Base(file), ".")
 		if len(parts) == 4 {
-			ts, err := strconv.Atoi(parts[1])
+			ts, err := strconv.ParseInt(parts[1], 10, 64)
 			if err != nil {
-				return fmt.Errorf("failed to split checkpoint name: %w", err)
+				return "", 0, fmt.Errorf("failed to split checkpoint name: %w", err)
+			}
+
+			if before > 0 && ts > before {
+				continue
 			}
 
 			if ts > ckpt {
+				rid, err := strconv.ParseInt(parts[2], 10, 64)
+				if err != nil {
+					return "", 0, fmt.Errorf("failed to split checkpoint name: %w", err)
+				}
 				ckpt = ts
 				path = file
-				pauseId = parts[2]
+				pauseId = rid
 			}
 		}
 	}
 
-	reader, err := mmap.Open(path)
+	if path == "" {
+		return "", 0, ErrCheckpointNotFound
+	}
+
+	return path, pauseId, nil
+}
+
+func recoveryCheckpointIndex(fsys Filesystem, path string, indexs []*indexMap) error {
+	reader, err := openReaderAt(fsys, path)
 	if err != nil {
 		return fmt.Errorf("failed to mmap checkpoint file: %w", err)
 	}
@@ -1757,70 +3741,5 @@ func scanAndRecoveryCheckpoint(files []string, regions map[int64]*Region, indexs
 		return fmt.Errorf("failed to recover data from checkpoint: %w", err)
 	}
 
-	// 由于检查点不是实时的索引快照，再从检查点之后数据文件进行恢复完整数据
-	pid, err := strconv.Atoi(pauseId)
-	if err != nil {
-		return err
-	}
-
-	var regionIds []int64
-	for id := range regions {
-		if id >= int64(pid) {
-			regionIds = append(regionIds, id)
-		}
-	}
-
-	sort.Slice(regionIds, func(i, j int) bool {
-		return regionIds[i] < regionIds[j]
-	})
-
-	for _, regionId := range regionIds {
-		reg, ok := regions[regionId]
-		if !ok {
-			return fmt.Errorf("data file does not exist regions id: %d", regionId)
-		}
-
-		stat, err := reg.Fd.Stat()
-		if err != nil {
-			return err
-		}
-
-		offset := int64(len(dataFileMetadata))
-
-		for offset < stat.Size() {
-			inum, segment, err := readSegment(reg.Fd, offset, _SEGMENT_PADDING)
-			if err != nil {
-				return fmt.Errorf("failed to parse data file segment: %w", err)
-			}
-
-			imap := indexs[inum%uint64(shard)]
-			if imap != nil {
-				if segment.IsTombstone() {
-					delete(imap.index, inum)
-					offset += int64(segment.Size())
-					continue
-				}
-
-				if segment.ExpiredAt > 0 && segment.ExpiredAt <= time.Now().UnixMicro() {
-					offset += int64(segment.Size())
-					continue
-				}
-
-				imap.index[inum] = &inode{
-					RegionId:  regionId,
-					Position:  offset,
-					Length:    segment.Size(),
-					CreatedAt: segment.CreatedAt,
-					ExpiredAt: segment.ExpiredAt,
-					mvcc:      0,
-				}
-
-				offset += int64(segment.Size())
-			} else {
-				return errors.New("no corresponding index shard")
-			}
-		}
-	}
-
 	return nil
 }
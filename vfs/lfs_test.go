@@ -16,14 +16,22 @@ package vfs
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/auula/urnadb/conf"
 	"github.com/auula/urnadb/types"
+	"github.com/auula/urnadb/utils"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -278,6 +286,40 @@ func BenchmarkVFSWrite(b *testing.B) {
 	}
 }
 
+// BenchmarkPutSegment 反复覆盖写入同一批 key，只观察写入路径上序列化和追加的内存分配
+func BenchmarkPutSegment(b *testing.B) {
+	fss, err := OpenFS(&Options{
+		FSPerm:    conf.FSPerm,
+		Path:      b.TempDir(),
+		Threshold: 1,
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer fss.StopExpireLoop()
+
+	keys := make([]string, 1024)
+	segs := make([]*Segment, len(keys))
+	for i := range keys {
+		keys[i] = fmt.Sprintf("put-key-%d", i)
+		segs[i], err = NewSegment(keys[i], types.NewVariant(strings.Repeat("v", 1024)), 0)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		n := i % len(keys)
+		err := fss.PutSegment(keys[n], segs[n])
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
 func BenchmarkVFSReads(b *testing.B) {
 	fss, err := OpenFS(&Options{
 		FSPerm:    conf.FSPerm,
@@ -438,3 +480,3050 @@ func TestVFSOpertions(t *testing.T) {
 
 	os.RemoveAll(conf.Settings.Path)
 }
+
+func TestIndexSnapshotInterval(t *testing.T) {
+	dir := t.TempDir()
+
+	fss, err := OpenFS(&Options{
+		FSPerm:                conf.FSPerm,
+		Path:                  dir,
+		Threshold:             1,
+		IndexSnapshotInterval: 100 * time.Millisecond,
+	})
+	assert.NoError(t, err)
+
+	for i := 0; i < 10; i++ {
+		seg, err := NewSegment(fmt.Sprintf("key-%d", i), types.NewVariant(int64(i)), 0)
+		assert.NoError(t, err)
+		assert.NoError(t, fss.PutSegment(seg.KeyString(), seg))
+	}
+
+	// 单个 region 的情况下也要按照定时器生成 index.db 快照
+	assert.Eventually(t, func() bool {
+		return utils.IsExist(filepath.Join(dir, defaultIndexFileName))
+	}, 2*time.Second, 50*time.Millisecond)
+
+	fss.StopIndexSnapshot()
+	fss.StopExpireLoop()
+
+	// 快照之后的写入和删除，需要在恢复的时候从快照之后的 region 重放
+	seg, err := NewSegment("key-after", types.NewVariant("after"), 0)
+	assert.NoError(t, err)
+	assert.NoError(t, fss.PutSegment("key-after", seg))
+	assert.NoError(t, fss.DeleteSegment("key-0"))
+
+	// 模拟崩溃，不调用 CloseFS 直接重新打开
+	recovered, err := OpenFS(&Options{
+		FSPerm:    conf.FSPerm,
+		Path:      dir,
+		Threshold: 1,
+	})
+	assert.NoError(t, err)
+	defer recovered.StopExpireLoop()
+
+	for i := 1; i < 10; i++ {
+		assert.True(t, recovered.IsActive(fmt.Sprintf("key-%d", i)))
+	}
+	assert.True(t, recovered.IsActive("key-after"))
+	assert.False(t, recovered.IsActive("key-0"))
+}
+
+func TestPutSegmentIfAbsentConcurrent(t *testing.T) {
+	fss, err := OpenFS(&Options{
+		FSPerm:    conf.FSPerm,
+		Path:      t.TempDir(),
+		Threshold: 1,
+	})
+	assert.NoError(t, err)
+	defer fss.StopExpireLoop()
+
+	var (
+		wg   sync.WaitGroup
+		wins atomic.Int32
+	)
+
+	concurrent := 100
+	wg.Add(concurrent)
+	for i := 0; i < concurrent; i++ {
+		go func(id int) {
+			defer wg.Done()
+			seg, err := NewSegment("setnx-key", types.NewVariant(int64(id)), 0)
+			if err != nil {
+				t.Errorf("failed to create segment: %v", err)
+				return
+			}
+
+			ok, err := fss.PutSegmentIfAbsent("setnx-key", seg)
+			if err != nil {
+				t.Errorf("failed to put segment if absent: %v", err)
+				return
+			}
+
+			if ok {
+				wins.Add(1)
+			}
+		}(i)
+	}
+
+	wg.Wait()
+
+	// 并发的 setnx 只能有一个成功
+	assert.Equal(t, int32(1), wins.Load())
+	assert.True(t, fss.IsActive("setnx-key"))
+
+	// 已经过期的 key 可以重新写入
+	seg, err := NewSegment("setnx-expired", types.NewVariant("old"), 1)
+	assert.NoError(t, err)
+	assert.NoError(t, fss.PutSegment("setnx-expired", seg))
+
+	time.Sleep(1100 * time.Millisecond)
+
+	seg, err = NewSegment("setnx-expired", types.NewVariant("new"), 0)
+	assert.NoError(t, err)
+	ok, err := fss.PutSegmentIfAbsent("setnx-expired", seg)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+}
+
+func TestCompactCallback(t *testing.T) {
+	var (
+		calls int
+		stats CompactStats
+	)
+
+	fss, err := OpenFS(&Options{
+		FSPerm:    conf.FSPerm,
+		Path:      t.TempDir(),
+		Threshold: 1,
+		CompactCallback: func(s CompactStats) {
+			calls++
+			stats = s
+		},
+	})
+	assert.NoError(t, err)
+	defer fss.StopExpireLoop()
+
+	// 缩小 region 的阈值，让少量数据就能产生多个 region 文件
+	fss.regionThreshold = 512
+
+	for i := 0; i < 100; i++ {
+		seg, err := NewSegment(fmt.Sprintf("gc-key-%d", i), types.NewVariant(int64(i)), 0)
+		assert.NoError(t, err)
+		assert.NoError(t, fss.PutSegment(seg.KeyString(), seg))
+	}
+
+	// 删除一半的数据制造垃圾
+	for i := 0; i < 100; i += 2 {
+		assert.NoError(t, fss.DeleteSegment(fmt.Sprintf("gc-key-%d", i)))
+	}
+
+	assert.GreaterOrEqual(t, len(fss.regions), 5)
+
+	err = fss.CompactNow()
+	assert.NoError(t, err)
+
+	assert.Equal(t, 1, calls)
+	assert.Equal(t, 4, stats.RegionsRemoved)
+	assert.Greater(t, stats.RecordsScanned, stats.RecordsMigrated)
+	assert.Greater(t, stats.RecordsMigrated, uint64(0))
+	assert.Greater(t, stats.BytesReclaimed, int64(0))
+	assert.Greater(t, stats.Duration, time.Duration(0))
+
+	for i := 0; i < 100; i++ {
+		assert.Equal(t, i%2 == 1, fss.IsActive(fmt.Sprintf("gc-key-%d", i)))
+	}
+
+	for i := 1; i < 100; i += 2 {
+		_, seg, err := fss.FetchSegment(fmt.Sprintf("gc-key-%d", i))
+		if assert.NoError(t, err) {
+			variant, err := seg.ToVariant()
+			assert.NoError(t, err)
+			assert.Equal(t, int64(i), variant.Value)
+		}
+	}
+}
+
+func TestFetchDuringCompaction(t *testing.T) {
+	fss, err := OpenFS(&Options{
+		FSPerm:    conf.FSPerm,
+		Path:      t.TempDir(),
+		Threshold: 1,
+	})
+	assert.NoError(t, err)
+	defer fss.StopExpireLoop()
+
+	fss.regionThreshold = 512
+
+	const keys = 200
+	for i := 0; i < keys; i++ {
+		seg, err := NewSegment(fmt.Sprintf("stress-key-%d", i), types.NewVariant(int64(i)), 0)
+		assert.NoError(t, err)
+		assert.NoError(t, fss.PutSegment(seg.KeyString(), seg))
+	}
+
+	var (
+		wg   sync.WaitGroup
+		done = make(chan struct{})
+	)
+
+	// 读取者持续读取在压缩过程中被迁移的 key，任何一次读取失败都说明读到了正在被删除的 region
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func(r int) {
+			defer wg.Done()
+			for n := r; ; n++ {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				i := n % keys
+				_, seg, err := fss.FetchSegment(fmt.Sprintf("stress-key-%d", i))
+				if !assert.NoError(t, err) {
+					return
+				}
+				variant, err := seg.ToVariant()
+				assert.NoError(t, err)
+				assert.Equal(t, int64(i), variant.Value)
+			}
+		}(r)
+	}
+
+	// 写入者不断产生新的 region，压缩的同时也会切换活跃 region
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for n := 0; ; n++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+
+			seg, err := NewSegment(fmt.Sprintf("filler-%d", n%50), types.NewVariant(int64(n)), 0)
+			assert.NoError(t, err)
+			assert.NoError(t, fss.PutSegment(seg.KeyString(), seg))
+		}
+	}()
+
+	for i := 0; i < 20; i++ {
+		assert.NoError(t, fss.CompactNow())
+	}
+
+	close(done)
+	wg.Wait()
+}
+
+func TestFetchSegmentRegionUnavailable(t *testing.T) {
+	fss, err := OpenFS(&Options{
+		FSPerm:    conf.FSPerm,
+		Path:      t.TempDir(),
+		Threshold: 1,
+	})
+	assert.NoError(t, err)
+	defer fss.StopExpireLoop()
+
+	seg, err := NewSegment("unavailable-key", types.NewVariant("value"), 0)
+	assert.NoError(t, err)
+	assert.NoError(t, fss.PutSegment("unavailable-key", seg))
+
+	inum := keyHash("unavailable-key")
+	imap := fss.indexs[inum%uint64(shard)]
+	original := imap.index[inum]
+
+	// 模拟索引中残留的 inode 指向已经被回收的 region
+	imap.index[inum] = original.relocate(999, original.Position)
+	_, _, err = fss.FetchSegment("unavailable-key")
+	assert.ErrorIs(t, err, ErrRegionUnavailable)
+
+	imap.index[inum] = original
+	_, seg, err = fss.FetchSegment("unavailable-key")
+	assert.NoError(t, err)
+	assert.Equal(t, "unavailable-key", seg.KeyString())
+}
+
+// hasTombstone 扫描所有的 region 文件，判断磁盘上是否还存在 key 对应的 tombstone 记录
+func hasTombstone(t *testing.T, fss *LogStructuredFS, key string) bool {
+	for _, reg := range fss.regions {
+		var (
+			reader io.ReaderAt = reg.ReaderAt
+			size   int64
+		)
+
+		if reg.ReaderAt != nil {
+			size = int64(reg.Len())
+		} else {
+			stat, err := reg.Fd.Stat()
+			assert.NoError(t, err)
+			reader, size = reg.Fd, stat.Size()
+		}
+
+		offset := int64(len(dataFileMetadata))
+		for offset < size {
+			_, seg, err := readSegment(reader, offset, _SEGMENT_PADDING)
+			if !assert.NoError(t, err) {
+				return false
+			}
+			if seg.IsTombstone() && seg.KeyString() == key {
+				return true
+			}
+			offset += int64(seg.Size())
+		}
+	}
+	return false
+}
+
+func TestTombstoneGracePeriod(t *testing.T) {
+	var stats CompactStats
+	fss, err := OpenFS(&Options{
+		FSPerm:               conf.FSPerm,
+		Path:                 t.TempDir(),
+		Threshold:            1,
+		TombstoneGracePeriod: 1500 * time.Millisecond,
+		CompactCallback: func(s CompactStats) {
+			stats = s
+		},
+	})
+	assert.NoError(t, err)
+	defer fss.StopExpireLoop()
+
+	fss.regionThreshold = 512
+
+	seg, err := NewSegment("grace-key", types.NewVariant("value"), 0)
+	assert.NoError(t, err)
+	assert.NoError(t, fss.PutSegment("grace-key", seg))
+	assert.NoError(t, fss.DeleteSegment("grace-key"))
+
+	fill := func(prefix string) {
+		for i := 0; len(fss.regions) < 5; i++ {
+			seg, err := NewSegment(fmt.Sprintf("%s-%d", prefix, i), types.NewVariant(int64(i)), 0)
+			assert.NoError(t, err)
+			assert.NoError(t, fss.PutSegment(seg.KeyString(), seg))
+		}
+	}
+
+	// 宽限期内执行垃圾回收，tombstone 会被保留下来
+	fill("within")
+	assert.NoError(t, fss.CompactNow())
+	assert.Equal(t, uint64(1), stats.TombstonesRetained)
+	assert.True(t, hasTombstone(t, fss, "grace-key"))
+	assert.False(t, fss.IsActive("grace-key"))
+
+	time.Sleep(1600 * time.Millisecond)
+
+	// 超过宽限期之后，tombstone 所在的 region 被回收时 tombstone 也就被回收了
+	for i := 0; i < 5 && hasTombstone(t, fss, "grace-key"); i++ {
+		fill(fmt.Sprintf("after-%d", i))
+		assert.NoError(t, fss.CompactNow())
+		assert.Equal(t, uint64(0), stats.TombstonesRetained)
+	}
+
+	assert.False(t, hasTombstone(t, fss, "grace-key"))
+	assert.False(t, fss.IsActive("grace-key"))
+}
+
+func TestScanRange(t *testing.T) {
+	path := t.TempDir()
+	fss, err := OpenFS(&Options{
+		FSPerm:      conf.FSPerm,
+		Path:        path,
+		Threshold:   1,
+		OrderedKeys: true,
+	})
+	assert.NoError(t, err)
+
+	for _, key := range []string{"delta", "alpha", "echo", "charlie", "bravo", "foxtrot"} {
+		seg, err := NewSegment(key, types.NewVariant(key), 0)
+		assert.NoError(t, err)
+		assert.NoError(t, fss.PutSegment(key, seg))
+	}
+
+	// 重复写入同一个 key 不会产生重复的结果
+	seg, err := NewSegment("bravo", types.NewVariant("bravo"), 0)
+	assert.NoError(t, err)
+	assert.NoError(t, fss.PutSegment("bravo", seg))
+	assert.NoError(t, fss.DeleteSegment("echo"))
+
+	scan := func(fss *LogStructuredFS, start, end string) []string {
+		var keys []string
+		err := fss.ScanRange(start, end, func(key string, seg *Segment) bool {
+			variant, err := seg.ToVariant()
+			assert.NoError(t, err)
+			assert.Equal(t, key, variant.Value)
+			variant.ReleaseToPool()
+			keys = append(keys, key)
+			return true
+		})
+		assert.NoError(t, err)
+		return keys
+	}
+
+	assert.Equal(t, []string{"alpha", "bravo", "charlie", "delta", "foxtrot"}, scan(fss, "", ""))
+	assert.Equal(t, []string{"bravo", "charlie"}, scan(fss, "bravo", "delta"))
+	assert.Equal(t, []string{"charlie", "delta", "foxtrot"}, scan(fss, "c", ""))
+	assert.Empty(t, scan(fss, "x", ""))
+	assert.Empty(t, scan(fss, "delta", "bravo"))
+
+	// fn 返回 false 的时候停止遍历
+	var visited []string
+	assert.NoError(t, fss.ScanRange("", "", func(key string, seg *Segment) bool {
+		visited = append(visited, key)
+		return len(visited) < 2
+	}))
+	assert.Equal(t, []string{"alpha", "bravo"}, visited)
+
+	fss.StopExpireLoop()
+	assert.NoError(t, fss.CloseFS())
+
+	// 重新打开之后从 region 中重建有序的 key 集合
+	recovered, err := OpenFS(&Options{
+		FSPerm:      conf.FSPerm,
+		Path:        path,
+		Threshold:   1,
+		OrderedKeys: true,
+	})
+	assert.NoError(t, err)
+	defer recovered.StopExpireLoop()
+
+	assert.Equal(t, []string{"alpha", "bravo", "charlie", "delta", "foxtrot"}, scan(recovered, "", ""))
+}
+
+func TestScanRangeDisabled(t *testing.T) {
+	fss, err := OpenFS(&Options{
+		FSPerm:    conf.FSPerm,
+		Path:      t.TempDir(),
+		Threshold: 1,
+	})
+	assert.NoError(t, err)
+	defer fss.StopExpireLoop()
+
+	err = fss.ScanRange("", "", func(key string, seg *Segment) bool {
+		return true
+	})
+	assert.ErrorIs(t, err, ErrOrderedKeysDisabled)
+}
+
+func BenchmarkPutSegmentOrderedKeys(b *testing.B) {
+	for _, ordered := range []bool{false, true} {
+		b.Run(fmt.Sprintf("ordered=%v", ordered), func(b *testing.B) {
+			fss, err := OpenFS(&Options{
+				FSPerm:      conf.FSPerm,
+				Path:        b.TempDir(),
+				Threshold:   1,
+				OrderedKeys: ordered,
+			})
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer fss.StopExpireLoop()
+
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				key := fmt.Sprintf("key-%d", i)
+				seg, err := NewSegment(key, types.NewVariant(int64(i)), 0)
+				if err != nil {
+					b.Fatal(err)
+				}
+				err = fss.PutSegment(key, seg)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestValueChecksum(t *testing.T) {
+	fss, err := OpenFS(&Options{
+		FSPerm:        conf.FSPerm,
+		Path:          t.TempDir(),
+		Threshold:     1,
+		ValueChecksum: true,
+	})
+	assert.NoError(t, err)
+	defer fss.StopExpireLoop()
+	defer valueChecksum.Store(false)
+
+	// 只校验 value 的 segment 在 DEL 字节中带有标记，tombstone 标记不受影响
+	tombstone, err := NewTombstoneSegment("tombstone-key").Serialize()
+	assert.NoError(t, err)
+	assert.Equal(t, _VALUE_CHECKSUM|1, int8(tombstone[0]))
+	_, seg, err := readSegment(bytes.NewReader(tombstone), 0, _SEGMENT_PADDING)
+	assert.NoError(t, err)
+	assert.True(t, seg.IsTombstone())
+
+	corrupt := func(key string, offset func(seg *Segment) int64) {
+		seg, err := NewSegment(key, types.NewVariant("value"), 0)
+		assert.NoError(t, err)
+		assert.NoError(t, fss.PutSegment(key, seg))
+
+		_, _, err = fss.FetchSegment(key)
+		assert.NoError(t, err)
+
+		inum := keyHash(key)
+		inode := fss.indexs[inum%uint64(shard)].index[inum]
+		fd, err := os.OpenFile(fss.regions[inode.RegionId].Fd.Name(), os.O_RDWR, conf.FSPerm)
+		assert.NoError(t, err)
+		defer fd.Close()
+
+		pos := inode.Position + offset(seg)
+		b := make([]byte, 1)
+		_, err = fd.ReadAt(b, pos)
+		assert.NoError(t, err)
+		b[0] ^= 0xFF
+		_, err = fd.WriteAt(b, pos)
+		assert.NoError(t, err)
+	}
+
+	// value 损坏之后 CRC32 校验失败
+	corrupt("value-key", func(seg *Segment) int64 {
+		return _SEGMENT_PADDING + int64(seg.KeySize)
+	})
+	_, _, err = fss.FetchSegment("value-key")
+	assert.ErrorContains(t, err, "checksum mismatch")
+
+	// key 不在 CRC32 的范围内，损坏之后通过索引的哈希值发现
+	corrupt("key-key", func(seg *Segment) int64 {
+		return _SEGMENT_PADDING
+	})
+	_, _, err = fss.FetchSegment("key-key")
+	assert.ErrorContains(t, err, "failed to verify key")
+}
+
+func BenchmarkReadSegmentLargeKey(b *testing.B) {
+	defer valueChecksum.Store(false)
+
+	key := string(bytes.Repeat([]byte("k"), 64*kb))
+	for _, valueOnly := range []bool{false, true} {
+		b.Run(fmt.Sprintf("value_checksum=%v", valueOnly), func(b *testing.B) {
+			valueChecksum.Store(valueOnly)
+			seg, err := NewSegment(key, types.NewVariant("value"), 0)
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			data, err := seg.Serialize()
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			reader := bytes.NewReader(data)
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				_, _, err := readSegment(reader, 0, _SEGMENT_PADDING)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestExpireMany(t *testing.T) {
+	path := t.TempDir()
+	fss, err := OpenFS(&Options{
+		FSPerm:    conf.FSPerm,
+		Path:      path,
+		Threshold: 1,
+	})
+	assert.NoError(t, err)
+
+	for _, key := range []string{"session-1", "session-2", "session-3"} {
+		seg, err := NewSegment(key, types.NewVariant(key), 10)
+		assert.NoError(t, err)
+		assert.NoError(t, fss.PutSegment(key, seg))
+	}
+
+	// 不存在的 key 被跳过，只统计实际更新的 key
+	updated, err := fss.ExpireMany(context.Background(), []string{"session-1", "missing-1", "session-3", "missing-2"}, 3600)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, updated)
+
+	ttl := func(fss *LogStructuredFS, key string) int64 {
+		_, seg, err := fss.FetchSegment(key)
+		if !assert.NoError(t, err) {
+			return 0
+		}
+		variant, err := seg.ToVariant()
+		assert.NoError(t, err)
+		assert.Equal(t, key, variant.Value)
+		ttl, _ := seg.ExpiresIn()
+		return ttl
+	}
+
+	assert.InDelta(t, 3600, ttl(fss, "session-1"), 2)
+	assert.InDelta(t, 10, ttl(fss, "session-2"), 2)
+	assert.InDelta(t, 3600, ttl(fss, "session-3"), 2)
+
+	// ttl 小于等于 0 表示永不过期
+	ok, err := fss.Expire("session-2", 0)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, int64(ImmortalTTL), ttl(fss, "session-2"))
+
+	fss.StopExpireLoop()
+	assert.NoError(t, fss.CloseFS())
+
+	// 新的过期时间已经持久化，重新打开之后仍然有效
+	recovered, err := OpenFS(&Options{
+		FSPerm:    conf.FSPerm,
+		Path:      path,
+		Threshold: 1,
+	})
+	assert.NoError(t, err)
+	defer recovered.StopExpireLoop()
+
+	assert.InDelta(t, 3600, ttl(recovered, "session-1"), 2)
+	assert.Equal(t, int64(ImmortalTTL), ttl(recovered, "session-2"))
+}
+
+func TestExpireManyWithPipeline(t *testing.T) {
+	path := t.TempDir()
+	fss, err := OpenFS(&Options{
+		FSPerm:    conf.FSPerm,
+		Path:      path,
+		Threshold: 1,
+	})
+	assert.NoError(t, err)
+
+	fss.SetCompressor(SnappyCompressor)
+	assert.NoError(t, fss.SetEncryptor(AESBlockCipher, []byte("1234567890123456")))
+	defer func() { pipeline = NewPipeline() }()
+
+	value := strings.Repeat("compressible-value-", 32)
+	for _, key := range []string{"encoded-1", "encoded-2"} {
+		seg, err := NewSegment(key, types.NewVariant(value), 10)
+		assert.NoError(t, err)
+		assert.NoError(t, fss.PutSegment(key, seg))
+	}
+
+	// 重新写入的 segment 的 value 需要重新经过 pipeline 编码，否则长度和 CRC32 都和磁盘上的数据不一致
+	updated, err := fss.ExpireMany(context.Background(), []string{"encoded-1", "encoded-2"}, 3600)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, updated)
+
+	verify := func(fss *LogStructuredFS) {
+		for _, key := range []string{"encoded-1", "encoded-2"} {
+			_, seg, err := fss.FetchSegment(key)
+			if !assert.NoError(t, err, key) {
+				continue
+			}
+			variant, err := seg.ToVariant()
+			assert.NoError(t, err)
+			assert.Equal(t, value, variant.Value)
+			ttl, _ := seg.ExpiresIn()
+			assert.InDelta(t, 3600, ttl, 2)
+		}
+	}
+	verify(fss)
+
+	fss.StopExpireLoop()
+	assert.NoError(t, fss.CloseFS())
+
+	// 删除索引快照之后通过重放 region 恢复，重新写入的记录必须能通过校验
+	assert.NoError(t, os.Remove(filepath.Join(path, defaultIndexFileName)))
+	recovered, err := OpenFS(&Options{
+		FSPerm:    conf.FSPerm,
+		Path:      path,
+		Threshold: 1,
+	})
+	assert.NoError(t, err)
+	defer recovered.StopExpireLoop()
+	verify(recovered)
+}
+
+func TestParallelRecovery(t *testing.T) {
+	path := t.TempDir()
+	fss, err := OpenFS(&Options{
+		FSPerm:    conf.FSPerm,
+		Path:      path,
+		Threshold: 1,
+	})
+	assert.NoError(t, err)
+	defer fss.StopExpireLoop()
+
+	fss.regionThreshold = 1024
+
+	// 同一个 key 在多个 region 中被覆盖和删除，恢复结果必须以最后一次写入为准
+	for round := 0; round < 5; round++ {
+		for i := 0; i < 20; i++ {
+			key := fmt.Sprintf("recovery-key-%d", i)
+			seg, err := NewSegment(key, types.NewVariant(int64(round*100+i)), 0)
+			assert.NoError(t, err)
+			assert.NoError(t, fss.PutSegment(key, seg))
+
+			if (i+round)%3 == 0 {
+				assert.NoError(t, fss.DeleteSegment(key))
+			}
+		}
+	}
+
+	assert.Greater(t, len(fss.regions), 5)
+
+	// 不调用 CloseFS 模拟崩溃，分别使用串行和并行的方式全局扫描 region 恢复索引
+	reopen := func(workers int) *LogStructuredFS {
+		recovered, err := OpenFS(&Options{
+			FSPerm:          conf.FSPerm,
+			Path:            path,
+			Threshold:       1,
+			RecoveryWorkers: workers,
+		})
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		return recovered
+	}
+
+	sequential := reopen(1)
+	defer sequential.StopExpireLoop()
+
+	parallel := reopen(4)
+	defer parallel.StopExpireLoop()
+
+	for i := 0; i < shard; i++ {
+		assert.Equal(t, len(fss.indexs[i].index), len(sequential.indexs[i].index))
+		assert.Equal(t, sequential.indexs[i].index, parallel.indexs[i].index)
+
+		for inum, node := range fss.indexs[i].index {
+			if assert.Contains(t, parallel.indexs[i].index, inum) {
+				assert.Equal(t, node.RegionId, parallel.indexs[i].index[inum].RegionId)
+				assert.Equal(t, node.Position, parallel.indexs[i].index[inum].Position)
+			}
+		}
+	}
+}
+
+func TestCompareAndSwapSegment(t *testing.T) {
+	fss, err := OpenFS(&Options{
+		FSPerm:    conf.FSPerm,
+		Path:      t.TempDir(),
+		Threshold: 1,
+	})
+	assert.NoError(t, err)
+	defer fss.StopExpireLoop()
+
+	seg, err := NewSegment("cas-key", types.NewList("a"), 0)
+	assert.NoError(t, err)
+
+	// 不存在的 key 不能 CAS
+	ok, err := fss.CompareAndSwapSegment("cas-key", 0, seg)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	assert.NoError(t, fss.PutSegment("cas-key", seg))
+
+	version, _, err := fss.FetchSegment("cas-key")
+	assert.NoError(t, err)
+
+	next, err := NewSegment("cas-key", types.NewList("a", "b"), 0)
+	assert.NoError(t, err)
+
+	ok, err = fss.CompareAndSwapSegment("cas-key", version, next)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	// 旧的版本号已经失效
+	ok, err = fss.CompareAndSwapSegment("cas-key", version, seg)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	current, fetched, err := fss.FetchSegment("cas-key")
+	assert.NoError(t, err)
+	assert.Equal(t, version+1, current)
+
+	list, err := fetched.ToList()
+	assert.NoError(t, err)
+	assert.Equal(t, []any{"a", "b"}, list.List)
+}
+
+func TestMaxValueAge(t *testing.T) {
+	fss, err := OpenFS(&Options{
+		FSPerm:      conf.FSPerm,
+		Path:        t.TempDir(),
+		Threshold:   1,
+		MaxValueAge: 300 * time.Millisecond,
+	})
+	assert.NoError(t, err)
+	defer fss.StopExpireLoop()
+
+	keys := []string{"retention-1", "retention-2", "retention-3"}
+	for _, key := range keys {
+		seg, err := NewSegment(key, types.NewVariant(key), 0)
+		assert.NoError(t, err)
+		assert.NoError(t, fss.PutSegment(key, seg))
+	}
+
+	lock, err := NewSegment("retention-lock", types.NewLeaseLock(), 0)
+	assert.NoError(t, err)
+	assert.NoError(t, fss.PutSegment("retention-lock", lock))
+
+	// 期限之内可以正常读取
+	_, _, err = fss.FetchSegment("retention-1")
+	assert.NoError(t, err)
+
+	// 缩短后台过期检查的周期，不通过 FetchSegment 触发淘汰
+	fss.expireLoopWorker.Reset(50 * time.Millisecond)
+
+	indexed := func(key string) bool {
+		inum := keyHash(key)
+		imap := fss.indexs[inum%uint64(shard)]
+		imap.mu.RLock()
+		defer imap.mu.RUnlock()
+		_, ok := imap.index[inum]
+		return ok
+	}
+
+	assert.Eventually(t, func() bool {
+		for _, key := range keys {
+			if indexed(key) {
+				return false
+			}
+		}
+		return true
+	}, 2*time.Second, 50*time.Millisecond)
+
+	// 没有开启 MaxValueAgeLocks，租约锁不受数据保留期限的影响
+	assert.True(t, indexed("retention-lock"))
+	_, _, err = fss.FetchSegment("retention-lock")
+	assert.NoError(t, err)
+
+	// 新写入的数据重新计算创建时间，恢复后台检查的周期，由 FetchSegment 发现过期
+	fss.expireLoopWorker.Reset(time.Hour)
+	seg, err := NewSegment("retention-1", types.NewVariant("fresh"), 0)
+	assert.NoError(t, err)
+	assert.NoError(t, fss.PutSegment("retention-1", seg))
+	_, _, err = fss.FetchSegment("retention-1")
+	assert.NoError(t, err)
+
+	time.Sleep(350 * time.Millisecond)
+	_, _, err = fss.FetchSegment("retention-1")
+	assert.ErrorIs(t, err, ErrSegmentExpired)
+}
+
+func TestConditionalWritesMaxValueAge(t *testing.T) {
+	fss, err := OpenFS(&Options{
+		FSPerm:      conf.FSPerm,
+		Path:        t.TempDir(),
+		Threshold:   1,
+		MaxValueAge: 200 * time.Millisecond,
+	})
+	assert.NoError(t, err)
+	defer fss.StopExpireLoop()
+
+	// 关闭后台的过期检查，超过期限的 inode 仍然留在索引中
+	fss.expireLoopWorker.Reset(time.Hour)
+
+	put := func(key string, value any) *Segment {
+		seg, err := NewSegment(key, types.NewVariant(value), 0)
+		assert.NoError(t, err)
+		return seg
+	}
+
+	for _, key := range []string{"aged-nx", "aged-cas", "aged-swap", "aged-delete", "aged-expire"} {
+		assert.NoError(t, fss.PutSegment(key, put(key, "old")))
+	}
+
+	acquisitions := func(key string) uint64 {
+		return fss.indexs[keyHash(key)%uint64(shard)].acquisitions.Load()
+	}
+
+	time.Sleep(250 * time.Millisecond)
+
+	// 超过 MaxValueAge 的 key 和读取时一样当作不存在
+	before := acquisitions("aged-nx")
+	ok, err := fss.PutSegmentIfAbsent("aged-nx", put("aged-nx", "new"))
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Greater(t, acquisitions("aged-nx"), before)
+
+	before = acquisitions("aged-cas")
+	ok, err = fss.CompareAndSwapSegment("aged-cas", 0, put("aged-cas", "new"))
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	assert.Greater(t, acquisitions("aged-cas"), before)
+
+	before = acquisitions("aged-swap")
+	previous, err := fss.Swap("aged-swap", put("aged-swap", "new"), false)
+	assert.NoError(t, err)
+	assert.Nil(t, previous)
+	assert.Greater(t, acquisitions("aged-swap"), before)
+
+	ok, err = fss.DeleteIf("aged-delete", func(*Segment) (bool, error) { return true, nil })
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	ok, err = fss.Expire("aged-expire", 3600)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	_, seg, err := fss.FetchSegment("aged-nx")
+	assert.NoError(t, err)
+	variant, err := seg.ToVariant()
+	assert.NoError(t, err)
+	assert.Equal(t, "new", variant.Value)
+}
+
+func TestSkipCRCOnRead(t *testing.T) {
+	defer skipCRCOnRead.Store(false)
+
+	fss, err := OpenFS(&Options{
+		FSPerm:        conf.FSPerm,
+		Path:          t.TempDir(),
+		Threshold:     1,
+		SkipCRCOnRead: true,
+	})
+	assert.NoError(t, err)
+	defer fss.StopExpireLoop()
+
+	key := "crc-key"
+	seg, err := NewSegment(key, types.NewVariant("hello world"), 0)
+	assert.NoError(t, err)
+	assert.NoError(t, fss.PutSegment(key, seg))
+
+	inum := keyHash(key)
+	inode := fss.indexs[inum%uint64(shard)].index[inum]
+
+	// 修改 value 中的一个字节，msgpack 编码之后的字符串仍然可以正常解码
+	fd, err := os.OpenFile(fss.regions[inode.RegionId].Fd.Name(), os.O_RDWR, conf.FSPerm)
+	assert.NoError(t, err)
+	_, err = fd.WriteAt([]byte("j"), inode.Position+_SEGMENT_PADDING+int64(len(key))+1)
+	assert.NoError(t, err)
+	assert.NoError(t, fd.Close())
+
+	// 跳过校验的时候损坏的数据不会被发现，这是开启这个选项需要承担的代价
+	_, seg, err = fss.FetchSegment(key)
+	if assert.NoError(t, err) {
+		variant, err := seg.ToVariant()
+		assert.NoError(t, err)
+		assert.Equal(t, "jello world", variant.Value)
+	}
+
+	skipCRCOnRead.Store(false)
+	_, _, err = fss.FetchSegment(key)
+	assert.ErrorContains(t, err, "checksum mismatch")
+}
+
+func BenchmarkReadSegmentSkipCRC(b *testing.B) {
+	defer skipCRCOnRead.Store(false)
+
+	seg, err := NewSegment("bench-key", types.NewVariant(string(bytes.Repeat([]byte("v"), 16*kb))), 0)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	data, err := seg.Serialize()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for _, skip := range []bool{false, true} {
+		b.Run(fmt.Sprintf("skip_crc=%v", skip), func(b *testing.B) {
+			skipCRCOnRead.Store(skip)
+			reader := bytes.NewReader(data)
+			b.SetBytes(int64(len(data)))
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				_, _, err := readSegment(reader, 0, _SEGMENT_PADDING)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkRecoveryReadahead(b *testing.B) {
+	path := b.TempDir()
+	fss, err := OpenFS(&Options{
+		FSPerm:    conf.FSPerm,
+		Path:      path,
+		Threshold: 1,
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	// 一个大约 32MB 的 region，每个 segment 只有几百字节，逐个 ReadAt 解析的时候会产生大量的小读取
+	value := string(bytes.Repeat([]byte("v"), 256))
+	for i := 0; i < 100000; i++ {
+		key := fmt.Sprintf("recovery-key-%d", i)
+		seg, err := NewSegment(key, types.NewVariant(value), 0)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if err := fss.PutSegment(key, seg); err != nil {
+			b.Fatal(err)
+		}
+	}
+	fss.StopExpireLoop()
+	if err := fss.CloseFS(); err != nil {
+		b.Fatal(err)
+	}
+
+	files, err := globFiles(OSFilesystem{}, path, defaultFileExtension)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	var size int64
+	regions := make(map[int64]*Region)
+	for _, file := range files {
+		id, err := parseDataFileName(filepath.Base(file), defaultFileExtension)
+		if err != nil {
+			continue
+		}
+		fd, err := os.Open(file)
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer fd.Close()
+
+		stat, err := fd.Stat()
+		if err != nil {
+			b.Fatal(err)
+		}
+		size += stat.Size()
+		regions[id] = &Region{Fd: fd}
+	}
+
+	for _, readahead := range []bool{false, true} {
+		b.Run(fmt.Sprintf("readahead=%v", readahead), func(b *testing.B) {
+			b.SetBytes(size)
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				indexs := make([]*indexMap, shard)
+				for j := range indexs {
+					indexs[j] = &indexMap{index: make(map[uint64]*inode)}
+				}
+				if err := crashRecoveryAllIndex(regions, indexs, 1, readahead); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestCompactOnDiskPressure(t *testing.T) {
+	var free atomic.Uint64
+	free.Store(10 * gb)
+
+	compacted := make(chan CompactStats, 16)
+	fss, err := OpenFS(&Options{
+		FSPerm:                        conf.FSPerm,
+		Path:                          t.TempDir(),
+		Threshold:                     1,
+		CompactWhenFreeDiskBelowBytes: 1 * gb,
+		DiskPressureInterval:          20 * time.Millisecond,
+		DiskFree: func(path string) (uint64, error) {
+			return free.Load(), nil
+		},
+		CompactCallback: func(stats CompactStats) {
+			compacted <- stats
+		},
+	})
+	assert.NoError(t, err)
+	defer fss.StopExpireLoop()
+	defer fss.StopDiskPressureMonitor()
+
+	// 可用空间充足的时候不会触发垃圾回收
+	select {
+	case <-compacted:
+		t.Fatal("compaction should not run while free disk space is above threshold")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	free.Store(512 * mb)
+
+	select {
+	case <-compacted:
+	case <-time.After(2 * time.Second):
+		t.Fatal("compaction was not triggered by disk pressure")
+	}
+}
+
+func TestExpiringWithin(t *testing.T) {
+	fss, err := OpenFS(&Options{
+		FSPerm:    conf.FSPerm,
+		Path:      t.TempDir(),
+		Threshold: 1,
+	})
+	assert.NoError(t, err)
+	defer fss.StopExpireLoop()
+
+	ttls := map[string]int64{
+		"expiring-5":        5,
+		"expiring-30":       30,
+		"expiring-120":      120,
+		"expiring-immortal": 0,
+	}
+	for key, ttl := range ttls {
+		seg, err := NewSegment(key, types.NewVariant(key), ttl)
+		assert.NoError(t, err)
+		assert.NoError(t, fss.PutSegment(key, seg))
+	}
+
+	keys, err := fss.ExpiringWithin(context.Background(), time.Minute)
+	assert.NoError(t, err)
+
+	// 只返回窗口内的 key，并且按照剩余时长从短到长排序
+	if assert.Len(t, keys, 2) {
+		assert.Equal(t, "expiring-5", keys[0].Key)
+		assert.Equal(t, keyHash("expiring-5"), keys[0].Inum)
+		assert.InDelta(t, 5*time.Second, keys[0].TTL, float64(time.Second))
+		assert.Equal(t, "expiring-30", keys[1].Key)
+		assert.InDelta(t, 30*time.Second, keys[1].TTL, float64(time.Second))
+	}
+
+	keys, err = fss.ExpiringWithin(context.Background(), time.Second)
+	assert.NoError(t, err)
+	assert.Empty(t, keys)
+
+	// 取消之后不再扫描索引
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = fss.ExpiringWithin(ctx, time.Minute)
+	assert.ErrorIs(t, err, context.Canceled)
+
+	updated, err := fss.ExpireMany(ctx, []string{"expiring-5"}, 60)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, 0, updated)
+}
+
+func TestHistory(t *testing.T) {
+	fss, err := OpenFS(&Options{
+		FSPerm:    conf.FSPerm,
+		Path:      t.TempDir(),
+		Threshold: 1,
+	})
+	assert.NoError(t, err)
+	defer fss.StopExpireLoop()
+
+	// 缩小 region 的阈值，让历史版本分布在多个 region 中
+	fss.regionThreshold = 256
+
+	for i := 1; i <= 3; i++ {
+		seg, err := NewSegment("history-key", types.NewVariant(fmt.Sprintf("v%d", i)), 0)
+		assert.NoError(t, err)
+		assert.NoError(t, fss.PutSegment("history-key", seg))
+
+		// 其他的 key 不应该出现在历史版本中
+		other, err := NewSegment("history-key-other", types.NewVariant(int64(i)), 0)
+		assert.NoError(t, err)
+		assert.NoError(t, fss.PutSegment("history-key-other", other))
+	}
+
+	assert.Greater(t, len(fss.regions), 1)
+
+	versions, err := fss.History("history-key", 0)
+	assert.NoError(t, err)
+	if assert.Len(t, versions, 3) {
+		for i, expected := range []string{"v3", "v2", "v1"} {
+			assert.Equal(t, "history-key", versions[i].Segment.KeyString())
+			assert.False(t, versions[i].Deleted)
+
+			variant, err := versions[i].Segment.ToVariant()
+			assert.NoError(t, err)
+			assert.Equal(t, expected, variant.Value)
+		}
+		assert.GreaterOrEqual(t, versions[0].CreatedAt, versions[1].CreatedAt)
+		assert.GreaterOrEqual(t, versions[1].CreatedAt, versions[2].CreatedAt)
+	}
+
+	versions, err = fss.History("history-key", 2)
+	assert.NoError(t, err)
+	assert.Len(t, versions, 2)
+
+	// 删除操作写入的 tombstone 作为最新的版本返回
+	assert.NoError(t, fss.DeleteSegment("history-key"))
+	versions, err = fss.History("history-key", 1)
+	assert.NoError(t, err)
+	if assert.Len(t, versions, 1) {
+		assert.True(t, versions[0].Deleted)
+	}
+
+	versions, err = fss.History("history-missing", 0)
+	assert.NoError(t, err)
+	assert.Empty(t, versions)
+}
+
+func TestHistoryConcurrentWrites(t *testing.T) {
+	fss, err := OpenFS(&Options{
+		FSPerm:    conf.FSPerm,
+		Path:      t.TempDir(),
+		Threshold: 1,
+	})
+	assert.NoError(t, err)
+	defer fss.StopExpireLoop()
+
+	fss.regionThreshold = 512
+
+	// 扫描期间写入仍然在追加活跃 region 和切换 region，History 不能读到写了一半的 segment
+	const writes = 200
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 1; i <= writes; i++ {
+			seg, err := NewSegment("history-key", types.NewVariant(int64(i)), 0)
+			assert.NoError(t, err)
+			assert.NoError(t, fss.PutSegment("history-key", seg))
+		}
+	}()
+
+	last := 0
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+
+		versions, err := fss.History("history-key", 0)
+		assert.NoError(t, err)
+		assert.GreaterOrEqual(t, len(versions), last)
+		last = len(versions)
+
+		for i, version := range versions {
+			variant, err := version.Segment.ToVariant()
+			assert.NoError(t, err)
+			assert.EqualValues(t, len(versions)-i, variant.Value)
+		}
+	}
+
+	assert.Equal(t, writes, last)
+}
+
+func TestVerifyRegion(t *testing.T) {
+	dir := t.TempDir()
+	fss, err := OpenFS(&Options{
+		FSPerm:    conf.FSPerm,
+		Path:      dir,
+		Threshold: 1,
+	})
+	assert.NoError(t, err)
+	defer fss.StopExpireLoop()
+
+	for i := 0; i < 5; i++ {
+		seg, err := NewSegment(fmt.Sprintf("verify-key-%d", i), types.NewVariant(fmt.Sprintf("value-%d", i)), 0)
+		assert.NoError(t, err)
+		assert.NoError(t, fss.PutSegment(seg.KeyString(), seg))
+	}
+
+	report, err := fss.VerifyRegion(fss.regionId)
+	assert.NoError(t, err)
+	assert.Equal(t, 5, report.Good)
+	assert.Equal(t, 0, report.Corrupt)
+	assert.Equal(t, int64(-1), report.FirstCorruptOffset)
+
+	// 直接修改磁盘上第三条记录 value 中的一个字节
+	inum := keyHash("verify-key-2")
+	target := fss.indexs[inum%uint64(shard)].index[inum]
+
+	name, err := fss.toStringFileName(target.RegionId)
+	assert.NoError(t, err)
+	fd, err := os.OpenFile(filepath.Join(dir, name), os.O_RDWR, conf.FSPerm)
+	assert.NoError(t, err)
+
+	at := target.Position + _SEGMENT_PADDING + int64(len("verify-key-2"))
+	b := make([]byte, 1)
+	_, err = fd.ReadAt(b, at)
+	assert.NoError(t, err)
+	b[0] ^= 0xff
+	_, err = fd.WriteAt(b, at)
+	assert.NoError(t, err)
+	assert.NoError(t, fd.Close())
+
+	// 损坏的记录不会中断扫描，后面的记录仍然被校验
+	report, err = fss.VerifyRegion(target.RegionId)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, report.Good)
+	assert.Equal(t, 1, report.Corrupt)
+	assert.Equal(t, target.Position, report.FirstCorruptOffset)
+	assert.False(t, report.Truncated)
+
+	_, err = fss.VerifyRegion(target.RegionId + 100)
+	assert.ErrorIs(t, err, ErrRegionNotFound)
+}
+
+func TestVerifyOnOpen(t *testing.T) {
+	path := t.TempDir()
+	fss, err := OpenFS(&Options{
+		FSPerm:    conf.FSPerm,
+		Path:      path,
+		Threshold: 1,
+	})
+	assert.NoError(t, err)
+
+	// 缩小 region 的阈值，让损坏的记录落在一个旧的 region 中，正常启动时不会被重放
+	fss.regionThreshold = 256
+
+	for i := 0; i < 10; i++ {
+		seg, err := NewSegment(fmt.Sprintf("verify-open-%d", i), types.NewVariant(fmt.Sprintf("value-%d", i)), 0)
+		assert.NoError(t, err)
+		assert.NoError(t, fss.PutSegment(seg.KeyString(), seg))
+	}
+	assert.Greater(t, len(fss.regions), 1)
+
+	inum := keyHash("verify-open-0")
+	target := fss.indexs[inum%uint64(shard)].index[inum]
+	assert.Less(t, target.RegionId, latestRegionId(fss.indexs))
+
+	fss.StopExpireLoop()
+	assert.NoError(t, fss.ExportSnapshotIndex())
+
+	// 直接修改磁盘上记录 value 中的一个字节
+	name, err := fss.toStringFileName(target.RegionId)
+	assert.NoError(t, err)
+	fd, err := os.OpenFile(filepath.Join(path, name), os.O_RDWR, conf.FSPerm)
+	assert.NoError(t, err)
+
+	at := target.Position + _SEGMENT_PADDING + int64(len("verify-open-0"))
+	b := make([]byte, 1)
+	_, err = fd.ReadAt(b, at)
+	assert.NoError(t, err)
+	b[0] ^= 0xff
+	_, err = fd.WriteAt(b, at)
+	assert.NoError(t, err)
+	assert.NoError(t, fd.Close())
+
+	// 默认只校验 region 文件的头部，损坏的记录不会被发现
+	recovered, err := OpenFS(&Options{
+		FSPerm:    conf.FSPerm,
+		Path:      path,
+		Threshold: 1,
+	})
+	if assert.NoError(t, err) {
+		recovered.StopExpireLoop()
+	}
+
+	_, err = OpenFS(&Options{
+		FSPerm:       conf.FSPerm,
+		Path:         path,
+		Threshold:    1,
+		VerifyOnOpen: true,
+	})
+	assert.ErrorIs(t, err, ErrCorruptRegion)
+	assert.ErrorContains(t, err, fmt.Sprintf("region %d has 1 corrupt records, first at offset %d", target.RegionId, target.Position))
+}
+
+func TestTopKeys(t *testing.T) {
+	_, err := new(LogStructuredFS).TopKeys(3, true)
+	assert.ErrorIs(t, err, ErrAccessStatsDisabled)
+
+	fss, err := OpenFS(&Options{
+		FSPerm:           conf.FSPerm,
+		Path:             t.TempDir(),
+		Threshold:        1,
+		TrackAccessStats: true,
+	})
+	assert.NoError(t, err)
+	defer fss.StopExpireLoop()
+
+	// 缩小 region 的阈值，让垃圾回收有旧的 region 可以迁移
+	fss.regionThreshold = 256
+
+	for i := 0; i < 20; i++ {
+		seg, err := NewSegment(fmt.Sprintf("access-key-%d", i), types.NewVariant(int64(i)), 0)
+		assert.NoError(t, err)
+		assert.NoError(t, fss.PutSegment(seg.KeyString(), seg))
+	}
+
+	// access-key-3 读取最多，access-key-7 次之，access-key-11 写入最多
+	hot := map[string]int{"access-key-3": 300, "access-key-7": 200, "access-key-11": 12}
+	var wg sync.WaitGroup
+	for key, times := range hot {
+		for w := 0; w < 4; w++ {
+			wg.Add(1)
+			go func(key string, times int) {
+				defer wg.Done()
+				for i := 0; i < times/4; i++ {
+					_, seg, err := fss.FetchSegment(key)
+					assert.NoError(t, err)
+					seg.ReleaseToPool()
+				}
+			}(key, times)
+		}
+	}
+	wg.Wait()
+
+	for i := 0; i < 5; i++ {
+		seg, err := NewSegment("access-key-11", types.NewVariant(int64(i)), 0)
+		assert.NoError(t, err)
+		assert.NoError(t, fss.PutSegment(seg.KeyString(), seg))
+	}
+
+	// 垃圾回收迁移之后计数器仍然保留
+	assert.NoError(t, fss.CompactNow())
+
+	stats, err := fss.TopKeys(3, true)
+	assert.NoError(t, err)
+	assert.Equal(t, []KeyStat{
+		{Key: "access-key-3", Reads: 300, Writes: 1},
+		{Key: "access-key-7", Reads: 200, Writes: 1},
+		{Key: "access-key-11", Reads: 12, Writes: 6},
+	}, stats)
+
+	stats, err = fss.TopKeys(1, false)
+	assert.NoError(t, err)
+	assert.Equal(t, []KeyStat{{Key: "access-key-11", Reads: 12, Writes: 6}}, stats)
+
+	// 删除之后计数器一起被删除
+	assert.NoError(t, fss.DeleteSegment("access-key-3"))
+	stats, err = fss.TopKeys(1, true)
+	assert.NoError(t, err)
+	assert.Equal(t, "access-key-7", stats[0].Key)
+}
+
+func TestDeleteIfEquals(t *testing.T) {
+	fss, err := OpenFS(&Options{
+		FSPerm:    conf.FSPerm,
+		Path:      t.TempDir(),
+		Threshold: 1,
+	})
+	assert.NoError(t, err)
+	defer fss.StopExpireLoop()
+
+	put := func(value string) {
+		seg, err := NewSegment("cad-key", types.NewVariant(value), 0)
+		assert.NoError(t, err)
+		assert.NoError(t, fss.PutSegment("cad-key", seg))
+	}
+
+	put("v1")
+	_, seg, err := fss.FetchSegment("cad-key")
+	assert.NoError(t, err)
+	observed := append([]byte(nil), seg.Value...)
+
+	// 读取之后被其他写入者修改，基于旧值的条件删除失败
+	put("v2")
+	deleted, err := fss.DeleteIfEquals("cad-key", observed)
+	assert.NoError(t, err)
+	assert.False(t, deleted)
+	assert.True(t, fss.IsActive("cad-key"))
+
+	// 并发的条件删除只有一个能成功
+	_, seg, err = fss.FetchSegment("cad-key")
+	assert.NoError(t, err)
+	observed = append([]byte(nil), seg.Value...)
+
+	var (
+		wg        sync.WaitGroup
+		successes atomic.Int32
+	)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ok, err := fss.DeleteIfEquals("cad-key", observed)
+			assert.NoError(t, err)
+			if ok {
+				successes.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, int32(1), successes.Load())
+	assert.False(t, fss.IsActive("cad-key"))
+
+	deleted, err = fss.DeleteIfEquals("cad-missing", observed)
+	assert.NoError(t, err)
+	assert.False(t, deleted)
+}
+
+func TestCompactRegionWithPipeline(t *testing.T) {
+	path := t.TempDir()
+	fss, err := OpenFS(&Options{
+		FSPerm:    conf.FSPerm,
+		Path:      path,
+		Threshold: 1,
+	})
+	assert.NoError(t, err)
+
+	fss.SetCompressor(SnappyCompressor)
+	defer func() { pipeline = NewPipeline() }()
+
+	fss.regionThreshold = 512
+
+	expected := make(map[string]string)
+	for i := 0; i < 24; i++ {
+		key := fmt.Sprintf("compressed-key-%d", i)
+		value := strings.Repeat(fmt.Sprintf("value-%d-", i), 8)
+		seg, err := NewSegment(key, types.NewVariant(value), 0)
+		assert.NoError(t, err)
+		assert.NoError(t, fss.PutSegment(key, seg))
+		expected[key] = value
+	}
+
+	first := tailRegionIds(fss.regions, 0)[0]
+	assert.NotEqual(t, fss.regionId, first)
+
+	// 迁移的时候 value 需要重新压缩，否则迁移之后的记录长度和 CRC32 都和磁盘上的数据不一致
+	assert.NoError(t, fss.CompactRegion(first))
+	assert.NotContains(t, fss.regions, first)
+
+	verify := func(fss *LogStructuredFS) {
+		for key, value := range expected {
+			_, seg, err := fss.FetchSegment(key)
+			if !assert.NoError(t, err, key) {
+				continue
+			}
+			variant, err := seg.ToVariant()
+			assert.NoError(t, err)
+			assert.Equal(t, value, variant.Value, key)
+		}
+	}
+	verify(fss)
+
+	// 写满之后切换出去的 region 的文件描述符已经关闭了，CloseFS 同步这些文件的时候会返回错误，这里不关心
+	fss.StopExpireLoop()
+	_ = fss.CloseFS()
+
+	// 删除索引快照之后通过重放 region 恢复，迁移之后的记录必须能通过校验
+	assert.NoError(t, os.Remove(filepath.Join(path, defaultIndexFileName)))
+	recovered, err := OpenFS(&Options{
+		FSPerm:    conf.FSPerm,
+		Path:      path,
+		Threshold: 1,
+	})
+	assert.NoError(t, err)
+	defer recovered.StopExpireLoop()
+	verify(recovered)
+}
+
+func TestCompactRegion(t *testing.T) {
+	path := t.TempDir()
+	fss, err := OpenFS(&Options{
+		FSPerm:    conf.FSPerm,
+		Path:      path,
+		Threshold: 1,
+	})
+	assert.NoError(t, err)
+	defer fss.StopExpireLoop()
+
+	fss.regionThreshold = 256
+
+	put := func(key, value string) {
+		seg, err := NewSegment(key, types.NewVariant(value), 0)
+		assert.NoError(t, err)
+		assert.NoError(t, fss.PutSegment(key, seg))
+	}
+
+	for i := 0; i < 12; i++ {
+		put(fmt.Sprintf("compact-key-%d", i), "v1")
+	}
+
+	// 第一个 region 中的 key 除了一个之外全部被覆盖，成为一个大部分都是垃圾数据的 region
+	inum := keyHash("compact-key-0")
+	target := fss.indexs[inum%uint64(shard)].index[inum].RegionId
+	var live string
+	for i := 0; i < 12; i++ {
+		key := fmt.Sprintf("compact-key-%d", i)
+		h := keyHash(key)
+		if fss.indexs[h%uint64(shard)].index[h].RegionId != target {
+			continue
+		}
+		if live == "" {
+			live = key
+			continue
+		}
+		put(key, "v2")
+	}
+	assert.NotEmpty(t, live)
+
+	regionSize := func(id int64) (int64, error) {
+		name, err := fss.toStringFileName(id)
+		if err != nil {
+			return 0, err
+		}
+		stat, err := os.Stat(filepath.Join(path, name))
+		if err != nil {
+			return 0, err
+		}
+		return stat.Size(), nil
+	}
+
+	sizes := make(map[int64]int64)
+	for id := range fss.regions {
+		if id == target || id == fss.regionId {
+			continue
+		}
+		sizes[id], err = regionSize(id)
+		assert.NoError(t, err)
+	}
+	assert.NotEmpty(t, sizes)
+
+	assert.ErrorIs(t, fss.CompactRegion(fss.regionId), ErrActiveRegion)
+	assert.ErrorIs(t, fss.CompactRegion(target+1000), ErrRegionNotFound)
+
+	assert.NoError(t, fss.CompactRegion(target))
+
+	_, ok := fss.regions[target]
+	assert.False(t, ok)
+	_, err = regionSize(target)
+	assert.True(t, os.IsNotExist(err))
+
+	// 其他的旧 region 没有被修改
+	for id, size := range sizes {
+		actual, err := regionSize(id)
+		assert.NoError(t, err)
+		assert.Equal(t, size, actual)
+	}
+
+	// 有效的数据被迁移到活跃 region 中，其他 key 仍然可以读取
+	for i := 0; i < 12; i++ {
+		key := fmt.Sprintf("compact-key-%d", i)
+		_, seg, err := fss.FetchSegment(key)
+		if assert.NoError(t, err, key) {
+			variant, err := seg.ToVariant()
+			assert.NoError(t, err)
+			if key == live {
+				assert.Equal(t, "v1", variant.Value)
+			}
+		}
+	}
+	h := keyHash(live)
+	assert.NotEqual(t, target, fss.indexs[h%uint64(shard)].index[h].RegionId)
+}
+
+func TestScanMeta(t *testing.T) {
+	fss, err := OpenFS(&Options{
+		FSPerm:    conf.FSPerm,
+		Path:      t.TempDir(),
+		Threshold: 1,
+	})
+	assert.NoError(t, err)
+	defer fss.StopExpireLoop()
+
+	expected := make(map[string]string)
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("meta-variant-%d", i)
+		seg, err := NewSegment(key, types.NewVariant(int64(i)), 0)
+		assert.NoError(t, err)
+		assert.NoError(t, fss.PutSegment(key, seg))
+		expected[key] = "VARIANT"
+	}
+
+	seg, err := NewSegment("meta-table", types.NewTable(), 60)
+	assert.NoError(t, err)
+	assert.NoError(t, fss.PutSegment("meta-table", seg))
+	expected["meta-table"] = "TABLE"
+
+	// 删除和已经过期的 key 不会被遍历到
+	assert.NoError(t, fss.DeleteSegment("meta-variant-0"))
+	delete(expected, "meta-variant-0")
+
+	inum := keyHash("meta-variant-1")
+	atomic.StoreInt64(&fss.indexs[inum%uint64(shard)].index[inum].ExpiredAt, time.Now().Add(-time.Second).UnixMicro())
+	delete(expected, "meta-variant-1")
+
+	visited := make(map[string]string)
+	err = fss.ScanMeta(func(key string, kind string, createdAt, expiredAt int64) bool {
+		visited[key] = kind
+		assert.Greater(t, createdAt, int64(0))
+		if key == "meta-table" {
+			assert.Greater(t, expiredAt, time.Now().UnixMicro())
+		}
+		return true
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, expected, visited)
+
+	count := 0
+	err = fss.ScanMeta(func(string, string, int64, int64) bool {
+		count++
+		return count < 3
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, count)
+}
+
+func TestDeleteByKind(t *testing.T) {
+	fss, err := OpenFS(&Options{
+		FSPerm:    conf.FSPerm,
+		Path:      t.TempDir(),
+		Threshold: 1,
+	})
+	assert.NoError(t, err)
+	defer fss.StopExpireLoop()
+
+	put := func(key string, value Serializable) {
+		seg, err := NewSegment(key, value, 0)
+		assert.NoError(t, err)
+		assert.NoError(t, fss.PutSegment(key, seg))
+	}
+
+	for i := 0; i < 5; i++ {
+		put(fmt.Sprintf("lock-%d", i), types.NewLeaseLock())
+		put(fmt.Sprintf("variant-%d", i), types.NewVariant(int64(i)))
+	}
+	put("table", types.NewTable())
+
+	// 没有过期的不可变 key 会被跳过
+	immutable, err := NewSegment("lock-immutable", types.NewLeaseLock(), 0)
+	assert.NoError(t, err)
+	immutable.Immutable = true
+	assert.NoError(t, fss.PutSegment("lock-immutable", immutable))
+
+	deleted, err := fss.DeleteByKind(_LEASELOCK)
+	assert.NoError(t, err)
+	assert.Equal(t, 5, deleted)
+
+	kinds := make(map[string]int)
+	err = fss.ScanMeta(func(key string, kind string, createdAt, expiredAt int64) bool {
+		kinds[kind]++
+		return true
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int{"LEASELOCK": 1, "VARIANT": 5, "TABLE": 1}, kinds)
+
+	deleted, err = fss.DeleteByType("variant")
+	assert.NoError(t, err)
+	assert.Equal(t, 5, deleted)
+	assert.False(t, fss.IsActive("variant-0"))
+	assert.True(t, fss.IsActive("table"))
+
+	_, err = fss.DeleteByType("unknown")
+	assert.ErrorIs(t, err, ErrUnknownKind)
+}
+
+func BenchmarkScanMetaLargeValues(b *testing.B) {
+	fss, err := OpenFS(&Options{
+		FSPerm:    conf.FSPerm,
+		Path:      b.TempDir(),
+		Threshold: 1,
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer fss.StopExpireLoop()
+
+	value := string(bytes.Repeat([]byte("v"), 256*kb))
+	for i := 0; i < 200; i++ {
+		key := fmt.Sprintf("bench-meta-%d", i)
+		seg, err := NewSegment(key, types.NewVariant(value), 0)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if err := fss.PutSegment(key, seg); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	b.Run("scan_meta", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			err := fss.ScanMeta(func(string, string, int64, int64) bool { return true })
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("full_decode", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			fss.mu.RLock()
+			for _, imap := range fss.indexs {
+				imap.mu.RLock()
+				for _, inode := range imap.index {
+					_, seg, err := fss.readInode(inode)
+					if err != nil {
+						b.Fatal(err)
+					}
+					if _, err := seg.ToVariant(); err != nil {
+						b.Fatal(err)
+					}
+				}
+				imap.mu.RUnlock()
+			}
+			fss.mu.RUnlock()
+		}
+	})
+}
+
+func TestSwap(t *testing.T) {
+	fss, err := OpenFS(&Options{
+		FSPerm:    conf.FSPerm,
+		Path:      t.TempDir(),
+		Threshold: 1,
+	})
+	assert.NoError(t, err)
+	defer fss.StopExpireLoop()
+
+	variant := func(value string, ttl int64) *Segment {
+		seg, err := NewSegment("swap-key", types.NewVariant(value), ttl)
+		assert.NoError(t, err)
+		return seg
+	}
+
+	// 不存在的 key 返回 nil
+	previous, err := fss.Swap("swap-key", variant("initial", 60), false)
+	assert.NoError(t, err)
+	assert.Nil(t, previous)
+
+	_, seg, err := fss.FetchSegment("swap-key")
+	assert.NoError(t, err)
+	expiredAt := seg.ExpiredAt
+
+	// 保留旧值的过期时间
+	previous, err = fss.Swap("swap-key", variant("kept", 0), true)
+	assert.NoError(t, err)
+	if assert.NotNil(t, previous) {
+		v, err := previous.ToVariant()
+		assert.NoError(t, err)
+		assert.Equal(t, "initial", v.Value)
+	}
+
+	_, seg, err = fss.FetchSegment("swap-key")
+	assert.NoError(t, err)
+	assert.Equal(t, expiredAt, seg.ExpiredAt)
+
+	// 重置为新值自己的过期时间
+	_, err = fss.Swap("swap-key", variant("reset", 0), false)
+	assert.NoError(t, err)
+	_, seg, err = fss.FetchSegment("swap-key")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(ImmortalTTL), seg.ExpiredAt)
+
+	list, err := NewSegment("swap-key", types.NewList("a"), 0)
+	assert.NoError(t, err)
+	_, err = fss.Swap("swap-key", list, false)
+	assert.ErrorIs(t, err, ErrTypeMismatch)
+
+	// 并发的 swap 每一个都拿到不同的旧值，所有写入的值要么被某一个 swap 返回，要么是最终的值，没有丢失的更新
+	const workers, swaps = 8, 50
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		seen = make(map[string]int)
+	)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < swaps; i++ {
+				previous, err := fss.Swap("swap-key", variant(fmt.Sprintf("w%d-%d", w, i), 0), false)
+				if !assert.NoError(t, err) || !assert.NotNil(t, previous) {
+					return
+				}
+				v, err := previous.ToVariant()
+				assert.NoError(t, err)
+				mu.Lock()
+				seen[v.Value.(string)]++
+				mu.Unlock()
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	_, seg, err = fss.FetchSegment("swap-key")
+	assert.NoError(t, err)
+	final, err := seg.ToVariant()
+	assert.NoError(t, err)
+	seen[final.Value.(string)]++
+
+	assert.Len(t, seen, workers*swaps+1)
+	assert.Equal(t, 1, seen["reset"])
+	for value, count := range seen {
+		assert.Equal(t, 1, count, "value %s", value)
+	}
+}
+
+func TestRejectSegmentLargerThanRegion(t *testing.T) {
+	fss, err := OpenFS(&Options{
+		FSPerm:    conf.FSPerm,
+		Path:      t.TempDir(),
+		Threshold: 1,
+	})
+	assert.NoError(t, err)
+	defer fss.StopExpireLoop()
+
+	// 缩小 region 的阈值，方便构造超过 region 大小的数据
+	fss.regionThreshold = 4 << 10
+
+	small, err := NewSegment("small-key", types.NewVariant("ok"), 0)
+	assert.NoError(t, err)
+	assert.NoError(t, fss.PutSegment("small-key", small))
+
+	large, err := NewSegment("large-key", types.NewVariant(strings.Repeat("x", 8<<10)), 0)
+	assert.NoError(t, err)
+
+	regionId, offset := fss.regionId, fss.offset
+
+	err = fss.PutSegment("large-key", large)
+	assert.ErrorIs(t, err, ErrSegmentTooLarge)
+
+	_, err = fss.PutSegmentIfAbsent("large-key", large)
+	assert.ErrorIs(t, err, ErrSegmentTooLarge)
+
+	_, err = fss.CompareAndSwapSegment("small-key", 0, large)
+	assert.ErrorIs(t, err, ErrSegmentTooLarge)
+
+	_, err = fss.Swap("large-key", large, false)
+	assert.ErrorIs(t, err, ErrSegmentTooLarge)
+
+	err = fss.CommitTxns(map[string]*Snapshot{
+		"small-key": NewSnapshot(small, 0),
+		"large-key": NewSnapshot(large, 0),
+	})
+	assert.ErrorIs(t, err, ErrSegmentTooLarge)
+
+	// 被拒绝的写入不会在 region 中留下任何数据
+	assert.Equal(t, regionId, fss.regionId)
+	assert.Equal(t, offset, fss.offset)
+	assert.False(t, fss.IsActive("large-key"))
+
+	version, _, err := fss.FetchSegment("small-key")
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(0), version)
+}
+
+func TestRecoverAfterCompactWithoutClose(t *testing.T) {
+	path := t.TempDir()
+	fss, err := OpenFS(&Options{
+		FSPerm:    conf.FSPerm,
+		Path:      path,
+		Threshold: 1,
+	})
+	assert.NoError(t, err)
+	defer fss.StopExpireLoop()
+
+	fss.regionThreshold = 256
+
+	put := func(key, value string) {
+		seg, err := NewSegment(key, types.NewVariant(value), 0)
+		assert.NoError(t, err)
+		assert.NoError(t, fss.PutSegment(key, seg))
+	}
+
+	for i := 0; i < 8; i++ {
+		put(fmt.Sprintf("crash-key-%d", i), "v1")
+	}
+
+	// 后台定时生成的快照，之后的垃圾回收会删除其中引用的 region
+	assert.NoError(t, fss.ExportSnapshotIndex())
+
+	// 删除产生的 tombstone 落在较早的 region 中，垃圾回收的时候和这个 region 一起被删除
+	assert.NoError(t, fss.DeleteSegment("crash-key-0"))
+
+	for i := 0; i < 24; i++ {
+		put(fmt.Sprintf("crash-filler-%d", i), "v1")
+	}
+
+	inum := keyHash("crash-key-1")
+	oldest := fss.indexs[inum%uint64(shard)].index[inum].RegionId
+	assert.NoError(t, fss.CompactNow())
+	_, ok := fss.regions[oldest]
+	assert.False(t, ok)
+
+	// 模拟进程崩溃，没有调用 CloseFS 导出最新的索引快照
+	recovered, err := OpenFS(&Options{
+		FSPerm:    conf.FSPerm,
+		Path:      path,
+		Threshold: 1,
+	})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer recovered.StopExpireLoop()
+
+	// 旧的快照中仍然有被删除的 key，它指向的 region 已经不存在了
+	assert.False(t, recovered.IsActive("crash-key-0"))
+
+	for i := 1; i < 8; i++ {
+		key := fmt.Sprintf("crash-key-%d", i)
+		_, _, err := recovered.FetchSegment(key)
+		assert.NoError(t, err, key)
+	}
+	for i := 0; i < 24; i++ {
+		key := fmt.Sprintf("crash-filler-%d", i)
+		_, _, err := recovered.FetchSegment(key)
+		assert.NoError(t, err, key)
+	}
+}
+
+func TestReclaimExpiredRegions(t *testing.T) {
+	path := t.TempDir()
+	fss, err := OpenFS(&Options{
+		FSPerm:                conf.FSPerm,
+		Path:                  path,
+		Threshold:             1,
+		ReclaimExpiredRegions: true,
+	})
+	assert.NoError(t, err)
+	defer fss.StopExpireLoop()
+
+	put := func(key, value string, ttl int64) {
+		seg, err := NewSegment(key, types.NewVariant(value), ttl)
+		assert.NoError(t, err)
+		assert.NoError(t, fss.PutSegment(key, seg))
+	}
+
+	// 手动切换 region，每个 region 中的数据都是确定的
+	roll := func() int64 {
+		fss.mu.Lock()
+		defer fss.mu.Unlock()
+		id := fss.regionId
+		assert.NoError(t, fss.changeRegions())
+		return id
+	}
+
+	shorts := func(prefix string) {
+		for i := 0; i < 3; i++ {
+			put(fmt.Sprintf("%s-%d", prefix, i), "value", 1)
+		}
+	}
+
+	// 第一个 region 在打开的时候就已经存在，之后的 region 只有短 TTL 的 key
+	shorts("first")
+	first := roll()
+	shorts("second")
+	second := roll()
+
+	// shadow-key 的旧版本和永不过期的 key 在同一个 region 中，之后被一个会过期的新版本覆盖
+	put("anchor-key", "anchor", 0)
+	put("shadow-key", "old", 0)
+	anchor := roll()
+	put("shadow-key", "new", 1)
+	shorts("shadow")
+	shadow := roll()
+
+	// tombstone 删除的是同一个 region 中的 key，没有覆盖更早的 region
+	put("tomb-key", "value", 1)
+	assert.NoError(t, fss.DeleteSegment("tomb-key"))
+	shorts("tomb")
+	tomb := roll()
+
+	put("live-key", "value", 0)
+
+	time.Sleep(1100 * time.Millisecond)
+
+	fss.sweepExpired()
+	assert.NoError(t, fss.reclaimDeadRegions())
+
+	for _, id := range []int64{first, second, tomb} {
+		_, ok := fss.regions[id]
+		assert.False(t, ok, "region %d should be reclaimed", id)
+		name, err := fss.toStringFileName(id)
+		assert.NoError(t, err)
+		_, err = os.Stat(filepath.Join(path, name))
+		assert.True(t, os.IsNotExist(err))
+	}
+
+	// anchor 中还有存活的数据，shadow 中过期的新版本覆盖了 anchor 中的旧版本，删除之后旧版本会在全量恢复时重新出现
+	for _, id := range []int64{anchor, shadow} {
+		_, ok := fss.regions[id]
+		assert.True(t, ok, "region %d should be kept", id)
+	}
+
+	// 再次检查不会删除任何 region，也不需要重新读取 region 的内容
+	removed := len(fss.regions)
+	assert.NoError(t, fss.reclaimDeadRegions())
+	assert.Equal(t, removed, len(fss.regions))
+
+	// 删除索引快照，强制通过全量扫描 region 恢复索引
+	assert.NoError(t, os.Remove(filepath.Join(path, fss.indexFileName)))
+
+	recovered, err := OpenFS(&Options{
+		FSPerm:    conf.FSPerm,
+		Path:      path,
+		Threshold: 1,
+	})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer recovered.StopExpireLoop()
+
+	assert.True(t, recovered.IsActive("anchor-key"))
+	assert.True(t, recovered.IsActive("live-key"))
+	assert.False(t, recovered.IsActive("shadow-key"))
+	assert.False(t, recovered.IsActive("tomb-key"))
+	assert.False(t, recovered.IsActive("first-0"))
+}
+
+func TestRegionLiveCounts(t *testing.T) {
+	fss, err := OpenFS(&Options{
+		FSPerm:    conf.FSPerm,
+		Path:      t.TempDir(),
+		Threshold: 1,
+	})
+	assert.NoError(t, err)
+	defer fss.StopExpireLoop()
+
+	live := func() map[int64]int {
+		counts := make(map[int64]int)
+		for _, imap := range fss.indexs {
+			for id, n := range imap.live {
+				counts[id] += n
+			}
+		}
+		return counts
+	}
+
+	put := func(key string, ttl int64) {
+		seg, err := NewSegment(key, types.NewVariant("value"), ttl)
+		assert.NoError(t, err)
+		assert.NoError(t, fss.PutSegment(key, seg))
+	}
+
+	region := fss.regionId
+	for i := 0; i < 4; i++ {
+		put(fmt.Sprintf("count-%d", i), 0)
+	}
+	put("count-expiring", 1)
+	assert.Equal(t, map[int64]int{region: 5}, live())
+
+	// 覆盖写入不会增加引用，删除和过期都会减少引用
+	put("count-0", 0)
+	assert.Equal(t, map[int64]int{region: 5}, live())
+
+	assert.NoError(t, fss.DeleteSegment("count-1"))
+	assert.Equal(t, map[int64]int{region: 4}, live())
+
+	time.Sleep(1100 * time.Millisecond)
+	fss.sweepExpired()
+	assert.Equal(t, map[int64]int{region: 3}, live())
+
+	// 切换 region 之后覆盖写入把引用转移到新的 region
+	fss.mu.Lock()
+	assert.NoError(t, fss.changeRegions())
+	fss.mu.Unlock()
+
+	put("count-2", 0)
+	assert.Equal(t, map[int64]int{region: 2, fss.regionId: 1}, live())
+	assert.Equal(t, region, fss.supersedes[fss.regionId])
+}
+
+func TestOpenFSAtCheckpoint(t *testing.T) {
+	path := t.TempDir()
+	opt := &Options{
+		FSPerm:    conf.FSPerm,
+		Path:      path,
+		Threshold: 1,
+	}
+	fss, err := OpenFS(opt)
+	assert.NoError(t, err)
+	defer fss.StopExpireLoop()
+
+	fss.regionThreshold = 256
+
+	put := func(key string) {
+		seg, err := NewSegment(key, types.NewVariant("value"), 0)
+		assert.NoError(t, err)
+		assert.NoError(t, fss.PutSegment(key, seg))
+	}
+
+	for i := 0; i < 10; i++ {
+		put(fmt.Sprintf("early-key-%d", i))
+	}
+	_, err = fss.writeCheckpoint(fmt.Sprintf("mem.%d.%d.tmp", 1000, fss.regionId))
+	assert.NoError(t, err)
+
+	for i := 0; i < 10; i++ {
+		put(fmt.Sprintf("late-key-%d", i))
+	}
+	assert.NoError(t, fss.DeleteSegment("early-key-0"))
+	_, err = fss.writeCheckpoint(fmt.Sprintf("mem.%d.%d.tmp", 2000, fss.regionId))
+	assert.NoError(t, err)
+
+	_, err = OpenFSAtCheckpoint(opt, 999)
+	assert.ErrorIs(t, err, ErrCheckpointNotFound)
+
+	early, err := OpenFSAtCheckpoint(opt, 1500)
+	assert.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		assert.True(t, early.IsActive(fmt.Sprintf("early-key-%d", i)))
+		assert.False(t, early.IsActive(fmt.Sprintf("late-key-%d", i)))
+	}
+	_, seg, err := early.FetchSegment("early-key-0")
+	assert.NoError(t, err)
+	assert.Equal(t, "early-key-0", string(seg.Key))
+
+	// 只读实例不能写入，也不能覆盖当前的索引快照
+	seg, err = NewSegment("early-key-0", types.NewVariant("value"), 0)
+	assert.NoError(t, err)
+	assert.ErrorIs(t, early.PutSegment("early-key-0", seg), ErrReadOnly)
+	assert.ErrorIs(t, early.DeleteSegment("early-key-1"), ErrReadOnly)
+	assert.ErrorIs(t, early.ExportSnapshotIndex(), ErrReadOnly)
+	assert.True(t, early.IsActive("early-key-1"))
+	assert.NoError(t, early.CloseFS())
+	assert.False(t, isExist(fss.fsys, filepath.Join(path, defaultIndexFileName)))
+
+	late, err := OpenFSAtCheckpoint(opt, 2000)
+	assert.NoError(t, err)
+	assert.False(t, late.IsActive("early-key-0"))
+	assert.True(t, late.IsActive("early-key-1"))
+	assert.True(t, late.IsActive("late-key-9"))
+	assert.NoError(t, late.CloseFS())
+}
+
+func TestImmutableSegment(t *testing.T) {
+	dir := t.TempDir()
+	fss, err := OpenFS(&Options{
+		FSPerm:    conf.FSPerm,
+		Path:      dir,
+		Threshold: 1,
+	})
+	assert.NoError(t, err)
+	defer fss.StopExpireLoop()
+
+	seg, err := NewSegment("audit-key", types.NewList("a"), 0)
+	assert.NoError(t, err)
+	seg.Immutable = true
+	assert.NoError(t, fss.PutSegment("audit-key", seg))
+
+	version, fetched, err := fss.FetchSegment("audit-key")
+	assert.NoError(t, err)
+	assert.True(t, fetched.Immutable)
+
+	next, err := NewSegment("audit-key", types.NewList("b"), 0)
+	assert.NoError(t, err)
+
+	assert.ErrorIs(t, fss.PutSegment("audit-key", next), ErrImmutable)
+
+	ok, err := fss.CompareAndSwapSegment("audit-key", version, next)
+	assert.ErrorIs(t, err, ErrImmutable)
+	assert.False(t, ok)
+
+	_, err = fss.Swap("audit-key", next, false)
+	assert.ErrorIs(t, err, ErrImmutable)
+
+	assert.ErrorIs(t, fss.DeleteSegment("audit-key"), ErrImmutable)
+
+	ok, err = fss.DeleteIf("audit-key", func(*Segment) (bool, error) { return true, nil })
+	assert.ErrorIs(t, err, ErrImmutable)
+	assert.False(t, ok)
+
+	// 修改过期时间相当于延迟删除，同样不允许
+	ok, err = fss.Expire("audit-key", 1)
+	assert.ErrorIs(t, err, ErrImmutable)
+	assert.False(t, ok)
+	_, fetched, err = fss.FetchSegment("audit-key")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(ImmortalTTL), fetched.ExpiredAt)
+
+	// 普通的 key 不受影响
+	plain, err := NewSegment("plain-key", types.NewList("a"), 0)
+	assert.NoError(t, err)
+	assert.NoError(t, fss.PutSegment("plain-key", plain))
+	plain, err = NewSegment("plain-key", types.NewList("b"), 0)
+	assert.NoError(t, err)
+	assert.NoError(t, fss.PutSegment("plain-key", plain))
+	assert.NoError(t, fss.DeleteSegment("plain-key"))
+
+	// 重启之后通过索引快照恢复的 inode 仍然是不可变的
+	assert.NoError(t, fss.CloseFS())
+
+	fss, err = OpenFS(&Options{
+		FSPerm:    conf.FSPerm,
+		Path:      dir,
+		Threshold: 1,
+	})
+	assert.NoError(t, err)
+	defer fss.StopExpireLoop()
+	defer fss.CloseFS()
+
+	assert.ErrorIs(t, fss.PutSegment("audit-key", next), ErrImmutable)
+	assert.ErrorIs(t, fss.DeleteSegment("audit-key"), ErrImmutable)
+
+	_, fetched, err = fss.FetchSegment("audit-key")
+	assert.NoError(t, err)
+	list, err := fetched.ToList()
+	assert.NoError(t, err)
+	assert.Equal(t, []any{"a"}, list.List)
+
+	// 设置了过期时间的不可变 key 过期之后可以重新写入
+	expiring, err := NewSegment("expiring-key", types.NewList("a"), 0)
+	assert.NoError(t, err)
+	expiring.Immutable = true
+	expiring.ExpiredAt = time.Now().Add(50 * time.Millisecond).UnixMicro()
+	assert.NoError(t, fss.PutSegment("expiring-key", expiring))
+	assert.ErrorIs(t, fss.PutSegment("expiring-key", next), ErrImmutable)
+
+	time.Sleep(100 * time.Millisecond)
+	expiring, err = NewSegment("expiring-key", types.NewList("b"), 0)
+	assert.NoError(t, err)
+	assert.NoError(t, fss.PutSegment("expiring-key", expiring))
+}
+
+func TestHasSegments(t *testing.T) {
+	fss, err := OpenFS(&Options{
+		FSPerm:    conf.FSPerm,
+		Path:      t.TempDir(),
+		Threshold: 1,
+	})
+	assert.NoError(t, err)
+	defer fss.StopExpireLoop()
+
+	for _, key := range []string{"present-1", "present-2"} {
+		seg, err := NewSegment(key, types.NewVariant(key), 0)
+		assert.NoError(t, err)
+		assert.NoError(t, fss.PutSegment(key, seg))
+	}
+
+	expired, err := NewSegment("expired-1", types.NewVariant("expired"), 0)
+	assert.NoError(t, err)
+	expired.ExpiredAt = time.Now().Add(50 * time.Millisecond).UnixMicro()
+	assert.NoError(t, fss.PutSegment("expired-1", expired))
+
+	time.Sleep(100 * time.Millisecond)
+
+	// 过期但是还没有被清理的 key 也返回 false
+	assert.Equal(t, map[string]bool{
+		"present-1": true,
+		"present-2": true,
+		"expired-1": false,
+		"missing-1": false,
+	}, fss.HasSegments([]string{"present-1", "expired-1", "missing-1", "present-2", "present-1"}))
+
+	assert.Empty(t, fss.HasSegments(nil))
+}
+
+func TestSerializedIndexImmutable(t *testing.T) {
+	var buf bytes.Buffer
+	data, err := serializedIndex(&buf, 42, &inode{RegionId: 1, Position: 4, Length: 128, immutable: true})
+	assert.NoError(t, err)
+
+	inum, node, err := deserializedIndex(data)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(42), inum)
+	assert.Equal(t, int32(128), node.Length)
+	assert.True(t, node.immutable)
+}
+
+func TestSerializedIndexKey(t *testing.T) {
+	var buf bytes.Buffer
+	keyed, err := serializedIndex(&buf, 42, &inode{RegionId: 1, Position: 4, Length: 128, immutable: true, key: "user:1001", kind: _RECORD})
+	assert.NoError(t, err)
+	assert.Len(t, keyed, _INDEX_SEGMENT_SIZE+_INDEX_KEY_HEADER+len("user:1001")+4)
+
+	inum, node, err := deserializedIndex(keyed)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(42), inum)
+	assert.Equal(t, int32(128), node.Length)
+	assert.True(t, node.immutable)
+	assert.Equal(t, "user:1001", node.key)
+	assert.Equal(t, _RECORD, node.kind)
+
+	// 扩展部分损坏的时候校验失败
+	corrupted := bytes.Clone(keyed)
+	corrupted[len(corrupted)-6] ^= 0xff
+	_, _, err = deserializedIndex(corrupted)
+	assert.Error(t, err)
+
+	// 带 key 和不带 key 的记录可以混合在同一个文件中顺序读取
+	file := bytes.Clone(keyed)
+	plain, err := serializedIndex(&buf, 43, &inode{RegionId: 2, Position: 8, Length: 64})
+	assert.NoError(t, err)
+	file = append(file, plain...)
+
+	reader := bytes.NewReader(file)
+	var (
+		offset int64
+		keys   []string
+		record []byte
+	)
+	for offset < int64(len(file)) {
+		record, err = readIndexRecord(reader, offset, record)
+		if !assert.NoError(t, err) {
+			return
+		}
+		offset += int64(len(record))
+
+		_, node, err := deserializedIndex(record)
+		assert.NoError(t, err)
+		keys = append(keys, node.key)
+	}
+	assert.Equal(t, []string{"user:1001", ""}, keys)
+}
+
+func TestStoreKeysInIndex(t *testing.T) {
+	path := t.TempDir()
+	open := func(storeKeys bool) *LogStructuredFS {
+		fss, err := OpenFS(&Options{
+			FSPerm:           conf.FSPerm,
+			Path:             path,
+			Threshold:        1,
+			StoreKeysInIndex: storeKeys,
+		})
+		assert.NoError(t, err)
+		return fss
+	}
+
+	fss := open(true)
+	expected := make(map[string]string)
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("indexed-variant-%d", i)
+		seg, err := NewSegment(key, types.NewVariant(int64(i)), 0)
+		assert.NoError(t, err)
+		assert.NoError(t, fss.PutSegment(key, seg))
+		expected[key] = "VARIANT"
+	}
+	assert.NoError(t, fss.ExportSnapshotIndex())
+
+	// 快照之后写入的 key 在启动的时候通过重放 region 补齐
+	seg, err := NewSegment("indexed-table", types.NewTable(), 0)
+	assert.NoError(t, err)
+	assert.NoError(t, fss.PutSegment("indexed-table", seg))
+	expected["indexed-table"] = "TABLE"
+
+	fss.StopExpireLoop()
+	assert.NoError(t, fss.CloseFS())
+
+	recovered := open(true)
+	defer recovered.StopExpireLoop()
+
+	// 去掉所有的 region，遍历 key 的时候不能读取任何数据文件
+	regions := recovered.regions
+	recovered.regions = map[int64]*Region{}
+
+	visited := make(map[string]string)
+	err = recovered.ScanMeta(func(key string, kind string, createdAt, expiredAt int64) bool {
+		visited[key] = kind
+		return true
+	})
+	recovered.regions = regions
+	assert.NoError(t, err)
+	assert.Equal(t, expected, visited)
+
+	// 关闭之后导出的快照恢复为不带 key 的格式
+	recovered.StopExpireLoop()
+	assert.NoError(t, recovered.CloseFS())
+
+	plain := open(false)
+	defer plain.StopExpireLoop()
+	assert.NoError(t, plain.ExportSnapshotIndex())
+
+	stat, err := os.Stat(filepath.Join(path, defaultIndexFileName))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(dataFileMetadata)+len(expected)*_INDEX_SEGMENT_SIZE), stat.Size())
+}
+
+func TestCheckpointMinRegions(t *testing.T) {
+	path := t.TempDir()
+	fss, err := OpenFS(&Options{
+		FSPerm:               conf.FSPerm,
+		Path:                 path,
+		Threshold:            1,
+		CheckpointMinRegions: 1,
+	})
+	assert.NoError(t, err)
+	defer fss.StopExpireLoop()
+	assert.Len(t, fss.regions, 1)
+
+	seg, err := NewSegment("ckpt-key", types.NewVariant("v1"), 0)
+	assert.NoError(t, err)
+	assert.NoError(t, fss.PutSegment("ckpt-key", seg))
+
+	// 只存在于索引中的 inode，恢复之后还能找到说明索引来自检查点而不是扫描 region
+	inum, marker := keyHash("ckpt-key"), keyHash("ckpt-only")
+	imap := fss.indexs[marker%uint64(shard)]
+	imap.mu.Lock()
+	imap.index[marker] = fss.indexs[inum%uint64(shard)].index[inum].relocate(fss.regionId, int64(len(dataFileMetadata)))
+	imap.mu.Unlock()
+
+	fss.RunCheckpoint(1)
+	defer fss.StopCheckpoint()
+
+	var ckpts []string
+	assert.Eventually(t, func() bool {
+		ckpts, _ = globFiles(fss.fsys, path, ckptExtension)
+		return len(ckpts) > 0
+	}, 5*time.Second, 100*time.Millisecond)
+
+	// 模拟进程崩溃，没有 index.db 的时候只能通过检查点或者全局扫描恢复
+	recovered, err := OpenFS(&Options{
+		FSPerm:               conf.FSPerm,
+		Path:                 path,
+		Threshold:            1,
+		CheckpointMinRegions: 1,
+	})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer recovered.StopExpireLoop()
+
+	_, _, err = recovered.FetchSegment("ckpt-key")
+	assert.NoError(t, err)
+
+	_, ok := recovered.indexs[marker%uint64(shard)].index[marker]
+	assert.True(t, ok)
+}
+
+func TestValueCodecMixedDirectory(t *testing.T) {
+	t.Cleanup(func() { _ = types.SetValueCodec(types.MsgpackValueCodec) })
+
+	path := t.TempDir()
+	open := func(codec types.ValueCodec) *LogStructuredFS {
+		fss, err := OpenFS(&Options{
+			FSPerm:     conf.FSPerm,
+			Path:       path,
+			Threshold:  1,
+			ValueCodec: codec,
+		})
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		t.Cleanup(fss.StopExpireLoop)
+		return fss
+	}
+
+	put := func(fss *LogStructuredFS, key string, codec types.ValueCodec) {
+		table := types.NewTable()
+		table.AddRows(map[string]any{"codec": codec.String()})
+		seg, err := NewSegment(key, table, 0)
+		assert.NoError(t, err)
+		assert.Equal(t, codec, seg.Codec)
+		assert.NoError(t, fss.PutSegment(key, seg))
+	}
+
+	fss := open(types.CBORValueCodec)
+	put(fss, "cbor-table", types.CBORValueCodec)
+	assert.NoError(t, fss.CloseFS())
+
+	fss = open(types.JSONValueCodec)
+	put(fss, "json-table", types.JSONValueCodec)
+	assert.NoError(t, fss.CloseFS())
+
+	// 默认的 msgpack 实例按照每个 segment 头部中记录的格式解码
+	fss = open(types.MsgpackValueCodec)
+	defer fss.CloseFS()
+	put(fss, "msgpack-table", types.MsgpackValueCodec)
+
+	for key, codec := range map[string]types.ValueCodec{
+		"cbor-table":    types.CBORValueCodec,
+		"json-table":    types.JSONValueCodec,
+		"msgpack-table": types.MsgpackValueCodec,
+	} {
+		_, seg, err := fss.FetchSegment(key)
+		assert.NoError(t, err, key)
+		assert.Equal(t, codec, seg.Codec, key)
+
+		table, err := seg.ToTable()
+		assert.NoError(t, err, key)
+		assert.Equal(t, codec.String(), table.Table[1]["codec"], key)
+
+		size, nextID, err := seg.TableSummary()
+		assert.NoError(t, err, key)
+		assert.Equal(t, 1, size, key)
+		assert.Equal(t, uint32(1), nextID, key)
+	}
+}
+
+func TestValueCodecHeaderDrivesDecoding(t *testing.T) {
+	t.Cleanup(func() { _ = types.SetValueCodec(types.MsgpackValueCodec) })
+	assert.NoError(t, types.SetValueCodec(types.JSONValueCodec))
+
+	seg, err := NewSegment("codec-key", types.NewList("a", "b"), 0)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `["a","b"]`, string(seg.Value))
+
+	data, err := seg.Serialize()
+	assert.NoError(t, err)
+	assert.Equal(t, int8(types.JSONValueCodec), int8(data[0])&_CODEC_MASK>>_CODEC_SHIFT)
+
+	_, decoded, err := readSegment(bytes.NewReader(data), 0, _SEGMENT_PADDING)
+	assert.NoError(t, err)
+	assert.Equal(t, types.JSONValueCodec, decoded.Codec)
+	assert.False(t, decoded.IsTombstone())
+
+	list, err := decoded.ToList()
+	assert.NoError(t, err)
+	assert.Equal(t, []any{"a", "b"}, list.List)
+
+	// 头部记录的格式和实际的数据不一致的时候按照头部解码，返回 ErrDecodeFailed
+	decoded.Codec = types.CBORValueCodec
+	_, err = decoded.ToList()
+	assert.ErrorIs(t, err, ErrDecodeFailed)
+}
+
+func TestCompactIndex(t *testing.T) {
+	fss, err := OpenFS(&Options{
+		FSPerm:    conf.FSPerm,
+		Path:      t.TempDir(),
+		Threshold: 1,
+	})
+	assert.NoError(t, err)
+	defer fss.StopExpireLoop()
+
+	const total = 20000
+	for i := 0; i < total; i++ {
+		seg, err := NewSegment(fmt.Sprintf("index-key-%d", i), types.NewVariant(int64(i)), 0)
+		assert.NoError(t, err)
+		assert.NoError(t, fss.PutSegment(seg.KeyString(), seg))
+	}
+
+	// 删除大部分 key，只保留 1%
+	for i := 0; i < total; i++ {
+		if i%100 != 0 {
+			assert.NoError(t, fss.DeleteSegment(fmt.Sprintf("index-key-%d", i)))
+		}
+	}
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+
+	released := fss.CompactIndex()
+	assert.Equal(t, shard*_INDEX_MAP_CAPACITY-total/100, released)
+
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+	assert.Less(t, after.HeapInuse, before.HeapInuse)
+
+	live := 0
+	for _, imap := range fss.indexs {
+		assert.Equal(t, len(imap.index), imap.capacity)
+		live += len(imap.index)
+	}
+	assert.Equal(t, total/100, live)
+
+	for i := 0; i < total; i += 100 {
+		_, _, err := fss.FetchSegment(fmt.Sprintf("index-key-%d", i))
+		assert.NoError(t, err)
+	}
+}
+
+func TestCompactIndexFromExpireLoop(t *testing.T) {
+	fss, err := OpenFS(&Options{
+		FSPerm:            conf.FSPerm,
+		Path:              t.TempDir(),
+		Threshold:         1,
+		CompactIndexRatio: 0.5,
+	})
+	assert.NoError(t, err)
+	defer fss.StopExpireLoop()
+
+	seg, err := NewSegment("sparse-key", types.NewVariant("v"), 0)
+	assert.NoError(t, err)
+	assert.NoError(t, fss.PutSegment("sparse-key", seg))
+
+	// 预分配的容量远大于存活的 inode 数量，过期检查之后所有的 shard 都会被重建
+	fss.sweepExpired()
+	for _, imap := range fss.indexs {
+		assert.Equal(t, len(imap.index), imap.capacity)
+	}
+
+	assert.True(t, fss.IsActive("sparse-key"))
+}
+
+func TestShardStats(t *testing.T) {
+	fss, err := OpenFS(&Options{
+		FSPerm:    conf.FSPerm,
+		Path:      t.TempDir(),
+		Threshold: 1,
+	})
+	assert.NoError(t, err)
+	defer fss.StopExpireLoop()
+
+	const hotKey = "shard-hot-key"
+	hot := int(keyHash(hotKey) % uint64(shard))
+
+	// 其他 shard 各自只有少量的访问
+	for i := 0; i < 50; i++ {
+		key := fmt.Sprintf("shard-cold-key-%d", i)
+		if int(keyHash(key)%uint64(shard)) == hot {
+			continue
+		}
+		seg, err := NewSegment(key, types.NewVariant(int64(i)), 0)
+		assert.NoError(t, err)
+		assert.NoError(t, fss.PutSegment(key, seg))
+	}
+
+	seg, err := NewSegment(hotKey, types.NewVariant("hot"), 0)
+	assert.NoError(t, err)
+	assert.NoError(t, fss.PutSegment(hotKey, seg))
+
+	// 多个 goroutine 同时读写同一个 key，所有的锁都落在同一个 shard 上
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 500; i++ {
+				if w%2 == 0 {
+					seg, err := NewSegment(hotKey, types.NewVariant(int64(i)), 0)
+					assert.NoError(t, err)
+					assert.NoError(t, fss.PutSegment(hotKey, seg))
+				} else {
+					_, _, err := fss.FetchSegment(hotKey)
+					assert.NoError(t, err)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	stats := fss.ShardStats()
+	assert.Len(t, stats, shard)
+
+	var others, othersContended uint64
+	for _, stat := range stats {
+		if stat.Shard != hot {
+			others += stat.Acquisitions
+			othersContended += stat.Contended
+		}
+	}
+
+	assert.GreaterOrEqual(t, stats[hot].Acquisitions, uint64(4001))
+	assert.Greater(t, stats[hot].Acquisitions, others)
+	// 单核的环境中持有锁的 goroutine 很少被抢占，等待次数可能为 0，这里只比较相对大小
+	assert.GreaterOrEqual(t, stats[hot].Contended, othersContended)
+	assert.Equal(t, 1, stats[hot].Keys)
+}
+
+func TestSegmentWriter(t *testing.T) {
+	dir := t.TempDir()
+
+	fss, err := OpenFS(&Options{
+		FSPerm:    conf.FSPerm,
+		Path:      dir,
+		Threshold: 1,
+	})
+	assert.NoError(t, err)
+
+	plain, err := NewSegment("plain-key", types.NewVariant("plain"), 0)
+	assert.NoError(t, err)
+	assert.NoError(t, fss.PutSegment("plain-key", plain))
+
+	tagged, err := NewSegment("tagged-key", types.NewVariant("tagged"), 0)
+	assert.NoError(t, err)
+	tagged.Writer = "billing-service"
+	assert.NoError(t, fss.PutSegment("tagged-key", tagged))
+	// 写入者标识占用 VALUE 末尾的 len + 1 个字节
+	assert.Equal(t, _SEGMENT_PADDING+tagged.KeySize+tagged.ValueSize+int32(len("billing-service"))+1+4, tagged.Size())
+
+	tooLong, err := NewSegment("too-long-key", types.NewVariant("x"), 0)
+	assert.NoError(t, err)
+	tooLong.Writer = strings.Repeat("w", MaxWriterSize+1)
+	assert.ErrorIs(t, fss.PutSegment("too-long-key", tooLong), ErrWriterTooLong)
+
+	assertWriters := func(fss *LogStructuredFS) {
+		_, seg, err := fss.FetchSegment("tagged-key")
+		if assert.NoError(t, err) {
+			assert.Equal(t, "billing-service", seg.Writer)
+			v, err := seg.ToVariant()
+			assert.NoError(t, err)
+			assert.Equal(t, "tagged", v.Value)
+		}
+
+		_, seg, err = fss.FetchSegment("plain-key")
+		if assert.NoError(t, err) {
+			assert.Empty(t, seg.Writer)
+			v, err := seg.ToVariant()
+			assert.NoError(t, err)
+			assert.Equal(t, "plain", v.Value)
+		}
+
+		versions, err := fss.History("tagged-key", 0)
+		if assert.NoError(t, err) && assert.NotEmpty(t, versions) {
+			for _, version := range versions {
+				assert.Equal(t, "billing-service", version.Segment.Writer)
+			}
+		}
+	}
+	assertWriters(fss)
+
+	// 过期时间的更新会重写 segment，写入者标识需要保留
+	ok, err := fss.Expire("tagged-key", 3600)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assertWriters(fss)
+
+	report, err := fss.VerifyRegion(fss.regionId)
+	assert.NoError(t, err)
+	assert.Zero(t, report.Corrupt)
+	assert.Equal(t, 3, report.Good)
+
+	fss.StopExpireLoop()
+
+	// 不使用 index.db 快照，重新扫描 region 恢复索引
+	recovered, err := OpenFS(&Options{
+		FSPerm:    conf.FSPerm,
+		Path:      dir,
+		Threshold: 1,
+	})
+	assert.NoError(t, err)
+	defer recovered.StopExpireLoop()
+	assertWriters(recovered)
+}
+
+func TestOpenLegacyDataFileVersion(t *testing.T) {
+	dir := t.TempDir()
+
+	fss, err := OpenFS(&Options{
+		FSPerm:    conf.FSPerm,
+		Path:      dir,
+		Threshold: 1,
+	})
+	assert.NoError(t, err)
+
+	seg, err := NewSegment("legacy-key", types.NewVariant("legacy"), 0)
+	assert.NoError(t, err)
+	assert.NoError(t, fss.PutSegment("legacy-key", seg))
+	assert.NoError(t, fss.CloseFS())
+	fss.StopExpireLoop()
+
+	// 没有写入者标识的 segment 和版本 2 的格式完全一致，把文件头改回版本 2 之后仍然可以读取
+	name, err := fss.toStringFileName(1)
+	assert.NoError(t, err)
+	fd, err := os.OpenFile(filepath.Join(dir, name), os.O_RDWR, conf.FSPerm)
+	assert.NoError(t, err)
+	_, err = fd.WriteAt(legacyFileMetadata[1], 0)
+	assert.NoError(t, err)
+	assert.NoError(t, fd.Close())
+
+	recovered, err := OpenFS(&Options{
+		FSPerm:    conf.FSPerm,
+		Path:      dir,
+		Threshold: 1,
+	})
+	assert.NoError(t, err)
+	defer recovered.StopExpireLoop()
+
+	_, seg, err = recovered.FetchSegment("legacy-key")
+	if assert.NoError(t, err) {
+		assert.Empty(t, seg.Writer)
+		v, err := seg.ToVariant()
+		assert.NoError(t, err)
+		assert.Equal(t, "legacy", v.Value)
+	}
+
+	// 未知的版本仍然拒绝打开
+	fd, err = os.OpenFile(filepath.Join(dir, name), os.O_RDWR, conf.FSPerm)
+	assert.NoError(t, err)
+	_, err = fd.WriteAt([]byte{0xDB, 0x00, 0x01, 0x09}, 0)
+	assert.NoError(t, err)
+	assert.NoError(t, fd.Close())
+
+	_, err = OpenFS(&Options{
+		FSPerm:    conf.FSPerm,
+		Path:      dir,
+		Threshold: 1,
+	})
+	assert.Error(t, err)
+}
+
+func TestCustomFileNames(t *testing.T) {
+	open := func(path, ext, index string) *LogStructuredFS {
+		fss, err := OpenFS(&Options{
+			FSPerm:        conf.FSPerm,
+			Path:          path,
+			Threshold:     1,
+			FileExtension: ext,
+			IndexFileName: index,
+		})
+		assert.NoError(t, err)
+		return fss
+	}
+
+	dirs := []string{t.TempDir(), t.TempDir()}
+	exts := []string{".urna", ".region"}
+	indexes := []string{"urna.idx", "meta.index"}
+
+	// 两个实例同时打开，各自使用自己的文件名约定
+	instances := make([]*LogStructuredFS, 2)
+	for i := range instances {
+		instances[i] = open(dirs[i], exts[i], indexes[i])
+		seg, err := NewSegment("owner", types.NewVariant(exts[i]), 0)
+		assert.NoError(t, err)
+		assert.NoError(t, instances[i].PutSegment("owner", seg))
+	}
+
+	for i, fss := range instances {
+		assert.NoError(t, fss.ExportSnapshotIndex())
+		fss.StopExpireLoop()
+		assert.NoError(t, fss.CloseFS())
+
+		files, err := os.ReadDir(dirs[i])
+		assert.NoError(t, err)
+		var regions int
+		for _, file := range files {
+			if file.IsDir() {
+				continue
+			}
+			if strings.HasSuffix(file.Name(), exts[i]) {
+				regions++
+				continue
+			}
+			assert.Contains(t, []string{indexes[i], tempIndexFile}, file.Name())
+		}
+		assert.Greater(t, regions, 0)
+		assert.FileExists(t, filepath.Join(dirs[i], indexes[i]))
+	}
+
+	for i := range instances {
+		fss := open(dirs[i], exts[i], indexes[i])
+		_, seg, err := fss.FetchSegment("owner")
+		if assert.NoError(t, err) {
+			variant, err := seg.ToVariant()
+			assert.NoError(t, err)
+			assert.Equal(t, exts[i], variant.Value)
+		}
+		fss.StopExpireLoop()
+		assert.NoError(t, fss.CloseFS())
+	}
+
+	// 默认的扩展名不会识别其他扩展名的 region
+	fss := open(dirs[0], "", "")
+	_, _, err := fss.FetchSegment("owner")
+	assert.Error(t, err)
+	fss.StopExpireLoop()
+	assert.NoError(t, fss.CloseFS())
+
+	for _, opt := range []Options{
+		{FileExtension: "db"},
+		{FileExtension: "."},
+		{FileExtension: "./db"},
+		{IndexFileName: "index/db"},
+		{IndexFileName: tempIndexFile},
+		{IndexFileName: "0000000001.db"},
+	} {
+		opt.Path, opt.FSPerm, opt.Threshold = t.TempDir(), conf.FSPerm, 1
+		_, err := OpenFS(&opt)
+		assert.Error(t, err, opt)
+	}
+}
+
+func TestMergeRegions(t *testing.T) {
+	path := t.TempDir()
+	var merged CompactStats
+	open := func() *LogStructuredFS {
+		fss, err := OpenFS(&Options{
+			FSPerm:          conf.FSPerm,
+			Path:            path,
+			Threshold:       1,
+			CompactCallback: func(stats CompactStats) { merged = stats },
+		})
+		assert.NoError(t, err)
+		return fss
+	}
+
+	fss := open()
+	fss.regionThreshold = 256
+
+	put := func(key, value string) {
+		seg, err := NewSegment(key, types.NewVariant(value), 0)
+		assert.NoError(t, err)
+		assert.NoError(t, fss.PutSegment(key, seg))
+	}
+
+	expected := make(map[string]string)
+	for i := 0; i < 24; i++ {
+		key := fmt.Sprintf("merge-key-%d", i)
+		put(key, "v1")
+		expected[key] = "v1"
+	}
+
+	// 一部分 key 被覆盖或者删除，合并之后只能保留最新的版本
+	for i := 0; i < 24; i += 3 {
+		key := fmt.Sprintf("merge-key-%d", i)
+		put(key, "v2")
+		expected[key] = "v2"
+	}
+	for i := 1; i < 24; i += 6 {
+		key := fmt.Sprintf("merge-key-%d", i)
+		assert.NoError(t, fss.DeleteSegment(key))
+		delete(expected, key)
+	}
+
+	before := len(fss.regions)
+	assert.Greater(t, before, 4)
+
+	// 阈值调大之后之前写满的 region 都变成了小 region
+	fss.regionThreshold = 64 * 1024
+	assert.NoError(t, fss.MergeRegions())
+	assert.Greater(t, merged.RegionsMerged, 1)
+	assert.Equal(t, merged.RegionsMerged, merged.RegionsRemoved)
+	assert.Equal(t, before-merged.RegionsMerged, len(fss.regions))
+
+	files, err := globFiles(fss.fsys, path, fss.fileExtension)
+	assert.NoError(t, err)
+	assert.Less(t, len(files), before)
+
+	verify := func(fss *LogStructuredFS) {
+		for key, value := range expected {
+			_, seg, err := fss.FetchSegment(key)
+			if !assert.NoError(t, err, key) {
+				continue
+			}
+			variant, err := seg.ToVariant()
+			assert.NoError(t, err)
+			assert.Equal(t, value, variant.Value, key)
+		}
+		for i := 1; i < 24; i += 6 {
+			_, _, err := fss.FetchSegment(fmt.Sprintf("merge-key-%d", i))
+			assert.Error(t, err)
+		}
+	}
+	verify(fss)
+
+	// 没有可以合并的 region 的时候什么都不做
+	assert.NoError(t, fss.MergeRegions())
+	assert.Equal(t, 0, merged.RegionsMerged)
+
+	fss.StopExpireLoop()
+	assert.NoError(t, fss.CloseFS())
+
+	// 删除索引快照之后通过全局扫描 region 恢复，合并之后的记录顺序仍然正确
+	assert.NoError(t, os.Remove(filepath.Join(path, defaultIndexFileName)))
+	recovered := open()
+	defer recovered.StopExpireLoop()
+	verify(recovered)
+}
+
+func TestMergeRegionsKeepsDeletes(t *testing.T) {
+	path := t.TempDir()
+	open := func() *LogStructuredFS {
+		fss, err := OpenFS(&Options{
+			FSPerm:    conf.FSPerm,
+			Path:      path,
+			Threshold: 1,
+		})
+		assert.NoError(t, err)
+		return fss
+	}
+
+	fss := open()
+	put := func(key string) {
+		seg, err := NewSegment(key, types.NewVariant(strings.Repeat("v", 64)), 0)
+		assert.NoError(t, err)
+		assert.NoError(t, fss.PutSegment(key, seg))
+	}
+
+	// 第一个 region 比较大，保存着被删除的 key 的旧版本
+	fss.regionThreshold = 2048
+	put("deleted-key")
+	for i := 0; fss.regionId == 1; i++ {
+		put(fmt.Sprintf("large-region-key-%d", i))
+	}
+
+	// 之后的小 region 中保存着 tombstone
+	fss.regionThreshold = 256
+	assert.NoError(t, fss.DeleteSegment("deleted-key"))
+	for i := 0; fss.regionId < 4; i++ {
+		put(fmt.Sprintf("small-region-key-%d", i))
+	}
+
+	// 只有最旧的一段连续的小 region 才能合并，tombstone 所在的 region 前面还有大 region，不能丢弃 tombstone
+	fss.regionThreshold = 1024
+	assert.NoError(t, fss.MergeRegions())
+	_, _, err := fss.FetchSegment("deleted-key")
+	assert.Error(t, err)
+
+	fss.StopExpireLoop()
+	_ = fss.CloseFS()
+
+	// 删除索引快照之后通过重放 region 恢复，被删除的 key 不能重新出现
+	assert.NoError(t, os.Remove(filepath.Join(path, defaultIndexFileName)))
+	recovered := open()
+	defer recovered.StopExpireLoop()
+
+	_, _, err = recovered.FetchSegment("deleted-key")
+	assert.Error(t, err)
+	_, _, err = recovered.FetchSegment("small-region-key-0")
+	assert.NoError(t, err)
+}
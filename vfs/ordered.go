@@ -0,0 +1,142 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vfs
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+var ErrOrderedKeysDisabled = errors.New("ordered keys is not enabled")
+
+// orderedKeys 按照字典序维护所有 key 的有序集合，内存索引是哈希表没有顺序，
+// 开启 Options.OrderedKeys 之后写入的时候同步维护这个集合，用写入时的插入开销换取范围扫描时不需要对所有 key 排序。
+// 过期和被垃圾回收掉的 key 不会立即从集合中删除，扫描的时候会再次通过索引确认 key 是否还存在。
+type orderedKeys struct {
+	mu   sync.RWMutex
+	keys []string
+}
+
+func (o *orderedKeys) insert(key string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	i := sort.SearchStrings(o.keys, key)
+	if i < len(o.keys) && o.keys[i] == key {
+		return
+	}
+
+	o.keys = append(o.keys, "")
+	copy(o.keys[i+1:], o.keys[i:])
+	o.keys[i] = key
+}
+
+func (o *orderedKeys) remove(key string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	i := sort.SearchStrings(o.keys, key)
+	if i < len(o.keys) && o.keys[i] == key {
+		o.keys = append(o.keys[:i], o.keys[i+1:]...)
+	}
+}
+
+// between 返回 [start, end) 区间内的 key 副本，end 为空表示没有上界
+func (o *orderedKeys) between(start, end string) []string {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+
+	lo := sort.SearchStrings(o.keys, start)
+	hi := len(o.keys)
+	if end != "" {
+		hi = sort.SearchStrings(o.keys, end)
+	}
+
+	if lo >= hi {
+		return nil
+	}
+
+	keys := make([]string, hi-lo)
+	copy(keys, o.keys[lo:hi])
+
+	return keys
+}
+
+func (lfs *LogStructuredFS) trackKey(key string) {
+	if lfs.ordered != nil {
+		lfs.ordered.insert(key)
+	}
+}
+
+func (lfs *LogStructuredFS) untrackKey(key string) {
+	if lfs.ordered != nil {
+		lfs.ordered.remove(key)
+	}
+}
+
+// ScanRange 按照 key 的字典序遍历 [start, end) 区间内的数据，end 为空表示扫描到最后一个 key，
+// fn 返回 false 的时候停止遍历，只有开启了 Options.OrderedKeys 才可以使用。
+func (lfs *LogStructuredFS) ScanRange(start, end string, fn func(key string, seg *Segment) bool) error {
+	if lfs.ordered == nil {
+		return ErrOrderedKeysDisabled
+	}
+
+	for _, key := range lfs.ordered.between(start, end) {
+		_, seg, err := lfs.FetchSegment(key)
+		if err != nil {
+			// 已经过期或者被删除的 key 直接跳过
+			continue
+		}
+
+		// 索引使用的是 key 的哈希值，需要排除哈希冲突的情况
+		if seg.KeyString() != key {
+			continue
+		}
+
+		if !fn(key, seg) {
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// rebuildOrderedKeys 没有开启 Options.StoreKeysInIndex 的时候索引中只有 key 的哈希值，启动恢复之后需要从 region 中读取 key 重建有序集合
+func (lfs *LogStructuredFS) rebuildOrderedKeys() error {
+	var keys []string
+	for _, imap := range lfs.indexs {
+		imap.mu.RLock()
+		for inum, inode := range imap.index {
+			key, err := lfs.readInodeKey(inode)
+			if err != nil {
+				imap.mu.RUnlock()
+				return fmt.Errorf("failed to read key (inum: %d): %w", inum, err)
+			}
+
+			keys = append(keys, key)
+		}
+		imap.mu.RUnlock()
+	}
+
+	sort.Strings(keys)
+
+	lfs.ordered.mu.Lock()
+	lfs.ordered.keys = keys
+	lfs.ordered.mu.Unlock()
+
+	return nil
+}
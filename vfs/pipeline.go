@@ -86,6 +86,18 @@ func (p *Pipeline) IsCompressionEnabled() bool {
 	return p.flags&EnabledCompression != 0
 }
 
+// CompressorName 返回正在使用的压缩算法的名称，没有开启压缩的时候返回空字符串，
+// 压缩器实现了 Name() string 的时候使用它返回的名称，否则使用类型名称
+func (p *Pipeline) CompressorName() string {
+	if !p.IsCompressionEnabled() || p.Compressor == nil {
+		return ""
+	}
+	if named, ok := p.Compressor.(interface{ Name() string }); ok {
+		return named.Name()
+	}
+	return fmt.Sprintf("%T", p.Compressor)
+}
+
 func (p *Pipeline) DisableAll() {
 	p.flags = 0
 }
@@ -162,6 +174,10 @@ func (*Snappy) Decompress(data []byte) ([]byte, error) {
 	return snappy.Decode(nil, data)
 }
 
+func (*Snappy) Name() string {
+	return "snappy"
+}
+
 type Cryptor struct{}
 
 func (*Cryptor) Encrypt(secret, plaintext []byte) ([]byte, error) {
@@ -47,6 +47,23 @@ func TestPipelineWithComplexData(t *testing.T) {
 	}
 }
 
+func TestPipelineCompressorName(t *testing.T) {
+	pipeline := NewPipeline()
+	if name := pipeline.CompressorName(); name != "" {
+		t.Fatalf("unexpected compressor name without compression: %q", name)
+	}
+
+	pipeline.SetCompressor(SnappyCompressor)
+	if name := pipeline.CompressorName(); name != "snappy" {
+		t.Fatalf("unexpected compressor name: got %q, want snappy", name)
+	}
+
+	pipeline.DisableCompression()
+	if name := pipeline.CompressorName(); name != "" {
+		t.Fatalf("unexpected compressor name after disabling compression: %q", name)
+	}
+}
+
 // 测试 SnappyCompressor 类的压缩、加密和解密功能
 func TestSnappyCompressor(t *testing.T) {
 	// 构造复杂数据结构，包括 uint 和字符串
@@ -0,0 +1,165 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vfs
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// ErrUnknownKind DeleteByType 的类型名称不是任何一种数据类型
+var ErrUnknownKind = errors.New("unknown data type")
+
+// segmentMeta 是 ScanMeta 从 segment 头部中读取出来的元信息
+type segmentMeta struct {
+	key       string
+	kind      kind
+	createdAt int64
+	expiredAt int64
+}
+
+// ScanMeta 遍历所有存活的 key，只读取 segment 的头部和 key，不会读取和解码 value，
+// 适合过期时间审计、类型统计、导出 key 列表这类不关心 value 的后台任务，fn 返回 false 的时候停止遍历。
+// 遍历的顺序是不确定的，每次只在持有锁的时候读取一个索引分片的元信息，fn 在锁外调用，可以在 fn 中访问存储。
+func (lfs *LogStructuredFS) ScanMeta(fn func(key string, kind string, createdAt, expiredAt int64) bool) error {
+	for _, imap := range lfs.indexs {
+		metas, err := lfs.shardMeta(imap)
+		if err != nil {
+			return err
+		}
+
+		for _, meta := range metas {
+			if !fn(meta.key, kindToString[meta.kind], meta.createdAt, meta.expiredAt) {
+				return nil
+			}
+		}
+	}
+
+	return nil
+}
+
+// DeleteByKind 删除所有类型为 k 的存活 key，返回实际删除的数量，用于不清空整个数据库的情况下重置一类数据，例如清理所有残留的租约锁。
+// 先通过 ScanMeta 找出类型匹配的 key，删除的时候在 shard 锁内重新确认类型，遍历之后被覆盖为其他类型的 key 不会被删除，
+// 没有过期的不可变 key 不能删除，直接跳过。
+func (lfs *LogStructuredFS) DeleteByKind(k kind) (int, error) {
+	var keys []string
+	err := lfs.ScanMeta(func(key string, name string, createdAt, expiredAt int64) bool {
+		if name == kindToString[k] {
+			keys = append(keys, key)
+		}
+		return true
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	deleted := 0
+	for _, key := range keys {
+		ok, err := lfs.DeleteIf(key, func(seg *Segment) (bool, error) {
+			return seg.Type == k, nil
+		})
+		if errors.Is(err, ErrImmutable) {
+			continue
+		}
+		if err != nil {
+			return deleted, err
+		}
+		if ok {
+			deleted++
+		}
+	}
+
+	return deleted, nil
+}
+
+// DeleteByType 和 DeleteByKind 一样，类型使用不区分大小写的名称，例如 leaselock、TABLE，名称不存在的时候返回 ErrUnknownKind
+func (lfs *LogStructuredFS) DeleteByType(name string) (int, error) {
+	for k, s := range kindToString {
+		if k != _UNKNOWN && strings.EqualFold(s, name) {
+			return lfs.DeleteByKind(k)
+		}
+	}
+	return 0, fmt.Errorf("%w: %q", ErrUnknownKind, name)
+}
+
+func (lfs *LogStructuredFS) shardMeta(imap *indexMap) ([]segmentMeta, error) {
+	// 读取 region 需要持有 lfs.mu 的读锁，锁的顺序和写入时保持一致
+	lfs.mu.RLock()
+	defer lfs.mu.RUnlock()
+
+	imap.mu.RLock()
+	defer imap.mu.RUnlock()
+
+	now := time.Now().UnixMicro()
+	metas := make([]segmentMeta, 0, len(imap.index))
+	for inum, inode := range imap.index {
+		expiredAt := atomic.LoadInt64(&inode.ExpiredAt)
+		if expiredAt > 0 && expiredAt <= now {
+			continue
+		}
+
+		key, kind, err := lfs.readInodeMeta(inode)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read segment meta (inum: %d): %w", inum, err)
+		}
+
+		metas = append(metas, segmentMeta{
+			key:       key,
+			kind:      kind,
+			createdAt: atomic.LoadInt64(&inode.CreatedAt),
+			expiredAt: expiredAt,
+		})
+	}
+
+	return metas, nil
+}
+
+// syncIndexKeys 让启动恢复之后的内存索引和 Options.StoreKeysInIndex 保持一致，开启的时候从 region 中读取一次补齐没有 key 的 inode，
+// 例如旧格式的快照或者快照之后重放的记录，关闭的时候清除快照中带回来的 key，下一次导出的快照恢复为旧版本的格式。
+func (lfs *LogStructuredFS) syncIndexKeys() error {
+	for _, imap := range lfs.indexs {
+		err := func() error {
+			imap.mu.Lock()
+			defer imap.mu.Unlock()
+
+			for inum, inode := range imap.index {
+				if !lfs.storeKeysInIndex {
+					inode.key, inode.kind = "", 0
+					continue
+				}
+
+				if inode.key != "" {
+					continue
+				}
+
+				key, kind, err := lfs.readInodeMeta(inode)
+				if err != nil {
+					return fmt.Errorf("failed to read segment meta (inum: %d): %w", inum, err)
+				}
+				inode.key, inode.kind = key, kind
+			}
+
+			return nil
+		}()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
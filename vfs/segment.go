@@ -22,6 +22,7 @@ import (
 	"hash/crc32"
 	"io"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/auula/urnadb/types"
@@ -36,16 +37,96 @@ const (
 	_UNKNOWN
 	_VARIANT
 	_LEASELOCK
+	_LIST
+	_TIMESERIES
 )
 
 const ImmortalTTL = -1
 
+// isExpired 判断过期时间是否已经到了，小于等于 0 的过期时间都表示永不过期，和启动恢复以及读取时的判断保持一致
+func isExpired(expiredAt int64) bool {
+	return expiredAt > 0 && expiredAt <= time.Now().UnixMicro()
+}
+
+// ErrSegmentNotFound 内存索引中没有 key 对应的 inode，key 从来没有写入过或者已经被删除
+var ErrSegmentNotFound = errors.New("not found")
+
+// ErrSegmentExpired 读取的时候 segment 已经过期，索引会在读取时被删除，之后再读取就是不存在了
+var ErrSegmentExpired = errors.New("segment has expired")
+
+// ErrRegionUnavailable inode 指向的 region 已经不存在了，一般是读取到了被垃圾回收迁移之前的 inode，重新读取索引之后可以恢复
+var ErrRegionUnavailable = errors.New("data region is unavailable")
+
+// ErrSegmentTooLarge 序列化之后的 segment 超过了一个 region 能够容纳的大小
+var ErrSegmentTooLarge = errors.New("segment exceeds region size")
+
+// ErrTypeMismatch segment 中存储的数据类型和需要转换的类型不一致
+var ErrTypeMismatch = errors.New("segment type mismatch")
+
+// ErrDecodeFailed segment 的类型匹配但是 value 无法解码为对应的数据类型，一般是数据损坏或者编码格式不兼容，和存储层的读写错误区分开
+var ErrDecodeFailed = errors.New("stored value could not be decoded")
+
+// _VALUE_CHECKSUM 是 DEL 字节中的标记位，最低位仍然是 tombstone 标记，
+// 带有这个标记的 segment 的 CRC32 只覆盖 header 和 value，不再包含 key。
+const _VALUE_CHECKSUM int8 = 1 << 1
+
+// _IMMUTABLE 是 DEL 字节中的标记位，带有这个标记的 key 写入之后不能再被覆盖或者删除，过期之后仍然会被正常淘汰
+const _IMMUTABLE int8 = 1 << 2
+
+// _CODEC_SHIFT 和 _CODEC_MASK 是 DEL 字节中保存 value 序列化格式的两位，旧版本写入的数据这两位都是 0，也就是 msgpack
+const (
+	_CODEC_SHIFT      = 3
+	_CODEC_MASK  int8 = 0b11 << _CODEC_SHIFT
+)
+
+// _WRITER 是 DEL 字节中的标记位，带有这个标记的 segment 在 VALUE 区域的末尾追加了写入者标识，
+// 格式为 | VALUE ? | WRITER ? | WLEN 1 |，头部中的 VLEN 包含这两部分，所以按照 VLEN 跳过记录的逻辑不需要改变。
+const _WRITER int8 = 1 << 5
+
+// MaxWriterSize 是写入者标识的最大长度，长度保存在一个字节中
+const MaxWriterSize = 255
+
+// ErrImmutable 修改或者删除一个没有过期的不可变 key
+var ErrImmutable = errors.New("segment is immutable")
+
+// ErrWriterTooLong 写入者标识超过了 MaxWriterSize
+var ErrWriterTooLong = errors.New("writer id is too long")
+
+// valueChecksum 开启之后新写入的 segment 使用只覆盖 value 的 CRC32，读取时 key 的完整性通过索引的哈希值校验，
+// 由 Options.ValueChecksum 设置，和 pipeline 一样是进程级别的配置。
+var valueChecksum atomic.Bool
+
+// skipCRCOnRead 开启之后 readSegment 不再校验 CRC32，由 Options.SkipCRCOnRead 设置，只在启动恢复完成之后生效
+var skipCRCOnRead atomic.Bool
+
+// compressionStats 累计所有通过 AcquirePoolSegment 和 NewSegment 创建的 segment 在 pipeline 编码前后的 value 大小，
+// 用来评估当前的数据开启压缩是否划算，和 pipeline 一样是进程级别的统计。
+var compressionStats struct {
+	rawBytes     atomic.Uint64
+	encodedBytes atomic.Uint64
+}
+
+func recordCompression(raw, encoded int) {
+	compressionStats.rawBytes.Add(uint64(raw))
+	compressionStats.encodedBytes.Add(uint64(encoded))
+}
+
+// compressionRatio 返回编码之后和编码之前大小的比值，越小说明压缩效果越好，没有数据的时候返回 1
+func compressionRatio(raw, encoded uint64) float64 {
+	if raw == 0 {
+		return 1
+	}
+	return float64(encoded) / float64(raw)
+}
+
 var kindToString = map[kind]string{
-	_TABLE:     "TABLE",
-	_RECORD:    "RECORD",
-	_VARIANT:   "VARIANT",
-	_UNKNOWN:   "UNKNOWN",
-	_LEASELOCK: "LEASELOCK",
+	_TABLE:      "TABLE",
+	_RECORD:     "RECORD",
+	_VARIANT:    "VARIANT",
+	_UNKNOWN:    "UNKNOWN",
+	_LEASELOCK:  "LEASELOCK",
+	_LIST:       "LIST",
+	_TIMESERIES: "TIMESERIES",
 }
 
 // | DEL 1 | KIND 1 | EAT 8 | CAT 8 | KLEN 4 | VLEN 4 | KEY ? | VALUE ? | CRC32 4 |
@@ -58,8 +139,20 @@ type Segment struct {
 	ValueSize int32
 	Key       []byte
 	Value     []byte
+	// Immutable 保存在 DEL 字节的 _IMMUTABLE 标记位中，为 true 的 key 在过期之前不能被覆盖或者删除
+	Immutable bool
+	// Codec 是 Value 使用的序列化格式，保存在 DEL 字节的 _CODEC_MASK 中，读取的时候按照它解码
+	Codec types.ValueCodec
+	// Writer 是写入这个 segment 的客户端标识，为空的时候不占用磁盘空间，也就是旧版本的格式
+	Writer string
+	// decoded 为 true 表示 Value 已经在 readSegment 中经过 pipeline 解码，不能再解码一次
+	decoded bool
 }
 
+// segmentPoolDisabled 关闭对象池之后 AcquirePoolSegment 每次都分配新的对象，ReleaseToPool 什么也不做，
+// 用于调试在 ReleaseToPool 之后仍然使用 segment 的问题，由 Options.DisableSegmentPool 设置，是进程级别的配置。
+var segmentPoolDisabled atomic.Bool
+
 // Available segment in the pool
 var segmentPool = sync.Pool{
 	New: func() any {
@@ -80,12 +173,13 @@ type Serializable interface {
 }
 
 func AcquirePoolSegment[T Serializable](key string, data T, ttl int64) (*Segment, error) {
-	seg := segmentPool.Get().(*Segment)
+	seg := acquireSegment()
 	createdAt, expiredAt := int64(time.Now().UnixMicro()), int64(ImmortalTTL)
 	if ttl > 0 {
 		expiredAt = time.Now().Add(time.Second * time.Duration(ttl)).UnixMicro()
 	}
 
+	codec := types.CurrentValueCodec()
 	bytes, err := data.ToBytes()
 	if err != nil {
 		seg.ReleaseToPool()
@@ -98,9 +192,14 @@ func AcquirePoolSegment[T Serializable](key string, data T, ttl int64) (*Segment
 		return nil, fmt.Errorf("pipeline encode: %w", err)
 	}
 
+	recordCompression(len(bytes), len(encodedata))
+
 	// 只能这样初始化复用 segment 结构
 	seg.Type = toKind(data)
 	seg.Tombstone = 0
+	seg.Immutable = false
+	seg.Codec = codec
+	seg.Writer = ""
 	seg.CreatedAt = createdAt
 	seg.ExpiredAt = expiredAt
 	seg.KeySize = int32(len(key))
@@ -111,7 +210,17 @@ func AcquirePoolSegment[T Serializable](key string, data T, ttl int64) (*Segment
 	return seg, nil
 }
 
+func acquireSegment() *Segment {
+	if segmentPoolDisabled.Load() {
+		return new(Segment)
+	}
+	return segmentPool.Get().(*Segment)
+}
+
 func (s *Segment) ReleaseToPool() {
+	if segmentPoolDisabled.Load() {
+		return
+	}
 	s.Clear()
 	segmentPool.Put(s)
 }
@@ -123,6 +232,10 @@ func (s *Segment) Clear() {
 	s.CreatedAt = 0
 	s.ValueSize = 0
 	s.Tombstone = 0
+	s.Immutable = false
+	s.Codec = types.MsgpackValueCodec
+	s.Writer = ""
+	s.decoded = false
 	s.ExpiredAt = ImmortalTTL
 }
 
@@ -143,6 +256,7 @@ func NewSegment[T Serializable](key string, data T, ttl int64) (*Segment, error)
 		expiredAt = time.Now().Add(time.Second * time.Duration(ttl)).UnixMicro()
 	}
 
+	codec := types.CurrentValueCodec()
 	bytes, err := data.ToBytes()
 	if err != nil {
 		return nil, err
@@ -154,9 +268,12 @@ func NewSegment[T Serializable](key string, data T, ttl int64) (*Segment, error)
 		return nil, fmt.Errorf("pipeline encode: %w", err)
 	}
 
+	recordCompression(len(bytes), len(encodedata))
+
 	return &Segment{
 		Type:      toKind(data),
 		Tombstone: 0,
+		Codec:     codec,
 		CreatedAt: createdAt,
 		ExpiredAt: expiredAt,
 		KeySize:   int32(len(key)),
@@ -195,24 +312,48 @@ func (s *Segment) KeyString() string {
 
 func (s *Segment) Size() int32 {
 	// 计算一整块记录的大小，+4 CRC 校验码占用 4 个字节
-	return _SEGMENT_PADDING + s.KeySize + s.ValueSize + 4
+	return _SEGMENT_PADDING + s.KeySize + s.ValueSize + s.writerSize() + 4
+}
+
+// writerSize 返回写入者标识在 VALUE 区域末尾占用的字节数，包括保存长度的一个字节
+func (s *Segment) writerSize() int32 {
+	if s.Writer == "" {
+		return 0
+	}
+	return int32(len(s.Writer)) + 1
+}
+
+// splitWriter 从 VALUE 区域的末尾拆分出写入者标识，返回真正的 value
+func splitWriter(area []byte) ([]byte, string, error) {
+	if len(area) == 0 {
+		return nil, "", errors.New("missing writer id length")
+	}
+
+	wlen := int(area[len(area)-1])
+	end := len(area) - 1
+	if wlen > end {
+		return nil, "", fmt.Errorf("writer id length %d exceeds value area %d", wlen, end)
+	}
+
+	return area[:end-wlen], string(area[end-wlen : end]), nil
 }
 
 func (s *Segment) ToVariant() (*types.Variant, error) {
 	// 如果类型不匹配，则返回错误
 	if s.Type != _VARIANT {
-		return nil, fmt.Errorf("not support conversion to variant type")
+		return nil, typeMismatch(_VARIANT, s.Type)
 	}
 
-	decodedData, err := pipeline.Decode(s.Value)
+	decodedData, err := s.decodedValue()
 	if err != nil {
 		return nil, fmt.Errorf("failed to decode segment value: %w", err)
 	}
 
 	variant := types.AcquireVariant()
-	err = variant.FromBytesSafe(decodedData)
+	err = variant.FromBytesWithCodec(s.Codec, decodedData)
 	if err != nil {
-		return nil, err
+		variant.ReleaseToPool()
+		return nil, decodeFailed(_VARIANT, err)
 	}
 
 	return variant, nil
@@ -221,20 +362,20 @@ func (s *Segment) ToVariant() (*types.Variant, error) {
 func (s *Segment) ToRecord() (*types.Record, error) {
 	// 如果类型不匹配，则返回错误
 	if s.Type != _RECORD {
-		return nil, fmt.Errorf("not support conversion to record type")
+		return nil, typeMismatch(_RECORD, s.Type)
 	}
 
 	// 先通过 pipeline 解码
-	decodedData, err := pipeline.Decode(s.Value)
+	decodedData, err := s.decodedValue()
 	if err != nil {
 		return nil, fmt.Errorf("failed to decode segment value: %w", err)
 	}
 
 	record := types.AcquireRecord()
-	err = msgpack.Unmarshal(decodedData, &record.Record)
+	err = types.UnmarshalValue(s.Codec, decodedData, &record.Record)
 	if err != nil {
 		record.ReleaseToPool()
-		return nil, err
+		return nil, decodeFailed(_RECORD, err)
 	}
 	return record, nil
 }
@@ -242,45 +383,164 @@ func (s *Segment) ToRecord() (*types.Record, error) {
 func (s *Segment) ToTable() (*types.Table, error) {
 	// 如果类型不匹配，则返回错误
 	if s.Type != _TABLE {
-		return nil, fmt.Errorf("not support conversion to table type")
+		return nil, typeMismatch(_TABLE, s.Type)
 	}
 
 	// 先通过 pipeline 解码
-	decodedData, err := pipeline.Decode(s.Value)
+	decodedData, err := s.decodedValue()
 	if err != nil {
 		return nil, fmt.Errorf("failed to decode segment value: %w", err)
 	}
 
 	table := types.AcquireTable()
-	err = msgpack.Unmarshal(decodedData, table)
+	err = types.UnmarshalValue(s.Codec, decodedData, table)
 	if err != nil {
 		table.ReleaseToPool()
-		return nil, err
+		return nil, decodeFailed(_TABLE, err)
 	}
 	return table, nil
 }
 
+// TableSummary 只读取 Table 的行数和下一个行号，逐个跳过行数据而不解码，
+// 不会为每一行分配 map，适合只需要统计信息的超大表。
+func (s *Segment) TableSummary() (size int, nextID uint32, err error) {
+	if s.Type != _TABLE {
+		return 0, 0, typeMismatch(_TABLE, s.Type)
+	}
+
+	decodedData, err := s.decodedValue()
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to decode segment value: %w", err)
+	}
+
+	// 只有 msgpack 格式可以逐个跳过行数据，其他格式的表完整解码之后再统计
+	if s.Codec != types.MsgpackValueCodec {
+		table := types.AcquireTable()
+		defer table.ReleaseToPool()
+
+		err = types.UnmarshalValue(s.Codec, decodedData, table)
+		if err != nil {
+			return 0, 0, decodeFailed(_TABLE, err)
+		}
+
+		return table.Size(), table.NextID, nil
+	}
+
+	size, nextID, err = summarizeTable(decodedData)
+	if err != nil {
+		return 0, 0, decodeFailed(_TABLE, err)
+	}
+
+	return size, nextID, nil
+}
+
+// summarizeTable 使用 msgpack 解码器逐个读取 Table 的字段，行数据直接跳过
+func summarizeTable(decodedData []byte) (size int, nextID uint32, err error) {
+	dec := msgpack.NewDecoder(bytes.NewReader(decodedData))
+	fields, err := dec.DecodeMapLen()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	for i := 0; i < fields; i++ {
+		field, err := dec.DecodeString()
+		if err != nil {
+			return 0, 0, err
+		}
+
+		switch field {
+		case "table":
+			size, err = dec.DecodeMapLen()
+			if err != nil {
+				return 0, 0, err
+			}
+			// 空表编码为 nil，DecodeMapLen 返回 -1
+			for j := 0; j < size; j++ {
+				err = dec.Skip()
+				if err == nil {
+					err = dec.Skip()
+				}
+				if err != nil {
+					return 0, 0, err
+				}
+			}
+			size = max(size, 0)
+		case "next_id":
+			nextID, err = dec.DecodeUint32()
+		default:
+			err = dec.Skip()
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+
+	return size, nextID, nil
+}
+
 func (s *Segment) ToLeaseLock() (*types.LeaseLock, error) {
 	// 如果类型不匹配，则返回错误
 	if s.Type != _LEASELOCK {
-		return nil, fmt.Errorf("not support conversion to lease lock type")
+		return nil, typeMismatch(_LEASELOCK, s.Type)
 	}
 
 	// 先通过 pipeline 解码
-	decodedData, err := pipeline.Decode(s.Value)
+	decodedData, err := s.decodedValue()
 	if err != nil {
 		return nil, fmt.Errorf("failed to decode segment value: %w", err)
 	}
 
 	leaseLock := types.AcquireLeaseLock()
-	err = msgpack.Unmarshal(decodedData, &leaseLock.Token)
+	err = types.UnmarshalLeaseLock(s.Codec, decodedData, leaseLock)
 	if err != nil {
 		leaseLock.ReleaseToPool()
-		return nil, err
+		return nil, decodeFailed(_LEASELOCK, err)
 	}
 	return leaseLock, nil
 }
 
+func (s *Segment) ToList() (*types.List, error) {
+	// 如果类型不匹配，则返回错误
+	if s.Type != _LIST {
+		return nil, typeMismatch(_LIST, s.Type)
+	}
+
+	// 先通过 pipeline 解码
+	decodedData, err := s.decodedValue()
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode segment value: %w", err)
+	}
+
+	list := types.AcquireList()
+	err = types.UnmarshalValue(s.Codec, decodedData, &list.List)
+	if err != nil {
+		list.ReleaseToPool()
+		return nil, decodeFailed(_LIST, err)
+	}
+	return list, nil
+}
+
+func (s *Segment) ToTimeSeries() (*types.TimeSeries, error) {
+	// 如果类型不匹配，则返回错误
+	if s.Type != _TIMESERIES {
+		return nil, typeMismatch(_TIMESERIES, s.Type)
+	}
+
+	// 先通过 pipeline 解码
+	decodedData, err := s.decodedValue()
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode segment value: %w", err)
+	}
+
+	ts := types.AcquireTimeSeries()
+	err = types.UnmarshalValue(s.Codec, decodedData, ts)
+	if err != nil {
+		ts.ReleaseToPool()
+		return nil, decodeFailed(_TIMESERIES, err)
+	}
+	return ts, nil
+}
+
 // ExpiresIn 返回剩下的存活时间，一般在基于原有的 segment 更新时使用，
 // 如果返回 -1，表示这个 segment 永不过期，并且返回 ok = true 表示这个 segment 没有过期。
 // 如果返回 0，表示这个 segment 已经过期，ok = false 表示这个 segment 已经过期。
@@ -288,8 +548,8 @@ func (s *Segment) ToLeaseLock() (*types.LeaseLock, error) {
 func (s *Segment) ExpiresIn() (int64, bool) {
 	now := time.Now().UnixMicro()
 
-	// 永不过期
-	if s.ExpiredAt == ImmortalTTL {
+	// 永不过期，小于等于 0 的过期时间都视为永不过期
+	if s.ExpiredAt <= 0 {
 		return ImmortalTTL, true
 	}
 
@@ -321,16 +581,35 @@ func toKind(data Serializable) kind {
 		return _LEASELOCK
 	case *types.Variant:
 		return _VARIANT
+	case *types.List:
+		return _LIST
+	case *types.TimeSeries:
+		return _TIMESERIES
 	}
 	return _UNKNOWN
 }
 
+// decodedValue 返回经过 pipeline 解码之后的 Value，NewSegment 创建的 Value 是编码之后的数据，
+// 从 region 中读取的 Value 已经解码过了，开启压缩或者加密的时候重复解码会失败
+func (s *Segment) decodedValue() ([]byte, error) {
+	if s.decoded {
+		return s.Value, nil
+	}
+	return pipeline.Decode(s.Value)
+}
+
 // Payload 返回 Segment 的值和长度
 // 注意：这里的长度是 Value 的实际字节长度，不包括 padding 和其他字段
 func (s *Segment) Payload() ([]byte, uint32) {
 	return s.Value, uint32(len(s.Value))
 }
 
+// CompressionRatio 返回从 region 中读取出来的 segment 存储大小和原始大小的比值，越小说明压缩效果越好，
+// readSegment 会把 Value 解码为原始数据，但是 ValueSize 仍然是磁盘上编码之后的大小。
+func (s *Segment) CompressionRatio() float64 {
+	return compressionRatio(uint64(len(s.Value)), uint64(s.ValueSize))
+}
+
 var segmentJsonEncoders = map[kind]func(*Segment) ([]byte, error){
 	_RECORD: func(s *Segment) ([]byte, error) {
 		num, err := s.ToRecord()
@@ -360,6 +639,20 @@ var segmentJsonEncoders = map[kind]func(*Segment) ([]byte, error){
 		}
 		return leaseLock.ToJSON()
 	},
+	_LIST: func(s *Segment) ([]byte, error) {
+		list, err := s.ToList()
+		if err != nil {
+			return nil, err
+		}
+		return list.ToJSON()
+	},
+	_TIMESERIES: func(s *Segment) ([]byte, error) {
+		ts, err := s.ToTimeSeries()
+		if err != nil {
+			return nil, err
+		}
+		return ts.ToJSON()
+	},
 }
 
 func (s *Segment) ToJSON() ([]byte, error) {
@@ -370,64 +663,154 @@ func (s *Segment) ToJSON() ([]byte, error) {
 	return cast(s)
 }
 
-func (seg *Segment) Serialize() ([]byte, error) {
-	buf := new(bytes.Buffer)
-	err := seg.serializeToWriter(buf)
-	if err != nil {
-		return nil, err
+// encodeValue 把从 region 中读取出来、已经解码过的 Value 重新经过 pipeline 编码，并且按照编码之后的长度更新 ValueSize，
+// readSegment 返回的 ValueSize 是磁盘上编码之后的大小，直接序列化解码之后的 Value 会写出长度和 CRC32 都不匹配的记录。
+func (seg *Segment) encodeValue() error {
+	if !seg.decoded {
+		return nil
 	}
-	return buf.Bytes(), nil
-}
 
-func (seg *Segment) serializeToWriter(w io.Writer) error {
-	err := binary.Write(w, binary.LittleEndian, seg.Tombstone)
+	encoded, err := pipeline.Encode(seg.Value)
 	if err != nil {
-		return fmt.Errorf("failed to write Tombstone: %w", err)
+		return fmt.Errorf("failed to pipeline encode value in segment: %w", err)
 	}
 
-	err = binary.Write(w, binary.LittleEndian, seg.Type)
-	if err != nil {
-		return fmt.Errorf("failed to write Type: %w", err)
-	}
+	seg.Value = encoded
+	seg.ValueSize = int32(len(encoded))
+	seg.decoded = false
+	return nil
+}
 
-	err = binary.Write(w, binary.LittleEndian, seg.ExpiredAt)
+// Serialize 序列化 segment，从 region 中读取出来的 segment 会先重新编码 Value，之后 Size 返回的是重新编码之后的大小
+func (seg *Segment) Serialize() ([]byte, error) {
+	err := seg.encodeValue()
 	if err != nil {
-		return fmt.Errorf("failed to write ExpiredAt: %w", err)
+		return nil, err
 	}
 
-	err = binary.Write(w, binary.LittleEndian, seg.CreatedAt)
+	buf := new(bytes.Buffer)
+	buf.Grow(int(seg.Size()))
+	err = seg.serializeToWriter(buf)
 	if err != nil {
-		return fmt.Errorf("failed to write CreatedAt: %w", err)
+		return nil, err
 	}
+	return buf.Bytes(), nil
+}
 
-	err = binary.Write(w, binary.LittleEndian, seg.KeySize)
-	if err != nil {
-		return fmt.Errorf("failed to write KeySize: %w", err)
-	}
+// maxPooledBufferSize 超过这个容量的序列化 buffer 不会放回对象池，避免偶尔写入的大 value 一直占用内存
+const maxPooledBufferSize = 1 << 20
+
+var serializeBufferPools = sync.Pool{
+	New: func() any {
+		return new(bytes.Buffer)
+	},
+}
 
-	err = binary.Write(w, binary.LittleEndian, seg.ValueSize)
+// serializePooled 和 Serialize 一样序列化 segment，但是使用对象池中的 buffer，减少写入路径上的内存分配，
+// 返回的 buffer 使用完之后需要调用 releaseSerializeBuffer 归还，归还之后不能再引用其中的数据。
+func (seg *Segment) serializePooled() (*bytes.Buffer, error) {
+	err := seg.encodeValue()
 	if err != nil {
-		return fmt.Errorf("failed to write ValueSize: %w", err)
+		return nil, err
 	}
 
-	err = binary.Write(w, binary.LittleEndian, seg.Key)
+	buf := serializeBufferPools.Get().(*bytes.Buffer)
+	buf.Grow(int(seg.Size()))
+	err = seg.serializeToWriter(buf)
 	if err != nil {
-		return fmt.Errorf("failed to write Key: %w", err)
+		releaseSerializeBuffer(buf)
+		return nil, err
 	}
+	return buf, nil
+}
 
-	err = binary.Write(w, binary.LittleEndian, seg.Value)
-	if err != nil {
-		return fmt.Errorf("failed to write Value: %w", err)
+func releaseSerializeBuffer(buf *bytes.Buffer) {
+	if buf.Cap() > maxPooledBufferSize {
+		return
 	}
+	buf.Reset()
+	serializeBufferPools.Put(buf)
+}
 
-	// 对于 checksum，我们需要先获取所有字节，这里需要特殊处理 Buffer 才行
-	if buf, ok := w.(*bytes.Buffer); ok {
-		checksum := crc32.ChecksumIEEE(buf.Bytes())
-		err = binary.Write(w, binary.LittleEndian, checksum)
+func (seg *Segment) serializeToWriter(w io.Writer) error {
+	flags, valueOnly := seg.Tombstone, valueChecksum.Load()
+	if valueOnly {
+		flags |= _VALUE_CHECKSUM
+	}
+	if seg.Immutable {
+		flags |= _IMMUTABLE
+	}
+	flags |= int8(seg.Codec) << _CODEC_SHIFT & _CODEC_MASK
+
+	if len(seg.Writer) > MaxWriterSize {
+		return fmt.Errorf("%w: %d bytes", ErrWriterTooLong, len(seg.Writer))
+	}
+
+	var trailer []byte
+	if seg.Writer != "" {
+		flags |= _WRITER
+		trailer = append([]byte(seg.Writer), byte(len(seg.Writer)))
+	}
+
+	// 头部和末尾的 checksum 共用一个数组，字段直接按照小端序编码，不需要经过 binary.Write 的反射
+	var scratch [_SEGMENT_PADDING + 4]byte
+	header := scratch[:_SEGMENT_PADDING]
+	header[0] = byte(flags)
+	header[1] = byte(seg.Type)
+	binary.LittleEndian.PutUint64(header[2:10], uint64(seg.ExpiredAt))
+	binary.LittleEndian.PutUint64(header[10:18], uint64(seg.CreatedAt))
+	binary.LittleEndian.PutUint32(header[18:22], uint32(seg.KeySize))
+	binary.LittleEndian.PutUint32(header[22:26], uint32(seg.ValueSize+seg.writerSize()))
+
+	// 直接对各个字段累加计算 CRC32，不需要在写完之后再对整个 buffer 做一次校验
+	checksum := crc32.ChecksumIEEE(header)
+	if !valueOnly {
+		checksum = crc32.Update(checksum, crc32.IEEETable, seg.Key)
+	}
+	checksum = crc32.Update(checksum, crc32.IEEETable, seg.Value)
+	checksum = crc32.Update(checksum, crc32.IEEETable, trailer)
+	binary.LittleEndian.PutUint32(scratch[_SEGMENT_PADDING:], checksum)
+
+	fields := [...]struct {
+		name string
+		data []byte
+	}{
+		{"Tombstone", header[0:1]},
+		{"Type", header[1:2]},
+		{"ExpiredAt", header[2:10]},
+		{"CreatedAt", header[10:18]},
+		{"KeySize", header[18:22]},
+		{"ValueSize", header[22:26]},
+		{"Key", seg.Key},
+		{"Value", seg.Value},
+		{"Writer", trailer},
+		{"checksum", scratch[_SEGMENT_PADDING:]},
+	}
+
+	for _, field := range fields {
+		// 没有写入者标识的时候 trailer 为 nil，不需要写入
+		if field.data == nil {
+			continue
+		}
+		_, err := w.Write(field.data)
 		if err != nil {
-			return fmt.Errorf("failed to write checksum: %w", err)
+			return fmt.Errorf("failed to write %s: %w", field.name, err)
 		}
 	}
 
 	return nil
 }
+
+// checksumWithoutKey 计算 header 和 value 的 CRC32，跳过 key 避免每次读取都对大 key 重复计算
+func checksumWithoutKey(header, value []byte) uint32 {
+	return crc32.Update(crc32.ChecksumIEEE(header), crc32.IEEETable, value)
+}
+
+// typeMismatch 返回包装了 ErrTypeMismatch 的错误，错误信息中带有期望的类型和实际的类型
+func typeMismatch(expected, actual kind) error {
+	return fmt.Errorf("%w: expected %s, got %s", ErrTypeMismatch, kindToString[expected], kindToString[actual])
+}
+
+func decodeFailed(expected kind, err error) error {
+	return fmt.Errorf("%w as %s: %v", ErrDecodeFailed, kindToString[expected], err)
+}
@@ -15,9 +15,14 @@
 package vfs
 
 import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/auula/urnadb/conf"
 	"github.com/auula/urnadb/types"
 	"github.com/stretchr/testify/assert"
 )
@@ -95,6 +100,73 @@ func TestToTable(t *testing.T) {
 	assert.Equal(t, tablesData.Size(), result.Size())
 }
 
+func TestTableSummary(t *testing.T) {
+	tab := types.NewTable()
+	for i := 0; i < 5; i++ {
+		tab.AddRows(map[string]any{"id": i, "tags": []any{"a", "b"}})
+	}
+	tab.RemoveRows(map[string]any{"id": 0})
+
+	segment, err := NewSegment("summary-table", tab, 0)
+	assert.NoError(t, err)
+
+	size, nextID, err := segment.TableSummary()
+	assert.NoError(t, err)
+	assert.Equal(t, tab.Size(), size)
+	assert.Equal(t, tab.NextID, nextID)
+
+	segment, err = NewSegment("empty-table", types.NewTable(), 0)
+	assert.NoError(t, err)
+
+	size, _, err = segment.TableSummary()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, size)
+
+	segment, err = NewSegment("summary-record", types.NewRecord(), 0)
+	assert.NoError(t, err)
+
+	_, _, err = segment.TableSummary()
+	assert.ErrorIs(t, err, ErrTypeMismatch)
+}
+
+// TestTypeMismatch 测试把 Table 类型的 segment 转换为其他类型
+func TestTypeMismatch(t *testing.T) {
+	segment, err := NewSegment("table-key", types.NewTable(), 0)
+	assert.NoError(t, err)
+
+	_, err = segment.ToRecord()
+	assert.True(t, errors.Is(err, ErrTypeMismatch))
+	assert.EqualError(t, err, "segment type mismatch: expected RECORD, got TABLE")
+
+	_, err = segment.ToVariant()
+	assert.ErrorIs(t, err, ErrTypeMismatch)
+
+	_, err = segment.ToLeaseLock()
+	assert.ErrorIs(t, err, ErrTypeMismatch)
+}
+
+func TestVariantKindRoundTrip(t *testing.T) {
+	segment, err := NewSegment("variant-key", types.NewVariant(int64(42)), 0)
+	assert.NoError(t, err)
+	assert.Equal(t, _VARIANT, segment.Type)
+	assert.Equal(t, "VARIANT", segment.TypeString())
+
+	// 类型标记随 segment 一起持久化，从磁盘上读取回来仍然是 VARIANT
+	buf, err := segment.Serialize()
+	assert.NoError(t, err)
+
+	_, decoded, err := readSegment(bytes.NewReader(buf), 0, _SEGMENT_PADDING)
+	assert.NoError(t, err)
+	assert.Equal(t, _VARIANT, decoded.Type)
+
+	variant, err := decoded.ToVariant()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(42), variant.Value)
+
+	_, err = decoded.ToTable()
+	assert.ErrorIs(t, err, ErrTypeMismatch)
+}
+
 // TestSerializeWithInvalidData 测试 Serialize 在极端情况下的行为
 func TestSerializeWithInvalidData(t *testing.T) {
 	// 创建一个包含超大数据的 Segment，可能导致内存问题
@@ -156,6 +228,7 @@ func TestSerializeWriteError(t *testing.T) {
 		{"ValueSize", 22, "failed to write ValueSize"},
 		{"Key", 26, "failed to write Key"},
 		{"Value", 30, "failed to write Value"},
+		{"checksum", 35, "failed to write checksum"},
 	}
 
 	for _, tt := range tests {
@@ -166,4 +239,107 @@ func TestSerializeWriteError(t *testing.T) {
 			assert.Contains(t, err.Error(), tt.errMsg)
 		})
 	}
+
+	seg.Writer = "svc"
+	err := seg.serializeToWriter(&failingWriter{failAfter: 35})
+	assert.ErrorContains(t, err, "failed to write Writer")
+}
+
+func TestCompressionRatio(t *testing.T) {
+	fss, err := OpenFS(&Options{
+		FSPerm:    conf.FSPerm,
+		Path:      t.TempDir(),
+		Threshold: 1,
+	})
+	assert.NoError(t, err)
+	defer fss.StopExpireLoop()
+
+	fss.SetCompressor(SnappyCompressor)
+	defer func() {
+		pipeline = NewPipeline()
+	}()
+
+	random := make([]byte, 64*1024)
+	_, err = rand.Read(random)
+	assert.NoError(t, err)
+
+	ratioOf := func(key string, value string) (float64, float64) {
+		compressionStats.rawBytes.Store(0)
+		compressionStats.encodedBytes.Store(0)
+
+		seg, err := NewSegment(key, types.NewVariant(value), 0)
+		assert.NoError(t, err)
+		assert.NoError(t, fss.PutSegment(key, seg))
+
+		_, seg, err = fss.FetchSegment(key)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+
+		return seg.CompressionRatio(), fss.CompressionRatio()
+	}
+
+	compressible, total := ratioOf("compressible", strings.Repeat("urnadb", 10*1024))
+	assert.Less(t, compressible, 0.1)
+	assert.InDelta(t, compressible, total, 0.01)
+
+	incompressible, total := ratioOf("random", string(random))
+	assert.Greater(t, incompressible, 0.95)
+	assert.InDelta(t, incompressible, total, 0.01)
+}
+
+func TestDisableSegmentPool(t *testing.T) {
+	defer segmentPoolDisabled.Store(false)
+
+	fss, err := OpenFS(&Options{
+		FSPerm:             conf.FSPerm,
+		Path:               t.TempDir(),
+		Threshold:          1,
+		DisableSegmentPool: true,
+	})
+	assert.NoError(t, err)
+	defer fss.StopExpireLoop()
+
+	released, err := AcquirePoolSegment("pool-key", types.NewVariant("released"), 0)
+	assert.NoError(t, err)
+	value := append([]byte(nil), released.Value...)
+	released.ReleaseToPool()
+
+	// 关闭对象池之后 ReleaseToPool 不会清空数据，重新获取的也一定是新的对象
+	assert.Equal(t, value, released.Value)
+	assert.Equal(t, "pool-key", released.KeyString())
+
+	acquired, err := AcquirePoolSegment("pool-key", types.NewVariant("acquired"), 0)
+	assert.NoError(t, err)
+	assert.NotSame(t, released, acquired)
+	assert.Equal(t, value, released.Value)
+}
+
+func TestDecodeFailed(t *testing.T) {
+	// value 是合法的 msgpack，但是并不是 segment 类型对应的结构
+	seg, err := NewSegment("decode-key", types.NewVariant("not a table"), 0)
+	assert.NoError(t, err)
+
+	seg.Type = _TABLE
+	_, err = seg.ToTable()
+	assert.ErrorIs(t, err, ErrDecodeFailed)
+	assert.NotErrorIs(t, err, ErrTypeMismatch)
+	_, _, err = seg.TableSummary()
+	assert.ErrorIs(t, err, ErrDecodeFailed)
+
+	seg.Type = _RECORD
+	_, err = seg.ToRecord()
+	assert.ErrorIs(t, err, ErrDecodeFailed)
+
+	seg.Type = _LIST
+	_, err = seg.ToList()
+	assert.ErrorIs(t, err, ErrDecodeFailed)
+
+	seg.Type = _TIMESERIES
+	_, err = seg.ToTimeSeries()
+	assert.ErrorIs(t, err, ErrDecodeFailed)
+
+	// 类型不一致仍然是 ErrTypeMismatch
+	_, err = seg.ToRecord()
+	assert.ErrorIs(t, err, ErrTypeMismatch)
 }
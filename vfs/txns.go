@@ -47,7 +47,7 @@ func acquireTxnId() uint64 {
 // 但是还没有提交，万一这个时候系统崩溃了数据就丢了，所以要有 .txn 文件来记录是对应 key 的老数据版本。
 // 等系统重启的时候再去读取 .txn 文件中的数据来恢复对应 key 的老数据版本，这样就保证了数据的安全性和一致性了。
 type Transaction struct {
-	fd        *os.File
+	fd        File
 	id        uint64
 	path      string
 	store     *LogStructuredFS
@@ -59,7 +59,7 @@ type Transaction struct {
 }
 
 type TxnState struct {
-	fd     *os.File
+	fd     File
 	store  *LogStructuredFS
 	writes map[string]*Snapshot
 	reads  map[string]*Snapshot
@@ -147,7 +147,7 @@ func (s *Snapshot) hasConflict(version uint64) bool {
 func (store *LogStructuredFS) NewTransaction() (*Transaction, error) {
 	txnId := acquireTxnId()
 	txnPath := filepath.Join(store.directory, txnDirName, fmt.Sprintf("%d%s", txnId, txnExtension))
-	fd, err := os.OpenFile(txnPath, os.O_CREATE|os.O_WRONLY|os.O_EXCL, store.fsPerm)
+	fd, err := store.fsys.OpenFile(txnPath, os.O_CREATE|os.O_WRONLY|os.O_EXCL, store.fsPerm)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create new transaction file: %w", err)
 	}
@@ -155,13 +155,13 @@ func (store *LogStructuredFS) NewTransaction() (*Transaction, error) {
 	n, err := fd.Write(dataFileMetadata)
 	if err != nil {
 		_ = fd.Close()
-		_ = os.Remove(txnPath)
+		_ = store.fsys.Remove(txnPath)
 		return nil, fmt.Errorf("failed to write metadata to transaction file: %w", err)
 	}
 
 	if n != len(dataFileMetadata) {
 		_ = fd.Close()
-		_ = os.Remove(txnPath)
+		_ = store.fsys.Remove(txnPath)
 		return nil, fmt.Errorf("failed to write full metadata to transaction file")
 	}
 
@@ -249,7 +249,7 @@ func (t *Transaction) Commit() error {
 			t.rollback = true
 			return fmt.Errorf("failed to commit transaction: %w", err)
 		}
-		err = os.Remove(t.path)
+		err = t.store.fsys.Remove(t.path)
 		if err != nil {
 			t.rollback = false
 			return fmt.Errorf("failed to commit delete transaction: %w", err)
@@ -276,7 +276,7 @@ func (t *Transaction) Rollback() error {
 		}
 	}
 
-	err := os.Remove(t.path)
+	err := t.store.fsys.Remove(t.path)
 	if err != nil {
 		return fmt.Errorf("failed to rollback delete transaction file: %w", err)
 	}
@@ -357,7 +357,7 @@ func TestRollbackWithNewKeys(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	var activeFd *os.File
+	var activeFd File
 	txns.AtomicBatch(func(txns *TxnState) error {
 		keys := []string{"key1"}
 		snapshots, err := txns.Begin(keys)
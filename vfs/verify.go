@@ -0,0 +1,128 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vfs
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	ErrRegionNotFound = errors.New("region not found")
+	ErrCorruptRegion  = errors.New("region contains corrupt records")
+)
+
+// VerifyReport 是一次 region 完整性校验的结果，FirstCorruptOffset 为 -1 表示没有发现损坏的记录，
+// Truncated 表示 region 尾部的记录头部中的长度超出了文件范围，后面的数据已经无法继续解析。
+type VerifyReport struct {
+	RegionId           int64 `json:"region_id"`
+	Size               int64 `json:"size"`
+	Good               int   `json:"good"`
+	Corrupt            int   `json:"corrupt"`
+	FirstCorruptOffset int64 `json:"first_corrupt_offset"`
+	Truncated          bool  `json:"truncated"`
+}
+
+// VerifyRegion 按照写入顺序读取 region 中的每一条记录并校验 CRC32，遇到损坏的记录不会中断扫描，
+// 只统计正常和损坏的记录数以及第一个损坏记录的偏移量，不会解码 value 也不会修改内存索引。
+// 这个校验不受 Options.SkipCRCOnRead 的影响。
+func (lfs *LogStructuredFS) VerifyRegion(regionId int64) (VerifyReport, error) {
+	report := VerifyReport{RegionId: regionId, FirstCorruptOffset: -1}
+
+	lfs.mu.RLock()
+	defer lfs.mu.RUnlock()
+
+	region, ok := lfs.regions[regionId]
+	if !ok {
+		return report, fmt.Errorf("%w: %d", ErrRegionNotFound, regionId)
+	}
+
+	reader, length, err := regionReader(region)
+	if err != nil {
+		return report, fmt.Errorf("failed to open region %d: %w", regionId, err)
+	}
+	report.Size = length
+
+	header := make([]byte, _SEGMENT_PADDING)
+	offset := int64(len(dataFileMetadata))
+	for offset < length {
+		size := int64(_SEGMENT_PADDING)
+		if offset+size <= length {
+			_, err = reader.ReadAt(header, offset)
+			if err != nil {
+				return report, fmt.Errorf("failed to read segment header at %d: %w", offset, err)
+			}
+			klen := int64(binary.LittleEndian.Uint32(header[18:22]))
+			vlen := int64(binary.LittleEndian.Uint32(header[22:26]))
+			size += klen + vlen + 4
+		}
+
+		// 头部中的长度已经损坏，无法定位下一条记录的位置，只能停止扫描
+		if offset+size > length {
+			report.markCorrupt(offset)
+			report.Truncated = true
+			break
+		}
+
+		record := make([]byte, size)
+		_, err = reader.ReadAt(record, offset)
+		if err != nil {
+			return report, fmt.Errorf("failed to read segment at %d: %w", offset, err)
+		}
+
+		keyEnd := int64(_SEGMENT_PADDING) + int64(binary.LittleEndian.Uint32(header[18:22]))
+		checksum := binary.LittleEndian.Uint32(record[size-4:])
+		if checksum == segmentChecksum(record[:_SEGMENT_PADDING], record[_SEGMENT_PADDING:keyEnd], record[keyEnd:size-4]) {
+			report.Good++
+		} else {
+			report.markCorrupt(offset)
+		}
+
+		offset += size
+	}
+
+	return report, nil
+}
+
+func (r *VerifyReport) markCorrupt(offset int64) {
+	r.Corrupt++
+	if r.FirstCorruptOffset < 0 {
+		r.FirstCorruptOffset = offset
+	}
+}
+
+// verifyRegions 按照 region ID 的升序校验所有 region 中的记录，只要有一个 region 中存在损坏的记录就返回 ErrCorruptRegion，
+// 错误信息中包含所有损坏的 region 和它们第一个损坏记录的偏移量。
+func (lfs *LogStructuredFS) verifyRegions() error {
+	var corrupted []string
+	for _, regionId := range tailRegionIds(lfs.regions, 0) {
+		report, err := lfs.VerifyRegion(regionId)
+		if err != nil {
+			return err
+		}
+
+		if report.Corrupt > 0 {
+			corrupted = append(corrupted, fmt.Sprintf("region %d has %d corrupt records, first at offset %d", regionId, report.Corrupt, report.FirstCorruptOffset))
+		}
+	}
+
+	if len(corrupted) > 0 {
+		return fmt.Errorf("%w: %s", ErrCorruptRegion, strings.Join(corrupted, "; "))
+	}
+
+	return nil
+}